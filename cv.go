@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/wlattner/rf/forest"
+
+	flag "github.com/docker/docker/pkg/mflag"
+)
+
+var (
+	nFolds    = flag.Int([]string{"k", "-folds"}, 5, "number of folds for cross validation")
+	nRepeats  = flag.Int([]string{"-repeats"}, 1, "number of times to repeat cross validation with different folds")
+	groupCol  = flag.String([]string{"-group"}, "", "name of a column with group ids, examples with the same id are kept in the same fold")
+	foldsFile = flag.String([]string{"-cv_predictions"}, "", "file to output out of fold predictions for each example")
+)
+
+// runCV estimates the performance of a model using k-fold cross validation,
+// the folds are stratified by class for classification. Up to nWorkers
+// folds are fit at the same time.
+func runCV() {
+	opt, err := parseModelOpts()
+	if err != nil {
+		fatal("invalid model option", err.Error())
+	}
+	if opt.online {
+		fatal("cross validation is not supported for online models")
+	}
+
+	d, err := loadData(parseOptions{forceClf: *forceClf, groupCol: *groupCol})
+	if err != nil {
+		fatal("error parsing input data", err.Error())
+	}
+	if d.Sparse != nil {
+		fatal("cross validation is not supported for sparse (LIBSVM) input")
+	}
+	if d.Weights != nil {
+		fatal("cross validation is not supported with --weight")
+	}
+
+	k := *nFolds
+	if k < 2 || k > len(d.X) {
+		fatal("invalid number of folds", k)
+	}
+	if d.Groups != nil && countUniq(d.Groups) < k {
+		fatal("number of groups is less than the number of folds")
+	}
+
+	var folds []forest.Fold
+	r := opt.rand()
+	for i := 0; i < *nRepeats; i++ {
+		switch {
+		case d.Groups != nil:
+			folds = append(folds, forest.GroupKFold(d.Groups, k, r)...)
+		case !d.isRegression:
+			folds = append(folds, forest.StratifiedKFold(d.YClf, k, r)...)
+		default:
+			folds = append(folds, forest.KFold(len(d.X), k, r)...)
+		}
+	}
+
+	// folds are fit in parallel, the trees of each fold are not
+	foldWorkers := opt.nWorkers
+	opt.nWorkers = 1
+
+	var res *forest.CVResult
+	if d.isRegression {
+		res = forest.CrossValidateRegressor(d.X, d.YReg, folds, foldWorkers, opt.newRegressor)
+	} else {
+		var classes []string
+		res, classes = forest.CrossValidateClassifier(d.X, d.YClf, folds, foldWorkers, opt.newClassifier)
+
+		if *foldsFile != "" {
+			err = writeFile(*foldsFile, func(w io.Writer) error {
+				return writeClassPred(w, classes, d.YClf, res.Prob, res.Count, "n_folds")
+			})
+		}
+	}
+
+	if d.isRegression && *foldsFile != "" {
+		err = writeFile(*foldsFile, func(w io.Writer) error {
+			return writeRegPred(w, d.YReg, res.Pred, res.Count, "n_folds")
+		})
+	}
+	if err != nil {
+		fatal("error saving out of fold predictions", err.Error())
+	}
+
+	reportCV(os.Stderr, res, k, *nRepeats, len(d.X))
+}
+
+func reportCV(w io.Writer, res *forest.CVResult, k, repeats, nSample int) {
+	fmt.Fprintf(w, "%d-fold cross validation repeated %d time(s) using %d examples\n", k, repeats, nSample)
+	fmt.Fprintf(w, "\n")
+
+	fmt.Fprintf(w, "%-20s %-10s %-10s\n", "Metric", "Mean", "Std")
+	fmt.Fprintf(w, "%-20s %-10s %-10s\n", "------", "----", "---")
+	for i, m := range res.Mean {
+		fmt.Fprintf(w, "%-20s %-10.4f %-10.4f\n", m.Name, m.Value, res.Std[i].Value)
+	}
+}
+
+// writeFile creates the file fName and writes to it with fn
+func writeFile(fName string, fn func(io.Writer) error) error {
+	f, err := os.Create(fName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return fn(f)
+}
+
+func countUniq(vals []string) int {
+	uniq := make(map[string]bool)
+	for _, v := range vals {
+		uniq[v] = true
+	}
+	return len(uniq)
+}
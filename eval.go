@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/wlattner/rf/forest"
+
+	flag "github.com/docker/docker/pkg/mflag"
+)
+
+var jsonOut = flag.Bool([]string{"-json"}, false, "write the report as JSON to stdout")
+
+// Evaluation holds the performance of a fitted model on labeled examples
+// not used to fit it.
+type Evaluation struct {
+	NSample int
+	// classification, Classes maps class ids in Class to labels, labels of the
+	// test data not seen during fitting are appended after the model's classes
+	Classes []string
+	Unseen  []string
+	Class   *forest.ClassMetrics
+	// regression
+	Reg *forest.RegMetrics
+}
+
+// runEval scores a saved model against the labeled examples in --data and
+// writes the same report as fitting.
+func runEval() {
+	m, err := loadModel(*modelFile)
+	if err != nil {
+		fatal("error opening model file", err.Error())
+	}
+	m.setWorkers(*nWorkers)
+
+	d, err := loadData(parseOptions{forceClf: *forceClf || !m.IsRegression, pipeline: m.inputPipeline(), modelTarget: m.Target})
+	if err != nil {
+		fatal("error parsing input data", err.Error())
+	}
+
+	e, err := m.Evaluate(d)
+	if err != nil {
+		fatal("error evaluating model", err.Error())
+	}
+
+	if *jsonOut {
+		err = e.writeJSON(os.Stdout)
+		if err != nil {
+			fatal("error writing report", err.Error())
+		}
+		return
+	}
+	e.Report(os.Stderr)
+}
+
+// Evaluate predicts the examples in d and compares the predictions to the
+// labels of d.
+func (m *Model) Evaluate(d *parsedInput) (*Evaluation, error) {
+	if d.isRegression != m.IsRegression {
+		return nil, errors.New("model type and data type don't match")
+	}
+	if d.numRows() == 0 {
+		return nil, errors.New("no examples to evaluate")
+	}
+	// sparse examples only list features up to the largest nonzero
+	if n := d.numFeatures(); n > len(m.VarNames) || (d.Sparse == nil && n != len(m.VarNames)) {
+		return nil, fmt.Errorf("model was fit with %d features, data has %d", len(m.VarNames), n)
+	}
+	if m.IsOnline && d.Sparse != nil {
+		return nil, errOnlineSparse
+	}
+
+	e := &Evaluation{NSample: d.numRows()}
+
+	if m.IsRegression {
+		var pred []float64
+		if m.IsOnline {
+			pred = m.OnlineReg.Predict(d.X)
+		} else {
+			pred = m.Reg.PredictDataset(d.dataset())
+		}
+		e.Reg = forest.ComputeRegMetrics(d.YReg, pred)
+		return e, nil
+	}
+
+	// the confusion matrix uses the majority vote, as predict does, the
+	// probabilities are only used for log loss and AUC
+	var pred []int
+	var prob [][]float64
+	if m.IsOnline {
+		e.Classes = append(e.Classes, m.OnlineClf.Classes...)
+		pred = m.OnlineClf.Predict(d.X)
+		prob = m.OnlineClf.PredictProb(d.X)
+	} else {
+		e.Classes = append(e.Classes, m.Clf.Classes...)
+		pred = m.Clf.PredictDataset(d.dataset())
+		prob = m.Clf.PredictProbDataset(d.dataset())
+	}
+
+	uniq := make(map[string]int)
+	for id, class := range e.Classes {
+		uniq[class] = id
+	}
+
+	// the model gives 0 probability to labels it has not seen
+	yIDs := make([]int, len(d.YClf))
+	for i, val := range d.YClf {
+		id, ok := uniq[val]
+		if !ok {
+			id = len(e.Classes)
+			uniq[val] = id
+			e.Classes = append(e.Classes, val)
+			e.Unseen = append(e.Unseen, val)
+		}
+		yIDs[i] = id
+	}
+
+	if len(e.Unseen) > 0 {
+		for i := range prob {
+			prob[i] = append(prob[i], make([]float64, len(e.Unseen))...)
+		}
+	}
+
+	e.Class = forest.ComputeClassMetricsPred(yIDs, pred, prob)
+	return e, nil
+}
+
+// Report writes the metrics of the evaluation in the same format as fitting.
+func (e *Evaluation) Report(w io.Writer) {
+	fmt.Fprintf(w, "Evaluated %d examples\n", e.NSample)
+	fmt.Fprintf(w, "\n")
+
+	if e.Reg != nil {
+		fmt.Fprintf(w, "Mean Squared Error: %.3f\n", e.Reg.MSE)
+		fmt.Fprintf(w, "Root Mean Squared Error: %.3f\n", e.Reg.RMSE)
+		fmt.Fprintf(w, "Mean Absolute Error: %.3f\n", e.Reg.MAE)
+		fmt.Fprintf(w, "R-Squared: %.3f%%\n", 100*e.Reg.RSquared)
+		return
+	}
+
+	if len(e.Unseen) > 0 {
+		fmt.Fprintf(w, "Labels not seen during fitting: %v\n", e.Unseen)
+		fmt.Fprintf(w, "\n")
+	}
+	reportClassMetrics(w, e.Classes, e.Class)
+}
+
+// evalJSON is the JSON form of an Evaluation, NaN metrics are written as
+// null
+type evalJSON struct {
+	Examples        int                 `json:"examples"`
+	Classes         []string            `json:"classes,omitempty"`
+	Unseen          []string            `json:"unseen_labels,omitempty"`
+	ConfusionMatrix [][]int             `json:"confusion_matrix,omitempty"`
+	PerClass        []classJSON         `json:"per_class,omitempty"`
+	Metrics         map[string]*float64 `json:"metrics"`
+}
+
+type classJSON struct {
+	Class     string  `json:"class"`
+	Precision float64 `json:"precision"`
+	Recall    float64 `json:"recall"`
+	F1        float64 `json:"f1"`
+	Support   int     `json:"support"`
+}
+
+func (e *Evaluation) writeJSON(w io.Writer) error {
+	out := evalJSON{Examples: e.NSample}
+
+	var metrics []forest.Metric
+	if e.Reg != nil {
+		metrics = e.Reg.Summary()
+	} else {
+		metrics = e.Class.Summary()
+		out.Classes = e.Classes
+		out.Unseen = e.Unseen
+		out.ConfusionMatrix = e.Class.ConfusionMatrix
+		for id, class := range e.Classes {
+			out.PerClass = append(out.PerClass, classJSON{class,
+				e.Class.Precision[id], e.Class.Recall[id], e.Class.F1[id], e.Class.Support[id]})
+		}
+	}
+
+	out.Metrics = make(map[string]*float64)
+	for _, m := range metrics {
+		v := m.Value
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			out.Metrics[m.Name] = nil
+		} else {
+			out.Metrics[m.Name] = &v
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEvaluateUnseenLabels(t *testing.T) {
+	train, err := parseCSV(strings.NewReader(irisCSV), false)
+	if err != nil {
+		t.Fatal("unexpected error parsing iris data:", err)
+	}
+
+	m := new(Model)
+	m.Fit(train, modelOptions{nTree: 5, minSplit: 2, minLeaf: 1, maxFeatures: -1, nWorkers: 1})
+
+	test, err := parseCSV(strings.NewReader(irisCSV+`"versicolor",7,3.2,4.7,1.4
+`), true)
+	if err != nil {
+		t.Fatal("unexpected error parsing test data:", err)
+	}
+
+	e, err := m.Evaluate(test)
+	if err != nil {
+		t.Fatal("unexpected error evaluating model:", err)
+	}
+
+	if len(e.Unseen) != 1 || e.Unseen[0] != "versicolor" {
+		t.Errorf("expected versicolor to be an unseen label, got: %v", e.Unseen)
+	}
+	if len(e.Classes) != 3 || e.Classes[2] != "versicolor" {
+		t.Errorf("expected unseen labels after the model's classes, got: %v", e.Classes)
+	}
+	if e.Class.Support[2] != 1 || e.Class.Recall[2] != 0 {
+		t.Errorf("expected 1 unseen example with recall 0, got: %d, %v", e.Class.Support[2], e.Class.Recall[2])
+	}
+}
+
+func TestEvaluateMajorityVote(t *testing.T) {
+	d, err := parseCSV(strings.NewReader(syntheticCSV(600, false)), false)
+	if err != nil {
+		t.Fatal("unexpected error parsing data:", err)
+	}
+
+	// with large leaves the most probable class can differ from the vote
+	m := new(Model)
+	m.Fit(d, modelOptions{nTree: 10, minSplit: 2, minLeaf: 20, maxFeatures: -1, nWorkers: 2, seed: 1})
+	votes := m.Clf.Predict(d.X)
+	differ := false
+	for i, p := range m.Clf.PredictProb(d.X) {
+		for class := range p {
+			if p[class] > p[votes[i]] {
+				differ = true
+			}
+		}
+	}
+	if !differ {
+		t.Fatal("expected the vote and the most probable class to differ for some example")
+	}
+
+	e, err := m.Evaluate(d)
+	if err != nil {
+		t.Fatal("unexpected error evaluating model:", err)
+	}
+	want, _ := m.Predict(d)
+	correct := 0
+	for i, label := range want {
+		if label == d.YClf[i] {
+			correct++
+		}
+	}
+	if acc := float64(correct) / float64(len(want)); e.Class.Accuracy != acc {
+		t.Errorf("expected the accuracy of the predicted labels %v, got: %v", acc, e.Class.Accuracy)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	flag "github.com/docker/docker/pkg/mflag"
+)
+
+var (
+	exportFormat = flag.String([]string{"-format"}, "pmml", "format for export to write or import to read the model in, "+strings.Join(exportFormats(), ", "))
+	exportFile   = flag.String([]string{"o", "-output"}, "-", "file for export to write the model to, - for stdout")
+	importFile   = flag.String([]string{"i", "-input"}, "-", "file for import to read the model from, - for stdin")
+)
+
+// exporters writes a model in each format supported by export
+var exporters = map[string]func(*Model, io.Writer) error{
+	"onnx":    (*Model).WriteONNX,
+	"pmml":    (*Model).WritePMML,
+	"sklearn": (*Model).WriteSklearn,
+	"xgboost": (*Model).WriteXGBoost,
+}
+
+// errExportPipeline is returned when exporting a model that encodes its csv
+// columns, the exported trees would read the encoded features without the
+// encoding
+func errExportPipeline(format string) error {
+	return fmt.Errorf("models with encoded columns (categorical columns or --impute) can't be exported to %s, the encoding isn't exported", format)
+}
+
+// importers reads a model in each format supported by import
+var importers = map[string]func(io.Reader) (*Model, error){
+	"sklearn": readSklearn,
+	"xgboost": readXGBoost,
+}
+
+func exportFormats() []string {
+	var formats []string
+	for f := range exporters {
+		formats = append(formats, f)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+func importFormats() []string {
+	var formats []string
+	for f := range importers {
+		formats = append(formats, f)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// runExport writes the model in --final_model to --output in --format
+func runExport() {
+	export, ok := exporters[*exportFormat]
+	if !ok {
+		fatal(fmt.Sprintf("unknown export format %q, choices are %s", *exportFormat, strings.Join(exportFormats(), ", ")))
+	}
+
+	m, err := loadModel(*modelFile)
+	if err != nil {
+		fatal("error opening model file", err.Error())
+	}
+
+	err = writeOutput(*exportFile, func(w io.Writer) error {
+		return export(m, w)
+	})
+	if err != nil {
+		fatal("error exporting model", err.Error())
+	}
+}
+
+// runImport reads a model in --format from --input and saves it to
+// --final_model in --model_format
+func runImport() {
+	read, ok := importers[*exportFormat]
+	if !ok {
+		fatal(fmt.Sprintf("unknown import format %q, choices are %s", *exportFormat, strings.Join(importFormats(), ", ")))
+	}
+	if err := checkModelFormat(); err != nil {
+		fatal(err.Error())
+	}
+
+	in, err := openInput(*importFile)
+	if err != nil {
+		fatal("error opening", *importFile, err.Error())
+	}
+	defer in.Close()
+
+	m, err := read(in)
+	if err != nil {
+		fatal("error importing model", err.Error())
+	}
+
+	err = saveModel(m, *modelFile)
+	if err != nil {
+		fatal("error saving model", err.Error())
+	}
+}
@@ -1,12 +1,20 @@
 package forest
 
 import (
+	"bytes"
+	"context"
 	"math"
+	"math/rand"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/wlattner/rf/tree"
 )
 
 func TestBostonFitPredict(t *testing.T) {
-	reg := NewRegressor()
+	reg := NewRegressor(RandState(2))
 	reg.Fit(bostonX, bostonY)
 
 	pred := reg.Predict(bostonX)
@@ -23,6 +31,34 @@ func TestBostonFitPredict(t *testing.T) {
 	}
 }
 
+func TestBostonFitDataset(t *testing.T) {
+	rows := NewRegressor(RandState(2), ComputeOOB)
+	rows.Fit(bostonX, bostonY)
+
+	cols := NewRegressor(RandState(2), ComputeOOB, NumWorkers(4))
+	X := tree.NewColMajor(bostonX)
+	cols.FitDataset(X, bostonY)
+
+	if !bytes.Equal(gobBytes(t, rows), gobBytes(t, cols)) {
+		t.Error("expected the same forest from row and column major data")
+	}
+	if !reflect.DeepEqual(rows.Predict(bostonX), cols.PredictDataset(X)) {
+		t.Error("expected the same predictions from row and column major data")
+	}
+
+	cols32 := NewRegressor(RandState(2), ComputeOOB)
+	cols32.FitDataset(tree.NewColMajor32(bostonX), bostonY)
+	if math.Abs(cols32.MSE-rows.MSE) > 0.5 {
+		t.Errorf("expected similar oob mse from float32 data, got: %f and %f", cols32.MSE, rows.MSE)
+	}
+
+	sparse := NewRegressor(RandState(2), ComputeOOB)
+	sparse.FitDataset(tree.NewCSR(bostonX).ToCSC(), bostonY)
+	if math.Abs(sparse.MSE-rows.MSE) > 0.5 {
+		t.Errorf("expected similar oob mse from sparse data, got: %f and %f", sparse.MSE, rows.MSE)
+	}
+}
+
 func TestBostonVariableImportance(t *testing.T) {
 	reg := NewRegressor(NumTrees(10))
 	reg.Fit(bostonX, bostonY)
@@ -38,7 +74,7 @@ func TestBostonVariableImportance(t *testing.T) {
 }
 
 func TestBostonOOBMSE(t *testing.T) {
-	reg := NewRegressor(NumTrees(10), ComputeOOB)
+	reg := NewRegressor(NumTrees(10), ComputeOOB, RandState(2))
 
 	reg.Fit(bostonX, bostonY)
 
@@ -50,6 +86,230 @@ func TestBostonOOBMSE(t *testing.T) {
 	if reg.RSquared < 0.7 {
 		t.Errorf("expected oob rsquared to be greater than 0.7, got: %f", reg.RSquared)
 	}
+
+	// mse from the per example oob predictions should match
+	sqErrSum := 0.0
+	n := 0
+	for i, pred := range reg.OOBPred {
+		if reg.OOBCount[i] < 1 {
+			continue
+		}
+		d := pred - bostonY[i]
+		sqErrSum += d * d
+		n++
+	}
+	if math.Abs(sqErrSum/float64(n)-reg.MSE) > 1e-7 {
+		t.Errorf("expected oob predictions mse to be %f, got: %f", reg.MSE, sqErrSum/float64(n))
+	}
+
+	// the last point of the oob curve is the mse of the full forest
+	if len(reg.OOBCurve) != 10 {
+		t.Fatalf("expected oob curve for 10 trees, got: %d", len(reg.OOBCurve))
+	}
+	if reg.OOBCurve[9] != reg.MSE {
+		t.Errorf("expected last point of oob curve to be %f, got: %f", reg.MSE, reg.OOBCurve[9])
+	}
+}
+
+func TestBostonRandState(t *testing.T) {
+	// same seed, different number of workers
+	a := NewRegressor(NumTrees(20), ComputeOOB, KeepInBag, RandState(42), NumWorkers(1))
+	a.Fit(bostonX, bostonY)
+	b := NewRegressor(NumTrees(20), ComputeOOB, KeepInBag, RandState(42), NumWorkers(4))
+	b.Fit(bostonX, bostonY)
+
+	if !bytes.Equal(gobBytes(t, a), gobBytes(t, b)) {
+		t.Error("expected forests fit with the same seed to be identical")
+	}
+
+	c := NewRegressor(NumTrees(20), ComputeOOB, KeepInBag, RandState(43))
+	c.Fit(bostonX, bostonY)
+	if bytes.Equal(gobBytes(t, a), gobBytes(t, c)) {
+		t.Error("expected forests fit with different seeds to differ")
+	}
+}
+
+func TestBostonSampleWeights(t *testing.T) {
+	// examples with weight 0 are never drawn, the last example is drawn
+	// about as often as all the others together
+	w := make([]float64, len(bostonY))
+	for i := len(w) / 2; i < len(w); i++ {
+		w[i] = 1
+	}
+	w[len(w)-1] = float64(len(w) / 2)
+	reg := NewRegressor(NumTrees(20), KeepInBag, RandState(42), SampleWeights(w))
+	reg.Fit(bostonX, bostonY)
+
+	for i, counts := range reg.InBag {
+		for j, n := range counts[:len(w)/2] {
+			if n > 0 {
+				t.Fatalf("tree %d: expected example %d with weight 0 to be out of bag, drawn %d times", i, j, n)
+			}
+		}
+		if n := counts[len(w)-1]; n < len(w)/4 || n > 3*len(w)/4 {
+			t.Errorf("tree %d: expected the heavy example to be drawn about %d times, got: %d", i, len(w)/2, n)
+		}
+	}
+}
+
+func TestBostonBadSampleWeights(t *testing.T) {
+	tests := []struct {
+		name string
+		w    []float64
+		err  string
+	}{
+		{"short", make([]float64, len(bostonY)-1), "sample weights for"},
+		{"zero", make([]float64, len(bostonY)), "positive, finite total"},
+		{"negative", append([]float64{-1}, make([]float64, len(bostonY)-1)...), "sample weight 0 is -1"},
+	}
+	for _, tc := range tests {
+		reg := NewRegressor(NumTrees(5), SampleWeights(tc.w))
+		err := reg.FitContext(context.Background(), bostonX, bostonY)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected an error containing %q, got: %v", tc.name, tc.err, err)
+		}
+		if len(reg.Trees) != 0 {
+			t.Errorf("%s: expected no trees, got %d", tc.name, len(reg.Trees))
+		}
+	}
+
+}
+
+func TestBostonMaxFitTime(t *testing.T) {
+	reg := NewRegressor(NumTrees(100000), ComputeOOB, MaxFitTime(50*time.Millisecond))
+
+	err := reg.FitContext(context.Background(), bostonX, bostonY)
+	if err != nil {
+		t.Error("expected no error when the time budget is reached, got:", err)
+	}
+	if reg.NTrees >= 100000 || len(reg.Trees) != reg.NTrees {
+		t.Errorf("expected the forest to be limited by the time budget, got %d trees", len(reg.Trees))
+	}
+
+	reg = NewRegressor(NumTrees(10), ComputeOOB, MaxFitTime(time.Nanosecond))
+	if err := reg.FitContext(context.Background(), bostonX, bostonY); err != ErrNoTrees {
+		t.Error("expected ErrNoTrees when the time is up before the first tree, got:", err)
+	}
+}
+
+func TestBostonEarlyStopping(t *testing.T) {
+	reg := NewRegressor(NumTrees(500), EarlyStopping(10, 0.01), NumWorkers(4))
+	reg.Fit(bostonX, bostonY)
+
+	if reg.NTrees >= 500 || reg.NTrees <= 10 {
+		t.Errorf("expected early stopping after more than 10 and less than 500 trees, got: %d", reg.NTrees)
+	}
+	if len(reg.Trees) != reg.NTrees || len(reg.OOBCurve) != reg.NTrees {
+		t.Errorf("expected %d trees and oob curve points, got: %d, %d", reg.NTrees, len(reg.Trees), len(reg.OOBCurve))
+	}
+	for i, tr := range reg.Trees {
+		if tr == nil {
+			t.Fatalf("expected tree %d to be fit", i)
+		}
+	}
+}
+
+func TestBostonPredictVariance(t *testing.T) {
+	reg := NewRegressor(NumTrees(50), KeepInBag)
+	reg.Fit(bostonX, bostonY)
+
+	pred := reg.Predict(bostonX[:20])
+	mean, std := reg.PredictWithStd(bostonX[:20])
+	for i := range pred {
+		if math.Abs(pred[i]-mean[i]) > 1e-7 {
+			t.Errorf("expected mean %f to equal prediction %f", mean[i], pred[i])
+		}
+		if std[i] < 0 {
+			t.Error("expected non-negative standard deviation, got:", std[i])
+		}
+	}
+
+	for _, method := range []VarianceEstimator{InfinitesimalJackknife, JackknifeAfterBootstrap} {
+		v, err := reg.PredictVariance(bostonX[:20], method)
+		if err != nil {
+			t.Error("unexpected error estimating variance:", err)
+			continue
+		}
+
+		sum := 0.0
+		for _, val := range v {
+			if val < 0 {
+				t.Error("expected non-negative variance, got:", val)
+			}
+			sum += val
+		}
+		if sum == 0 {
+			t.Error("expected some non-zero variance estimates for method", method)
+		}
+	}
+
+	reg = NewRegressor(NumTrees(5))
+	reg.Fit(bostonX, bostonY)
+	if _, err := reg.PredictVariance(bostonX[:20], InfinitesimalJackknife); err == nil {
+		t.Error("expected error estimating variance without in bag counts")
+	}
+}
+
+func TestBostonCrossValidate(t *testing.T) {
+	folds := RepeatedKFold(len(bostonY), 5, 2, rand.New(rand.NewSource(1)))
+
+	res := CrossValidateRegressor(bostonX, bostonY, folds, 2, func() *Regressor {
+		return NewRegressor(NumTrees(10))
+	})
+
+	if len(res.Folds) != 10 {
+		t.Fatalf("expected metrics for 10 folds, got: %d", len(res.Folds))
+	}
+
+	if res.Mean[0].Name != "mse" || res.Mean[0].Value > 25 {
+		t.Errorf("expected mean mse to be less than 25, got: %v", res.Mean[0])
+	}
+
+	for i, ct := range res.Count {
+		if ct != 2 {
+			t.Errorf("expected example %d to be predicted twice, got: %d", i, ct)
+		}
+	}
+}
+
+func TestBostonMondrianPartialFit(t *testing.T) {
+	reg := NewMondrianRegressor(NumTrees(10), NumWorkers(2))
+
+	for i := 0; i < len(bostonY); i += 100 {
+		end := i + 100
+		if end > len(bostonY) {
+			end = len(bostonY)
+		}
+		reg.PartialFit(bostonX[i:end], bostonY[i:end])
+	}
+	if err := reg.PartialFit(bostonX[:1], bostonY[:2]); err == nil || reg.NSample != len(bostonY) {
+		t.Error("expected an error updating with more targets than examples, got:", err)
+	}
+	if p := NewMondrianRegressor().Predict(bostonX); p != nil {
+		t.Error("expected no predictions from an empty forest, got:", p)
+	}
+
+	pred := reg.Predict(bostonX)
+
+	sqErrSum := 0.0
+	for i := range bostonY {
+		d := pred[i] - bostonY[i]
+		sqErrSum += d * d
+	}
+
+	sqErr := sqErrSum / float64(len(bostonY))
+	if sqErr > 2.75 { // just a sanity check
+		t.Error("expected error to be 0, got:", sqErr)
+	}
+
+	sum := 0.0
+	for _, val := range reg.VarImp() {
+		sum += val
+	}
+
+	if math.Abs(sum-1.0) > 1e-7 {
+		t.Error("expected variable importance to sum to 1, got:", sum)
+	}
 }
 
 var bostonFeatures = []string{"CRIM", "ZN", "INDUS", "CHAS", "NOX", "RM", "AGE", "DIS", "RAD", "TAX", "PTRATIO", "B", "LSTAT"}
@@ -0,0 +1,349 @@
+package forest
+
+import (
+	"math"
+	"sort"
+)
+
+// Calibration selects the method used to calibrate the class probabilities
+// of a Classifier.
+type Calibration int
+
+const (
+	NoCalibration Calibration = iota
+	// Sigmoid fits a logistic function to the probabilities as described in
+	// Platt, J. (1999) "Probabilistic Outputs for Support Vector Machines and
+	// Comparisons to Regularized Likelihood Methods", using the Newton method
+	// from Lin, H., Lin, C., Weng, R. (2007) "A Note on Platt's Probabilistic
+	// Outputs for Support Vector Machines".
+	Sigmoid
+	// Isotonic fits a non-decreasing step function to the probabilities
+	// using the pool adjacent violators algorithm.
+	Isotonic
+)
+
+// Calibrator maps the class probabilities of a forest to calibrated
+// probabilities. Each class is calibrated one-vs-rest, the calibrated
+// probabilities are normalized to sum to 1.
+type Calibrator struct {
+	Method Calibration
+	// sigmoid, p = 1 / (1 + exp(A*f + B)) for each class
+	A []float64
+	B []float64
+	// isotonic, knots of a piecewise linear function for each class
+	Thresholds [][]float64
+	Values     [][]float64
+}
+
+// Calibrate returns the calibrated class probabilities for p, the
+// uncalibrated probabilities of a single example.
+func (c *Calibrator) Calibrate(p []float64) []float64 {
+	out := make([]float64, len(p))
+	sum := 0.0
+
+	for class, v := range p {
+		switch c.Method {
+		case Sigmoid:
+			out[class] = 1.0 / (1.0 + math.Exp(c.A[class]*v+c.B[class]))
+		case Isotonic:
+			out[class] = interpolate(c.Thresholds[class], c.Values[class], v)
+		default:
+			out[class] = v
+		}
+		sum += out[class]
+	}
+
+	if sum > 0 {
+		for class := range out {
+			out[class] /= sum
+		}
+	}
+
+	return out
+}
+
+// fitCalibrator fits a calibrator to the out of bag class probabilities prob
+// and class ids Y, examples with a zero count are skipped.
+func fitCalibrator(method Calibration, prob [][]float64, count []int, Y []int, nClasses int) *Calibrator {
+	c := &Calibrator{Method: method}
+
+	for class := 0; class < nClasses; class++ {
+		var (
+			f []float64
+			y []bool
+		)
+		for i := range prob {
+			if count[i] < 1 {
+				continue
+			}
+			f = append(f, prob[i][class])
+			y = append(y, Y[i] == class)
+		}
+
+		switch method {
+		case Sigmoid:
+			a, b := fitSigmoid(f, y)
+			c.A = append(c.A, a)
+			c.B = append(c.B, b)
+		case Isotonic:
+			x, v := fitIsotonic(f, y)
+			c.Thresholds = append(c.Thresholds, x)
+			c.Values = append(c.Values, v)
+		}
+	}
+
+	return c
+}
+
+// fitSigmoid returns A, B for p = 1 / (1 + exp(A*f + B)), following the
+// pseudo code in Lin et al. (2007).
+func fitSigmoid(f []float64, y []bool) (float64, float64) {
+	var prior1, prior0 float64
+	for _, label := range y {
+		if label {
+			prior1++
+		} else {
+			prior0++
+		}
+	}
+
+	// targets smoothed to avoid overfitting
+	hiTarget := (prior1 + 1.0) / (prior1 + 2.0)
+	loTarget := 1.0 / (prior0 + 2.0)
+	t := make([]float64, len(y))
+	for i, label := range y {
+		if label {
+			t[i] = hiTarget
+		} else {
+			t[i] = loTarget
+		}
+	}
+
+	const (
+		maxIter = 100
+		minStep = 1e-10
+		sigma   = 1e-12 // for a positive definite hessian
+		eps     = 1e-5
+	)
+
+	a := 0.0
+	b := math.Log((prior0 + 1.0) / (prior1 + 1.0))
+
+	// negative log likelihood
+	fval := func(a, b float64) float64 {
+		v := 0.0
+		for i := range f {
+			fApB := f[i]*a + b
+			if fApB >= 0 {
+				v += t[i]*fApB + math.Log(1+math.Exp(-fApB))
+			} else {
+				v += (t[i]-1)*fApB + math.Log(1+math.Exp(fApB))
+			}
+		}
+		return v
+	}
+	fv := fval(a, b)
+
+	for iter := 0; iter < maxIter; iter++ {
+		// gradient and hessian
+		h11, h22, h21 := sigma, sigma, 0.0
+		g1, g2 := 0.0, 0.0
+		for i := range f {
+			fApB := f[i]*a + b
+			var p, q float64
+			if fApB >= 0 {
+				p = math.Exp(-fApB) / (1.0 + math.Exp(-fApB))
+				q = 1.0 / (1.0 + math.Exp(-fApB))
+			} else {
+				p = 1.0 / (1.0 + math.Exp(fApB))
+				q = math.Exp(fApB) / (1.0 + math.Exp(fApB))
+			}
+			d2 := p * q
+			h11 += f[i] * f[i] * d2
+			h22 += d2
+			h21 += f[i] * d2
+			d1 := t[i] - p
+			g1 += f[i] * d1
+			g2 += d1
+		}
+
+		if math.Abs(g1) < eps && math.Abs(g2) < eps {
+			break
+		}
+
+		// newton direction
+		det := h11*h22 - h21*h21
+		dA := -(h22*g1 - h21*g2) / det
+		dB := -(-h21*g1 + h11*g2) / det
+		gd := g1*dA + g2*dB
+
+		// line search
+		step := 1.0
+		for step >= minStep {
+			newA := a + step*dA
+			newB := b + step*dB
+			newf := fval(newA, newB)
+			if newf < fv+0.0001*step*gd {
+				a, b, fv = newA, newB, newf
+				break
+			}
+			step /= 2.0
+		}
+
+		if step < minStep {
+			break // line search failed
+		}
+	}
+
+	return a, b
+}
+
+// fitIsotonic returns the knots of a non-decreasing fit of y on f using pool
+// adjacent violators, each knot is the mean f and mean y of a block.
+// Examples with equal f start in the same block, so the fit doesn't depend
+// on the order of ties.
+func fitIsotonic(f []float64, y []bool) ([]float64, []float64) {
+	inx := make([]int, len(f))
+	for i := range inx {
+		inx[i] = i
+	}
+	sort.Sort(probSort{f: f, inx: inx})
+
+	type block struct {
+		sumX, sumY, n float64
+	}
+	var ties []block
+	for k, i := range inx {
+		if k == 0 || f[i] != f[inx[k-1]] {
+			ties = append(ties, block{})
+		}
+		b := &ties[len(ties)-1]
+		b.sumX += f[i]
+		b.n++
+		if y[i] {
+			b.sumY++
+		}
+	}
+
+	var blocks []block
+	for _, b := range ties {
+		blocks = append(blocks, b)
+
+		// merge with previous blocks while the means decrease
+		for len(blocks) > 1 {
+			last := blocks[len(blocks)-1]
+			prev := blocks[len(blocks)-2]
+			if prev.sumY/prev.n < last.sumY/last.n {
+				break
+			}
+			blocks = blocks[:len(blocks)-1]
+			blocks[len(blocks)-1] = block{prev.sumX + last.sumX, prev.sumY + last.sumY, prev.n + last.n}
+		}
+	}
+
+	x := make([]float64, len(blocks))
+	v := make([]float64, len(blocks))
+	for i, b := range blocks {
+		x[i] = b.sumX / b.n
+		v[i] = b.sumY / b.n
+	}
+
+	return x, v
+}
+
+// probSort sorts inx by the values in f
+type probSort struct {
+	f   []float64
+	inx []int
+}
+
+func (p probSort) Len() int           { return len(p.inx) }
+func (p probSort) Less(i, j int) bool { return p.f[p.inx[i]] < p.f[p.inx[j]] }
+func (p probSort) Swap(i, j int)      { p.inx[i], p.inx[j] = p.inx[j], p.inx[i] }
+
+// interpolate evaluates the piecewise linear function with knots x, y at v,
+// values outside of the knots are clamped to the first/last knot.
+func interpolate(x, y []float64, v float64) float64 {
+	if len(x) == 0 {
+		return v
+	}
+	if v <= x[0] {
+		return y[0]
+	}
+	if v >= x[len(x)-1] {
+		return y[len(y)-1]
+	}
+
+	i := sort.SearchFloat64s(x, v) // x[i-1] < v <= x[i]
+	w := (v - x[i-1]) / (x[i] - x[i-1])
+	return y[i-1] + w*(y[i]-y[i-1])
+}
+
+// ReliabilityBin summarizes the examples with predicted probability in
+// [Lower, Upper) for a reliability diagram.
+type ReliabilityBin struct {
+	Lower    float64
+	Upper    float64
+	MeanProb float64 // mean predicted probability
+	FracPos  float64 // fraction of examples with the class
+	Count    int
+}
+
+// reliabilityBins pools the predicted probability of every class for every
+// example (one-vs-rest) into nBins equal width bins, examples with a zero
+// count are skipped.
+func reliabilityBins(prob [][]float64, count []int, Y []int, nBins int) []ReliabilityBin {
+	bins := make([]ReliabilityBin, nBins)
+	for i := range bins {
+		bins[i].Lower = float64(i) / float64(nBins)
+		bins[i].Upper = float64(i+1) / float64(nBins)
+	}
+
+	for i := range prob {
+		if count[i] < 1 {
+			continue
+		}
+		for class, p := range prob[i] {
+			b := int(p * float64(nBins))
+			if b >= nBins {
+				b = nBins - 1
+			}
+			bins[b].MeanProb += p
+			if Y[i] == class {
+				bins[b].FracPos++
+			}
+			bins[b].Count++
+		}
+	}
+
+	for i := range bins {
+		if bins[i].Count > 0 {
+			bins[i].MeanProb /= float64(bins[i].Count)
+			bins[i].FracPos /= float64(bins[i].Count)
+		}
+	}
+
+	return bins
+}
+
+// brierScore returns the mean over examples of the squared difference
+// between the predicted class probabilities and the one-hot encoded class,
+// examples with a zero count are skipped.
+func brierScore(prob [][]float64, count []int, Y []int) float64 {
+	sum := 0.0
+	n := 0
+	for i := range prob {
+		if count[i] < 1 {
+			continue
+		}
+		for class, p := range prob[i] {
+			d := p
+			if Y[i] == class {
+				d = p - 1
+			}
+			sum += d * d
+		}
+		n++
+	}
+	return sum / float64(n)
+}
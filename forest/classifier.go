@@ -1,7 +1,9 @@
 package forest
 
 import (
+	"context"
 	"math"
+	"math/rand"
 	"time"
 
 	"github.com/wlattner/rf/tree"
@@ -18,10 +20,25 @@ type Classifier struct {
 	impurity        tree.ImpurityMeasure
 	nWorkers        int
 	computeOOB      bool
+	calibration     Calibration
 	ConfusionMatrix [][]int
 	Accuracy        float64
+	OOBProb         [][]float64 // out of bag class probabilities for each example
+	OOBCount        []int       // number of trees each example was out of bag for
+	Calibrator      *Calibrator // nil unless fit with Calibrate
+	Brier           float64     // out of bag Brier score, after calibration
+	Reliability     []ReliabilityBin
+	OOBMetrics      *ClassMetrics // from out of bag class probabilities, after calibration
+	OOBCurve        []float64     // out of bag error rate of the first i+1 trees
+	earlyStopWindow int
+	earlyStopTol    float64
+	seed            int64
+	seeded          bool
+	maxFitTime      time.Duration
+	progress        func(FitProgress)
+	weights         []float64 // sampling weight of each example, nil for uniform
 	NSample         int
-	nFeatures       int
+	NFeatures       int // number of features the forest was fit with
 }
 
 // methods for the forestConfiger interface
@@ -32,7 +49,25 @@ func (c *Classifier) setImpurity(f tree.ImpurityMeasure) { c.impurity = f }
 func (c *Classifier) setMaxFeatures(n int)               { c.MaxFeatures = n }
 func (c *Classifier) setNumTrees(n int)                  { c.NTrees = n }
 func (c *Classifier) setNumWorkers(n int)                { c.nWorkers = n }
+func (c *Classifier) setLifetime(l float64)              {}
 func (c *Classifier) setComputeOOB()                     { c.computeOOB = true }
+func (c *Classifier) setKeepInBag()                      {}
+func (c *Classifier) setCalibration(m Calibration) {
+	c.calibration = m
+	c.computeOOB = true
+}
+func (c *Classifier) setMaxFitTime(d time.Duration)    { c.maxFitTime = d }
+func (c *Classifier) setProgress(fn func(FitProgress)) { c.progress = fn }
+func (c *Classifier) setSampleWeights(w []float64)     { c.weights = w }
+func (c *Classifier) setRandState(seed int64) {
+	c.seed = seed
+	c.seeded = true
+}
+func (c *Classifier) setEarlyStopping(w int, tol float64) {
+	c.earlyStopWindow = w
+	c.earlyStopTol = tol
+	c.computeOOB = true
+}
 
 // NewClassifier returns a configured/initialized random forest classifier.
 // If no options are passed, the returned Classifier will be equivalent to
@@ -58,8 +93,34 @@ func NewClassifier(options ...func(forestConfiger)) *Classifier {
 }
 
 // Fit constructs a forest from fitting n trees from the provided features X, and
-// labels Y.
+// labels Y. With EarlyStopping or MaxFitTime, fewer than n trees may be fit,
+// NTrees is set to the number of trees in the forest.
 func (f *Classifier) Fit(X [][]float64, Y []string) {
+	f.FitContext(context.Background(), X, Y)
+}
+
+// FitContext fits the forest as Fit. If ctx is done before all trees are fit,
+// no more trees are started and the forest is made of the trees fit so far,
+// ctx.Err() is returned. ErrNoTrees is returned if no tree was fit.
+func (f *Classifier) FitContext(ctx context.Context, X [][]float64, Y []string) error {
+	return f.FitDatasetContext(ctx, tree.RowMajor(X), Y)
+}
+
+// FitDataset fits the forest as Fit from the examples in the Dataset X. A
+// tree.ColMajor32 filled with SetRow uses less than half the memory of
+// [][]float64, a tree.CSC stores only the nonzero values of sparse data.
+func (f *Classifier) FitDataset(X tree.Dataset, Y []string) {
+	f.FitDatasetContext(context.Background(), X, Y)
+}
+
+// FitDatasetContext fits the forest as FitContext from the examples in the
+// Dataset X.
+func (f *Classifier) FitDatasetContext(ctx context.Context, X tree.Dataset, Y []string) error {
+	cum, err := cumulativeWeights(f.weights, X.NumRows())
+	if err != nil {
+		return err
+	}
+
 	// labels as integer ids, ensure all trees know about all classes
 	var yIDs []int
 	uniq := make(map[string]int)
@@ -76,82 +137,138 @@ func (f *Classifier) Fit(X [][]float64, Y []string) {
 	f.Classes = classes
 	f.NSample = len(yIDs)
 
-	f.nFeatures = len(X[0])
+	f.NFeatures = X.NumFeatures()
 
 	f.Trees = make([]*tree.Classifier, f.NTrees)
 
 	if f.MaxFeatures < 0 {
-		f.MaxFeatures = int(math.Sqrt(float64(f.nFeatures)))
+		f.MaxFeatures = int(math.Sqrt(float64(f.NFeatures)))
 	}
 
-	var oobClassCtr *oobCtr
+	var (
+		oobClassCtr *oobCtr
+		oobInx      [][]int       // out of bag examples for each tree
+		oobTreeProb [][][]float64 // and their predicted class probabilities
+	)
 	if f.computeOOB {
 		oobClassCtr = newOOBCtr(len(Y), len(f.Classes))
+		oobInx = make([][]int, f.NTrees)
+		oobTreeProb = make([][][]float64, f.NTrees)
+	}
+	f.OOBCurve = nil
+
+	// each tree draws its bootstrap sample and split features from its own
+	// seed, so the forest doesn't depend on the order trees are fit
+	seeds := treeSeeds(f.NTrees, f.seed, f.seeded)
+
+	fit := func(i int) {
+		r := rand.New(rand.NewSource(seeds[i]))
+		inx, inBag := bootstrapInx(r, X.NumRows(), cum)
+		clf := tree.NewClassifier(tree.MinSplit(f.MinSplit), tree.MinLeaf(f.MinLeaf),
+			tree.MaxDepth(f.MaxDepth), tree.Impurity(f.impurity), tree.MaxFeatures(f.MaxFeatures),
+			tree.RandState(r.Int63()))
+		clf.FitInxDataset(X, yIDs, inx, classes)
+		f.Trees[i] = clf
+
+		if f.computeOOB {
+			oobInx[i] = outOfBag(inBag)
+			oobTreeProb[i] = clf.PredictProbInxDataset(X, oobInx[i])
+		}
 	}
 
-	in := make(chan *fitTree)
-	out := make(chan *fitTree)
+	// accumulate oob predictions in tree order
+	add := func(i int) bool {
+		if !f.computeOOB {
+			f.reportProgress(i + 1)
+			return true
+		}
+		oobClassCtr.update(oobInx[i], oobTreeProb[i])
+		oobInx[i], oobTreeProb[i] = nil, nil
 
-	nWorkers := f.nWorkers
-	if nWorkers < 1 {
-		nWorkers = 1
+		f.OOBCurve = append(f.OOBCurve, oobClassCtr.errorRate(yIDs))
+		f.reportProgress(i + 1)
+		return !stopEarly(f.OOBCurve, f.earlyStopWindow, f.earlyStopTol)
 	}
 
-	// start workers
-	for i := 0; i < nWorkers; i++ {
-		go func(id int) {
-			for w := range in {
-				clf := tree.NewClassifier(tree.MinSplit(f.MinSplit), tree.MinLeaf(f.MinLeaf),
-					tree.MaxDepth(f.MaxDepth), tree.Impurity(f.impurity), tree.MaxFeatures(f.MaxFeatures),
-					tree.RandState(int64(id)*time.Now().UnixNano()))
-				clf.FitInx(X, yIDs, w.inx, classes)
+	fitCtx, cancel := fitContext(ctx, f.maxFitTime)
+	defer cancel()
 
-				w.t = clf
+	f.NTrees = fitTrees(fitCtx, f.NTrees, f.nWorkers, fit, add)
+	f.Trees = f.Trees[:f.NTrees]
 
-				if f.computeOOB {
-					oobClassCtr.update(X, w.inBag, w.t)
-				}
+	if f.NTrees == 0 {
+		return ErrNoTrees
+	}
 
-				out <- w
+	if f.computeOOB {
+		f.ConfusionMatrix, f.Accuracy = oobClassCtr.compute(yIDs)
+		f.OOBProb, f.OOBCount = oobClassCtr.predictions()
+
+		f.Calibrator = nil
+		prob := f.OOBProb
+		if f.calibration != NoCalibration {
+			f.Calibrator = fitCalibrator(f.calibration, f.OOBProb, f.OOBCount, yIDs, len(classes))
+			prob = make([][]float64, len(f.OOBProb))
+			for i, p := range f.OOBProb {
+				prob[i] = f.Calibrator.Calibrate(p)
+			}
+		}
+		f.Brier = brierScore(prob, f.OOBCount, yIDs)
+		f.Reliability = reliabilityBins(prob, f.OOBCount, yIDs, 10)
+
+		// skip examples that were in all trees
+		var oobY []int
+		var oobProb [][]float64
+		for i, ct := range f.OOBCount {
+			if ct > 0 {
+				oobY = append(oobY, yIDs[i])
+				oobProb = append(oobProb, prob[i])
 			}
-		}(i)
+		}
+		f.OOBMetrics = ComputeClassMetrics(oobY, oobProb)
 	}
 
-	// fill the queue
-	go func() {
-		for _ = range f.Trees {
-			inx, inBag := bootstrapInx(len(X))
-			in <- &fitTree{inx: inx, inBag: inBag}
-		}
-		close(in)
-	}()
+	return ctx.Err()
+}
 
-	for i := range f.Trees {
-		w := <-out
-		f.Trees[i] = w.t
+// reportProgress calls the progress function, if any, with the number of
+// trees added so far
+func (f *Classifier) reportProgress(trees int) {
+	if f.progress == nil {
+		return
 	}
-
-	if f.computeOOB {
-		f.ConfusionMatrix, f.Accuracy = oobClassCtr.compute(yIDs)
+	oobErr := math.NaN()
+	if len(f.OOBCurve) > 0 {
+		oobErr = f.OOBCurve[len(f.OOBCurve)-1]
 	}
+	f.progress(FitProgress{Trees: trees, NTrees: f.NTrees, OOBError: oobErr})
 }
 
 // Predict returns the most probable class id for each example. The id
 // corresponds to the index of the class label in Classifier.Classes.
 func (f *Classifier) Predict(X [][]float64) []int {
-	classVotes := make([][]int, len(X))
+	return f.PredictDataset(tree.RowMajor(X))
+}
+
+// PredictDataset returns the most probable class id for each example in the
+// Dataset X as in Predict.
+func (f *Classifier) PredictDataset(X tree.Dataset) []int {
+	classVotes := make([][]int, X.NumRows())
 	for i := range classVotes {
 		classVotes[i] = make([]int, len(f.Classes))
 	}
 
-	for _, t := range f.Trees {
-		for i, class := range t.Predict(X) {
-			classVotes[i][class]++
+	parallelRows(X.NumRows(), f.nWorkers, func(start, end int) {
+		inx := rowRange(start, end)
+		for _, t := range f.Trees {
+			for i, class := range t.PredictIDDataset(X, inx) {
+				classVotes[start+i][class]++
+			}
 		}
-	}
+	})
 
 	// find max class for each example
-	maxClass := make([]int, len(X))
+	maxClass := make([]int, X.NumRows())
 
 	for i := range maxClass {
 		maxCt := 0
@@ -169,73 +286,134 @@ func (f *Classifier) Predict(X [][]float64) []int {
 }
 
 // PredictProb returns the class probability for each example. The indices of the
-// return value correspond to Classifier.Classes.
+// return value correspond to Classifier.Classes. If the forest was fit with
+// Calibrate, the probabilities are calibrated.
 func (f *Classifier) PredictProb(X [][]float64) [][]float64 {
+	return f.PredictProbDataset(tree.RowMajor(X))
+}
+
+// PredictProbDataset returns the class probability for each example in the
+// Dataset X as in PredictProb.
+func (f *Classifier) PredictProbDataset(X tree.Dataset) [][]float64 {
 	//TODO: weighted voting...
-	probs := make([][]float64, len(X))
+	probs := make([][]float64, X.NumRows())
 	// initialize the other dim
 	for row := range probs {
 		probs[row] = make([]float64, len(f.Classes))
 	}
 
-	for _, t := range f.Trees {
-		tProbs := t.PredictProb(X)
-		for row := range tProbs {
-			for class := range tProbs[row] {
-				probs[row][class] += tProbs[row][class] / float64(f.NTrees)
+	parallelRows(X.NumRows(), f.nWorkers, func(start, end int) {
+		inx := rowRange(start, end)
+		for _, t := range f.Trees {
+			tProbs := t.PredictProbInxDataset(X, inx)
+			for row := range tProbs {
+				for class := range tProbs[row] {
+					probs[start+row][class] += tProbs[row][class] / float64(f.NTrees)
+				}
 			}
 		}
-	}
+
+		if f.Calibrator != nil {
+			for row := start; row < end; row++ {
+				probs[row] = f.Calibrator.Calibrate(probs[row])
+			}
+		}
+	})
 
 	return probs
 }
 
-// VarImp returns importance scores for the model.
-func (f *Classifier) VarImp() []float64 {
-	imp := make([]float64, f.nFeatures)
-
-	for _, t := range f.Trees {
-		for inx, importance := range t.VarImp() {
-			imp[inx] += importance / float64(f.NTrees)
-		}
-	}
-
-	return imp
+// Impurity returns the impurity measure used to evaluate splits.
+func (f *Classifier) Impurity() tree.ImpurityMeasure {
+	return f.impurity
 }
 
-type fitTree struct {
-	t     *tree.Classifier
-	inx   []int
-	inBag []bool
+// VarImp returns importance scores for the model.
+func (f *Classifier) VarImp() []float64 {
+	return sumVarImp(len(f.Trees), f.NFeatures, f.nWorkers, func(i int) []float64 {
+		return f.Trees[i].VarImp()
+	})
 }
 
 type oobCtr struct {
-	classVotes [][]int // array of nExample x nClasses
+	classVotes [][]int     // array of nExample x nClasses
+	probSum    [][]float64 // array of nExample x nClasses
+	ct         []int
 }
 
 func newOOBCtr(nExample, nClasses int) *oobCtr {
 	classVotes := make([][]int, nExample)
+	probSum := make([][]float64, nExample)
 	for i := range classVotes {
 		classVotes[i] = make([]int, nClasses)
+		probSum[i] = make([]float64, nClasses)
 	}
-	m := oobCtr{classVotes: classVotes}
+	m := oobCtr{classVotes: classVotes, probSum: probSum, ct: make([]int, nExample)}
 	return &m
 }
 
-// accumulate oob predictions for a tree
-func (o *oobCtr) update(X [][]float64, inBag []bool, t *tree.Classifier) {
-	var inx []int
-	for i, in := range inBag {
-		if !in {
-			inx = append(inx, i)
+// accumulate the oob class probabilities pred of a tree for the examples inx
+func (o *oobCtr) update(inx []int, pred [][]float64) {
+	for i, sampleInx := range inx {
+		// vote for the most probable class, same as tree.PredictID
+		maxP := 0.0
+		maxC := 0
+		for class, p := range pred[i] {
+			o.probSum[sampleInx][class] += p
+			if p > maxP {
+				maxP = p
+				maxC = class
+			}
 		}
+		o.classVotes[sampleInx][maxC]++
+		o.ct[sampleInx]++
 	}
+}
 
-	pred := t.PredictID(X, inx)
+// errorRate returns the fraction of misclassified examples by majority vote,
+// examples that have not been out of bag are skipped.
+func (o *oobCtr) errorRate(Y []int) float64 {
+	n := 0
+	wrong := 0
+	for i, actual := range Y {
+		if o.ct[i] < 1 {
+			continue
+		}
+		maxClass := 0
+		maxVotes := 0
+		for class, nVotes := range o.classVotes[i] {
+			if nVotes > maxVotes {
+				maxVotes = nVotes
+				maxClass = class
+			}
+		}
+		if maxClass != actual {
+			wrong++
+		}
+		n++
+	}
+	return float64(wrong) / float64(n)
+}
 
-	for i, sampleInx := range inx {
-		o.classVotes[sampleInx][pred[i]]++
+// predictions returns the average class probabilities over the trees each
+// example was out of bag for and the number of trees, examples that were in
+// every bootstrap sample have all zero probabilities.
+func (o *oobCtr) predictions() ([][]float64, []int) {
+	prob := make([][]float64, len(o.probSum))
+	for i := range prob {
+		prob[i] = make([]float64, len(o.probSum[i]))
+		if o.ct[i] < 1 {
+			continue
+		}
+		for class, p := range o.probSum[i] {
+			prob[i][class] = p / float64(o.ct[i])
+		}
 	}
+
+	ct := make([]int, len(o.ct))
+	copy(ct, o.ct)
+
+	return prob, ct
 }
 
 // compute confusion matrix and overall accuracy from oob predictions
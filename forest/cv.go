@@ -0,0 +1,312 @@
+package forest
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Fold holds the indices of the examples used to fit and evaluate a model
+// for one fold of cross validation.
+type Fold struct {
+	Train []int
+	Test  []int
+}
+
+// KFold randomly partitions n examples into k folds of nearly equal size
+// using r.
+func KFold(n, k int, r *rand.Rand) []Fold {
+	assign := make([]int, n)
+	for i, j := range r.Perm(n) {
+		assign[j] = i % k
+	}
+	return makeFolds(assign, k)
+}
+
+// RepeatedKFold returns the folds from repeats independent calls to KFold.
+func RepeatedKFold(n, k, repeats int, r *rand.Rand) []Fold {
+	var folds []Fold
+	for i := 0; i < repeats; i++ {
+		folds = append(folds, KFold(n, k, r)...)
+	}
+	return folds
+}
+
+// StratifiedKFold randomly partitions the examples into k folds such that
+// the proportion of each class in Y is about the same in every fold.
+func StratifiedKFold(Y []string, k int, r *rand.Rand) []Fold {
+	byClass := make(map[string][]int)
+	var classes []string
+	for i, class := range Y {
+		if _, ok := byClass[class]; !ok {
+			classes = append(classes, class)
+		}
+		byClass[class] = append(byClass[class], i)
+	}
+
+	// deal the examples of each class to the folds in turn, continuing from
+	// where the previous class stopped to keep the folds the same size
+	assign := make([]int, len(Y))
+	next := 0
+	for _, class := range classes {
+		inx := byClass[class]
+		for _, j := range r.Perm(len(inx)) {
+			assign[inx[j]] = next % k
+			next++
+		}
+	}
+
+	return makeFolds(assign, k)
+}
+
+// GroupKFold partitions the examples into k folds such that all examples
+// with the same group are in the same fold. Groups are assigned, largest
+// first, to the fold with the fewest examples, ties are broken using r.
+func GroupKFold(groups []string, k int, r *rand.Rand) []Fold {
+	members := make(map[string][]int)
+	var uniq []string
+	for i, g := range groups {
+		if _, ok := members[g]; !ok {
+			uniq = append(uniq, g)
+		}
+		members[g] = append(members[g], i)
+	}
+
+	// shuffle before sorting so ties are broken at random
+	for i, j := range r.Perm(len(uniq)) {
+		uniq[i], uniq[j] = uniq[j], uniq[i]
+	}
+	sort.Stable(groupSort{uniq, members})
+
+	size := make([]int, k)
+	assign := make([]int, len(groups))
+	for _, g := range uniq {
+		smallest := 0
+		for f := range size {
+			if size[f] < size[smallest] {
+				smallest = f
+			}
+		}
+		for _, i := range members[g] {
+			assign[i] = smallest
+		}
+		size[smallest] += len(members[g])
+	}
+
+	return makeFolds(assign, k)
+}
+
+// sorts groups by decreasing size
+type groupSort struct {
+	groups  []string
+	members map[string][]int
+}
+
+func (g groupSort) Len() int { return len(g.groups) }
+func (g groupSort) Less(i, j int) bool {
+	return len(g.members[g.groups[i]]) > len(g.members[g.groups[j]])
+}
+func (g groupSort) Swap(i, j int) { g.groups[i], g.groups[j] = g.groups[j], g.groups[i] }
+
+// makeFolds builds k folds from the fold assigned to each example
+func makeFolds(assign []int, k int) []Fold {
+	folds := make([]Fold, k)
+	for i, f := range assign {
+		for j := range folds {
+			if j == f {
+				folds[j].Test = append(folds[j].Test, i)
+			} else {
+				folds[j].Train = append(folds[j].Train, i)
+			}
+		}
+	}
+	return folds
+}
+
+// Metric is a named summary of the performance of a model.
+type Metric struct {
+	Name  string
+	Value float64
+}
+
+// CVResult holds the results of cross validation.
+type CVResult struct {
+	Folds [][]Metric // metrics for each fold, in the order of the folds
+	Mean  []Metric   // mean over folds of each metric
+	Std   []Metric   // standard deviation over folds of each metric
+	// out of fold predictions for each example, averaged over repeats
+	Prob  [][]float64 // classification, indices correspond to the classes
+	Pred  []float64   // regression
+	Count []int       // number of folds each example was predicted in
+}
+
+// CrossValidateClassifier fits a classifier returned by newClf to the
+// training examples of each fold and evaluates it on the test examples.
+// Up to nWorkers folds are fit at the same time. The indices of the out of
+// fold class probabilities correspond to classes, the unique labels of Y in
+// order of appearance as in Classifier.Fit.
+func CrossValidateClassifier(X [][]float64, Y []string, folds []Fold, nWorkers int,
+	newClf func() *Classifier) (*CVResult, []string) {
+
+	uniq := make(map[string]int)
+	var classes []string
+	yIDs := make([]int, len(Y))
+	for i, val := range Y {
+		id, ok := uniq[val]
+		if !ok {
+			id = len(uniq)
+			uniq[val] = id
+			classes = append(classes, val)
+		}
+		yIDs[i] = id
+	}
+
+	foldProb := make([][][]float64, len(folds))
+
+	parallel(len(folds), nWorkers, func(f int) {
+		clf := newClf()
+		clf.Fit(subsetX(X, folds[f].Train), subsetY(Y, folds[f].Train))
+
+		// map the classes of the fold to the classes of Y, some classes may
+		// be missing from the fold
+		prob := clf.PredictProb(subsetX(X, folds[f].Test))
+		foldProb[f] = make([][]float64, len(prob))
+		for i, p := range prob {
+			foldProb[f][i] = make([]float64, len(classes))
+			for id, v := range p {
+				foldProb[f][i][uniq[clf.Classes[id]]] = v
+			}
+		}
+	})
+
+	res := &CVResult{
+		Prob:  make([][]float64, len(Y)),
+		Count: make([]int, len(Y)),
+	}
+	for i := range res.Prob {
+		res.Prob[i] = make([]float64, len(classes))
+	}
+
+	for f, fold := range folds {
+		testY := make([]int, len(fold.Test))
+		for i, inx := range fold.Test {
+			testY[i] = yIDs[inx]
+			for class, v := range foldProb[f][i] {
+				res.Prob[inx][class] += v
+			}
+			res.Count[inx]++
+		}
+		res.Folds = append(res.Folds, ComputeClassMetrics(testY, foldProb[f]).Summary())
+	}
+
+	for i, ct := range res.Count {
+		for class := range res.Prob[i] {
+			if ct > 0 {
+				res.Prob[i][class] /= float64(ct)
+			}
+		}
+	}
+
+	res.summarize()
+	return res, classes
+}
+
+// CrossValidateRegressor fits a regressor returned by newReg to the training
+// examples of each fold and evaluates it on the test examples. Up to
+// nWorkers folds are fit at the same time.
+func CrossValidateRegressor(X [][]float64, Y []float64, folds []Fold, nWorkers int,
+	newReg func() *Regressor) *CVResult {
+
+	foldPred := make([][]float64, len(folds))
+
+	parallel(len(folds), nWorkers, func(f int) {
+		trainY := make([]float64, len(folds[f].Train))
+		for i, inx := range folds[f].Train {
+			trainY[i] = Y[inx]
+		}
+
+		reg := newReg()
+		reg.Fit(subsetX(X, folds[f].Train), trainY)
+		foldPred[f] = reg.Predict(subsetX(X, folds[f].Test))
+	})
+
+	res := &CVResult{
+		Pred:  make([]float64, len(Y)),
+		Count: make([]int, len(Y)),
+	}
+
+	for f, fold := range folds {
+		testY := make([]float64, len(fold.Test))
+		for i, inx := range fold.Test {
+			testY[i] = Y[inx]
+			res.Pred[inx] += foldPred[f][i]
+			res.Count[inx]++
+		}
+		res.Folds = append(res.Folds, ComputeRegMetrics(testY, foldPred[f]).Summary())
+	}
+
+	for i, ct := range res.Count {
+		if ct > 0 {
+			res.Pred[i] /= float64(ct)
+		} else {
+			res.Pred[i] = math.NaN()
+		}
+	}
+
+	res.summarize()
+	return res
+}
+
+// summarize computes the mean and standard deviation of each metric over
+// the folds, NaN values (e.g. AUC for a fold with one class) are skipped.
+func (r *CVResult) summarize() {
+	if len(r.Folds) == 0 {
+		return
+	}
+
+	r.Mean = nil
+	r.Std = nil
+	for m, metric := range r.Folds[0] {
+		n := 0
+		mean := 0.0
+		ss := 0.0
+		for _, fold := range r.Folds {
+			v := fold[m].Value
+			if math.IsNaN(v) {
+				continue
+			}
+			n++
+			d := v - mean
+			mean += d / float64(n)
+			ss += d * (v - mean)
+		}
+
+		std := 0.0
+		if n > 1 {
+			std = math.Sqrt(ss / float64(n-1))
+		}
+		if n == 0 {
+			mean = math.NaN()
+			std = math.NaN()
+		}
+
+		r.Mean = append(r.Mean, Metric{metric.Name, mean})
+		r.Std = append(r.Std, Metric{metric.Name, std})
+	}
+}
+
+func subsetX(X [][]float64, inx []int) [][]float64 {
+	s := make([][]float64, len(inx))
+	for i, id := range inx {
+		s[i] = X[id]
+	}
+	return s
+}
+
+func subsetY(Y []string, inx []int) []string {
+	s := make([]string, len(inx))
+	for i, id := range inx {
+		s[i] = Y[id]
+	}
+	return s
+}
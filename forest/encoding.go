@@ -0,0 +1,446 @@
+package forest
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/wlattner/rf/tree"
+)
+
+// The JSON form of a forest holds its parameters, its trees as encoded by the
+// tree package and the out of bag estimates from fitting, e.g.
+//
+//	{
+//	  "n_trees": 10, "min_split": 2, "min_leaf": 1, "max_depth": -1,
+//	  "max_features": 2, "n_features": 4, "n_sample": 150,
+//	  "impurity": "gini",
+//	  "classes": ["setosa", "versicolor", "virginica"],
+//	  "trees": [...],
+//	  "accuracy": 0.95,
+//	  ...
+//	}
+//
+// Settings that only affect fitting, such as the number of workers or early
+// stopping, aren't encoded.
+
+var impurityNames = map[tree.ImpurityMeasure]string{
+	Gini:    "gini",
+	Entropy: "entropy",
+}
+
+var calibrationNames = map[Calibration]string{
+	NoCalibration: "",
+	Sigmoid:       "sigmoid",
+	Isotonic:      "isotonic",
+}
+
+// parseImpurity returns the impurity measure called name
+func parseImpurity(name string) (tree.ImpurityMeasure, error) {
+	for imp, n := range impurityNames {
+		if n == name {
+			return imp, nil
+		}
+	}
+	return Gini, fmt.Errorf("unknown impurity %q", name)
+}
+
+// parseCalibration returns the calibration method called name
+func parseCalibration(name string) (Calibration, error) {
+	for c, n := range calibrationNames {
+		if n == name {
+			return c, nil
+		}
+	}
+	return NoCalibration, fmt.Errorf("unknown calibration %q", name)
+}
+
+type calibratorJSON struct {
+	Method     string        `json:"method"`
+	A          tree.Floats   `json:"a,omitempty"`
+	B          tree.Floats   `json:"b,omitempty"`
+	Thresholds []tree.Floats `json:"thresholds,omitempty"`
+	Values     []tree.Floats `json:"values,omitempty"`
+}
+
+// MarshalJSON encodes the calibrator.
+func (c *Calibrator) MarshalJSON() ([]byte, error) {
+	return json.Marshal(calibratorJSON{
+		Method:     calibrationNames[c.Method],
+		A:          c.A,
+		B:          c.B,
+		Thresholds: tree.FloatRows(c.Thresholds),
+		Values:     tree.FloatRows(c.Values),
+	})
+}
+
+// UnmarshalJSON decodes a calibrator encoded by MarshalJSON.
+func (c *Calibrator) UnmarshalJSON(b []byte) error {
+	var cj calibratorJSON
+	if err := json.Unmarshal(b, &cj); err != nil {
+		return err
+	}
+	method, err := parseCalibration(cj.Method)
+	if err != nil {
+		return err
+	}
+	*c = Calibrator{
+		Method:     method,
+		A:          cj.A,
+		B:          cj.B,
+		Thresholds: tree.Float64Rows(cj.Thresholds),
+		Values:     tree.Float64Rows(cj.Values),
+	}
+	return nil
+}
+
+type reliabilityJSON struct {
+	Lower    tree.Float `json:"lower"`
+	Upper    tree.Float `json:"upper"`
+	MeanProb tree.Float `json:"mean_prob"`
+	FracPos  tree.Float `json:"frac_pos"`
+	Count    int        `json:"count"`
+}
+
+type classMetricsJSON struct {
+	ConfusionMatrix   [][]int     `json:"confusion_matrix"`
+	Accuracy          tree.Float  `json:"accuracy"`
+	Precision         tree.Floats `json:"precision"`
+	Recall            tree.Floats `json:"recall"`
+	F1                tree.Floats `json:"f1"`
+	Support           []int       `json:"support"`
+	MacroPrecision    tree.Float  `json:"macro_precision"`
+	MacroRecall       tree.Float  `json:"macro_recall"`
+	MacroF1           tree.Float  `json:"macro_f1"`
+	WeightedPrecision tree.Float  `json:"weighted_precision"`
+	WeightedRecall    tree.Float  `json:"weighted_recall"`
+	WeightedF1        tree.Float  `json:"weighted_f1"`
+	Kappa             tree.Float  `json:"kappa"`
+	LogLoss           tree.Float  `json:"log_loss"`
+	ROCAUC            tree.Float  `json:"roc_auc"`
+	PRAUC             tree.Float  `json:"pr_auc"`
+}
+
+// MarshalJSON encodes the metrics.
+func (m *ClassMetrics) MarshalJSON() ([]byte, error) {
+	return json.Marshal(classMetricsJSON{
+		ConfusionMatrix:   m.ConfusionMatrix,
+		Accuracy:          tree.Float(m.Accuracy),
+		Precision:         m.Precision,
+		Recall:            m.Recall,
+		F1:                m.F1,
+		Support:           m.Support,
+		MacroPrecision:    tree.Float(m.MacroPrecision),
+		MacroRecall:       tree.Float(m.MacroRecall),
+		MacroF1:           tree.Float(m.MacroF1),
+		WeightedPrecision: tree.Float(m.WeightedPrecision),
+		WeightedRecall:    tree.Float(m.WeightedRecall),
+		WeightedF1:        tree.Float(m.WeightedF1),
+		Kappa:             tree.Float(m.Kappa),
+		LogLoss:           tree.Float(m.LogLoss),
+		ROCAUC:            tree.Float(m.ROCAUC),
+		PRAUC:             tree.Float(m.PRAUC),
+	})
+}
+
+// UnmarshalJSON decodes metrics encoded by MarshalJSON.
+func (m *ClassMetrics) UnmarshalJSON(b []byte) error {
+	var mj classMetricsJSON
+	if err := json.Unmarshal(b, &mj); err != nil {
+		return err
+	}
+	*m = ClassMetrics{
+		ConfusionMatrix:   mj.ConfusionMatrix,
+		Accuracy:          float64(mj.Accuracy),
+		Precision:         mj.Precision,
+		Recall:            mj.Recall,
+		F1:                mj.F1,
+		Support:           mj.Support,
+		MacroPrecision:    float64(mj.MacroPrecision),
+		MacroRecall:       float64(mj.MacroRecall),
+		MacroF1:           float64(mj.MacroF1),
+		WeightedPrecision: float64(mj.WeightedPrecision),
+		WeightedRecall:    float64(mj.WeightedRecall),
+		WeightedF1:        float64(mj.WeightedF1),
+		Kappa:             float64(mj.Kappa),
+		LogLoss:           float64(mj.LogLoss),
+		ROCAUC:            float64(mj.ROCAUC),
+		PRAUC:             float64(mj.PRAUC),
+	}
+	return nil
+}
+
+type classifierJSON struct {
+	NTrees          int                `json:"n_trees"`
+	MinSplit        int                `json:"min_split"`
+	MinLeaf         int                `json:"min_leaf"`
+	MaxDepth        int                `json:"max_depth"`
+	MaxFeatures     int                `json:"max_features"`
+	NFeatures       int                `json:"n_features"`
+	NSample         int                `json:"n_sample"`
+	Impurity        string             `json:"impurity"`
+	Calibration     string             `json:"calibration,omitempty"`
+	Classes         []string           `json:"classes"`
+	Trees           []*tree.Classifier `json:"trees"`
+	Calibrator      *Calibrator        `json:"calibrator,omitempty"`
+	ConfusionMatrix [][]int            `json:"confusion_matrix,omitempty"`
+	Accuracy        tree.Float         `json:"accuracy"`
+	Brier           tree.Float         `json:"brier"`
+	OOBProb         []tree.Floats      `json:"oob_prob,omitempty"`
+	OOBCount        []int              `json:"oob_count,omitempty"`
+	OOBCurve        tree.Floats        `json:"oob_curve,omitempty"`
+	OOBMetrics      *ClassMetrics      `json:"oob_metrics,omitempty"`
+	Reliability     []reliabilityJSON  `json:"reliability,omitempty"`
+}
+
+// MarshalJSON encodes the fitted forest.
+func (f *Classifier) MarshalJSON() ([]byte, error) {
+	c := classifierJSON{
+		NTrees:          f.NTrees,
+		MinSplit:        f.MinSplit,
+		MinLeaf:         f.MinLeaf,
+		MaxDepth:        f.MaxDepth,
+		MaxFeatures:     f.MaxFeatures,
+		NFeatures:       f.NFeatures,
+		NSample:         f.NSample,
+		Impurity:        impurityNames[f.impurity],
+		Calibration:     calibrationNames[f.calibration],
+		Classes:         f.Classes,
+		Trees:           f.Trees,
+		Calibrator:      f.Calibrator,
+		ConfusionMatrix: f.ConfusionMatrix,
+		Accuracy:        tree.Float(f.Accuracy),
+		Brier:           tree.Float(f.Brier),
+		OOBProb:         tree.FloatRows(f.OOBProb),
+		OOBCount:        f.OOBCount,
+		OOBCurve:        f.OOBCurve,
+		OOBMetrics:      f.OOBMetrics,
+	}
+	for _, b := range f.Reliability {
+		c.Reliability = append(c.Reliability, reliabilityJSON{
+			Lower:    tree.Float(b.Lower),
+			Upper:    tree.Float(b.Upper),
+			MeanProb: tree.Float(b.MeanProb),
+			FracPos:  tree.Float(b.FracPos),
+			Count:    b.Count,
+		})
+	}
+	return json.Marshal(c)
+}
+
+// UnmarshalJSON decodes a forest encoded by MarshalJSON.
+func (f *Classifier) UnmarshalJSON(b []byte) error {
+	var c classifierJSON
+	if err := json.Unmarshal(b, &c); err != nil {
+		return err
+	}
+
+	impurity, err := parseImpurity(c.Impurity)
+	if err != nil {
+		return err
+	}
+	calibration, err := parseCalibration(c.Calibration)
+	if err != nil {
+		return err
+	}
+	if len(c.Trees) != c.NTrees {
+		return fmt.Errorf("forest has %d trees, expected %d", len(c.Trees), c.NTrees)
+	}
+	for i, t := range c.Trees {
+		if t == nil || t.NFeatures != c.NFeatures || len(t.Classes) != len(c.Classes) {
+			return fmt.Errorf("tree %d doesn't match the forest", i)
+		}
+	}
+
+	*f = Classifier{
+		NTrees:          c.NTrees,
+		MinSplit:        c.MinSplit,
+		MinLeaf:         c.MinLeaf,
+		MaxDepth:        c.MaxDepth,
+		MaxFeatures:     c.MaxFeatures,
+		NFeatures:       c.NFeatures,
+		NSample:         c.NSample,
+		impurity:        impurity,
+		calibration:     calibration,
+		Classes:         c.Classes,
+		Trees:           c.Trees,
+		Calibrator:      c.Calibrator,
+		ConfusionMatrix: c.ConfusionMatrix,
+		Accuracy:        float64(c.Accuracy),
+		Brier:           float64(c.Brier),
+		OOBProb:         tree.Float64Rows(c.OOBProb),
+		OOBCount:        c.OOBCount,
+		OOBCurve:        c.OOBCurve,
+		OOBMetrics:      c.OOBMetrics,
+	}
+	for _, b := range c.Reliability {
+		f.Reliability = append(f.Reliability, ReliabilityBin{
+			Lower:    float64(b.Lower),
+			Upper:    float64(b.Upper),
+			MeanProb: float64(b.MeanProb),
+			FracPos:  float64(b.FracPos),
+			Count:    b.Count,
+		})
+	}
+	return nil
+}
+
+type regressorJSON struct {
+	NTrees      int               `json:"n_trees"`
+	MinSplit    int               `json:"min_split"`
+	MinLeaf     int               `json:"min_leaf"`
+	MaxDepth    int               `json:"max_depth"`
+	MaxFeatures int               `json:"max_features"`
+	NFeatures   int               `json:"n_features"`
+	NSample     int               `json:"n_sample"`
+	Trees       []*tree.Regressor `json:"trees"`
+	InBag       [][]int           `json:"in_bag,omitempty"`
+	MSE         tree.Float        `json:"mse"`
+	RSquared    tree.Float        `json:"r_squared"`
+	OOBPred     tree.Floats       `json:"oob_pred,omitempty"`
+	OOBCount    []int             `json:"oob_count,omitempty"`
+	OOBCurve    tree.Floats       `json:"oob_curve,omitempty"`
+}
+
+// MarshalJSON encodes the fitted forest.
+func (f *Regressor) MarshalJSON() ([]byte, error) {
+	return json.Marshal(regressorJSON{
+		NTrees:      f.NTrees,
+		MinSplit:    f.MinSplit,
+		MinLeaf:     f.MinLeaf,
+		MaxDepth:    f.MaxDepth,
+		MaxFeatures: f.MaxFeatures,
+		NFeatures:   f.NFeatures,
+		NSample:     f.NSample,
+		Trees:       f.Trees,
+		InBag:       f.InBag,
+		MSE:         tree.Float(f.MSE),
+		RSquared:    tree.Float(f.RSquared),
+		OOBPred:     f.OOBPred,
+		OOBCount:    f.OOBCount,
+		OOBCurve:    f.OOBCurve,
+	})
+}
+
+// UnmarshalJSON decodes a forest encoded by MarshalJSON.
+func (f *Regressor) UnmarshalJSON(b []byte) error {
+	var r regressorJSON
+	if err := json.Unmarshal(b, &r); err != nil {
+		return err
+	}
+
+	if len(r.Trees) != r.NTrees {
+		return fmt.Errorf("forest has %d trees, expected %d", len(r.Trees), r.NTrees)
+	}
+	for i, t := range r.Trees {
+		if t == nil || t.NFeatures != r.NFeatures {
+			return fmt.Errorf("tree %d doesn't match the forest", i)
+		}
+	}
+	if r.InBag != nil && len(r.InBag) != r.NTrees {
+		return fmt.Errorf("forest has bootstrap counts for %d trees, expected %d", len(r.InBag), r.NTrees)
+	}
+
+	*f = Regressor{
+		NTrees:      r.NTrees,
+		MinSplit:    r.MinSplit,
+		MinLeaf:     r.MinLeaf,
+		MaxDepth:    r.MaxDepth,
+		MaxFeatures: r.MaxFeatures,
+		NFeatures:   r.NFeatures,
+		NSample:     r.NSample,
+		Trees:       r.Trees,
+		InBag:       r.InBag,
+		keepInBag:   r.InBag != nil,
+		MSE:         float64(r.MSE),
+		RSquared:    float64(r.RSquared),
+		OOBPred:     r.OOBPred,
+		OOBCount:    r.OOBCount,
+		OOBCurve:    r.OOBCurve,
+	}
+	return nil
+}
+
+type mondrianClassifierJSON struct {
+	NTrees   int                        `json:"n_trees"`
+	Lifetime tree.Float                 `json:"lifetime"`
+	NSample  int                        `json:"n_sample"`
+	Classes  []string                   `json:"classes"`
+	Trees    []*tree.MondrianClassifier `json:"trees"`
+}
+
+// MarshalJSON encodes the forest.
+func (f *MondrianClassifier) MarshalJSON() ([]byte, error) {
+	return json.Marshal(mondrianClassifierJSON{
+		NTrees:   f.NTrees,
+		Lifetime: tree.Float(f.Lifetime),
+		NSample:  f.NSample,
+		Classes:  f.Classes,
+		Trees:    f.Trees,
+	})
+}
+
+// UnmarshalJSON decodes a forest encoded by MarshalJSON.
+func (f *MondrianClassifier) UnmarshalJSON(b []byte) error {
+	var m mondrianClassifierJSON
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	if len(m.Trees) != m.NTrees {
+		return fmt.Errorf("forest has %d trees, expected %d", len(m.Trees), m.NTrees)
+	}
+	for i, t := range m.Trees {
+		if t == nil || len(t.Classes) > len(m.Classes) {
+			return fmt.Errorf("tree %d doesn't match the forest", i)
+		}
+	}
+
+	*f = MondrianClassifier{
+		NTrees:   m.NTrees,
+		Lifetime: float64(m.Lifetime),
+		NSample:  m.NSample,
+		Classes:  m.Classes,
+		Trees:    m.Trees,
+	}
+	return nil
+}
+
+type mondrianRegressorJSON struct {
+	NTrees   int                       `json:"n_trees"`
+	Lifetime tree.Float                `json:"lifetime"`
+	NSample  int                       `json:"n_sample"`
+	Trees    []*tree.MondrianRegressor `json:"trees"`
+}
+
+// MarshalJSON encodes the forest.
+func (f *MondrianRegressor) MarshalJSON() ([]byte, error) {
+	return json.Marshal(mondrianRegressorJSON{
+		NTrees:   f.NTrees,
+		Lifetime: tree.Float(f.Lifetime),
+		NSample:  f.NSample,
+		Trees:    f.Trees,
+	})
+}
+
+// UnmarshalJSON decodes a forest encoded by MarshalJSON.
+func (f *MondrianRegressor) UnmarshalJSON(b []byte) error {
+	var m mondrianRegressorJSON
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	if len(m.Trees) != m.NTrees {
+		return fmt.Errorf("forest has %d trees, expected %d", len(m.Trees), m.NTrees)
+	}
+	for i, t := range m.Trees {
+		if t == nil {
+			return fmt.Errorf("tree %d doesn't match the forest", i)
+		}
+	}
+
+	*f = MondrianRegressor{
+		NTrees:   m.NTrees,
+		Lifetime: float64(m.Lifetime),
+		NSample:  m.NSample,
+		Trees:    m.Trees,
+	}
+	return nil
+}
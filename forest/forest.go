@@ -7,16 +7,18 @@
 package forest
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
 	"math/rand"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/wlattner/rf/tree"
 )
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
-}
-
 type forestConfiger interface {
 	setMinSplit(n int)
 	setMinLeaf(n int)
@@ -25,7 +27,15 @@ type forestConfiger interface {
 	setMaxFeatures(n int)
 	setNumTrees(n int)
 	setNumWorkers(n int)
+	setLifetime(l float64)
 	setComputeOOB()
+	setKeepInBag()
+	setCalibration(c Calibration)
+	setEarlyStopping(window int, tol float64)
+	setRandState(seed int64)
+	setMaxFitTime(d time.Duration)
+	setProgress(fn func(FitProgress))
+	setSampleWeights(w []float64)
 }
 
 var (
@@ -33,6 +43,11 @@ var (
 	Entropy = tree.Entropy
 )
 
+// ErrNoTrees is returned when fitting a Classifier or Regressor is stopped,
+// by its context or MaxFitTime, before any tree was fit. A forest without
+// trees can't make predictions.
+var ErrNoTrees = errors.New("no trees were fit")
+
 // MinSplit limits the size for a node to be split vs marked as a leaf
 func MinSplit(n int) func(forestConfiger) {
 	return func(c forestConfiger) {
@@ -80,27 +95,356 @@ func NumTrees(n int) func(forestConfiger) {
 	}
 }
 
-// NumWorkers sets the number of workes used to fit trees; ensure
-// GOMAXPROCS is also set > 1 to take advantage of multi cpu.
+// NumWorkers sets the number of workes used to fit trees and make
+// predictions; ensure GOMAXPROCS is also set > 1 to take advantage of multi
+// cpu.
 func NumWorkers(n int) func(forestConfiger) {
 	return func(c forestConfiger) {
 		c.setNumWorkers(n)
 	}
 }
 
+// Lifetime sets the budget of the Mondrian process used to grow the trees of
+// a MondrianClassifier or MondrianRegressor. Specifying -1 will grow unlimited
+// trees. Lifetime will be ignored for Classifier and Regressor.
+func Lifetime(l float64) func(forestConfiger) {
+	return func(c forestConfiger) {
+		c.setLifetime(l)
+	}
+}
+
 // ComputeOOB will compute mean squared error (Regressor) or overall accuracy
 // and confusion matrix from out of bag samples for each tree.
 func ComputeOOB(c forestConfiger) {
 	c.setComputeOOB()
 }
 
-func bootstrapInx(n int) ([]int, []bool) {
-	inBag := make([]bool, n)
+// KeepInBag will store the number of times each example was drawn in the
+// bootstrap sample of each tree (Regressor). The counts are required for the
+// jackknife variance estimates from PredictVariance.
+func KeepInBag(c forestConfiger) {
+	c.setKeepInBag()
+}
+
+// Calibrate fits a calibrator to the out of bag class probabilities of a
+// Classifier, the calibrated probabilities are returned by PredictProb. Out
+// of bag estimates are computed as with ComputeOOB. Calibrate will be ignored
+// for regression.
+func Calibrate(method Calibration) func(forestConfiger) {
+	return func(c forestConfiger) {
+		c.setCalibration(method)
+	}
+}
+
+// EarlyStopping stops adding trees to a Classifier or Regressor once the out
+// of bag error (MSE for Regressor) of the last window trees has not improved
+// on the best error of the earlier trees by at least tol. NumTrees is the
+// maximum number of trees. Out of bag estimates are computed as with
+// ComputeOOB.
+func EarlyStopping(window int, tol float64) func(forestConfiger) {
+	return func(c forestConfiger) {
+		c.setEarlyStopping(window, tol)
+	}
+}
+
+// RandState sets the seed for the random number generators used to fit the
+// forest. Forests fit with the same seed, data and options are identical
+// regardless of the number of workers. If not provided, the seed is taken
+// from the current time.
+func RandState(seed int64) func(forestConfiger) {
+	return func(c forestConfiger) {
+		c.setRandState(seed)
+	}
+}
+
+// treeSeeds returns a seed for each of n trees drawn from seed, or from the
+// current time if seeded is false
+func treeSeeds(n int, seed int64, seeded bool) []int64 {
+	if !seeded {
+		seed = time.Now().UnixNano()
+	}
+	r := rand.New(rand.NewSource(seed))
+
+	seeds := make([]int64, n)
+	for i := range seeds {
+		seeds[i] = r.Int63()
+	}
+	return seeds
+}
+
+// MaxFitTime limits the time spent fitting a Classifier or Regressor. Once d
+// has elapsed no more trees are started, the forest is made of the trees fit
+// so far, FitContext returns ErrNoTrees if there are none. MaxFitTime will
+// be ignored for online forests.
+func MaxFitTime(d time.Duration) func(forestConfiger) {
+	return func(c forestConfiger) {
+		c.setMaxFitTime(d)
+	}
+}
+
+// FitProgress describes the state of a forest being fit.
+type FitProgress struct {
+	Trees    int     // number of trees fit so far
+	NTrees   int     // number of trees requested
+	OOBError float64 // out of bag error (MSE for Regressor) of the trees so far, NaN without ComputeOOB
+}
+
+// Progress sets a function called after each tree is added to a Classifier
+// or Regressor. fn is called from the goroutine calling Fit, trees are added
+// in order. Progress will be ignored for online forests.
+func Progress(fn func(FitProgress)) func(forestConfiger) {
+	return func(c forestConfiger) {
+		c.setProgress(fn)
+	}
+}
+
+// SampleWeights sets a weight for each example passed to Fit, the bootstrap
+// sample of each tree draws examples with probability proportional to their
+// weight, as the case weights of ranger. Examples with weight 0 are never
+// drawn. FitContext and FitDatasetContext return an error without fitting
+// any trees unless there is a weight >= 0 for each example and their total
+// is positive. SampleWeights will be ignored for online forests.
+func SampleWeights(w []float64) func(forestConfiger) {
+	return func(c forestConfiger) {
+		c.setSampleWeights(w)
+	}
+}
+
+// cumulativeWeights returns the running sums of the weights w of n
+// examples, nil for nil w. The weights must be >= 0 with a positive total.
+func cumulativeWeights(w []float64, n int) ([]float64, error) {
+	if w == nil {
+		return nil, nil
+	}
+	if len(w) != n {
+		return nil, fmt.Errorf("%d sample weights for %d examples", len(w), n)
+	}
+	cum := make([]float64, len(w))
+	sum := 0.0
+	for i, wi := range w {
+		if !(wi >= 0) || math.IsInf(wi, 1) {
+			return nil, fmt.Errorf("sample weight %d is %g, expected a number >= 0", i, wi)
+		}
+		sum += wi
+		cum[i] = sum
+	}
+	if !(sum > 0) || math.IsInf(sum, 1) {
+		return nil, fmt.Errorf("sample weights total %g, expected a positive, finite total", sum)
+	}
+	return cum, nil
+}
+
+// bootstrapInx draws a bootstrap sample of size n using r, it returns the
+// indices of the sample and the number of times each example was drawn.
+// Examples are drawn in proportion to their weights when cum, the running
+// sums of the weights, isn't nil.
+func bootstrapInx(r *rand.Rand, n int, cum []float64) ([]int, []int) {
+	inBag := make([]int, n)
 	inx := make([]int, n)
 	for i := range inx {
-		id := rand.Intn(n)
+		var id int
+		if cum == nil {
+			id = r.Intn(n)
+		} else {
+			u := r.Float64() * cum[n-1]
+			id = sort.Search(n, func(j int) bool { return cum[j] > u })
+			if id == n {
+				// u rounded up to the total, draw the last example with a
+				// positive weight so examples with weight 0 are never drawn
+				id = sort.Search(n, func(j int) bool { return cum[j] >= cum[n-1] })
+			}
+		}
 		inx[i] = id
-		inBag[id] = true
+		inBag[id]++
 	}
 	return inx, inBag
 }
+
+// outOfBag returns the indices of the examples not in a bootstrap sample
+func outOfBag(inBag []int) []int {
+	var inx []int
+	for i, in := range inBag {
+		if in == 0 {
+			inx = append(inx, i)
+		}
+	}
+	return inx
+}
+
+// fitTrees calls fit(i) for each tree i in [0, n) using nWorkers goroutines.
+// add(i) is called from the calling goroutine once trees 0 through i have
+// been fit, so trees are added in the same order regardless of the number of
+// workers. If add returns false or ctx is done, no more trees are started and
+// trees not yet added are discarded, fitTrees waits for running calls to fit
+// to return. fitTrees returns the number of trees added.
+func fitTrees(ctx context.Context, n, nWorkers int, fit func(i int), add func(i int) bool) int {
+	if nWorkers < 1 {
+		nWorkers = 1
+	}
+
+	in := make(chan int)
+	out := make(chan int)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	for w := 0; w < nWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range in {
+				fit(i)
+				out <- i
+			}
+		}()
+	}
+
+	// fill the queue
+	go func() {
+		defer close(in)
+		for i := 0; i < n; i++ {
+			select {
+			case in <- i:
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	fitted := make([]bool, n)
+	next := 0
+	stopped := false
+	for i := range out {
+		fitted[i] = true
+		for !stopped && next < n && fitted[next] {
+			if ctx.Err() != nil {
+				stopped = true
+				break
+			}
+			if !add(next) {
+				stopped = true
+				close(done)
+			}
+			next++
+		}
+	}
+
+	return next
+}
+
+// fitContext returns the context for fitting a forest, limited by maxFitTime
+// if > 0
+func fitContext(ctx context.Context, maxFitTime time.Duration) (context.Context, context.CancelFunc) {
+	if maxFitTime > 0 {
+		return context.WithTimeout(ctx, maxFitTime)
+	}
+	return context.WithCancel(ctx)
+}
+
+// stopEarly reports whether the last window values of the out of bag error
+// curve have not improved on the best earlier value by at least tol.
+func stopEarly(curve []float64, window int, tol float64) bool {
+	if window < 1 || len(curve) <= window {
+		return false
+	}
+
+	bestBefore := math.Inf(1)
+	for _, v := range curve[:len(curve)-window] {
+		if v < bestBefore {
+			bestBefore = v
+		}
+	}
+	bestLast := math.Inf(1)
+	for _, v := range curve[len(curve)-window:] {
+		if v < bestLast {
+			bestLast = v
+		}
+	}
+
+	return bestBefore-bestLast < tol
+}
+
+// parallel calls fn for each i in [0, n) using nWorkers goroutines, it
+// returns when all calls have completed.
+func parallel(n, nWorkers int, fn func(i int)) {
+	if nWorkers < 1 {
+		nWorkers = 1
+	}
+
+	in := make(chan int)
+	var wg sync.WaitGroup
+
+	for w := 0; w < nWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range in {
+				fn(i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		in <- i
+	}
+	close(in)
+
+	wg.Wait()
+}
+
+// parallelRows splits the rows [0, n) into contiguous blocks and calls
+// fn(start, end) for each block using nWorkers goroutines, it returns when
+// all calls have completed.
+func parallelRows(n, nWorkers int, fn func(start, end int)) {
+	if nWorkers <= 1 || n < 2 {
+		fn(0, n)
+		return
+	}
+
+	size := (n + nWorkers - 1) / nWorkers
+	nBlocks := (n + size - 1) / size
+	parallel(nBlocks, nWorkers, func(b int) {
+		end := (b + 1) * size
+		if end > n {
+			end = n
+		}
+		fn(b*size, end)
+	})
+}
+
+// rowRange returns the row indices [start, end)
+func rowRange(start, end int) []int {
+	inx := make([]int, end-start)
+	for i := range inx {
+		inx[i] = start + i
+	}
+	return inx
+}
+
+// sumVarImp returns the mean over trees of the variable importance of each
+// tree, imp(i) returns the importance for tree i. Trees are evaluated using
+// nWorkers goroutines and summed in order.
+func sumVarImp(nTrees, nFeatures, nWorkers int, imp func(i int) []float64) []float64 {
+	treeImp := make([][]float64, nTrees)
+	parallel(nTrees, nWorkers, func(i int) {
+		treeImp[i] = imp(i)
+	})
+
+	sum := make([]float64, nFeatures)
+	for _, tImp := range treeImp {
+		// online trees only know the features they have seen
+		if len(sum) < len(tImp) {
+			sum = append(sum, make([]float64, len(tImp)-len(sum))...)
+		}
+		for inx, importance := range tImp {
+			sum[inx] += importance / float64(nTrees)
+		}
+	}
+	return sum
+}
@@ -1,8 +1,15 @@
 package forest
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
 	"math"
+	"math/rand"
+	"reflect"
 	"testing"
+
+	"github.com/wlattner/rf/tree"
 )
 
 func TestIrisFitPredict(t *testing.T) {
@@ -40,7 +47,7 @@ func TestIrisVariableImportance(t *testing.T) {
 }
 
 func TestIrisOOBError(t *testing.T) {
-	clf := NewClassifier(NumTrees(10), ComputeOOB)
+	clf := NewClassifier(NumTrees(10), ComputeOOB, RandState(1))
 
 	clf.Fit(X, Y)
 
@@ -55,6 +62,356 @@ func TestIrisOOBError(t *testing.T) {
 			t.Errorf("expected confusion matrix entry to be at least 45 and less than 50, got: %d", clf.ConfusionMatrix[i][i])
 		}
 	}
+
+	// check per example oob predictions
+	if len(clf.OOBProb) != len(Y) || len(clf.OOBCount) != len(Y) {
+		t.Fatalf("expected oob predictions for %d examples, got: %d", len(Y), len(clf.OOBProb))
+	}
+	for i, p := range clf.OOBProb {
+		sum := 0.0
+		for _, v := range p {
+			sum += v
+		}
+		if clf.OOBCount[i] > 0 && math.Abs(sum-1.0) > 1e-7 {
+			t.Error("expected oob class probabilities to sum to 1, got:", sum)
+		}
+	}
+
+	if len(clf.OOBCurve) != 10 {
+		t.Fatalf("expected oob curve for 10 trees, got: %d", len(clf.OOBCurve))
+	}
+	if clf.OOBCurve[9] > 0.1 {
+		t.Errorf("expected oob error of 10 trees to be at most 0.1, got: %f", clf.OOBCurve[9])
+	}
+}
+
+func TestIrisCalibration(t *testing.T) {
+	for _, method := range []Calibration{Sigmoid, Isotonic} {
+		clf := NewClassifier(NumTrees(20), Calibrate(method))
+		clf.Fit(X, Y)
+
+		if clf.Calibrator == nil {
+			t.Fatal("expected calibrator to be fit for method", method)
+		}
+
+		for _, p := range clf.PredictProb(X) {
+			sum := 0.0
+			for _, v := range p {
+				if v < 0 || v > 1 {
+					t.Error("expected calibrated probability in [0, 1], got:", v)
+				}
+				sum += v
+			}
+			if math.Abs(sum-1.0) > 1e-7 {
+				t.Error("expected calibrated probabilities to sum to 1, got:", sum)
+			}
+		}
+
+		if clf.Brier < 0 || clf.Brier > 0.3 {
+			t.Errorf("expected oob brier score in [0, 0.3], got: %f", clf.Brier)
+		}
+	}
+}
+
+func TestIrisRandState(t *testing.T) {
+	// same seed, different number of workers
+	a := NewClassifier(NumTrees(20), Calibrate(Isotonic), RandState(42), NumWorkers(1))
+	a.Fit(X, Y)
+	b := NewClassifier(NumTrees(20), Calibrate(Isotonic), RandState(42), NumWorkers(4))
+	b.Fit(X, Y)
+
+	if !bytes.Equal(gobBytes(t, a), gobBytes(t, b)) {
+		t.Error("expected forests fit with the same seed to be identical")
+	}
+
+	c := NewMondrianClassifier(NumTrees(5), RandState(42), NumWorkers(1))
+	c.Fit(X, Y)
+	d := NewMondrianClassifier(NumTrees(5), RandState(42), NumWorkers(3))
+	d.Fit(X, Y)
+
+	if !bytes.Equal(gobBytes(t, c), gobBytes(t, d)) {
+		t.Error("expected online forests fit with the same seed to be identical")
+	}
+}
+
+func TestIrisParallelPredict(t *testing.T) {
+	clf := NewClassifier(NumTrees(20), RandState(1))
+	clf.Fit(X, Y)
+	prob := clf.PredictProb(X)
+	pred := clf.Predict(X)
+	imp := clf.VarImp()
+
+	NumWorkers(4)(clf)
+	if !reflect.DeepEqual(prob, clf.PredictProb(X)) {
+		t.Error("expected the same class probabilities with 4 workers")
+	}
+	if !reflect.DeepEqual(pred, clf.Predict(X)) {
+		t.Error("expected the same predictions with 4 workers")
+	}
+	if !reflect.DeepEqual(imp, clf.VarImp()) {
+		t.Error("expected the same variable importance with 4 workers")
+	}
+}
+
+func TestIrisFitDataset(t *testing.T) {
+	clf := NewClassifier(NumTrees(20), RandState(1))
+	clf.Fit(X, Y)
+
+	X32 := tree.NewColMajor32(X)
+	clf32 := NewClassifier(NumTrees(20), RandState(1), NumWorkers(4))
+	clf32.FitDataset(X32, Y)
+
+	if !reflect.DeepEqual(clf.Predict(X), clf32.PredictDataset(X32)) {
+		t.Error("expected the same predictions from float32 column major data")
+	}
+	if !reflect.DeepEqual(clf32.PredictProb(X), clf32.PredictProbDataset(X32)) {
+		t.Error("expected the same class probabilities from row and column major data")
+	}
+}
+
+func TestIrisFitContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var progress []FitProgress
+	clf := NewClassifier(NumTrees(100), ComputeOOB, NumWorkers(4), Progress(func(p FitProgress) {
+		progress = append(progress, p)
+		if p.Trees == 5 {
+			cancel()
+		}
+	}))
+
+	err := clf.FitContext(ctx, X, Y)
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got: %v", err)
+	}
+	if clf.NTrees != 5 || len(clf.Trees) != 5 {
+		t.Errorf("expected forest with the 5 trees fit before canceling, got: %d", len(clf.Trees))
+	}
+
+	for i, p := range progress {
+		if p.Trees != i+1 || p.NTrees != 100 || math.IsNaN(p.OOBError) {
+			t.Errorf("unexpected progress for tree %d: %+v", i+1, p)
+		}
+	}
+
+	if pred := clf.Predict(X); len(pred) != len(Y) {
+		t.Errorf("expected predictions from the partial forest, got: %d", len(pred))
+	}
+}
+
+// gobBytes returns the gob encoding of v, the exported fields of a fitted
+// forest
+func gobBytes(t *testing.T, v interface{}) []byte {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		t.Fatal("unexpected error encoding forest:", err)
+	}
+	return buf.Bytes()
+}
+
+func TestIsotonic(t *testing.T) {
+	f := []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6}
+	y := []bool{false, true, false, false, true, true}
+
+	x, v := fitIsotonic(f, y)
+
+	for i := 1; i < len(v); i++ {
+		if v[i] < v[i-1] {
+			t.Error("expected isotonic fit to be non-decreasing, got:", v)
+		}
+	}
+
+	if interpolate(x, v, 0.0) != v[0] || interpolate(x, v, 1.0) != v[len(v)-1] {
+		t.Error("expected values outside the knots to be clamped")
+	}
+
+	// tied probabilities are one block, 3 of the 4 examples at 1 are true
+	f = []float64{0.2, 0.2, 1, 1, 1, 1}
+	y = []bool{false, false, true, true, false, true}
+	x, v = fitIsotonic(f, y)
+	if !reflect.DeepEqual(x, []float64{0.2, 1}) || !reflect.DeepEqual(v, []float64{0, 0.75}) {
+		t.Errorf("expected knots [0.2 1] [0 0.75] for tied probabilities, got: %v %v", x, v)
+	}
+	if p := interpolate(x, v, 1); p != 0.75 {
+		t.Error("expected 0.75 at the tied probability 1, got:", p)
+	}
+}
+
+func TestIrisCrossValidate(t *testing.T) {
+	folds := StratifiedKFold(Y, 5, rand.New(rand.NewSource(1)))
+
+	for _, fold := range folds {
+		if len(fold.Test) != 30 || len(fold.Train) != 120 {
+			t.Errorf("expected 30 test and 120 train examples, got: %d, %d", len(fold.Test), len(fold.Train))
+		}
+	}
+
+	res, classes := CrossValidateClassifier(X, Y, folds, 2, func() *Classifier {
+		return NewClassifier(NumTrees(10))
+	})
+
+	if len(res.Folds) != 5 || len(classes) != 3 {
+		t.Fatalf("expected metrics for 5 folds and 3 classes, got: %d, %d", len(res.Folds), len(classes))
+	}
+
+	if res.Mean[0].Name != "accuracy" || res.Mean[0].Value < 0.9 {
+		t.Errorf("expected mean accuracy to be at least 0.9, got: %v", res.Mean[0])
+	}
+
+	for i, ct := range res.Count {
+		if ct != 1 {
+			t.Errorf("expected example %d to be predicted once, got: %d", i, ct)
+		}
+	}
+}
+
+func TestIrisSearch(t *testing.T) {
+	g := Grid{MaxFeatures: []int{1, 2, 4}, MinLeaf: []int{1, 5}, NTrees: []int{27}}
+	if len(g.Params()) != 6 {
+		t.Fatalf("expected 6 candidates, got: %d", len(g.Params()))
+	}
+
+	s := &Search{Candidates: g.Params(), Halving: true, MinTrees: 3, Eta: 3}
+	trials := s.Classifier(X, Y)
+
+	// 6 candidates with 3 trees, 2 with 9 trees, 1 with 27 trees
+	if len(trials) != 9 {
+		t.Fatalf("expected 9 trials, got: %d", len(trials))
+	}
+
+	best, ok := Best(trials)
+	if !ok || best.Round != 2 || best.NTrees != 27 {
+		t.Errorf("expected best trial from round 2 with 27 trees, got: %d, %d", best.Round, best.NTrees)
+	}
+	if best.Error > 0.1 {
+		t.Errorf("expected best error to be less than 0.1, got: %v", best.Error)
+	}
+
+	// the last candidate is refit until it has its 20 trees, 3 candidates
+	// with 3 trees, 1 with 9 and 1 with 20
+	h := Grid{MaxFeatures: []int{1, 2, 4}, NTrees: []int{20}}
+	s = &Search{Candidates: h.Params(), Halving: true, MinTrees: 3, Eta: 3}
+	trials = s.Classifier(X, Y)
+	if best, _ := Best(trials); len(trials) != 5 || best.NTrees != 20 || best.Target != 20 {
+		t.Errorf("expected the best of 5 trials to have 20 trees, got: %d trials, %+v", len(trials), best)
+	}
+
+	// a search cut short keeps the target number of trees
+	s.MaxTrials = 4
+	trials = s.Classifier(X, Y)
+	if best, _ := Best(trials); best.NTrees != 9 || best.Target != 20 {
+		t.Errorf("expected the best trial to have 9 of its 20 trees, got: %+v", best)
+	}
+	if _, ok := Best(nil); ok {
+		t.Error("expected no best trial without trials")
+	}
+
+	s = &Search{Candidates: g.Params(), MaxTrials: 4}
+	if trials := s.Classifier(X, Y); len(trials) != 4 {
+		t.Errorf("expected search to stop after 4 trials, got: %d", len(trials))
+	}
+
+	// Options are used by every candidate, trees that can't split are no
+	// better than guessing
+	s = &Search{Candidates: g.Params()[:1], Options: []func(forestConfiger){MinSplit(len(Y) + 1)}}
+	if trials := s.Classifier(X, Y); trials[0].Error < 0.5 {
+		t.Errorf("expected candidates to be fit with MinSplit %d, got error: %v", len(Y)+1, trials[0].Error)
+	}
+	trials = TuneMaxFeaturesClassifier(X, Y, Params{NTrees: 20, MinLeaf: 1}, 2, 0.05, 1, nil, MinSplit(len(Y)+1))
+	if trials[0].Error < 0.5 {
+		t.Errorf("expected max features search to use MinSplit %d, got error: %v", len(Y)+1, trials[0].Error)
+	}
+
+	trials = TuneMaxFeaturesClassifier(X, Y, Params{NTrees: 20, MinLeaf: 1}, 2, 0.05, 1, nil)
+	if len(trials) < 2 || trials[0].MaxFeatures != 2 {
+		t.Errorf("expected max features search to start from 2 and try at least 2 values, got: %v", trials)
+	}
+}
+
+func TestGroupKFold(t *testing.T) {
+	groups := make([]string, len(Y))
+	for i := range groups {
+		groups[i] = string(rune('a' + i%7))
+	}
+
+	for _, fold := range GroupKFold(groups, 3, rand.New(rand.NewSource(1))) {
+		test := make(map[string]bool)
+		for _, i := range fold.Test {
+			test[groups[i]] = true
+		}
+		for _, i := range fold.Train {
+			if test[groups[i]] {
+				t.Fatal("expected groups to not cross folds, found:", groups[i])
+			}
+		}
+	}
+}
+
+func TestIrisMondrianPartialFit(t *testing.T) {
+	clf := NewMondrianClassifier(NumTrees(10))
+
+	// feed the examples in two batches, iris is sorted by species so the
+	// second batch introduces a new class
+	clf.PartialFit(X[:75], Y[:75])
+	clf.PartialFit(X[75:], Y[75:])
+
+	if clf.NSample != len(Y) {
+		t.Errorf("expected %d samples, got: %d", len(Y), clf.NSample)
+	}
+
+	if len(clf.Classes) != 3 {
+		t.Errorf("expected 3 classes, got: %d", len(clf.Classes))
+	}
+
+	// rows wider than the examples seen are an error, not a panic
+	wide := [][]float64{append(append([]float64{}, X[0]...), 1)}
+	if err := clf.PartialFit(wide, Y[:1]); err == nil || clf.NSample != len(Y) {
+		t.Errorf("expected an error updating with %d features, got: %v", len(wide[0]), err)
+	}
+	if err := clf.PartialFit(X[:1], Y[:2]); err == nil || clf.NSample != len(Y) {
+		t.Error("expected an error updating with more labels than examples, got:", err)
+	}
+
+	// a forest without examples predicts nothing instead of panicking
+	empty := NewMondrianClassifier(NumTrees(10))
+	if err := empty.PartialFit(nil, nil); err != nil {
+		t.Error("unexpected error updating with no examples:", err)
+	}
+	if p, prob := empty.Predict(X), empty.PredictProb(X); p != nil || prob != nil {
+		t.Errorf("expected no predictions from an empty forest, got: %v %v", p, prob)
+	}
+	if imp := empty.VarImp(); len(imp) != 0 {
+		t.Error("expected no importance from an empty forest, got:", imp)
+	}
+	if p := tree.NewMondrianClassifier().PredictProb(X); p != nil {
+		t.Error("expected no predictions from an empty tree, got:", p)
+	}
+
+	pred := clf.Predict(X)
+
+	correctFrac := 0.0
+	contrib := 1.0 / float64(len(pred))
+	for i := range Y {
+		if Y[i] == clf.Classes[pred[i]] {
+			correctFrac += contrib
+		}
+	}
+
+	if correctFrac < 0.98 {
+		t.Errorf("expected accuracy on iris data to be at least 0.98, got: %f", correctFrac)
+	}
+
+	for _, p := range clf.PredictProb(X[:1]) {
+		sum := 0.0
+		for _, v := range p {
+			sum += v
+		}
+		if math.Abs(sum-1.0) > 1e-7 {
+			t.Error("expected class probabilities to sum to 1, got:", sum)
+		}
+	}
 }
 
 func BenchmarkIrisFit(b *testing.B) {
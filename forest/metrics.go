@@ -0,0 +1,256 @@
+package forest
+
+import (
+	"math"
+	"sort"
+)
+
+// ClassMetrics summarizes the predictions of a classifier against the actual
+// classes. The predicted class of each example is the most probable class.
+type ClassMetrics struct {
+	ConfusionMatrix   [][]int // indexed by actual class then predicted class
+	Accuracy          float64
+	Precision         []float64 // per class
+	Recall            []float64
+	F1                []float64
+	Support           []int // number of examples of each class
+	MacroPrecision    float64
+	MacroRecall       float64
+	MacroF1           float64
+	WeightedPrecision float64 // weighted by support
+	WeightedRecall    float64
+	WeightedF1        float64
+	Kappa             float64 // Cohen's kappa
+	LogLoss           float64
+	ROCAUC            float64 // binary problems only, NaN otherwise
+	PRAUC             float64 // average precision, binary problems only, NaN otherwise
+}
+
+// ComputeClassMetrics computes classification metrics from the class ids Y
+// and predicted class probabilities prob, the indices of each row of prob
+// are class ids. For binary problems, class 1 is considered the positive
+// class for ROC AUC and PR AUC.
+func ComputeClassMetrics(Y []int, prob [][]float64) *ClassMetrics {
+	pred := make([]int, len(prob))
+	for i := range prob {
+		maxP := 0.0
+		for class, p := range prob[i] {
+			if p > maxP {
+				maxP = p
+				pred[i] = class
+			}
+		}
+	}
+	return ComputeClassMetricsPred(Y, pred, prob)
+}
+
+// ComputeClassMetricsPred computes classification metrics as
+// ComputeClassMetrics, but the confusion matrix and the metrics from it use
+// the predicted class ids pred, e.g. the majority vote of
+// Classifier.Predict, instead of the most probable class of prob. Log loss
+// and AUC use prob.
+func ComputeClassMetricsPred(Y, pred []int, prob [][]float64) *ClassMetrics {
+	nClasses := 0
+	if len(prob) > 0 {
+		nClasses = len(prob[0])
+	}
+
+	m := &ClassMetrics{
+		ConfusionMatrix: make([][]int, nClasses),
+		Precision:       make([]float64, nClasses),
+		Recall:          make([]float64, nClasses),
+		F1:              make([]float64, nClasses),
+		Support:         make([]int, nClasses),
+		ROCAUC:          math.NaN(),
+		PRAUC:           math.NaN(),
+	}
+	for i := range m.ConfusionMatrix {
+		m.ConfusionMatrix[i] = make([]int, nClasses)
+	}
+
+	for i, actual := range Y {
+		m.ConfusionMatrix[actual][pred[i]]++
+
+		// clip to avoid log(0)
+		m.LogLoss -= math.Log(math.Max(prob[i][actual], 1e-15))
+	}
+
+	n := float64(len(Y))
+	m.LogLoss /= n
+
+	// column sums are the number of predictions for each class
+	predicted := make([]int, nClasses)
+	correct := 0
+	for actual := range m.ConfusionMatrix {
+		for pred, ct := range m.ConfusionMatrix[actual] {
+			m.Support[actual] += ct
+			predicted[pred] += ct
+		}
+		correct += m.ConfusionMatrix[actual][actual]
+	}
+	m.Accuracy = float64(correct) / n
+
+	for class := range m.ConfusionMatrix {
+		tp := float64(m.ConfusionMatrix[class][class])
+		if predicted[class] > 0 {
+			m.Precision[class] = tp / float64(predicted[class])
+		}
+		if m.Support[class] > 0 {
+			m.Recall[class] = tp / float64(m.Support[class])
+		}
+		if m.Precision[class]+m.Recall[class] > 0 {
+			m.F1[class] = 2 * m.Precision[class] * m.Recall[class] / (m.Precision[class] + m.Recall[class])
+		}
+
+		m.MacroPrecision += m.Precision[class] / float64(nClasses)
+		m.MacroRecall += m.Recall[class] / float64(nClasses)
+		m.MacroF1 += m.F1[class] / float64(nClasses)
+
+		w := float64(m.Support[class]) / n
+		m.WeightedPrecision += w * m.Precision[class]
+		m.WeightedRecall += w * m.Recall[class]
+		m.WeightedF1 += w * m.F1[class]
+	}
+
+	// agreement expected by chance
+	pe := 0.0
+	for class := range m.ConfusionMatrix {
+		pe += float64(m.Support[class]) * float64(predicted[class]) / (n * n)
+	}
+	if pe < 1 {
+		m.Kappa = (m.Accuracy - pe) / (1 - pe)
+	}
+
+	if nClasses == 2 {
+		score := make([]float64, len(Y))
+		positive := make([]bool, len(Y))
+		for i, actual := range Y {
+			score[i] = prob[i][1]
+			positive[i] = actual == 1
+		}
+		m.ROCAUC, m.PRAUC = binaryAUC(score, positive)
+	}
+
+	return m
+}
+
+// Summary returns the scalar metrics, ROC AUC and PR AUC are only included
+// for binary problems.
+func (m *ClassMetrics) Summary() []Metric {
+	s := []Metric{
+		{"accuracy", m.Accuracy},
+		{"kappa", m.Kappa},
+		{"log_loss", m.LogLoss},
+		{"macro_precision", m.MacroPrecision},
+		{"macro_recall", m.MacroRecall},
+		{"macro_f1", m.MacroF1},
+		{"weighted_precision", m.WeightedPrecision},
+		{"weighted_recall", m.WeightedRecall},
+		{"weighted_f1", m.WeightedF1},
+	}
+	if len(m.ConfusionMatrix) == 2 {
+		s = append(s, Metric{"roc_auc", m.ROCAUC}, Metric{"pr_auc", m.PRAUC})
+	}
+	return s
+}
+
+// RegMetrics summarizes the predictions of a regressor against the actual
+// target values.
+type RegMetrics struct {
+	MSE      float64
+	RMSE     float64
+	MAE      float64
+	RSquared float64
+}
+
+// ComputeRegMetrics computes regression metrics from the target values Y and
+// predictions pred.
+func ComputeRegMetrics(Y []float64, pred []float64) *RegMetrics {
+	m := &RegMetrics{}
+
+	mean := 0.0
+	for _, y := range Y {
+		mean += y
+	}
+	mean /= float64(len(Y))
+
+	rss := 0.0
+	tss := 0.0
+	for i, y := range Y {
+		d := y - pred[i]
+		rss += d * d
+		m.MAE += math.Abs(d)
+		tss += (y - mean) * (y - mean)
+	}
+
+	n := float64(len(Y))
+	m.MSE = rss / n
+	m.RMSE = math.Sqrt(m.MSE)
+	m.MAE /= n
+	m.RSquared = 1.0 - rss/tss
+
+	return m
+}
+
+// Summary returns the scalar metrics.
+func (m *RegMetrics) Summary() []Metric {
+	return []Metric{
+		{"mse", m.MSE},
+		{"rmse", m.RMSE},
+		{"mae", m.MAE},
+		{"r_squared", m.RSquared},
+	}
+}
+
+// binaryAUC returns the area under the ROC curve and the average precision
+// (area under the precision recall curve) for the scores of the positive
+// class. Tied scores are treated as a single threshold.
+func binaryAUC(score []float64, positive []bool) (float64, float64) {
+	inx := make([]int, len(score))
+	for i := range inx {
+		inx[i] = i
+	}
+	// decreasing score
+	sort.Sort(sort.Reverse(probSort{f: score, inx: inx}))
+
+	var nPos, nNeg float64
+	for _, p := range positive {
+		if p {
+			nPos++
+		} else {
+			nNeg++
+		}
+	}
+	if nPos == 0 || nNeg == 0 {
+		return math.NaN(), math.NaN()
+	}
+
+	var (
+		tp, fp         float64 // at the current threshold
+		prevTP, prevFP float64 // at the previous threshold
+		roc, ap        float64
+	)
+
+	for i := 0; i < len(inx); {
+		// advance past all examples tied with inx[i]
+		j := i
+		for j < len(inx) && score[inx[j]] == score[inx[i]] {
+			if positive[inx[j]] {
+				tp++
+			} else {
+				fp++
+			}
+			j++
+		}
+
+		// trapezoid under the roc curve
+		roc += (fp - prevFP) / nNeg * (tp + prevTP) / 2 / nPos
+		// precision weighted by the increase in recall
+		ap += (tp - prevTP) / nPos * tp / (tp + fp)
+
+		prevTP, prevFP = tp, fp
+		i = j
+	}
+
+	return roc, ap
+}
@@ -0,0 +1,57 @@
+package forest
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBinaryAUC(t *testing.T) {
+	// example from the scikit-learn docs
+	score := []float64{0.1, 0.4, 0.35, 0.8}
+	positive := []bool{false, false, true, true}
+
+	roc, ap := binaryAUC(score, positive)
+	if math.Abs(roc-0.75) > 1e-7 {
+		t.Error("expected roc auc to be 0.75, got:", roc)
+	}
+	if math.Abs(ap-0.8333333) > 1e-6 {
+		t.Error("expected average precision to be 0.8333, got:", ap)
+	}
+}
+
+func TestComputeClassMetrics(t *testing.T) {
+	Y := []int{0, 0, 0, 1, 1, 1}
+	prob := [][]float64{
+		{0.9, 0.1},
+		{0.8, 0.2},
+		{0.3, 0.7},
+		{0.4, 0.6},
+		{0.2, 0.8},
+		{0.6, 0.4},
+	}
+
+	m := ComputeClassMetrics(Y, prob)
+
+	// rows are actual classes
+	if m.ConfusionMatrix[0][0] != 2 || m.ConfusionMatrix[0][1] != 1 ||
+		m.ConfusionMatrix[1][0] != 1 || m.ConfusionMatrix[1][1] != 2 {
+		t.Error("unexpected confusion matrix:", m.ConfusionMatrix)
+	}
+
+	if math.Abs(m.Accuracy-4.0/6.0) > 1e-7 {
+		t.Error("expected accuracy to be 0.667, got:", m.Accuracy)
+	}
+
+	if math.Abs(m.Precision[1]-2.0/3.0) > 1e-7 || math.Abs(m.Recall[1]-2.0/3.0) > 1e-7 {
+		t.Error("expected precision and recall to be 0.667, got:", m.Precision[1], m.Recall[1])
+	}
+
+	// po = 2/3, pe = 1/2
+	if math.Abs(m.Kappa-1.0/3.0) > 1e-7 {
+		t.Error("expected kappa to be 0.333, got:", m.Kappa)
+	}
+
+	if math.IsNaN(m.ROCAUC) || math.IsNaN(m.PRAUC) {
+		t.Error("expected auc for binary problem")
+	}
+}
@@ -0,0 +1,356 @@
+package forest
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/wlattner/rf/tree"
+)
+
+// Mondrian forests are described in
+// Lakshminarayanan, B., Roy, D. M., Teh, Y. W. (2014) "Mondrian Forests:
+// Efficient Online Random Forests" http://arxiv.org/abs/1406.2673
+//
+// Each tree is fit on all of the examples, no bootstrap samples are drawn, so
+// out of bag estimates are not available. The forest can be extended with new
+// examples using PartialFit, the result is the same as fitting all examples
+// seen so far in a single call.
+
+// MondrianClassifier implements an online random forest classifier.
+type MondrianClassifier struct {
+	NTrees   int
+	Lifetime float64
+	Classes  []string
+	Trees    []*tree.MondrianClassifier
+	NSample  int
+	nWorkers int
+	seed     int64
+	seeded   bool
+}
+
+// methods for the forestConfiger interface
+func (c *MondrianClassifier) setMinSplit(n int)                   {}
+func (c *MondrianClassifier) setMinLeaf(n int)                    {}
+func (c *MondrianClassifier) setMaxDepth(n int)                   {}
+func (c *MondrianClassifier) setImpurity(f tree.ImpurityMeasure)  {}
+func (c *MondrianClassifier) setMaxFeatures(n int)                {}
+func (c *MondrianClassifier) setNumTrees(n int)                   { c.NTrees = n }
+func (c *MondrianClassifier) setNumWorkers(n int)                 { c.nWorkers = n }
+func (c *MondrianClassifier) setLifetime(l float64)               { c.Lifetime = l }
+func (c *MondrianClassifier) setComputeOOB()                      {}
+func (c *MondrianClassifier) setKeepInBag()                       {}
+func (c *MondrianClassifier) setCalibration(m Calibration)        {}
+func (c *MondrianClassifier) setEarlyStopping(w int, tol float64) {}
+func (c *MondrianClassifier) setMaxFitTime(d time.Duration)       {}
+func (c *MondrianClassifier) setProgress(fn func(FitProgress))    {}
+func (c *MondrianClassifier) setSampleWeights(w []float64)        {}
+func (c *MondrianClassifier) setRandState(seed int64) {
+	c.seed = seed
+	c.seeded = true
+}
+
+// NewMondrianClassifier returns a configured/initialized Mondrian forest
+// classifier. Only the NumTrees, NumWorkers, Lifetime and RandState options
+// are used. If no options are passed, the returned MondrianClassifier will be
+// equivalent to the following call:
+//
+//	clf := NewMondrianClassifier(NumTrees(10), Lifetime(-1), NumWorkers(1))
+func NewMondrianClassifier(options ...func(forestConfiger)) *MondrianClassifier {
+	f := &MondrianClassifier{
+		NTrees:   10,
+		Lifetime: -1,
+	}
+
+	for _, opt := range options {
+		opt(f)
+	}
+
+	return f
+}
+
+// Fit constructs a forest from the provided features X, and labels Y. Any
+// previously fitted trees are discarded.
+func (f *MondrianClassifier) Fit(X [][]float64, Y []string) error {
+	f.Trees = nil
+	f.Classes = nil
+	f.NSample = 0
+	return f.PartialFit(X, Y)
+}
+
+// NumFeatures returns the number of features the forest was fit with, 0
+// before any examples.
+func (f *MondrianClassifier) NumFeatures() int {
+	if len(f.Trees) == 0 {
+		return 0
+	}
+	return f.Trees[0].Root.NumFeatures()
+}
+
+// PartialFit extends each tree in the forest with the examples in X and
+// labels Y. Labels not seen in previous calls are appended to
+// MondrianClassifier.Classes. An error is returned, and the forest isn't
+// changed, if X and Y have different lengths or the rows of X don't have
+// the number of features of the examples seen before.
+func (f *MondrianClassifier) PartialFit(X [][]float64, Y []string) error {
+	if len(X) != len(Y) {
+		return fmt.Errorf("%d examples and %d labels", len(X), len(Y))
+	}
+	if err := checkRowWidths(X, f.NumFeatures()); err != nil {
+		return err
+	}
+	if len(X) == 0 {
+		return nil
+	}
+
+	uniq := make(map[string]int)
+	for id, class := range f.Classes {
+		uniq[class] = id
+	}
+
+	var yIDs []int
+	for _, val := range Y {
+		id, ok := uniq[val]
+		if !ok {
+			id = len(uniq)
+			uniq[val] = id
+			f.Classes = append(f.Classes, val)
+		}
+		yIDs = append(yIDs, id)
+	}
+	f.NSample += len(yIDs)
+
+	if f.Trees == nil {
+		f.Trees = make([]*tree.MondrianClassifier, f.NTrees)
+		for i, seed := range treeSeeds(f.NTrees, f.seed, f.seeded) {
+			f.Trees[i] = tree.NewMondrianClassifier(tree.Lifetime(f.Lifetime), tree.RandState(seed))
+		}
+	}
+
+	inx := make([]int, len(yIDs))
+	for i := range inx {
+		inx[i] = i
+	}
+
+	parallel(len(f.Trees), f.nWorkers, func(i int) {
+		f.Trees[i].PartialFitInx(X, yIDs, inx, f.Classes)
+	})
+	return nil
+}
+
+// Predict returns the most probable class id for each example. The id
+// corresponds to the index of the class label in MondrianClassifier.Classes.
+// Predict returns nil if the forest hasn't seen any examples.
+func (f *MondrianClassifier) Predict(X [][]float64) []int {
+	if len(f.Trees) == 0 {
+		return nil
+	}
+	classVotes := make([][]int, len(X))
+	for i := range classVotes {
+		classVotes[i] = make([]int, len(f.Classes))
+	}
+
+	parallelRows(len(X), f.nWorkers, func(start, end int) {
+		for _, t := range f.Trees {
+			for i, class := range t.Predict(X[start:end]) {
+				classVotes[start+i][class]++
+			}
+		}
+	})
+
+	// find max class for each example
+	maxClass := make([]int, len(X))
+
+	for i := range maxClass {
+		maxCt := 0
+		maxC := 0
+		for class, count := range classVotes[i] {
+			if count > maxCt {
+				maxCt = count
+				maxC = class
+			}
+		}
+		maxClass[i] = maxC
+	}
+
+	return maxClass
+}
+
+// PredictProb returns the class probability for each example. The indices of
+// the return value correspond to MondrianClassifier.Classes. PredictProb
+// returns nil if the forest hasn't seen any examples.
+func (f *MondrianClassifier) PredictProb(X [][]float64) [][]float64 {
+	if len(f.Trees) == 0 {
+		return nil
+	}
+	probs := make([][]float64, len(X))
+	for row := range probs {
+		probs[row] = make([]float64, len(f.Classes))
+	}
+
+	parallelRows(len(X), f.nWorkers, func(start, end int) {
+		for _, t := range f.Trees {
+			tProbs := t.PredictProb(X[start:end])
+			for row := range tProbs {
+				for class := range tProbs[row] {
+					probs[start+row][class] += tProbs[row][class] / float64(len(f.Trees))
+				}
+			}
+		}
+	})
+
+	return probs
+}
+
+// VarImp returns importance scores for the model.
+func (f *MondrianClassifier) VarImp() []float64 {
+	return sumVarImp(len(f.Trees), 0, f.nWorkers, func(i int) []float64 {
+		return f.Trees[i].VarImp()
+	})
+}
+
+// MondrianRegressor implements an online random forest regressor.
+type MondrianRegressor struct {
+	NTrees   int
+	Lifetime float64
+	Trees    []*tree.MondrianRegressor
+	NSample  int
+	nWorkers int
+	seed     int64
+	seeded   bool
+}
+
+// methods for the forestConfiger interface
+func (c *MondrianRegressor) setMinSplit(n int)                   {}
+func (c *MondrianRegressor) setMinLeaf(n int)                    {}
+func (c *MondrianRegressor) setMaxDepth(n int)                   {}
+func (c *MondrianRegressor) setImpurity(f tree.ImpurityMeasure)  {}
+func (c *MondrianRegressor) setMaxFeatures(n int)                {}
+func (c *MondrianRegressor) setNumTrees(n int)                   { c.NTrees = n }
+func (c *MondrianRegressor) setNumWorkers(n int)                 { c.nWorkers = n }
+func (c *MondrianRegressor) setLifetime(l float64)               { c.Lifetime = l }
+func (c *MondrianRegressor) setComputeOOB()                      {}
+func (c *MondrianRegressor) setKeepInBag()                       {}
+func (c *MondrianRegressor) setCalibration(m Calibration)        {}
+func (c *MondrianRegressor) setEarlyStopping(w int, tol float64) {}
+func (c *MondrianRegressor) setMaxFitTime(d time.Duration)       {}
+func (c *MondrianRegressor) setProgress(fn func(FitProgress))    {}
+func (c *MondrianRegressor) setSampleWeights(w []float64)        {}
+func (c *MondrianRegressor) setRandState(seed int64) {
+	c.seed = seed
+	c.seeded = true
+}
+
+// NewMondrianRegressor returns a configured/initialized Mondrian forest
+// regressor. Only the NumTrees, NumWorkers, Lifetime and RandState options
+// are used. If no options are passed, the returned MondrianRegressor will be
+// equivalent to the following call:
+//
+//	reg := NewMondrianRegressor(NumTrees(10), Lifetime(-1), NumWorkers(1))
+func NewMondrianRegressor(options ...func(forestConfiger)) *MondrianRegressor {
+	f := &MondrianRegressor{
+		NTrees:   10,
+		Lifetime: -1,
+	}
+
+	for _, opt := range options {
+		opt(f)
+	}
+
+	return f
+}
+
+// Fit constructs a forest from the provided features X, and targets Y. Any
+// previously fitted trees are discarded.
+func (f *MondrianRegressor) Fit(X [][]float64, Y []float64) error {
+	f.Trees = nil
+	f.NSample = 0
+	return f.PartialFit(X, Y)
+}
+
+// NumFeatures returns the number of features the forest was fit with, 0
+// before any examples.
+func (f *MondrianRegressor) NumFeatures() int {
+	if len(f.Trees) == 0 {
+		return 0
+	}
+	return f.Trees[0].Root.NumFeatures()
+}
+
+// PartialFit extends each tree in the forest with the examples in X and
+// targets Y. An error is returned, and the forest isn't changed, if X and Y
+// have different lengths or the rows of X don't have the number of features
+// of the examples seen before.
+func (f *MondrianRegressor) PartialFit(X [][]float64, Y []float64) error {
+	if len(X) != len(Y) {
+		return fmt.Errorf("%d examples and %d targets", len(X), len(Y))
+	}
+	if err := checkRowWidths(X, f.NumFeatures()); err != nil {
+		return err
+	}
+	if len(X) == 0 {
+		return nil
+	}
+
+	f.NSample += len(Y)
+
+	if f.Trees == nil {
+		f.Trees = make([]*tree.MondrianRegressor, f.NTrees)
+		for i, seed := range treeSeeds(f.NTrees, f.seed, f.seeded) {
+			f.Trees[i] = tree.NewMondrianRegressor(tree.Lifetime(f.Lifetime), tree.RandState(seed))
+		}
+	}
+
+	inx := make([]int, len(Y))
+	for i := range inx {
+		inx[i] = i
+	}
+
+	parallel(len(f.Trees), f.nWorkers, func(i int) {
+		f.Trees[i].PartialFitInx(X, Y, inx)
+	})
+	return nil
+}
+
+// checkRowWidths returns an error unless every row of X has n features, or
+// the number of features of the first row when n is 0
+func checkRowWidths(X [][]float64, n int) error {
+	for i, x := range X {
+		if n == 0 {
+			n = len(x)
+		}
+		if len(x) != n {
+			return fmt.Errorf("example %d has %d features, expected %d", i, len(x), n)
+		}
+	}
+	return nil
+}
+
+// Predict returns the expected value for each example, nil if the forest
+// hasn't seen any examples.
+func (f *MondrianRegressor) Predict(X [][]float64) []float64 {
+	if len(f.Trees) == 0 {
+		return nil
+	}
+	sum := make([]float64, len(X))
+
+	parallelRows(len(X), f.nWorkers, func(start, end int) {
+		for _, t := range f.Trees {
+			for i, val := range t.Predict(X[start:end]) {
+				sum[start+i] += val
+			}
+		}
+	})
+
+	for i := range sum {
+		sum[i] /= float64(len(f.Trees))
+	}
+
+	return sum
+}
+
+// VarImp returns importance scores for the model.
+func (f *MondrianRegressor) VarImp() []float64 {
+	return sumVarImp(len(f.Trees), 0, f.nWorkers, func(i int) []float64 {
+		return f.Trees[i].VarImp()
+	})
+}
@@ -1,25 +1,40 @@
 package forest
 
 import (
+	"context"
+	"errors"
 	"math"
+	"math/rand"
 	"time"
 
 	"github.com/wlattner/rf/tree"
 )
 
 type Regressor struct {
-	NTrees      int
-	MinSplit    int
-	MinLeaf     int
-	MaxDepth    int
-	MaxFeatures int
-	Trees       []*tree.Regressor
-	nWorkers    int
-	computeOOB  bool
-	MSE         float64
-	RSquared    float64
-	NSample     int
-	nFeatures   int
+	NTrees          int
+	MinSplit        int
+	MinLeaf         int
+	MaxDepth        int
+	MaxFeatures     int
+	Trees           []*tree.Regressor
+	InBag           [][]int // bootstrap counts for each tree, only with KeepInBag
+	nWorkers        int
+	computeOOB      bool
+	keepInBag       bool
+	MSE             float64
+	RSquared        float64
+	OOBPred         []float64 // out of bag prediction for each example, NaN if never out of bag
+	OOBCount        []int     // number of trees each example was out of bag for
+	OOBCurve        []float64 // out of bag mean squared error of the first i+1 trees
+	NSample         int
+	NFeatures       int // number of features the forest was fit with
+	earlyStopWindow int
+	earlyStopTol    float64
+	seed            int64
+	seeded          bool
+	maxFitTime      time.Duration
+	progress        func(FitProgress)
+	weights         []float64 // sampling weight of each example, nil for uniform
 }
 
 // methods for the forestConfiger interface
@@ -30,7 +45,22 @@ func (c *Regressor) setImpurity(f tree.ImpurityMeasure) {}
 func (c *Regressor) setMaxFeatures(n int)               { c.MaxFeatures = n }
 func (c *Regressor) setNumTrees(n int)                  { c.NTrees = n }
 func (c *Regressor) setNumWorkers(n int)                { c.nWorkers = n }
+func (c *Regressor) setLifetime(l float64)              {}
 func (c *Regressor) setComputeOOB()                     { c.computeOOB = true }
+func (c *Regressor) setKeepInBag()                      { c.keepInBag = true }
+func (c *Regressor) setCalibration(m Calibration)       {}
+func (c *Regressor) setMaxFitTime(d time.Duration)      { c.maxFitTime = d }
+func (c *Regressor) setProgress(fn func(FitProgress))   { c.progress = fn }
+func (c *Regressor) setSampleWeights(w []float64)       { c.weights = w }
+func (c *Regressor) setRandState(seed int64) {
+	c.seed = seed
+	c.seeded = true
+}
+func (c *Regressor) setEarlyStopping(w int, tol float64) {
+	c.earlyStopWindow = w
+	c.earlyStopTol = tol
+	c.computeOOB = true
+}
 
 // NewRegressor returns a configured/initilized random forest regressor.
 // If no options are passed, the returned Regressor will be equivalent to
@@ -55,79 +85,150 @@ func NewRegressor(options ...func(forestConfiger)) *Regressor {
 }
 
 // Fit constructs a forest from fitting n trees to the provided features X, and
-// targets Y.
+// targets Y. With EarlyStopping or MaxFitTime, fewer than n trees may be fit,
+// NTrees is set to the number of trees in the forest.
 func (f *Regressor) Fit(X [][]float64, Y []float64) {
+	f.FitContext(context.Background(), X, Y)
+}
+
+// FitContext fits the forest as Fit. If ctx is done before all trees are fit,
+// no more trees are started and the forest is made of the trees fit so far,
+// ctx.Err() is returned. ErrNoTrees is returned if no tree was fit.
+func (f *Regressor) FitContext(ctx context.Context, X [][]float64, Y []float64) error {
+	return f.FitDatasetContext(ctx, tree.RowMajor(X), Y)
+}
+
+// FitDataset fits the forest as Fit from the examples in the Dataset X. A
+// tree.ColMajor32 filled with SetRow uses less than half the memory of
+// [][]float64, a tree.CSC stores only the nonzero values of sparse data.
+func (f *Regressor) FitDataset(X tree.Dataset, Y []float64) {
+	f.FitDatasetContext(context.Background(), X, Y)
+}
+
+// FitDatasetContext fits the forest as FitContext from the examples in the
+// Dataset X.
+func (f *Regressor) FitDatasetContext(ctx context.Context, X tree.Dataset, Y []float64) error {
+	cum, err := cumulativeWeights(f.weights, X.NumRows())
+	if err != nil {
+		return err
+	}
+
 	f.NSample = len(Y)
 
-	f.nFeatures = len(X[0])
+	f.NFeatures = X.NumFeatures()
 
 	f.Trees = make([]*tree.Regressor, f.NTrees)
 
+	f.InBag = nil
+	if f.keepInBag {
+		f.InBag = make([][]int, f.NTrees)
+	}
+
 	if f.MaxFeatures < 0 {
-		f.MaxFeatures = int(math.Sqrt(float64(f.nFeatures)))
+		f.MaxFeatures = int(math.Sqrt(float64(f.NFeatures)))
 	}
 
-	var oob *oobRegCtr
+	var (
+		oob         *oobRegCtr
+		oobInx      [][]int     // out of bag examples for each tree
+		oobTreePred [][]float64 // and their predictions
+	)
 	if f.computeOOB {
 		oob = newOOBRegCtr(len(Y))
+		oobInx = make([][]int, f.NTrees)
+		oobTreePred = make([][]float64, f.NTrees)
 	}
-
-	in := make(chan *fitRegTree)
-	out := make(chan *fitRegTree)
-
-	nWorkers := f.nWorkers
-	if nWorkers < 1 {
-		nWorkers = 1
+	f.OOBCurve = nil
+
+	// each tree draws its bootstrap sample and split features from its own
+	// seed, so the forest doesn't depend on the order trees are fit
+	seeds := treeSeeds(f.NTrees, f.seed, f.seeded)
+
+	fit := func(i int) {
+		r := rand.New(rand.NewSource(seeds[i]))
+		inx, inBag := bootstrapInx(r, X.NumRows(), cum)
+		reg := tree.NewRegressor(tree.MinSplit(f.MinSplit), tree.MinLeaf(f.MinLeaf),
+			tree.MaxDepth(f.MaxDepth), tree.MaxFeatures(f.MaxFeatures),
+			tree.RandState(r.Int63()))
+		reg.FitInxDataset(X, Y, inx)
+		f.Trees[i] = reg
+
+		if f.keepInBag {
+			f.InBag[i] = inBag
+		}
+		if f.computeOOB {
+			oobInx[i] = outOfBag(inBag)
+			oobTreePred[i] = reg.PredictInxDataset(X, oobInx[i])
+		}
 	}
 
-	// start workers
-	for i := 0; i < nWorkers; i++ {
-		go func(id int) {
-			for w := range in {
-				reg := tree.NewRegressor(tree.MinSplit(f.MinSplit), tree.MinLeaf(f.MinLeaf),
-					tree.MaxDepth(f.MaxDepth), tree.MaxFeatures(f.MaxFeatures),
-					tree.RandState(int64(id)*time.Now().UnixNano()))
-				reg.FitInx(X, Y, w.inx)
+	// accumulate oob predictions in tree order
+	add := func(i int) bool {
+		if !f.computeOOB {
+			f.reportProgress(i + 1)
+			return true
+		}
+		oob.update(oobInx[i], oobTreePred[i])
+		oobInx[i], oobTreePred[i] = nil, nil
 
-				w.t = reg
+		mse, _ := oob.compute(Y)
+		f.OOBCurve = append(f.OOBCurve, mse)
+		f.reportProgress(i + 1)
+		return !stopEarly(f.OOBCurve, f.earlyStopWindow, f.earlyStopTol)
+	}
 
-				if f.computeOOB {
-					oob.update(X, w.inBag, w.t)
-				}
+	fitCtx, cancel := fitContext(ctx, f.maxFitTime)
+	defer cancel()
 
-				out <- w
-			}
-		}(i)
+	f.NTrees = fitTrees(fitCtx, f.NTrees, f.nWorkers, fit, add)
+	f.Trees = f.Trees[:f.NTrees]
+	if f.keepInBag {
+		f.InBag = f.InBag[:f.NTrees]
 	}
 
-	// fill the queue
-	go func() {
-		for _ = range f.Trees {
-			inx, inBag := bootstrapInx(len(X))
-			in <- &fitRegTree{inx: inx, inBag: inBag}
-		}
-		close(in)
-	}()
-
-	for i := range f.Trees {
-		w := <-out
-		f.Trees[i] = w.t
+	if f.NTrees == 0 {
+		return ErrNoTrees
 	}
 
 	if f.computeOOB {
 		f.MSE, f.RSquared = oob.compute(Y)
+		f.OOBPred, f.OOBCount = oob.predictions()
+	}
+
+	return ctx.Err()
+}
+
+// reportProgress calls the progress function, if any, with the number of
+// trees added so far
+func (f *Regressor) reportProgress(trees int) {
+	if f.progress == nil {
+		return
+	}
+	oobErr := math.NaN()
+	if len(f.OOBCurve) > 0 {
+		oobErr = f.OOBCurve[len(f.OOBCurve)-1]
 	}
+	f.progress(FitProgress{Trees: trees, NTrees: f.NTrees, OOBError: oobErr})
 }
 
 // Predict returns the expected value for each example.
 func (f *Regressor) Predict(X [][]float64) []float64 {
-	sum := make([]float64, len(X))
+	return f.PredictDataset(tree.RowMajor(X))
+}
+
+// PredictDataset returns the expected value for each example in the Dataset
+// X.
+func (f *Regressor) PredictDataset(X tree.Dataset) []float64 {
+	sum := make([]float64, X.NumRows())
 
-	for _, t := range f.Trees {
-		for i, val := range t.Predict(X) {
-			sum[i] += val
+	parallelRows(X.NumRows(), f.nWorkers, func(start, end int) {
+		inx := rowRange(start, end)
+		for _, t := range f.Trees {
+			for i, val := range t.PredictInxDataset(X, inx) {
+				sum[start+i] += val
+			}
 		}
-	}
+	})
 
 	for i := range sum {
 		sum[i] /= float64(f.NTrees)
@@ -136,23 +237,137 @@ func (f *Regressor) Predict(X [][]float64) []float64 {
 	return sum
 }
 
-// VarImp returns importance scores for the model.
-func (f *Regressor) VarImp() []float64 {
-	imp := make([]float64, f.nFeatures)
+// PredictWithStd returns the expected value for each example along with the
+// standard deviation of the predictions of the individual trees.
+func (f *Regressor) PredictWithStd(X [][]float64) ([]float64, []float64) {
+	treePred := f.treePredictions(X)
+
+	mean := make([]float64, len(X))
+	std := make([]float64, len(X))
+
+	for i := range X {
+		for _, pred := range treePred {
+			mean[i] += pred[i]
+		}
+		mean[i] /= float64(len(treePred))
+
+		for _, pred := range treePred {
+			d := pred[i] - mean[i]
+			std[i] += d * d
+		}
+		std[i] = math.Sqrt(std[i] / float64(len(treePred)))
+	}
+
+	return mean, std
+}
+
+// VarianceEstimator selects the method used by PredictVariance.
+type VarianceEstimator int
+
+const (
+	// InfinitesimalJackknife is the bias corrected infinitesimal jackknife
+	// estimate, V_IJ-U in Wager et al.
+	InfinitesimalJackknife VarianceEstimator = iota
+	// JackknifeAfterBootstrap is the bias corrected jackknife-after-bootstrap
+	// estimate, V_J-U in Wager et al.
+	JackknifeAfterBootstrap
+)
+
+// PredictVariance returns an estimate of the sampling variance of the forest
+// prediction for each example as described in
+// Wager, S., Hastie, T., Efron, B. (2014) "Confidence Intervals for Random
+// Forests: The Jackknife and the Infinitesimal Jackknife"
+// http://jmlr.org/papers/v15/wager14a.html
+//
+// The forest must be fit with the KeepInBag option. Both estimators are bias
+// corrected for the finite number of trees, negative estimates are
+// truncated at 0.
+func (f *Regressor) PredictVariance(X [][]float64, method VarianceEstimator) ([]float64, error) {
+	if len(f.InBag) != len(f.Trees) {
+		return nil, errors.New("in bag counts not available, fit with KeepInBag")
+	}
+
+	treePred := f.treePredictions(X)
+
+	nTrees := float64(len(f.Trees))
+	n := float64(f.NSample)
+	variance := make([]float64, len(X))
+	dev := make([]float64, len(f.Trees)) // t_b(x) - mean
+
+	for row := range X {
+		mean := 0.0
+		for b := range treePred {
+			mean += treePred[b][row]
+		}
+		mean /= nTrees
+
+		// sum of squared deviations of the trees, for the bias correction
+		ss := 0.0
+		for b := range treePred {
+			dev[b] = treePred[b][row] - mean
+			ss += dev[b] * dev[b]
+		}
+
+		v := 0.0
+		switch method {
+		case InfinitesimalJackknife:
+			// sum over examples of Cov(N_bi, t_b(x))^2
+			for i := 0; i < f.NSample; i++ {
+				cov := 0.0
+				for b := range f.InBag {
+					cov += float64(f.InBag[b][i]) * dev[b]
+				}
+				cov /= nTrees
+				v += cov * cov
+			}
+			v -= n / (nTrees * nTrees) * ss
+		case JackknifeAfterBootstrap:
+			// mean of the trees not using example i vs the forest mean
+			for i := 0; i < f.NSample; i++ {
+				sum := 0.0
+				ct := 0
+				for b := range f.InBag {
+					if f.InBag[b][i] == 0 {
+						sum += treePred[b][row]
+						ct++
+					}
+				}
+				if ct == 0 {
+					continue // example was in every tree
+				}
+				d := sum/float64(ct) - mean
+				v += d * d
+			}
+			v *= (n - 1) / n
+			v -= (math.E - 1) * n / (nTrees * nTrees) * ss
+		default:
+			return nil, errors.New("unknown variance estimator")
+		}
 
-	for _, t := range f.Trees {
-		for inx, importance := range t.VarImp() {
-			imp[inx] += importance / float64(f.NTrees)
+		if v < 0 {
+			v = 0
 		}
+		variance[row] = v
 	}
 
-	return imp
+	return variance, nil
+}
+
+// treePredictions returns the predictions of each tree, indexed by tree then
+// example.
+func (f *Regressor) treePredictions(X [][]float64) [][]float64 {
+	pred := make([][]float64, len(f.Trees))
+	parallel(len(f.Trees), f.nWorkers, func(b int) {
+		pred[b] = f.Trees[b].Predict(X)
+	})
+	return pred
 }
 
-type fitRegTree struct {
-	t     *tree.Regressor
-	inx   []int
-	inBag []bool
+// VarImp returns importance scores for the model.
+func (f *Regressor) VarImp() []float64 {
+	return sumVarImp(len(f.Trees), f.NFeatures, f.nWorkers, func(i int) []float64 {
+		return f.Trees[i].VarImp()
+	})
 }
 
 type oobRegCtr struct {
@@ -166,22 +381,33 @@ func newOOBRegCtr(nExample int) *oobRegCtr {
 	return &oobRegCtr{sum, ct}
 }
 
-func (o *oobRegCtr) update(X [][]float64, inBag []bool, t *tree.Regressor) {
-	var inx []int
-	for i, in := range inBag {
-		if !in {
-			inx = append(inx, i)
-		}
-	}
-
-	pred := t.PredictInx(X, inx)
-
+// accumulate the oob predictions pred of a tree for the examples inx
+func (o *oobRegCtr) update(inx []int, pred []float64) {
 	for i, sampleInx := range inx {
 		o.sum[sampleInx] += pred[i]
 		o.ct[sampleInx]++
 	}
 }
 
+// predictions returns the average prediction over the trees each example was
+// out of bag for and the number of trees, examples that were in every
+// bootstrap sample are NaN.
+func (o *oobRegCtr) predictions() ([]float64, []int) {
+	pred := make([]float64, len(o.sum))
+	for i := range pred {
+		if o.ct[i] < 1 {
+			pred[i] = math.NaN()
+			continue
+		}
+		pred[i] = o.sum[i] / float64(o.ct[i])
+	}
+
+	ct := make([]int, len(o.ct))
+	copy(ct, o.ct)
+
+	return pred, ct
+}
+
 // compute returns mean squared error and rsquared
 func (o *oobRegCtr) compute(Y []float64) (float64, float64) {
 	rss := 0.0 // residual sum square
@@ -0,0 +1,361 @@
+package forest
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/wlattner/rf/tree"
+)
+
+// Params holds the hyperparameters of a forest evaluated by a Search.
+type Params struct {
+	NTrees      int
+	MaxFeatures int
+	MinLeaf     int
+	Impurity    tree.ImpurityMeasure
+}
+
+// options returns base followed by the options for p, so p overrides base
+func (p Params) options(nWorkers int, base []func(forestConfiger)) []func(forestConfiger) {
+	opts := append([]func(forestConfiger){}, base...)
+	return append(opts, NumTrees(p.NTrees), MaxFeatures(p.MaxFeatures),
+		MinLeaf(p.MinLeaf), Impurity(p.Impurity), NumWorkers(nWorkers))
+}
+
+// Grid lists the values to search for each hyperparameter, an empty list
+// uses the default value of NewClassifier.
+type Grid struct {
+	NTrees      []int
+	MaxFeatures []int
+	MinLeaf     []int
+	Impurity    []tree.ImpurityMeasure
+}
+
+// Params returns every combination of the values in the grid.
+func (g Grid) Params() []Params {
+	nTrees := g.NTrees
+	if len(nTrees) == 0 {
+		nTrees = []int{10}
+	}
+	maxFeatures := g.MaxFeatures
+	if len(maxFeatures) == 0 {
+		maxFeatures = []int{-1}
+	}
+	minLeaf := g.MinLeaf
+	if len(minLeaf) == 0 {
+		minLeaf = []int{1}
+	}
+	impurity := g.Impurity
+	if len(impurity) == 0 {
+		impurity = []tree.ImpurityMeasure{Gini}
+	}
+
+	var p []Params
+	for _, t := range nTrees {
+		for _, mf := range maxFeatures {
+			for _, ml := range minLeaf {
+				for _, imp := range impurity {
+					p = append(p, Params{t, mf, ml, imp})
+				}
+			}
+		}
+	}
+	return p
+}
+
+// Sample returns n combinations from the grid drawn at random using r without
+// replacement, or every combination if the grid is smaller than n.
+func (g Grid) Sample(n int, r *rand.Rand) []Params {
+	p := g.Params()
+	for i, j := range r.Perm(len(p)) {
+		p[i], p[j] = p[j], p[i]
+	}
+	if n < len(p) {
+		p = p[:n]
+	}
+	return p
+}
+
+// Trial is the result of evaluating one set of hyperparameters. Error is
+// the out of bag (or cross validation) error rate for classification or mean
+// squared error for regression.
+type Trial struct {
+	Params
+	Error   float64
+	Round   int // successive halving round, 0 without halving
+	Target  int // NTrees of the candidate, more than Params.NTrees before the last round of halving
+	FitTime time.Duration
+}
+
+// Search evaluates candidate hyperparameters by the out of bag error of a
+// forest fit with each set of Params, or by k-fold cross validation when
+// Folds > 1.
+//
+// With Halving, successive halving is used on the number of trees: every
+// candidate is first fit with MinTrees trees, the best 1/Eta candidates are
+// kept and refit with Eta times as many trees until the candidates reach
+// their NTrees.
+//
+// The search stops early when MaxTrials forests have been evaluated or
+// MaxTime has elapsed, whichever comes first (0 for no limit).
+//
+// If Rand is not nil, it seeds each forest (see RandState) and the cross
+// validation folds so the search is reproducible.
+//
+// Options, e.g. MinSplit or Calibrate, are applied to every forest before
+// the Params of the candidate, a forest refit with the best Params should
+// use the same Options.
+type Search struct {
+	Candidates []Params
+	Options    []func(forestConfiger)
+	Folds      int
+	Halving    bool
+	MinTrees   int
+	Eta        int
+	MaxTrials  int
+	MaxTime    time.Duration
+	NumWorkers int
+	Rand       *rand.Rand
+}
+
+// Classifier runs the search for a classifier fit to X and Y, it returns
+// the evaluated trials in order.
+func (s *Search) Classifier(X [][]float64, Y []string) []Trial {
+	return s.run(func(p Params) float64 {
+		return classifierError(X, Y, p, s.Options, s.Folds, s.NumWorkers, s.Rand)
+	})
+}
+
+// Regressor runs the search for a regressor fit to X and Y, it returns the
+// evaluated trials in order.
+func (s *Search) Regressor(X [][]float64, Y []float64) []Trial {
+	return s.run(func(p Params) float64 {
+		return regressorError(X, Y, p, s.Options, s.Folds, s.NumWorkers, s.Rand)
+	})
+}
+
+func (s *Search) run(evaluate func(Params) float64) []Trial {
+	start := time.Now()
+	var trials []Trial
+
+	// returns false when the budget is spent
+	try := func(p Params, target, round int) (Trial, bool) {
+		if s.MaxTrials > 0 && len(trials) >= s.MaxTrials {
+			return Trial{}, false
+		}
+		if s.MaxTime > 0 && time.Since(start) > s.MaxTime {
+			return Trial{}, false
+		}
+
+		fitStart := time.Now()
+		t := Trial{Params: p, Round: round, Target: target}
+		t.Error = evaluate(p)
+		t.FitTime = time.Since(fitStart)
+		trials = append(trials, t)
+		return t, true
+	}
+
+	if !s.Halving {
+		for _, p := range s.Candidates {
+			if _, ok := try(p, p.NTrees, 0); !ok {
+				break
+			}
+		}
+		return trials
+	}
+
+	eta := s.Eta
+	if eta < 2 {
+		eta = 3
+	}
+	nTrees := s.MinTrees
+	if nTrees < 1 {
+		nTrees = 1
+	}
+
+	candidates := s.Candidates
+	for round := 0; len(candidates) > 0; round++ {
+		var results []Trial
+		done := true
+		for _, c := range candidates {
+			p := c
+			if nTrees < p.NTrees {
+				p.NTrees = nTrees
+				done = false
+			}
+			t, ok := try(p, c.NTrees, round)
+			if !ok {
+				return trials
+			}
+			t.Params.NTrees = c.NTrees // target size for the next round
+			results = append(results, t)
+		}
+
+		// a single candidate is still refit until it reaches its NTrees
+		if done {
+			break
+		}
+
+		// keep the best 1/eta
+		sort.Stable(byError(results))
+		keep := int(math.Ceil(float64(len(results)) / float64(eta)))
+		candidates = candidates[:0:0]
+		for _, t := range results[:keep] {
+			candidates = append(candidates, t.Params)
+		}
+		nTrees *= eta
+	}
+
+	return trials
+}
+
+// Best returns the trial with the lowest error from the last round of the
+// search, trials from earlier rounds of successive halving used fewer trees
+// and are not comparable. The best trial may have fewer trees than its
+// Target when the search stopped early, forests refit with the best
+// parameters should use Target trees. Best returns false if trials is empty.
+func Best(trials []Trial) (Trial, bool) {
+	if len(trials) == 0 {
+		return Trial{}, false
+	}
+
+	last := 0
+	for _, t := range trials {
+		if t.Round > last {
+			last = t.Round
+		}
+	}
+
+	best := -1
+	for i, t := range trials {
+		if t.Round == last && (best < 0 || t.Error < trials[best].Error) {
+			best = i
+		}
+	}
+	return trials[best], true
+}
+
+type byError []Trial
+
+func (t byError) Len() int           { return len(t) }
+func (t byError) Less(i, j int) bool { return t[i].Error < t[j].Error }
+func (t byError) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+// TuneMaxFeaturesClassifier searches for the MaxFeatures with the lowest out
+// of bag error as in tuneRF from the R randomForest package. Starting from
+// √(# features), MaxFeatures is divided (then multiplied) by stepFactor while
+// the error improves by at least the fraction improve. The other
+// hyperparameters are taken from base, and opts are applied to every forest
+// as Search.Options. If r is not nil, it seeds each forest.
+func TuneMaxFeaturesClassifier(X [][]float64, Y []string, base Params, stepFactor, improve float64,
+	nWorkers int, r *rand.Rand, opts ...func(forestConfiger)) []Trial {
+	return tuneMaxFeatures(len(X[0]), base, stepFactor, improve, func(p Params) float64 {
+		return classifierError(X, Y, p, opts, 0, nWorkers, r)
+	})
+}
+
+// TuneMaxFeaturesRegressor searches for MaxFeatures as in
+// TuneMaxFeaturesClassifier.
+func TuneMaxFeaturesRegressor(X [][]float64, Y []float64, base Params, stepFactor, improve float64,
+	nWorkers int, r *rand.Rand, opts ...func(forestConfiger)) []Trial {
+	return tuneMaxFeatures(len(X[0]), base, stepFactor, improve, func(p Params) float64 {
+		return regressorError(X, Y, p, opts, 0, nWorkers, r)
+	})
+}
+
+func tuneMaxFeatures(nFeatures int, base Params, stepFactor, improve float64, evaluate func(Params) float64) []Trial {
+	var trials []Trial
+	tried := make(map[int]float64)
+
+	eval := func(mf int) float64 {
+		if err, ok := tried[mf]; ok {
+			return err
+		}
+		p := base
+		p.MaxFeatures = mf
+		start := time.Now()
+		t := Trial{Params: p, Error: evaluate(p), Target: p.NTrees}
+		t.FitTime = time.Since(start)
+		trials = append(trials, t)
+		tried[mf] = t.Error
+		return t.Error
+	}
+
+	start := int(math.Sqrt(float64(nFeatures)))
+	if start < 1 {
+		start = 1
+	}
+	startErr := eval(start)
+
+	// search left (fewer features) then right (more features)
+	for _, step := range []func(int) int{
+		func(mf int) int { return int(float64(mf) / stepFactor) },
+		func(mf int) int { return int(math.Ceil(float64(mf) * stepFactor)) },
+	} {
+		mf, errBest := start, startErr
+		for {
+			next := step(mf)
+			if next < 1 || next > nFeatures || next == mf {
+				break
+			}
+			err := eval(next)
+			if errBest == 0 || (errBest-err)/errBest < improve {
+				break
+			}
+			mf, errBest = next, err
+		}
+	}
+
+	return trials
+}
+
+// seeded returns the forest options for params p after base, seeded from r
+// unless r is nil, and the source for cross validation folds
+func (p Params) seeded(nWorkers int, base []func(forestConfiger), r *rand.Rand) ([]func(forestConfiger), *rand.Rand) {
+	opts := p.options(nWorkers, base)
+	if r == nil {
+		return opts, rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return append(opts, RandState(r.Int63())), r
+}
+
+// classifierError returns the error rate of a classifier with params p,
+// estimated from out of bag samples or k-fold cross validation
+func classifierError(X [][]float64, Y []string, p Params, base []func(forestConfiger), folds, nWorkers int, r *rand.Rand) float64 {
+	if folds > 1 {
+		opts, r := p.seeded(1, base, r)
+		res, _ := CrossValidateClassifier(X, Y, StratifiedKFold(Y, folds, r), nWorkers, func() *Classifier {
+			return NewClassifier(opts...)
+		})
+		return 1.0 - res.Mean[0].Value // accuracy
+	}
+
+	opts, _ := p.seeded(nWorkers, base, r)
+	clf := NewClassifier(append(opts, ComputeOOB)...)
+	if err := clf.FitContext(context.Background(), X, Y); err != nil {
+		return math.Inf(1) // no trees within MaxFitTime
+	}
+	return 1.0 - clf.OOBMetrics.Accuracy
+}
+
+// regressorError returns the mean squared error of a regressor with params
+// p, estimated from out of bag samples or k-fold cross validation
+func regressorError(X [][]float64, Y []float64, p Params, base []func(forestConfiger), folds, nWorkers int, r *rand.Rand) float64 {
+	if folds > 1 {
+		opts, r := p.seeded(1, base, r)
+		res := CrossValidateRegressor(X, Y, KFold(len(Y), folds, r), nWorkers, func() *Regressor {
+			return NewRegressor(opts...)
+		})
+		return res.Mean[0].Value // mse
+	}
+
+	opts, _ := p.seeded(nWorkers, base, r)
+	reg := NewRegressor(append(opts, ComputeOOB)...)
+	if err := reg.FitContext(context.Background(), X, Y); err != nil {
+		return math.Inf(1)
+	}
+	return reg.MSE
+}
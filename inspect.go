@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/wlattner/rf/tree"
+)
+
+// Inspection describes what is stored in a model, see runInspect.
+type Inspection struct {
+	File        string                  `json:"file,omitempty"`
+	Format      string                  `json:"format,omitempty"`
+	FileSize    int64                   `json:"file_size,omitempty"` // bytes
+	Type        string                  `json:"type"`                // classification or regression
+	Online      bool                    `json:"online"`
+	Parameters  map[string]interface{}  `json:"parameters"`
+	NSample     int                     `json:"n_sample"`
+	FitTime     float64                 `json:"fit_time"` // seconds
+	Features    []string                `json:"features"`
+	Classes     []string                `json:"classes,omitempty"`
+	Trees       []treeShape             `json:"trees"`
+	TreeSummary map[string]shapeSummary `json:"tree_summary"`
+	Memory      int64                   `json:"memory"` // approximate bytes
+	OOB         map[string]*float64     `json:"oob,omitempty"`
+	Importance  []featureImportance     `json:"importance"`
+}
+
+// treeShape is the size of a tree, the depth of the root is 0
+type treeShape struct {
+	Depth  int `json:"depth"`
+	Leaves int `json:"leaves"`
+	Nodes  int `json:"nodes"`
+}
+
+type shapeSummary struct {
+	Min  int     `json:"min"`
+	Mean float64 `json:"mean"`
+	Max  int     `json:"max"`
+}
+
+type featureImportance struct {
+	Feature    string   `json:"feature"`
+	Importance *float64 `json:"importance"` // null when not defined
+}
+
+// sizes of the nodes of each kind of tree, without their slices
+var (
+	nodeSize         = int64(reflect.TypeOf(tree.Node{}).Size())
+	regNodeSize      = int64(reflect.TypeOf(tree.RegNode{}).Size())
+	mondrianNodeSize = int64(reflect.TypeOf(tree.MondrianNode{}).Size())
+)
+
+// add adds the node n at depth to the shape of its tree and the size of n
+// to *mem
+func (s *treeShape) add(n interface{}, depth int, mem *int64) {
+	s.Nodes++
+	if depth > s.Depth {
+		s.Depth = depth
+	}
+
+	var leaf bool
+	var left, right interface{}
+	switch n := n.(type) {
+	case *tree.Node:
+		*mem += nodeSize + 8*int64(len(n.ClassCounts))
+		leaf, left, right = n.Leaf, n.Left, n.Right
+	case *tree.RegNode:
+		*mem += regNodeSize
+		leaf, left, right = n.Leaf, n.Left, n.Right
+	case *tree.MondrianNode:
+		*mem += mondrianNodeSize + 8*int64(len(n.ClassCounts)+len(n.Lower)+len(n.Upper))
+		leaf, left, right = n.Leaf, n.Left, n.Right
+	}
+	if leaf {
+		s.Leaves++
+		return
+	}
+	s.add(left, depth+1, mem)
+	s.add(right, depth+1, mem)
+}
+
+// Inspect describes the model, the file fields are left empty. The memory
+// is an estimate from the nodes of the trees and the out of bag estimates
+// kept for each example.
+func (m *Model) Inspect() *Inspection {
+	ins := &Inspection{
+		Type:       "classification",
+		Online:     m.IsOnline,
+		Parameters: make(map[string]interface{}),
+		NSample:    m.nSample,
+		FitTime:    m.fitTime.Seconds(),
+		Features:   m.VarNames,
+	}
+	if m.IsRegression {
+		ins.Type = "regression"
+	}
+
+	var roots []interface{}
+	p := ins.Parameters
+	switch {
+	case m.OnlineClf != nil:
+		p["n_trees"], p["lifetime"] = m.OnlineClf.NTrees, m.OnlineClf.Lifetime
+		ins.Classes = m.OnlineClf.Classes
+		for _, t := range m.OnlineClf.Trees {
+			roots = append(roots, t.Root)
+		}
+	case m.OnlineReg != nil:
+		p["n_trees"], p["lifetime"] = m.OnlineReg.NTrees, m.OnlineReg.Lifetime
+		for _, t := range m.OnlineReg.Trees {
+			roots = append(roots, t.Root)
+		}
+	case m.Clf != nil:
+		f := m.Clf
+		p["n_trees"], p["min_split"], p["min_leaf"] = f.NTrees, f.MinSplit, f.MinLeaf
+		p["max_depth"], p["max_features"] = f.MaxDepth, f.MaxFeatures
+		p["impurity"], p["calibration"] = "gini", "none"
+		for name, code := range impurityCode {
+			if code == f.Impurity() {
+				p["impurity"] = name
+			}
+		}
+		if f.Calibrator != nil {
+			for name, code := range calibrationCode {
+				if code == f.Calibrator.Method {
+					p["calibration"] = name
+				}
+			}
+		}
+		ins.Classes = f.Classes
+		for _, t := range f.Trees {
+			roots = append(roots, t.Root)
+		}
+
+		if f.OOBMetrics != nil {
+			ins.OOB = make(map[string]*float64)
+			for _, metric := range f.OOBMetrics.Summary() {
+				ins.OOB[metric.Name] = finite(metric.Value)
+			}
+			ins.OOB["brier"] = finite(f.Brier)
+		}
+		ins.Memory += 8 * int64(len(f.OOBCount)+len(f.OOBCurve))
+		for _, row := range f.OOBProb {
+			ins.Memory += 8 * int64(len(row))
+		}
+	case m.Reg != nil:
+		f := m.Reg
+		p["n_trees"], p["min_split"], p["min_leaf"] = f.NTrees, f.MinSplit, f.MinLeaf
+		p["max_depth"], p["max_features"] = f.MaxDepth, f.MaxFeatures
+		p["keep_in_bag"] = f.InBag != nil
+		for _, t := range f.Trees {
+			roots = append(roots, t.Root)
+		}
+
+		if f.OOBPred != nil {
+			ins.OOB = map[string]*float64{"mse": finite(f.MSE), "r_squared": finite(f.RSquared)}
+		}
+		ins.Memory += 8 * int64(len(f.OOBPred)+len(f.OOBCount)+len(f.OOBCurve))
+		for _, row := range f.InBag {
+			ins.Memory += 8 * int64(len(row))
+		}
+	}
+
+	for _, root := range roots {
+		var s treeShape
+		s.add(root, 0, &ins.Memory)
+		ins.Trees = append(ins.Trees, s)
+	}
+	ins.TreeSummary = map[string]shapeSummary{
+		"depth":  summarizeShapes(ins.Trees, func(s treeShape) int { return s.Depth }),
+		"leaves": summarizeShapes(ins.Trees, func(s treeShape) int { return s.Leaves }),
+		"nodes":  summarizeShapes(ins.Trees, func(s treeShape) int { return s.Nodes }),
+	}
+
+	imp := m.VarImp()
+	for i, name := range m.VarNames {
+		ins.Importance = append(ins.Importance, featureImportance{name, finite(imp[i])})
+	}
+	// most important first, undefined importance last
+	sort.SliceStable(ins.Importance, func(i, j int) bool {
+		a, b := ins.Importance[i].Importance, ins.Importance[j].Importance
+		return a != nil && (b == nil || *a > *b)
+	})
+	return ins
+}
+
+func summarizeShapes(shapes []treeShape, field func(treeShape) int) shapeSummary {
+	if len(shapes) == 0 {
+		return shapeSummary{}
+	}
+	s := shapeSummary{Min: field(shapes[0]), Max: field(shapes[0])}
+	for _, shape := range shapes {
+		v := field(shape)
+		if v < s.Min {
+			s.Min = v
+		}
+		if v > s.Max {
+			s.Max = v
+		}
+		s.Mean += float64(v)
+	}
+	s.Mean /= float64(len(shapes))
+	return s
+}
+
+// finite returns nil for values JSON can't represent
+func finite(v float64) *float64 {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil
+	}
+	return &v
+}
+
+func (ins *Inspection) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(ins)
+}
+
+// Report writes the inspection as text
+func (ins *Inspection) Report(w io.Writer) {
+	kind := "random forest"
+	if ins.Online {
+		kind = "online random forest"
+	}
+	fmt.Fprintf(w, "%s %s", strings.Title(ins.Type), kind)
+	if ins.File != "" {
+		fmt.Fprintf(w, " in %s (%s, %s)", ins.File, ins.Format, formatBytes(ins.FileSize))
+	}
+	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "Fit %d trees using %d examples in %.2f seconds\n", len(ins.Trees), ins.NSample, ins.FitTime)
+	fmt.Fprintf(w, "Memory: about %s\n", formatBytes(ins.Memory))
+	fmt.Fprintf(w, "\n")
+
+	fmt.Fprintf(w, "Parameters\n")
+	fmt.Fprintf(w, "----------\n")
+	var names []string
+	for name := range ins.Parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%-14s %v\n", name, ins.Parameters[name])
+	}
+	fmt.Fprintf(w, "\n")
+
+	fmt.Fprintf(w, "Features (%d): %s\n", len(ins.Features), strings.Join(ins.Features, ", "))
+	if ins.Classes != nil {
+		fmt.Fprintf(w, "Classes (%d): %s\n", len(ins.Classes), strings.Join(ins.Classes, ", "))
+	}
+	fmt.Fprintf(w, "\n")
+
+	fmt.Fprintf(w, "Trees\n")
+	fmt.Fprintf(w, "-----\n")
+	fmt.Fprintf(w, "%-14s %-14s %-14s %-14s\n", "", "Min", "Mean", "Max")
+	for _, field := range []string{"depth", "leaves", "nodes"} {
+		s := ins.TreeSummary[field]
+		fmt.Fprintf(w, "%-14s %-14d %-14.1f %-14d\n", field, s.Min, s.Mean, s.Max)
+	}
+	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "%-14s %-14s %-14s %-14s\n", "Tree", "Depth", "Leaves", "Nodes")
+	for i, s := range ins.Trees {
+		fmt.Fprintf(w, "%-14d %-14d %-14d %-14d\n", i, s.Depth, s.Leaves, s.Nodes)
+	}
+	fmt.Fprintf(w, "\n")
+
+	if ins.OOB != nil {
+		fmt.Fprintf(w, "Out of Bag Estimates\n")
+		fmt.Fprintf(w, "--------------------\n")
+		names = names[:0]
+		for name := range ins.OOB {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if v := ins.OOB[name]; v != nil {
+				fmt.Fprintf(w, "%-18s %.4f\n", name, *v)
+			} else {
+				fmt.Fprintf(w, "%-18s -\n", name)
+			}
+		}
+		fmt.Fprintf(w, "\n")
+	}
+
+	fmt.Fprintf(w, "Variable Importance\n")
+	fmt.Fprintf(w, "-------------------\n")
+	for _, f := range ins.Importance {
+		if f.Importance != nil {
+			fmt.Fprintf(w, "%-15s: %-10.2f\n", f.Feature, *f.Importance)
+		} else {
+			fmt.Fprintf(w, "%-15s: -\n", f.Feature)
+		}
+	}
+}
+
+// formatBytes returns n in B, KB or MB
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// runInspect describes the model in --final_model on stdout, as JSON with
+// --json
+func runInspect() {
+	m, err := loadModel(*modelFile)
+	if err != nil {
+		fatal("error opening model file", err.Error())
+	}
+	ins := m.Inspect()
+
+	f, err := os.Open(*modelFile)
+	if err != nil {
+		fatal("error opening model file", err.Error())
+	}
+	start := make([]byte, 512)
+	n, _ := io.ReadFull(f, start)
+	ins.Format = detectModelFormat(start[:n])
+	if fi, err := f.Stat(); err == nil {
+		ins.FileSize = fi.Size()
+	}
+	f.Close()
+	ins.File = *modelFile
+
+	if *jsonOut {
+		err = ins.writeJSON(os.Stdout)
+		if err != nil {
+			fatal("error writing report", err.Error())
+		}
+		return
+	}
+	ins.Report(os.Stdout)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/wlattner/rf/forest"
+)
+
+func TestInspect(t *testing.T) {
+	d, err := parseCSV(strings.NewReader(syntheticCSV(200, false)), false)
+	if err != nil {
+		t.Fatal("unexpected error parsing data:", err)
+	}
+	iris, err := parseCSV(strings.NewReader(irisCSV), false)
+	if err != nil {
+		t.Fatal("unexpected error parsing iris data:", err)
+	}
+	boston, err := parseCSV(strings.NewReader(bostonCSV), false)
+	if err != nil {
+		t.Fatal("unexpected error parsing boston data:", err)
+	}
+
+	opt := modelOptions{nTree: 5, minSplit: 2, minLeaf: 1, maxFeatures: -1, nWorkers: 1, seed: 1, lifetime: -1}
+	clf := opt
+	clf.impurity = forest.Entropy
+	clf.calibration = forest.Isotonic
+	online := opt
+	online.online = true
+
+	m := new(Model)
+	m.Fit(d, clf)
+	ins := m.Inspect()
+	if ins.Type != "classification" || ins.NSample != len(d.YClf) || len(ins.Classes) != len(m.Clf.Classes) {
+		t.Errorf("expected a classifier of %d examples and classes %v, got: %s %d %v", len(d.YClf), m.Clf.Classes, ins.Type, ins.NSample, ins.Classes)
+	}
+	if ins.Parameters["impurity"] != "entropy" || ins.Parameters["calibration"] != "isotonic" || ins.Parameters["n_trees"] != 5 {
+		t.Errorf("expected the parameters of the fit, got: %v", ins.Parameters)
+	}
+	if len(ins.Trees) != 5 {
+		t.Fatalf("expected 5 trees, got: %d", len(ins.Trees))
+	}
+	for i, s := range ins.Trees {
+		if n := countNodes(m.Clf.Trees[i].Root); s.Nodes != n || s.Leaves != (n+1)/2 {
+			t.Errorf("tree %d: expected %d nodes and %d leaves, got: %+v", i, n, (n+1)/2, s)
+		}
+	}
+	if s := ins.TreeSummary["nodes"]; float64(s.Min) > s.Mean || s.Mean > float64(s.Max) {
+		t.Errorf("expected min <= mean <= max, got: %+v", s)
+	}
+	if ins.OOB["accuracy"] == nil || ins.Memory <= 0 {
+		t.Errorf("expected out of bag accuracy and memory, got: %v %d", ins.OOB, ins.Memory)
+	}
+	for i := 1; i < len(ins.Importance); i++ {
+		a, b := ins.Importance[i-1].Importance, ins.Importance[i].Importance
+		if b != nil && (a == nil || *b > *a) {
+			t.Fatal("expected the most important features first, got:", ins.Importance)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := ins.writeJSON(&buf); err != nil {
+		t.Fatal("unexpected error writing inspection:", err)
+	}
+	var got Inspection
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil || len(got.Trees) != 5 {
+		t.Errorf("expected JSON with 5 trees, got: %v %v", got.Trees, err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		d    *parsedInput
+		opt  modelOptions
+		want func(*Model) int
+	}{
+		{"regressor", boston, opt, func(m *Model) int { return len(m.Reg.Trees) }},
+		{"online classifier", iris, online, func(m *Model) int { return len(m.OnlineClf.Trees) }},
+		{"online regressor", boston, online, func(m *Model) int { return len(m.OnlineReg.Trees) }},
+	} {
+		m := new(Model)
+		m.Fit(tc.d, tc.opt)
+		ins := m.Inspect()
+		if len(ins.Trees) != tc.want(m) || ins.TreeSummary["nodes"].Min < 1 {
+			t.Errorf("%s: expected %d trees, got: %v", tc.name, tc.want(m), ins.Trees)
+		}
+		if ins.Online != tc.opt.online {
+			t.Errorf("%s: expected online %v, got: %v", tc.name, tc.opt.online, ins.Online)
+		}
+		buf.Reset()
+		ins.Report(&buf)
+		if !strings.Contains(buf.String(), "Variable Importance") {
+			t.Errorf("%s: expected a report with variable importance, got:\n%s", tc.name, buf.String())
+		}
+	}
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
-	"bufio"
+	"encoding/csv"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/davecheney/profile"
+	"github.com/wlattner/rf/forest"
 	"github.com/wlattner/rf/tree"
 
 	flag "github.com/docker/docker/pkg/mflag"
@@ -16,21 +21,42 @@ import (
 
 var (
 	// model/prediction files
-	dataFile    = flag.String([]string{"d", "-data"}, "", "example data")
-	predictFile = flag.String([]string{"p", "-predictions"}, "", "file to output predictions")
+	dataFile    = flag.String([]string{"d", "-data"}, "", "example data, - for stdin")
+	predictFile = flag.String([]string{"p", "-predictions"}, "", "file to output predictions, - for stdout")
 	modelFile   = flag.String([]string{"f", "-final_model"}, "rf.model", "file to output fitted model")
 	impFile     = flag.String([]string{"-var_importance"}, "", "file to output variable importance estimates")
+	oobFile     = flag.String([]string{"-oob_predictions"}, "", "file to output out of bag predictions for each example")
+	curveFile   = flag.String([]string{"-oob_curve"}, "", "file to output the out of bag error as trees are added")
+	predStd     = flag.String([]string{"-std"}, "", "add a standard deviation column to regression predictions, one of trees, ij or jackknife")
+	batchSize   = flag.Int([]string{"-batch_size"}, 10000, "number of rows read and predicted at a time")
+	// csv columns
+	targetCol  = flag.String([]string{"-target"}, "", "name of the target column, the first column if not set")
+	idCols     = flag.String([]string{"-id"}, "", "comma separated names of id columns, not used as features and written with --predictions")
+	ignoreCols = flag.String([]string{"-ignore"}, "", "comma separated names of columns that aren't used")
+	weightCol  = flag.String([]string{"-weight"}, "", "name of a column of example weights >= 0, examples are drawn into the bootstrap samples in proportion to their weight")
 	// model params
 	nTree       = flag.Int([]string{"-trees"}, 10, "number of trees")
 	minSplit    = flag.Int([]string{"-min_split"}, 2, "minimum number of samples required to split an internal node")
 	minLeaf     = flag.Int([]string{"-min_leaf"}, 1, "minimum number of samples in newly created leaves")
 	maxFeatures = flag.Int([]string{"-max_features"}, -1, "number of features to consider when looking for the best split, -1 will default to √(# features)")
 	impurity    = flag.String([]string{"-impurity"}, "gini", "impurity measure for evaluating splits")
+	calibrate   = flag.String([]string{"-calibrate"}, "", "calibrate class probabilities using out of bag estimates, isotonic or sigmoid")
+	keepInBag   = flag.Bool([]string{"-inbag"}, false, "keep bootstrap counts for each tree, required for --std ij or jackknife")
+	maxFitTime  = flag.Duration([]string{"-max_fit_time"}, 0, "stop adding trees after this long, e.g. 5m, 0 for no limit")
+	earlyStop   = flag.Int([]string{"-early_stop"}, 0, "stop adding trees once the out of bag error has not improved over this many trees, --trees is the maximum, 0 to disable")
+	stopTol     = flag.Float64([]string{"-early_stop_tol"}, 0.0001, "minimum improvement in out of bag error for --early_stop")
+	// online models
+	online      = flag.Bool([]string{"-online"}, false, "fit an online (Mondrian) forest that can be updated with new examples")
+	lifetime    = flag.Float64([]string{"-lifetime"}, -1, "budget for growing online trees, -1 will grow unlimited trees")
+	updateModel = flag.Bool([]string{"u", "-update"}, false, "update a previously fitted online model with new examples")
 	// force classification
 	forceClf = flag.Bool([]string{"c", "-classification"}, false, "force parser to use integer targets/labels for classification")
+	libSVM   = flag.Bool([]string{"-libsvm"}, false, "parse --data as sparse LIBSVM/svmlight (label index:value ...) instead of csv")
 	// runtime params
-	nWorkers   = flag.Int([]string{"-workers"}, 1, "number of workers for fitting trees")
-	runProfile = flag.Bool([]string{"-profile"}, false, "cpu profile")
+	nWorkers    = flag.Int([]string{"-workers"}, 1, "number of workers for fitting trees and making predictions")
+	seed        = flag.Int64([]string{"-seed"}, 0, "seed for the random number generator, fits with the same seed are identical, 0 will use the current time")
+	runProfile  = flag.Bool([]string{"-profile"}, false, "cpu profile")
+	savePartial = flag.Bool([]string{"-save_partial"}, false, "on Ctrl-C, save the trees fit so far instead of exiting without a model")
 )
 
 type modelOptions struct {
@@ -39,7 +65,15 @@ type modelOptions struct {
 	minLeaf     int
 	maxFeatures int
 	impurity    tree.ImpurityMeasure
+	calibration forest.Calibration
 	nWorkers    int
+	keepInBag   bool
+	earlyStop   int
+	stopTol     float64
+	online      bool
+	lifetime    float64
+	seed        int64
+	maxFitTime  time.Duration
 }
 
 // lookup table for impurity measure
@@ -48,6 +82,13 @@ var impurityCode = map[string]tree.ImpurityMeasure{
 	"entropy": tree.Entropy,
 }
 
+// lookup table for probability calibration
+var calibrationCode = map[string]forest.Calibration{
+	"":         forest.NoCalibration,
+	"isotonic": forest.Isotonic,
+	"sigmoid":  forest.Sigmoid,
+}
+
 func parseModelOpts() (modelOptions, error) {
 	o := modelOptions{
 		nTree:       *nTree,
@@ -55,6 +96,13 @@ func parseModelOpts() (modelOptions, error) {
 		minLeaf:     *minLeaf,
 		maxFeatures: *maxFeatures,
 		nWorkers:    *nWorkers,
+		keepInBag:   *keepInBag,
+		earlyStop:   *earlyStop,
+		stopTol:     *stopTol,
+		online:      *online,
+		lifetime:    *lifetime,
+		seed:        *seed,
+		maxFitTime:  *maxFitTime,
 	}
 
 	imp, ok := impurityCode[*impurity]
@@ -63,11 +111,33 @@ func parseModelOpts() (modelOptions, error) {
 	}
 
 	o.impurity = imp
+
+	cal, ok := calibrationCode[*calibrate]
+	if !ok {
+		return o, errors.New("invalid calibrate option, choices are isotonic or sigmoid")
+	}
+
+	o.calibration = cal
 	return o, nil
 }
 
+// rand returns a random number generator seeded with o.seed, or the current
+// time if o.seed is 0
+func (o modelOptions) rand() *rand.Rand {
+	if o.seed == 0 {
+		return rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return rand.New(rand.NewSource(o.seed))
+}
+
 func main() {
-	flag.Parse()
+	// the first argument may be a command, all commands share the same flags
+	cmd := ""
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	flag.CommandLine.Parse(args)
 
 	if *nWorkers > 1 {
 		runtime.GOMAXPROCS(runtime.NumCPU())
@@ -77,91 +147,213 @@ func main() {
 		defer profile.Start(profile.CPUProfile).Stop()
 	}
 
-	// make sure user specified csv file w/ data
-	if *dataFile == "" {
+	// make sure user specified csv file w/ data, serve, rollback, convert,
+	// export, import and inspect only need models
+	if *dataFile == "" && cmd != "serve" && cmd != "rollback" && cmd != "convert" && cmd != "export" && cmd != "import" && cmd != "inspect" {
 		fmt.Fprintf(os.Stderr, "Usage of rf:\n\n")
+		fmt.Fprintf(os.Stderr, "  rf [command] [options]\n\n")
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		fmt.Fprintf(os.Stderr, "  convert  rewrite a saved model in --model_format\n")
+		fmt.Fprintf(os.Stderr, "  cv       estimate model performance with k-fold cross validation\n")
+		fmt.Fprintf(os.Stderr, "  eval     score a saved model against labeled examples\n")
+		fmt.Fprintf(os.Stderr, "  export   write a saved model in another format, such as PMML\n")
+		fmt.Fprintf(os.Stderr, "  import   save a model from scikit-learn or XGBoost\n")
+		fmt.Fprintf(os.Stderr, "  inspect  describe the trees, parameters and estimates in a saved model\n")
+		fmt.Fprintf(os.Stderr, "  rollback serve an earlier version of a model in a registry\n")
+		fmt.Fprintf(os.Stderr, "  serve    serve predictions from a saved model, or a registry of models, over HTTP\n")
+		fmt.Fprintf(os.Stderr, "  tune     search for the hyperparameters with the lowest out of bag error\n")
+		fmt.Fprintf(os.Stderr, "  (none)   fit a model, or make predictions with -p\n\n")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	f, err := os.Open(*dataFile)
-	if err != nil {
-		fatal("error opening data file", err.Error())
-	}
-	defer f.Close()
-
-	d, err := parseCSV(f, *forceClf)
-	if err != nil {
-		fatal("error parsing input data", err.Error())
+	switch cmd {
+	case "":
+	case "convert":
+		runConvert()
+		return
+	case "cv":
+		runCV()
+		return
+	case "tune":
+		runTune()
+		return
+	case "eval":
+		runEval()
+		return
+	case "export":
+		runExport()
+		return
+	case "import":
+		runImport()
+		return
+	case "inspect":
+		runInspect()
+		return
+	case "serve":
+		runServe()
+		return
+	case "rollback":
+		runRollback()
+		return
+	default:
+		fatal("unknown command", cmd)
 	}
 
 	// consider non-blank *predictFile as prediction, fit otherwise
 	if *predictFile != "" {
-		m, err := loadModel(*modelFile)
+		runPredict()
+		return
+	}
+
+	var err error
+
+	// a model being updated decides how the labels are parsed and how the
+	// columns are encoded
+	parseOpt := parseOptions{forceClf: *forceClf}
+	var prev *Model
+	if *updateModel {
+		prev, err = loadModel(*modelFile)
 		if err != nil {
 			fatal("error opening model file", err.Error())
 		}
+		parseOpt.forceClf = parseOpt.forceClf || !prev.IsRegression
+		parseOpt.pipeline = prev.inputPipeline()
+		parseOpt.modelTarget = prev.Target
+	}
+
+	d, err := loadData(parseOpt)
+	if err != nil {
+		fatal("error parsing input data", err.Error())
+	}
+
+	opt, err := parseModelOpts()
+	if err != nil {
+		fatal("invalid model option", err.Error())
+	}
+	if err := checkModelFormat(); err != nil {
+		fatal("invalid model option", err.Error())
+	}
 
-		pred, err := m.Predict(d)
+	if d.Sparse != nil && (opt.online || prev != nil) {
+		fatal(errOnlineSparse.Error())
+	}
+	if d.Weights != nil && (opt.online || prev != nil) {
+		fatal(errOnlineWeights.Error())
+	}
+
+	m := prev
+	if m != nil {
+		// update online model
+		err = m.PartialFit(d, opt)
 		if err != nil {
-			fatal(err.Error())
+			fatal("error updating model", err.Error())
 		}
+	} else {
+		// fit model, Ctrl-C stops adding trees
+		ctx, stop := interruptContext()
+		defer stop()
 
-		// write the predictions to file
-		o, err := os.Create(*predictFile)
-		if err != nil {
-			fatal("error creating", *predictFile, err.Error())
+		var progress func(forest.FitProgress)
+		if isTerminal(os.Stderr) {
+			progress = progressBar(os.Stderr)
 		}
-		defer o.Close()
 
-		err = writePred(o, pred)
+		m = new(Model)
+		err = m.FitContext(ctx, d, opt, progress)
+		if progress != nil {
+			fmt.Fprintf(os.Stderr, "\n")
+		}
+		if err == forest.ErrNoTrees {
+			fatal("error fitting model", "no trees were fit, model not saved")
+		}
+		if err != nil && ctx.Err() == nil {
+			fatal("error fitting model", err.Error())
+		}
 		if err != nil {
-			fatal("error writing predictions", err.Error())
+			if !*savePartial {
+				fatal("fitting interrupted, model not saved; use --save_partial to keep the trees fit so far")
+			}
+			fmt.Fprintf(os.Stderr, "fitting interrupted, saving partial model\n\n")
 		}
-		os.Exit(0)
+	}
 
-	} else {
-		// must be model fitting
-		opt, err := parseModelOpts()
+	// save model to disk
+	err = saveModel(m, *modelFile)
+	if err != nil {
+		fatal("error saving model", err.Error())
+	}
+
+	// write var importance to file
+	if *impFile != "" {
+		f, err := os.Create(*impFile)
 		if err != nil {
-			fatal("invalid model option", err.Error())
+			fatal("error saving variable importance", err.Error())
 		}
+		defer f.Close()
+		err = m.SaveVarImp(f)
+		if err != nil {
+			fatal("error saving variable importance", err.Error())
+		}
+	}
 
-		// fit model
-		m := new(Model)
-		m.Fit(d, opt)
-
-		// save model to disk
-		o, err := os.Create(*modelFile)
+	// write oob error curve to file
+	if *curveFile != "" {
+		f, err := os.Create(*curveFile)
 		if err != nil {
-			fatal("error saving model", err.Error())
+			fatal("error saving out of bag curve", err.Error())
 		}
-		defer o.Close()
+		defer f.Close()
+		err = m.SaveOOBCurve(f)
+		if err != nil {
+			fatal("error saving out of bag curve", err.Error())
+		}
+	}
 
-		err = m.Save(o)
+	// write oob predictions to file
+	if *oobFile != "" {
+		f, err := os.Create(*oobFile)
 		if err != nil {
-			fatal("error saving model", err.Error())
+			fatal("error saving out of bag predictions", err.Error())
 		}
+		defer f.Close()
+		err = m.SaveOOBPred(f, d)
+		if err != nil {
+			fatal("error saving out of bag predictions", err.Error())
+		}
+	}
 
-		// write var importance to file
-		if *impFile != "" {
-			f, err := os.Create(*impFile)
-			if err != nil {
-				fatal("error saving variable importance", err.Error())
-			}
-			defer f.Close()
-			err = m.SaveVarImp(f)
-			if err != nil {
-				fatal("error saving variable importance", err.Error())
-			}
+	m.Report(os.Stderr)
+}
+
+// loadData parses the csv (or LIBSVM with --libsvm) file given by --data,
+// csv columns are encoded as given by --column_types, --encoding and --impute
+// unless opt has a pipeline, their roles are given by --target, --id,
+// --ignore and --weight
+func loadData(opt parseOptions) (*parsedInput, error) {
+	if opt.pipeline == nil {
+		enc, err := parseEncodeOpts()
+		if err != nil {
+			return nil, err
 		}
+		opt.encode = enc
+	}
+	opt.setColumnRoles()
 
-		m.Report(os.Stderr)
+	f, err := openInput(*dataFile)
+	if err != nil {
+		return nil, err
 	}
+	defer f.Close()
+
+	if *libSVM {
+		return parseLibSVM(f, opt)
+	}
+	return parseCSVOpts(f, opt)
 }
 
 func loadModel(fName string) (*Model, error) {
-	f, err := os.Open(*modelFile)
+	f, err := os.Open(fName)
 	if err != nil {
 		return nil, err
 	}
@@ -177,20 +369,63 @@ func fatal(a ...interface{}) {
 	os.Exit(1)
 }
 
-func writePred(w io.Writer, prediction []string) error {
-	wtr := bufio.NewWriter(w)
+// setColumnRoles sets the csv columns given by --target, --id, --ignore and
+// --weight
+func (o *parseOptions) setColumnRoles() {
+	o.targetCol = *targetCol
+	o.idCols = splitNames(*idCols)
+	o.ignore = splitNames(*ignoreCols)
+	o.weightCol = *weightCol
+}
 
-	for _, pred := range prediction {
-		_, err := wtr.WriteString(pred)
-		if err != nil {
-			return err
+// splitNames splits a comma separated list of column names, nil for an
+// empty list
+func splitNames(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// writePredHeader writes the header row of predictions with id columns, std
+// adds the standard deviation column
+func writePredHeader(w io.Writer, idNames []string, std bool) error {
+	header := append(append([]string{}, idNames...), "prediction")
+	if std {
+		header = append(header, "std")
+	}
+	wtr := csv.NewWriter(w)
+	wtr.Write(header)
+	wtr.Flush()
+	return wtr.Error()
+}
+
+// writePred writes one prediction per line, preceded by the ids of the
+// example when ids is not nil. std is optional and written as the last column
+// when not nil.
+func writePred(w io.Writer, ids [][]string, prediction []string, std []float64) error {
+	wtr := csv.NewWriter(w)
+
+	var rec []string
+	for i, pred := range prediction {
+		rec = rec[:0]
+		if ids != nil {
+			rec = append(rec, ids[i]...)
+		}
+		rec = append(rec, pred)
+		if std != nil {
+			rec = append(rec, strconv.FormatFloat(std[i], 'f', -1, 64))
 		}
 
-		err = wtr.WriteByte('\n')
+		err := wtr.Write(rec)
 		if err != nil {
 			return err
 		}
 	}
 
-	return wtr.Flush()
+	wtr.Flush()
+	return wtr.Error()
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// requestCounter counts requests by model, version and response status and
+// serves the counts in the Prometheus text exposition format.
+type requestCounter struct {
+	mu     sync.Mutex
+	counts map[counterKey]int64
+}
+
+type counterKey struct {
+	model   string
+	version string
+	code    int
+}
+
+func newRequestCounter() *requestCounter {
+	return &requestCounter{counts: make(map[counterKey]int64)}
+}
+
+func (c *requestCounter) inc(model, version string, code int) {
+	c.mu.Lock()
+	c.counts[counterKey{model, version, code}]++
+	c.mu.Unlock()
+}
+
+func (c *requestCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	keys := make([]counterKey, 0, len(c.counts))
+	for k := range c.counts {
+		keys = append(keys, k)
+	}
+	counts := make([]int64, len(keys))
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.model != b.model {
+			return a.model < b.model
+		}
+		if a.version != b.version {
+			return a.version < b.version
+		}
+		return a.code < b.code
+	})
+	for i, k := range keys {
+		counts[i] = c.counts[k]
+	}
+	c.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP rf_requests_total Requests by model, version and response status.\n")
+	fmt.Fprintf(w, "# TYPE rf_requests_total counter\n")
+	for i, k := range keys {
+		fmt.Fprintf(w, "rf_requests_total{model=\"%s\",version=\"%s\",code=\"%d\"} %d\n",
+			escapeLabel(k.model), escapeLabel(k.version), k.code, counts[i])
+	}
+}
+
+// counted returns a handler that counts the requests to h for the model and
+// version
+func counted(h http.Handler, c *requestCounter, model, version string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		c.inc(model, version, rec.code)
+	})
+}
+
+// statusRecorder records the status code written to a ResponseWriter
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes a Prometheus label value
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
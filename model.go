@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/csv"
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"sort"
 	"strconv"
 	"time"
@@ -14,38 +16,200 @@ import (
 
 //TODO: consider moving this to rf/forest
 
+// errOnlineSparse is returned when sparse input is used with an online model
+var errOnlineSparse = errors.New("online models don't support sparse (LIBSVM) input")
+
+// errOnlineWeights is returned when example weights are used with an online model
+var errOnlineWeights = errors.New("online models don't support --weight")
+
+// errNoOOB is returned for out of bag estimates of a forest without them
+var errNoOOB = errors.New("out of bag estimates are not available, no trees were fit")
+
+// errNoTrees is returned when saving a model without trees
+var errNoTrees = errors.New("the model has no trees")
+
 type Model struct {
 	IsRegression bool
+	IsOnline     bool
 	Clf          *forest.Classifier
 	Reg          *forest.Regressor
+	OnlineClf    *forest.MondrianClassifier
+	OnlineReg    *forest.MondrianRegressor
 	VarNames     []string
+	Target       string    // name of the target column, "" if the data had no header
+	Pipeline     *Pipeline // encodes csv columns as VarNames, nil for numeric columns
 	fitTime      time.Duration
 	opt          modelOptions
 	nSample      int
 }
 
+// newClassifier returns a random forest classifier configured from o
+func (o modelOptions) newClassifier() *forest.Classifier {
+	clf := forest.NewClassifier(forest.NumTrees(o.nTree), forest.MinSplit(o.minSplit),
+		forest.MinLeaf(o.minLeaf), forest.MaxFeatures(o.maxFeatures), forest.Impurity(o.impurity),
+		forest.NumWorkers(o.nWorkers), forest.ComputeOOB, forest.Calibrate(o.calibration))
+	if o.earlyStop > 0 {
+		forest.EarlyStopping(o.earlyStop, o.stopTol)(clf)
+	}
+	if o.seed != 0 {
+		forest.RandState(o.seed)(clf)
+	}
+	if o.maxFitTime > 0 {
+		forest.MaxFitTime(o.maxFitTime)(clf)
+	}
+	return clf
+}
+
+// newRegressor returns a random forest regressor configured from o
+func (o modelOptions) newRegressor() *forest.Regressor {
+	reg := forest.NewRegressor(forest.NumTrees(o.nTree), forest.MinSplit(o.minSplit),
+		forest.MinLeaf(o.minLeaf), forest.MaxFeatures(o.maxFeatures),
+		forest.NumWorkers(o.nWorkers), forest.ComputeOOB)
+	if o.keepInBag {
+		forest.KeepInBag(reg)
+	}
+	if o.earlyStop > 0 {
+		forest.EarlyStopping(o.earlyStop, o.stopTol)(reg)
+	}
+	if o.seed != 0 {
+		forest.RandState(o.seed)(reg)
+	}
+	if o.maxFitTime > 0 {
+		forest.MaxFitTime(o.maxFitTime)(reg)
+	}
+	return reg
+}
+
 func (m *Model) Fit(d *parsedInput, opt modelOptions) {
-	start := time.Now()
-	if d.isRegression {
-		reg := forest.NewRegressor(forest.NumTrees(opt.nTree), forest.MinSplit(opt.minSplit),
-			forest.MinLeaf(opt.minLeaf), forest.MaxFeatures(opt.maxFeatures),
-			forest.NumWorkers(opt.nWorkers), forest.ComputeOOB)
+	m.FitContext(context.Background(), d, opt, nil)
+}
+
+// FitContext fits the model as Fit, progress is called after each tree is
+// added unless nil. If ctx is done before all trees are fit, the model is
+// made of the trees fit so far and ctx.Err() is returned. Online models
+// ignore ctx and progress.
+func (m *Model) FitContext(ctx context.Context, d *parsedInput, opt modelOptions, progress func(forest.FitProgress)) error {
+	if opt.online && d.Sparse != nil {
+		return errOnlineSparse
+	}
+	if opt.online && d.Weights != nil {
+		return errOnlineWeights
+	}
 
-		reg.Fit(d.X, d.YReg)
+	var err error
+	start := time.Now()
+	X := d.dataset()
+	if d.Sparse != nil {
+		// split search reads whole features
+		X = d.Sparse.ToCSC()
+	}
+	if opt.online {
+		m.IsOnline = true
+		if d.isRegression {
+			m.OnlineReg = forest.NewMondrianRegressor(forest.NumTrees(opt.nTree),
+				forest.Lifetime(opt.lifetime), forest.NumWorkers(opt.nWorkers))
+			m.IsRegression = true
+			if opt.seed != 0 {
+				forest.RandState(opt.seed)(m.OnlineReg)
+			}
+		} else {
+			m.OnlineClf = forest.NewMondrianClassifier(forest.NumTrees(opt.nTree),
+				forest.Lifetime(opt.lifetime), forest.NumWorkers(opt.nWorkers))
+			if opt.seed != 0 {
+				forest.RandState(opt.seed)(m.OnlineClf)
+			}
+		}
+		err = m.partialFit(d)
+	} else if d.isRegression {
+		reg := opt.newRegressor()
+		if progress != nil {
+			forest.Progress(progress)(reg)
+		}
+		if d.Weights != nil {
+			forest.SampleWeights(d.Weights)(reg)
+		}
+		err = reg.FitDatasetContext(ctx, X, d.YReg)
 		m.Reg = reg
 		m.IsRegression = true
+		opt.nTree = reg.NTrees // fewer with early stopping or a time limit
 	} else {
-		clf := forest.NewClassifier(forest.NumTrees(opt.nTree), forest.MinSplit(opt.minSplit),
-			forest.MinLeaf(opt.minLeaf), forest.MaxFeatures(opt.maxFeatures), forest.Impurity(opt.impurity),
-			forest.NumWorkers(opt.nWorkers), forest.ComputeOOB)
-
-		clf.Fit(d.X, d.YClf)
+		clf := opt.newClassifier()
+		if progress != nil {
+			forest.Progress(progress)(clf)
+		}
+		if d.Weights != nil {
+			forest.SampleWeights(d.Weights)(clf)
+		}
+		err = clf.FitDatasetContext(ctx, X, d.YClf)
 		m.Clf = clf
+		opt.nTree = clf.NTrees
 	}
 	m.fitTime = time.Since(start)
 	m.VarNames = d.VarNames
-	m.nSample = len(d.X)
+	m.Target = d.target
+	m.Pipeline = nil
+	if d.pipeline != nil && !d.pipeline.identity() {
+		m.Pipeline = d.pipeline
+	}
+	m.nSample = d.numRows()
 	m.opt = opt
+	return err
+}
+
+// PartialFit updates a previously fitted online model with the examples in d.
+// The number of trees and lifetime of the model are kept, only the number of
+// workers is taken from opt.
+func (m *Model) PartialFit(d *parsedInput, opt modelOptions) error {
+	if !m.IsOnline {
+		return errors.New("only online models can be updated, fit with --online")
+	}
+	if d.isRegression != m.IsRegression {
+		return errors.New("model type and data type don't match")
+	}
+	if d.Sparse != nil {
+		return errOnlineSparse
+	}
+	if d.Weights != nil {
+		return errOnlineWeights
+	}
+
+	start := time.Now()
+	if m.IsRegression {
+		forest.NumWorkers(opt.nWorkers)(m.OnlineReg)
+		opt.nTree = m.OnlineReg.NTrees
+	} else {
+		forest.NumWorkers(opt.nWorkers)(m.OnlineClf)
+		opt.nTree = m.OnlineClf.NTrees
+	}
+	if err := m.partialFit(d); err != nil {
+		return err
+	}
+	m.fitTime = time.Since(start)
+	m.nSample = d.numRows()
+	m.opt = opt
+	return nil
+}
+
+func (m *Model) partialFit(d *parsedInput) error {
+	if m.IsRegression {
+		return m.OnlineReg.PartialFit(d.X, d.YReg)
+	}
+	return m.OnlineClf.PartialFit(d.X, d.YClf)
+}
+
+// setWorkers sets the number of workers used to predict with a loaded model,
+// the setting isn't saved with the model.
+func (m *Model) setWorkers(n int) {
+	switch {
+	case m.OnlineClf != nil:
+		forest.NumWorkers(n)(m.OnlineClf)
+	case m.OnlineReg != nil:
+		forest.NumWorkers(n)(m.OnlineReg)
+	case m.Clf != nil:
+		forest.NumWorkers(n)(m.Clf)
+	case m.Reg != nil:
+		forest.NumWorkers(n)(m.Reg)
+	}
 }
 
 func (m *Model) Predict(d *parsedInput) ([]string, error) {
@@ -57,16 +221,23 @@ func (m *Model) Predict(d *parsedInput) ([]string, error) {
 	// 	return pStr, errors.New("model type and datatype don't match")
 	// }
 
-	pStr = make([]string, len(d.X))
+	pStr = make([]string, d.numRows())
+
+	if m.IsOnline {
+		if d.Sparse != nil {
+			return nil, errOnlineSparse
+		}
+		return m.predictOnline(d), nil
+	}
 
 	if m.IsRegression {
-		pNum := m.Reg.Predict(d.X)
+		pNum := m.Reg.PredictDataset(d.dataset())
 
 		for i, v := range pNum {
 			pStr[i] = strconv.FormatFloat(v, 'f', -1, 64)
 		}
 	} else {
-		pID := m.Clf.Predict(d.X)
+		pID := m.Clf.PredictDataset(d.dataset())
 
 		for i, id := range pID {
 			pStr[i] = m.Clf.Classes[id]
@@ -76,6 +247,60 @@ func (m *Model) Predict(d *parsedInput) ([]string, error) {
 	return pStr, nil
 }
 
+// PredictStd returns the standard deviation of the regression prediction for
+// each example. method is one of trees (spread of the tree predictions), ij
+// (infinitesimal jackknife) or jackknife (jackknife-after-bootstrap).
+func (m *Model) PredictStd(d *parsedInput, method string) ([]float64, error) {
+	if !m.IsRegression || m.IsOnline {
+		return nil, errors.New("standard deviations are only available for regression forests")
+	}
+	if d.Sparse != nil {
+		return nil, errors.New("standard deviations are not available for sparse input")
+	}
+
+	var (
+		variance []float64
+		err      error
+	)
+
+	switch method {
+	case "trees":
+		_, std := m.Reg.PredictWithStd(d.X)
+		return std, nil
+	case "ij":
+		variance, err = m.Reg.PredictVariance(d.X, forest.InfinitesimalJackknife)
+	case "jackknife":
+		variance, err = m.Reg.PredictVariance(d.X, forest.JackknifeAfterBootstrap)
+	default:
+		return nil, errors.New("invalid std option, choices are trees, ij or jackknife")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	std := make([]float64, len(variance))
+	for i, v := range variance {
+		std[i] = math.Sqrt(v)
+	}
+	return std, nil
+}
+
+func (m *Model) predictOnline(d *parsedInput) []string {
+	pStr := make([]string, len(d.X))
+
+	if m.IsRegression {
+		for i, v := range m.OnlineReg.Predict(d.X) {
+			pStr[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	} else {
+		for i, id := range m.OnlineClf.Predict(d.X) {
+			pStr[i] = m.OnlineClf.Classes[id]
+		}
+	}
+
+	return pStr
+}
+
 func (m *Model) Report(w io.Writer) {
 	// generic stuff
 	fmt.Fprintf(w, "Fit %d trees using %d examples in %.2f seconds\n",
@@ -84,7 +309,9 @@ func (m *Model) Report(w io.Writer) {
 
 	m.ReportVarImp(w, 20)
 
-	if m.IsRegression {
+	if m.IsOnline {
+		m.reportOnline(w)
+	} else if m.IsRegression {
 		m.reportReg(w)
 	} else {
 		m.reportClf(w)
@@ -92,29 +319,77 @@ func (m *Model) Report(w io.Writer) {
 }
 
 func (m *Model) reportClf(w io.Writer) {
-	fmt.Fprintf(w, "Confusion Matrix\n")
-	fmt.Fprintf(w, "----------------\n")
-	// print confusion matrix
+	if m.Clf.OOBMetrics == nil {
+		fmt.Fprintf(w, "%s\n", errNoOOB)
+		return
+	}
+	reportClassMetrics(w, m.Clf.Classes, m.Clf.OOBMetrics)
+	m.reportCalibration(w)
+}
+
+// reportClassMetrics writes the confusion matrix and classification metrics
+// in cm, classes maps class ids to labels.
+func reportClassMetrics(w io.Writer, classes []string, cm *forest.ClassMetrics) {
+	fmt.Fprintf(w, "Confusion Matrix (rows: actual, columns: predicted)\n")
+	fmt.Fprintf(w, "---------------------------------------------------\n")
 	// headers
 	fmt.Fprintf(w, "%-14s ", "")
-	for _, class := range m.Clf.Classes {
+	for _, class := range classes {
 		fmt.Fprintf(w, "%-14s ", class)
 	}
 	fmt.Fprintf(w, "\n")
 
 	// rows
-	for predictedID, class := range m.Clf.Classes {
+	for actualID, class := range classes {
 		fmt.Fprintf(w, "%-14s ", class)
 
-		for actualID := range m.Clf.Classes {
-			fmt.Fprintf(w, "%-14d ", m.Clf.ConfusionMatrix[actualID][predictedID])
+		for predictedID := range classes {
+			fmt.Fprintf(w, "%-14d ", cm.ConfusionMatrix[actualID][predictedID])
 		}
 
 		fmt.Fprintf(w, "\n")
 	}
+	fmt.Fprintf(w, "\n")
 
+	fmt.Fprintf(w, "%-14s %-14s %-14s %-14s %-14s\n", "", "Precision", "Recall", "F1", "Support")
+	for id, class := range classes {
+		fmt.Fprintf(w, "%-14s %-14.3f %-14.3f %-14.3f %-14d\n",
+			class, cm.Precision[id], cm.Recall[id], cm.F1[id], cm.Support[id])
+	}
+	fmt.Fprintf(w, "%-14s %-14.3f %-14.3f %-14.3f\n",
+		"macro avg", cm.MacroPrecision, cm.MacroRecall, cm.MacroF1)
+	fmt.Fprintf(w, "%-14s %-14.3f %-14.3f %-14.3f\n",
+		"weighted avg", cm.WeightedPrecision, cm.WeightedRecall, cm.WeightedF1)
 	fmt.Fprintf(w, "\n")
-	fmt.Fprintf(w, "Overall Accuracy: %.2f%%\n", 100.0*m.Clf.Accuracy)
+
+	fmt.Fprintf(w, "Overall Accuracy: %.2f%%\n", 100.0*cm.Accuracy)
+	fmt.Fprintf(w, "Cohen's Kappa: %.3f\n", cm.Kappa)
+	fmt.Fprintf(w, "Log Loss: %.4f\n", cm.LogLoss)
+	if len(classes) == 2 {
+		fmt.Fprintf(w, "ROC AUC (positive class %s): %.4f\n", classes[1], cm.ROCAUC)
+		fmt.Fprintf(w, "PR AUC (positive class %s): %.4f\n", classes[1], cm.PRAUC)
+	}
+}
+
+func (m *Model) reportCalibration(w io.Writer) {
+	fmt.Fprintf(w, "\n")
+	if m.Clf.Calibrator != nil {
+		fmt.Fprintf(w, "Brier Score (calibrated): %.4f\n", m.Clf.Brier)
+	} else {
+		fmt.Fprintf(w, "Brier Score: %.4f\n", m.Clf.Brier)
+	}
+	fmt.Fprintf(w, "\n")
+
+	fmt.Fprintf(w, "Reliability\n")
+	fmt.Fprintf(w, "-----------\n")
+	fmt.Fprintf(w, "%-14s %-14s %-14s %-14s\n", "Bin", "Mean Prob", "Frac Positive", "Count")
+	for _, b := range m.Clf.Reliability {
+		if b.Count == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%-14s %-14.3f %-14.3f %-14d\n",
+			fmt.Sprintf("[%.1f, %.1f)", b.Lower, b.Upper), b.MeanProb, b.FracPos, b.Count)
+	}
 }
 
 func (m *Model) reportReg(w io.Writer) {
@@ -123,7 +398,25 @@ func (m *Model) reportReg(w io.Writer) {
 	fmt.Fprintf(w, "R-Squared: %.3f%%\n", 100*m.Reg.RSquared)
 }
 
+func (m *Model) reportOnline(w io.Writer) {
+	nSample := 0
+	if m.IsRegression {
+		nSample = m.OnlineReg.NSample
+	} else {
+		nSample = m.OnlineClf.NSample
+	}
+	fmt.Fprintf(w, "Online forest fit using %d examples in total\n", nSample)
+	fmt.Fprintf(w, "No out of bag estimates are available for online forests\n")
+}
+
 func (m *Model) VarImp() []float64 {
+	if m.IsOnline {
+		if m.IsRegression {
+			return m.OnlineReg.VarImp()
+		}
+		return m.OnlineClf.VarImp()
+	}
+
 	if m.IsRegression {
 		return m.Reg.VarImp()
 	} else {
@@ -145,6 +438,118 @@ func (m *Model) SaveVarImp(w io.Writer) error {
 	return nil
 }
 
+// SaveOOBCurve writes the out of bag error (MSE for regression) of the first
+// n trees for each n as csv.
+func (m *Model) SaveOOBCurve(w io.Writer) error {
+	if m.IsOnline {
+		return errors.New("no out of bag estimates are available for online forests")
+	}
+
+	var curve []float64
+	header := []string{"trees", "mse"}
+	if m.IsRegression {
+		curve = m.Reg.OOBCurve
+	} else {
+		curve = m.Clf.OOBCurve
+		header[1] = "error_rate"
+	}
+
+	writer := csv.NewWriter(w)
+	err := writer.Write(header)
+	if err != nil {
+		return err
+	}
+
+	for i, v := range curve {
+		err = writer.Write([]string{strconv.Itoa(i + 1), strconv.FormatFloat(v, 'f', -1, 64)})
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// SaveOOBPred writes the out of bag prediction for each example in d, the
+// data used to fit the model, as csv. Each row has the actual and predicted
+// label/value, the class probabilities (classification) and the number of
+// trees the example was out of bag for. Examples that were never out of bag
+// have a blank prediction.
+func (m *Model) SaveOOBPred(w io.Writer, d *parsedInput) error {
+	if m.IsOnline {
+		return errors.New("out of bag predictions are not available for online models")
+	}
+
+	if m.IsRegression {
+		if m.Reg.OOBPred == nil {
+			return errNoOOB
+		}
+		return writeRegPred(w, d.YReg, m.Reg.OOBPred, m.Reg.OOBCount, "n_trees")
+	}
+	if m.Clf.OOBProb == nil {
+		return errNoOOB
+	}
+	return writeClassPred(w, m.Clf.Classes, d.YClf, m.Clf.OOBProb, m.Clf.OOBCount, "n_trees")
+}
+
+// writeRegPred writes the actual and predicted values for each example as
+// csv, count is the number of trees (or folds) the prediction is from and is
+// written in the countName column. Predictions with a zero count are blank.
+func writeRegPred(w io.Writer, actual []float64, pred []float64, count []int, countName string) error {
+	writer := csv.NewWriter(w)
+
+	err := writer.Write([]string{"actual", "predicted", countName})
+	if err != nil {
+		return err
+	}
+
+	for i, y := range actual {
+		p := ""
+		if count[i] > 0 {
+			p = strconv.FormatFloat(pred[i], 'f', -1, 64)
+		}
+		err := writer.Write([]string{strconv.FormatFloat(y, 'f', -1, 64), p, strconv.Itoa(count[i])})
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// writeClassPred writes the actual and most probable label for each example
+// as csv, followed by the class probabilities and count as in writeRegPred.
+func writeClassPred(w io.Writer, classes []string, actual []string, prob [][]float64, count []int, countName string) error {
+	writer := csv.NewWriter(w)
+
+	header := append([]string{"actual", "predicted"}, classes...)
+	err := writer.Write(append(header, countName))
+	if err != nil {
+		return err
+	}
+
+	for i, y := range actual {
+		row := []string{y, ""}
+		maxP := 0.0
+		for class, p := range prob[i] {
+			if p > maxP {
+				maxP = p
+				row[1] = classes[class]
+			}
+			row = append(row, strconv.FormatFloat(p, 'f', -1, 64))
+		}
+		err := writer.Write(append(row, strconv.Itoa(count[i])))
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
 func (m *Model) ReportVarImp(w io.Writer, maxVars int) {
 	fmt.Fprintf(w, "Variable Importance\n")
 	fmt.Fprintf(w, "-------------------\n")
@@ -166,16 +571,6 @@ func (m *Model) ReportVarImp(w io.Writer, maxVars int) {
 	fmt.Fprintf(w, "\n")
 }
 
-func (m *Model) Load(r io.Reader) error {
-	d := gob.NewDecoder(r)
-	return d.Decode(m)
-}
-
-func (m *Model) Save(w io.Writer) error {
-	e := gob.NewEncoder(w)
-	return e.Encode(m)
-}
-
 type varImpSort struct {
 	varName []string
 	imp     []float64
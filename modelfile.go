@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/wlattner/rf/forest"
+	"github.com/wlattner/rf/tree"
+
+	flag "github.com/docker/docker/pkg/mflag"
+)
+
+var modelFormat = flag.String([]string{"-model_format"}, formatBinary, "format for saving models, binary, json or gob (readable by versions of rf before json)")
+
+// Model file formats. The json format is documented in README.md, the binary
+// format is the json format compressed with gzip. gob is the format used
+// before json, it can't be read outside of Go and breaks when the model
+// structs change.
+const (
+	formatBinary = "binary"
+	formatJSON   = "json"
+	formatGob    = "gob"
+)
+
+const (
+	// modelFileFormat identifies rf models in the json format
+	modelFileFormat = "rf-model"
+	// modelSchemaVersion is the version of the json format written by Save,
+	// it is incremented with any change that older versions can't read.
+	// Version 2 added the pipeline, models without one are written as
+	// version 1.
+	modelSchemaVersion = 2
+)
+
+// modelHeader is read first to check the format and version of a json model
+// before decoding the rest
+type modelHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+// modelJSON is the json form of a Model, exactly one of the forests is set
+type modelJSON struct {
+	modelHeader
+	Type             string                     `json:"type"` // classification or regression
+	Online           bool                       `json:"online"`
+	Features         []string                   `json:"features"`
+	Target           string                     `json:"target,omitempty"`
+	FitTime          tree.Float                 `json:"fit_time"` // seconds
+	NSample          int                        `json:"n_sample"` // examples in the last fit or update
+	Pipeline         *Pipeline                  `json:"pipeline,omitempty"`
+	Classifier       *forest.Classifier         `json:"classifier,omitempty"`
+	Regressor        *forest.Regressor          `json:"regressor,omitempty"`
+	OnlineClassifier *forest.MondrianClassifier `json:"online_classifier,omitempty"`
+	OnlineRegressor  *forest.MondrianRegressor  `json:"online_regressor,omitempty"`
+}
+
+// Save writes the model in the binary format.
+func (m *Model) Save(w io.Writer) error {
+	return m.SaveFormat(w, formatBinary)
+}
+
+// SaveFormat writes the model in format, one of binary, json or gob. Models
+// without trees, from a fit stopped before any tree was fit, aren't saved.
+func (m *Model) SaveFormat(w io.Writer, format string) error {
+	if (m.Clf != nil && len(m.Clf.Trees) == 0) || (m.Reg != nil && len(m.Reg.Trees) == 0) {
+		return errNoTrees
+	}
+	switch format {
+	case formatGob:
+		return gob.NewEncoder(w).Encode(m)
+	case formatJSON:
+		return m.encodeJSON(w)
+	case formatBinary:
+		z := gzip.NewWriter(w)
+		if err := m.encodeJSON(z); err != nil {
+			return err
+		}
+		return z.Close()
+	}
+	return fmt.Errorf("unknown model format %q, choices are binary, json or gob", format)
+}
+
+func (m *Model) encodeJSON(w io.Writer) error {
+	mj := modelJSON{
+		modelHeader: modelHeader{Format: modelFileFormat, Version: 1},
+		Type:        "classification",
+		Online:      m.IsOnline,
+		Features:    m.VarNames,
+		Target:      m.Target,
+		FitTime:     tree.Float(m.fitTime.Seconds()),
+		NSample:     m.nSample,
+		Pipeline:    m.Pipeline,
+	}
+	if m.Pipeline != nil {
+		mj.Version = modelSchemaVersion
+	}
+	if m.IsRegression {
+		mj.Type = "regression"
+	}
+	switch {
+	case m.OnlineClf != nil:
+		mj.OnlineClassifier = m.OnlineClf
+	case m.OnlineReg != nil:
+		mj.OnlineRegressor = m.OnlineReg
+	case m.Clf != nil:
+		mj.Classifier = m.Clf
+	case m.Reg != nil:
+		mj.Regressor = m.Reg
+	}
+	return json.NewEncoder(w).Encode(mj)
+}
+
+// Load reads a model saved by Save or SaveFormat, the format is detected
+// from the first bytes. Models saved with gob by versions of rf before the
+// json format are migrated as they are read.
+func (m *Model) Load(r io.Reader) error {
+	br := bufio.NewReader(r)
+	start, _ := br.Peek(512)
+
+	switch detectModelFormat(start) {
+	case formatBinary:
+		z, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer z.Close()
+		return m.decodeJSON(z)
+	case formatJSON:
+		return m.decodeJSON(br)
+	}
+
+	if err := gob.NewDecoder(br).Decode(m); err != nil {
+		return err
+	}
+	m.migrateGob()
+	return nil
+}
+
+// detectModelFormat returns the format of a model file starting with start
+func detectModelFormat(start []byte) string {
+	switch {
+	case bytes.HasPrefix(start, []byte{0x1f, 0x8b}): // gzip
+		return formatBinary
+	case bytes.HasPrefix(bytes.TrimSpace(start), []byte("{")):
+		return formatJSON
+	}
+	return formatGob
+}
+
+func (m *Model) decodeJSON(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	// check the version before the rest of the model, which may be laid out
+	// differently in other versions
+	var h modelHeader
+	if err := json.Unmarshal(b, &h); err != nil {
+		return fmt.Errorf("invalid model file: %v", err)
+	}
+	if h.Format != modelFileFormat {
+		return errors.New("not an rf model file")
+	}
+	if h.Version < 1 || h.Version > modelSchemaVersion {
+		return fmt.Errorf("model file version %d isn't supported, this version of rf reads version %d", h.Version, modelSchemaVersion)
+	}
+
+	var mj modelJSON
+	if err := json.Unmarshal(b, &mj); err != nil {
+		return fmt.Errorf("invalid model file: %v", err)
+	}
+
+	*m = Model{
+		IsRegression: mj.Type == "regression",
+		IsOnline:     mj.Online,
+		VarNames:     mj.Features,
+		Target:       mj.Target,
+		Pipeline:     mj.Pipeline,
+		fitTime:      time.Duration(float64(mj.FitTime) * float64(time.Second)),
+		nSample:      mj.NSample,
+	}
+	if mj.Type != "classification" && mj.Type != "regression" {
+		return fmt.Errorf("invalid model file: unknown model type %q", mj.Type)
+	}
+
+	// the forest has to match the model type
+	var nForests, nFeatures int
+	switch {
+	case m.IsOnline && m.IsRegression:
+		m.OnlineReg, nFeatures = mj.OnlineRegressor, len(mj.Features)
+	case m.IsOnline:
+		m.OnlineClf, nFeatures = mj.OnlineClassifier, len(mj.Features)
+	case m.IsRegression && mj.Regressor != nil:
+		m.Reg, nFeatures = mj.Regressor, mj.Regressor.NFeatures
+	case !m.IsRegression && mj.Classifier != nil:
+		m.Clf, nFeatures = mj.Classifier, mj.Classifier.NFeatures
+	}
+	for _, set := range []bool{mj.Classifier != nil, mj.Regressor != nil, mj.OnlineClassifier != nil, mj.OnlineRegressor != nil} {
+		if set {
+			nForests++
+		}
+	}
+	if nForests != 1 || (m.Clf == nil && m.Reg == nil && m.OnlineClf == nil && m.OnlineReg == nil) {
+		return fmt.Errorf("invalid model file: expected one %s forest", mj.Type)
+	}
+	if nFeatures != len(mj.Features) {
+		return fmt.Errorf("invalid model file: forest has %d features, expected %d", nFeatures, len(mj.Features))
+	}
+	if p := mj.Pipeline; p != nil {
+		if err := p.check(); err != nil {
+			return fmt.Errorf("invalid model file: %v", err)
+		}
+		if n := len(p.Features()); n != len(mj.Features) {
+			return fmt.Errorf("invalid model file: pipeline writes %d features, expected %d", n, len(mj.Features))
+		}
+	}
+	return nil
+}
+
+// migrateGob fills in what models saved with gob before the json format
+// lost, the number of features wasn't saved with forests or trees. The fit
+// time can't be recovered.
+func (m *Model) migrateGob() {
+	n := len(m.VarNames)
+	switch {
+	case m.Clf != nil:
+		if m.Clf.NFeatures == 0 {
+			m.Clf.NFeatures = n
+			for _, t := range m.Clf.Trees {
+				t.NFeatures = n
+			}
+		}
+		m.nSample = m.Clf.NSample
+	case m.Reg != nil:
+		if m.Reg.NFeatures == 0 {
+			m.Reg.NFeatures = n
+			for _, t := range m.Reg.Trees {
+				t.NFeatures = n
+			}
+		}
+		m.nSample = m.Reg.NSample
+	}
+}
+
+// saveModel saves m to the file name in --model_format. The model is written
+// as in writeAtomic, so a reader such as serve --registry never sees a
+// partial model.
+func saveModel(m *Model, name string) error {
+	return writeAtomic(name, func(w io.Writer) error {
+		return m.SaveFormat(w, *modelFormat)
+	})
+}
+
+// writeAtomic calls fn with a temporary file that replaces the file name
+// once fn returns, the temporary file is removed if fn fails so name is
+// never left partially written.
+func writeAtomic(name string, fn func(io.Writer) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	err = fn(f)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// checkModelFormat returns an error unless --model_format is a valid format
+func checkModelFormat() error {
+	switch *modelFormat {
+	case formatBinary, formatJSON, formatGob:
+		return nil
+	}
+	return fmt.Errorf("unknown model format %q, choices are binary, json or gob", *modelFormat)
+}
+
+// runConvert rewrites the model in --final_model in --model_format, e.g. to
+// migrate a model saved with gob or to read a model outside of rf
+func runConvert() {
+	if err := checkModelFormat(); err != nil {
+		fatal(err.Error())
+	}
+
+	m, err := loadModel(*modelFile)
+	if err != nil {
+		fatal("error opening model file", err.Error())
+	}
+
+	err = saveModel(m, *modelFile)
+	if err != nil {
+		fatal("error saving model", err.Error())
+	}
+}
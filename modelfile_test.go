@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wlattner/rf/forest"
+)
+
+// roundTrip saves m in format and loads it back
+func roundTrip(t *testing.T, m *Model, format string) *Model {
+	var buf bytes.Buffer
+	if err := m.SaveFormat(&buf, format); err != nil {
+		t.Fatalf("unexpected error saving %s model: %v", format, err)
+	}
+	loaded := new(Model)
+	if err := loaded.Load(&buf); err != nil {
+		t.Fatalf("unexpected error loading %s model: %v", format, err)
+	}
+	return loaded
+}
+
+func TestModelFormats(t *testing.T) {
+	iris, err := parseCSV(strings.NewReader(irisCSV), false)
+	if err != nil {
+		t.Fatal("unexpected error parsing iris data:", err)
+	}
+	boston, err := parseCSV(strings.NewReader(bostonCSV), false)
+	if err != nil {
+		t.Fatal("unexpected error parsing boston data:", err)
+	}
+
+	opt := modelOptions{nTree: 5, minSplit: 2, minLeaf: 1, maxFeatures: -1, nWorkers: 1, seed: 1, lifetime: -1}
+	calibrated := opt
+	calibrated.calibration = forest.Isotonic
+	inBag := opt
+	inBag.keepInBag = true
+	online := opt
+	online.online = true
+
+	for _, tc := range []struct {
+		name string
+		d    *parsedInput
+		opt  modelOptions
+	}{
+		{"classifier", iris, calibrated},
+		{"regressor", boston, inBag},
+		{"online classifier", iris, online},
+		{"online regressor", boston, online},
+	} {
+		m := new(Model)
+		m.Fit(tc.d, tc.opt)
+		m.fitTime = 1500 * time.Millisecond
+		want, _ := m.Predict(tc.d)
+
+		for _, format := range []string{formatBinary, formatJSON, formatGob} {
+			loaded := roundTrip(t, m, format)
+
+			got, err := loaded.Predict(tc.d)
+			if err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("%s %s: expected the same predictions after loading, got: %v %v", tc.name, format, got, err)
+			}
+			if imp := loaded.VarImp(); len(imp) != len(m.VarNames) {
+				t.Errorf("%s %s: expected importance for %d features, got: %v", tc.name, format, len(m.VarNames), imp)
+			}
+			if format != formatGob && (loaded.fitTime != m.fitTime || loaded.nSample != m.nSample) {
+				t.Errorf("%s %s: expected fit time and examples to be kept, got: %v %d", tc.name, format, loaded.fitTime, loaded.nSample)
+			}
+		}
+	}
+
+	// online models can be updated after loading
+	m := new(Model)
+	m.Fit(iris, online)
+	loaded := roundTrip(t, m, formatJSON)
+	if err := loaded.PartialFit(iris, online); err != nil || loaded.OnlineClf.NSample != 2*len(iris.YClf) {
+		t.Error("expected an online model to be updated after loading, got:", err)
+	}
+
+	// the regressor keeps its bootstrap counts for the standard deviation
+	m = new(Model)
+	m.Fit(boston, inBag)
+	loaded = roundTrip(t, m, formatBinary)
+	want, _ := m.PredictStd(boston, "ij")
+	got, err := loaded.PredictStd(boston, "ij")
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the same standard deviations after loading, got: %v %v", got, err)
+	}
+}
+
+func TestModelGobMigration(t *testing.T) {
+	d, err := parseCSV(strings.NewReader(bostonCSV), false)
+	if err != nil {
+		t.Fatal("unexpected error parsing boston data:", err)
+	}
+	m := new(Model)
+	m.Fit(d, modelOptions{nTree: 5, minSplit: 2, minLeaf: 1, maxFeatures: -1, nWorkers: 1, seed: 1})
+	want := m.VarImp()
+
+	// models saved before the json format didn't keep the number of features
+	m.Reg.NFeatures = 0
+	for _, tree := range m.Reg.Trees {
+		tree.NFeatures = 0
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(m); err != nil {
+		t.Fatal("unexpected error saving gob model:", err)
+	}
+
+	loaded := new(Model)
+	if err := loaded.Load(&buf); err != nil {
+		t.Fatal("unexpected error loading gob model:", err)
+	}
+	if got := loaded.VarImp(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected variable importance %v after migrating, got: %v", want, got)
+	}
+	if loaded.nSample != len(d.YReg) {
+		t.Errorf("expected %d examples after migrating, got: %d", len(d.YReg), loaded.nSample)
+	}
+}
+
+func TestModelFileErrors(t *testing.T) {
+	d, err := parseCSV(strings.NewReader(irisCSV), false)
+	if err != nil {
+		t.Fatal("unexpected error parsing iris data:", err)
+	}
+	m := new(Model)
+	m.Fit(d, modelOptions{nTree: 2, minSplit: 2, minLeaf: 1, maxFeatures: -1, nWorkers: 1, seed: 1})
+	var buf bytes.Buffer
+	if err := m.SaveFormat(&buf, formatJSON); err != nil {
+		t.Fatal("unexpected error saving model:", err)
+	}
+	valid := buf.String()
+
+	for _, tc := range []struct {
+		name, file, msg string
+	}{
+		{"newer version", strings.Replace(valid, `"version":1`, `"version":3`, 1), "version 3 isn't supported"},
+		{"other format", strings.Replace(valid, `"rf-model"`, `"other"`, 1), "not an rf model"},
+		{"wrong forest", strings.Replace(valid, `"type":"classification"`, `"type":"regression"`, 1), "expected one regression forest"},
+		{"missing tree", strings.Replace(valid, `"n_trees":2`, `"n_trees":3`, 1), "forest has 2 trees, expected 3"},
+		{"cycle", strings.Replace(valid, `"left":[1,`, `"left":[0,`, 1), "invalid children"},
+		{"bad feature", strings.Replace(valid, `"n_features":4`, `"n_features":1`, -1), "invalid feature"},
+	} {
+		err := new(Model).Load(strings.NewReader(tc.file))
+		if err == nil || !strings.Contains(err.Error(), tc.msg) {
+			t.Errorf("%s: expected an error with %q, got: %v", tc.name, tc.msg, err)
+		}
+	}
+
+	if err := m.SaveFormat(new(bytes.Buffer), "xml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestModelNoTrees(t *testing.T) {
+	d, err := parseCSV(strings.NewReader(irisCSV), true)
+	if err != nil {
+		t.Fatal("unexpected error parsing iris data:", err)
+	}
+
+	// as rf -c --max_fit_time 1ns, the time is up before the first tree
+	m := new(Model)
+	err = m.FitContext(context.Background(), d, modelOptions{nTree: 10, minSplit: 2, minLeaf: 1, maxFeatures: -1,
+		nWorkers: 1, seed: 1, maxFitTime: time.Nanosecond}, nil)
+	if err != forest.ErrNoTrees {
+		t.Fatal("expected ErrNoTrees fitting without time for a tree, got:", err)
+	}
+
+	dir, err := ioutil.TempDir("", "rf-model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "rf.model")
+	if err := saveModel(m, name); err != errNoTrees {
+		t.Error("expected an error saving a model without trees, got:", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected no files after refusing to save, got %d", len(files))
+	}
+
+	// the report and out of bag predictions don't need trees
+	var report bytes.Buffer
+	m.Report(&report)
+	if !strings.Contains(report.String(), "Fit 0 trees") {
+		t.Error("expected the report to show 0 trees, got:", report.String())
+	}
+	if err := m.SaveOOBPred(new(bytes.Buffer), d); err != errNoOOB {
+		t.Error("expected no out of bag predictions without trees, got:", err)
+	}
+}
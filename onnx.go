@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+
+	"github.com/wlattner/rf/tree"
+)
+
+// ONNX models are protocol buffers, the messages are encoded here with the
+// field numbers from onnx.proto rather than generated code. Only the fields
+// needed for a graph with a single TreeEnsembleClassifier or
+// TreeEnsembleRegressor node from the ai.onnx.ml domain are written. See
+// https://github.com/onnx/onnx/blob/main/onnx/onnx.proto and
+// https://github.com/onnx/onnx/blob/main/docs/Operators-ml.md
+
+const (
+	onnxIRVersion = 7
+	onnxOpset     = 13 // default domain, none of its operators are used
+	onnxMLDomain  = "ai.onnx.ml"
+	onnxMLOpset   = 1
+)
+
+// TensorProto.DataType
+const (
+	onnxTypeFloat  = 1
+	onnxTypeString = 8
+)
+
+// AttributeProto.AttributeType
+const (
+	onnxAttrInt     = 2
+	onnxAttrString  = 3
+	onnxAttrFloats  = 6
+	onnxAttrInts    = 7
+	onnxAttrStrings = 8
+)
+
+// protoBuf is a protocol buffer message being encoded
+type protoBuf []byte
+
+func (b *protoBuf) uvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	*b = append(*b, buf[:n]...)
+}
+
+func (b *protoBuf) tag(field, wireType int) {
+	b.uvarint(uint64(field<<3 | wireType))
+}
+
+// int writes an int32, int64 or enum field
+func (b *protoBuf) int(field int, v int64) {
+	b.tag(field, 0)
+	b.uvarint(uint64(v))
+}
+
+func (b *protoBuf) bytes(field int, v []byte) {
+	b.tag(field, 2)
+	b.uvarint(uint64(len(v)))
+	*b = append(*b, v...)
+}
+
+func (b *protoBuf) string(field int, s string) {
+	b.bytes(field, []byte(s))
+}
+
+// ints writes a repeated int64 field, packed
+func (b *protoBuf) ints(field int, v []int64) {
+	var p protoBuf
+	for _, x := range v {
+		p.uvarint(uint64(x))
+	}
+	b.bytes(field, p)
+}
+
+// floats writes a repeated float field, packed
+func (b *protoBuf) floats(field int, v []float32) {
+	p := make([]byte, 4*len(v))
+	for i, x := range v {
+		binary.LittleEndian.PutUint32(p[4*i:], math.Float32bits(x))
+	}
+	b.bytes(field, p)
+}
+
+// AttributeProto messages
+func onnxInt(name string, v int64) protoBuf {
+	var a protoBuf
+	a.string(1, name)
+	a.int(20, onnxAttrInt)
+	a.int(3, v)
+	return a
+}
+
+func onnxString(name, v string) protoBuf {
+	var a protoBuf
+	a.string(1, name)
+	a.int(20, onnxAttrString)
+	a.string(4, v)
+	return a
+}
+
+func onnxInts(name string, v []int64) protoBuf {
+	var a protoBuf
+	a.string(1, name)
+	a.int(20, onnxAttrInts)
+	a.ints(8, v)
+	return a
+}
+
+func onnxFloats(name string, v []float32) protoBuf {
+	var a protoBuf
+	a.string(1, name)
+	a.int(20, onnxAttrFloats)
+	a.floats(7, v)
+	return a
+}
+
+func onnxStrings(name string, v []string) protoBuf {
+	var a protoBuf
+	a.string(1, name)
+	a.int(20, onnxAttrStrings)
+	for _, s := range v {
+		a.string(9, s)
+	}
+	return a
+}
+
+// onnxTensorInfo returns a ValueInfoProto for a tensor, a dim less than 0 is
+// the number of examples, which isn't fixed
+func onnxTensorInfo(name string, elemType int, dims ...int) protoBuf {
+	var shape protoBuf
+	for _, d := range dims {
+		var dim protoBuf
+		if d < 0 {
+			dim.string(2, "N")
+		} else {
+			dim.int(1, int64(d))
+		}
+		shape.bytes(1, dim)
+	}
+
+	var tensor protoBuf
+	tensor.int(1, int64(elemType))
+	tensor.bytes(2, shape)
+
+	var typ protoBuf
+	typ.bytes(1, tensor)
+
+	var info protoBuf
+	info.string(1, name)
+	info.bytes(2, typ)
+	return info
+}
+
+// onnxEnsemble collects the nodes_* and leaf weight attributes of a tree
+// ensemble operator, the leaf weights are the class_* attributes of a
+// classifier or the target_* attributes of a regressor
+type onnxEnsemble struct {
+	treeIDs, nodeIDs, featureIDs []int64
+	trueIDs, falseIDs            []int64
+	modes                        []string
+	values                       []float32
+
+	weightTreeIDs, weightNodeIDs, weightIDs []int64
+	weights                                 []float32
+}
+
+// node adds a node of tree to the ensemble, nodes are numbered in depth
+// first order starting from *id. The index of the node is returned so the
+// children of a split can be filled in once they are numbered.
+func (e *onnxEnsemble) node(tree int, id *int) int {
+	e.treeIDs = append(e.treeIDs, int64(tree))
+	e.nodeIDs = append(e.nodeIDs, int64(*id))
+	e.featureIDs = append(e.featureIDs, 0)
+	e.trueIDs = append(e.trueIDs, 0)
+	e.falseIDs = append(e.falseIDs, 0)
+	e.modes = append(e.modes, "LEAF")
+	e.values = append(e.values, 0)
+	*id++
+	return len(e.nodeIDs) - 1
+}
+
+// split makes node i a split, examples go to the true (left) child when the
+// feature is less than or equal to the threshold
+func (e *onnxEnsemble) split(i, feature int, threshold float64, left, right int) {
+	e.modes[i] = "BRANCH_LEQ"
+	e.featureIDs[i] = int64(feature)
+	e.values[i] = roundDown32(threshold)
+	e.trueIDs[i] = e.nodeIDs[left]
+	e.falseIDs[i] = e.nodeIDs[right]
+}
+
+// weight adds a leaf weight for class or target id to node i
+func (e *onnxEnsemble) weight(i, id int, w float32) {
+	e.weightTreeIDs = append(e.weightTreeIDs, e.treeIDs[i])
+	e.weightNodeIDs = append(e.weightNodeIDs, e.nodeIDs[i])
+	e.weightIDs = append(e.weightIDs, int64(id))
+	e.weights = append(e.weights, w)
+}
+
+func (e *onnxEnsemble) nodeAttributes() []protoBuf {
+	return []protoBuf{
+		onnxInts("nodes_treeids", e.treeIDs),
+		onnxInts("nodes_nodeids", e.nodeIDs),
+		onnxInts("nodes_featureids", e.featureIDs),
+		onnxStrings("nodes_modes", e.modes),
+		onnxFloats("nodes_values", e.values),
+		onnxInts("nodes_truenodeids", e.trueIDs),
+		onnxInts("nodes_falsenodeids", e.falseIDs),
+	}
+}
+
+// roundDown32 returns the largest float32 that isn't greater than t, a
+// float32 x is less than or equal to it exactly when x <= t. Rounding t to the
+// nearest float32 could send x the other way. The operators compare float
+// inputs with float thresholds.
+func roundDown32(t float64) float32 {
+	f := float32(t)
+	if float64(f) > t {
+		f = math.Nextafter32(f, float32(math.Inf(-1)))
+	}
+	return f
+}
+
+func (e *onnxEnsemble) addClassNode(n *tree.Node, t, nTrees int, id *int) int {
+	i := e.node(t, id)
+	if !n.Leaf {
+		left := e.addClassNode(n.Left, t, nTrees, id)
+		right := e.addClassNode(n.Right, t, nTrees, id)
+		e.split(i, n.SplitVar, n.SplitVal, left, right)
+		return i
+	}
+
+	// the leaf votes for its most common class, as in tree.Classifier.Predict,
+	// every class gets a weight so the scores are the share of the votes
+	maxCt := 0
+	maxC := 0
+	for class, count := range n.ClassCounts {
+		if count > maxCt {
+			maxCt = count
+			maxC = class
+		}
+	}
+	for class := range n.ClassCounts {
+		var w float32
+		if class == maxC {
+			w = 1 / float32(nTrees)
+		}
+		e.weight(i, class, w)
+	}
+	return i
+}
+
+func (e *onnxEnsemble) addRegNode(n *tree.RegNode, t int, id *int) int {
+	i := e.node(t, id)
+	if !n.Leaf {
+		left := e.addRegNode(n.Left, t, id)
+		right := e.addRegNode(n.Right, t, id)
+		e.split(i, n.SplitVar, n.SplitVal, left, right)
+		return i
+	}
+	e.weight(i, 0, float32(n.Value))
+	return i
+}
+
+// WriteONNX writes the forest as an ONNX model with a single
+// TreeEnsembleClassifier or TreeEnsembleRegressor operator from the
+// ai.onnx.ml domain. The input X is a float tensor with a row for each
+// example and a column for each feature, in the order of VarNames.
+//
+// A classifier has the outputs label, the predicted class, and scores, the
+// share of the trees voting for each class in the order of Clf.Classes. The
+// predicted class is the class with the most votes as in Predict, the
+// probability calibration isn't included. A regressor has the output
+// prediction, the average of the trees. Online forests can't be exported.
+//
+// The operators compare float32 inputs with float32 thresholds, each
+// threshold is rounded down so float32 inputs go to the same side of every
+// split as in Predict.
+func (m *Model) WriteONNX(w io.Writer) error {
+	if m.IsOnline {
+		return errors.New("online models can't be exported to ONNX")
+	}
+	if m.Pipeline != nil {
+		return errExportPipeline("ONNX")
+	}
+
+	var e onnxEnsemble
+	var node protoBuf
+	var outputs []protoBuf
+	var attrs []protoBuf
+
+	if m.IsRegression {
+		for t, tr := range m.Reg.Trees {
+			e.addRegNode(tr.Root, t, new(int))
+		}
+		node.string(1, "X")
+		node.string(2, "prediction")
+		node.string(4, "TreeEnsembleRegressor")
+		outputs = append(outputs, onnxTensorInfo("prediction", onnxTypeFloat, -1, 1))
+		attrs = append(e.nodeAttributes(),
+			onnxInts("target_treeids", e.weightTreeIDs),
+			onnxInts("target_nodeids", e.weightNodeIDs),
+			onnxInts("target_ids", e.weightIDs),
+			onnxFloats("target_weights", e.weights),
+			onnxInt("n_targets", 1),
+			onnxString("aggregate_function", "AVERAGE"),
+			onnxString("post_transform", "NONE"),
+		)
+	} else {
+		for t, tr := range m.Clf.Trees {
+			e.addClassNode(tr.Root, t, len(m.Clf.Trees), new(int))
+		}
+		node.string(1, "X")
+		node.string(2, "label")
+		node.string(2, "scores")
+		node.string(4, "TreeEnsembleClassifier")
+		outputs = append(outputs,
+			onnxTensorInfo("label", onnxTypeString, -1),
+			onnxTensorInfo("scores", onnxTypeFloat, -1, len(m.Clf.Classes)))
+		attrs = append(e.nodeAttributes(),
+			onnxInts("class_treeids", e.weightTreeIDs),
+			onnxInts("class_nodeids", e.weightNodeIDs),
+			onnxInts("class_ids", e.weightIDs),
+			onnxFloats("class_weights", e.weights),
+			onnxStrings("classlabels_strings", m.Clf.Classes),
+			onnxString("post_transform", "NONE"),
+		)
+	}
+	node.string(3, "forest")
+	node.string(7, onnxMLDomain)
+	for _, a := range attrs {
+		node.bytes(5, a)
+	}
+
+	var graph protoBuf
+	graph.bytes(1, node)
+	graph.string(2, "rf")
+	graph.bytes(11, onnxTensorInfo("X", onnxTypeFloat, -1, len(m.VarNames)))
+	for _, o := range outputs {
+		graph.bytes(12, o)
+	}
+
+	var model protoBuf
+	model.int(1, onnxIRVersion)
+	model.string(2, "rf")
+	model.bytes(7, graph)
+	for _, opset := range []struct {
+		domain  string
+		version int64
+	}{{"", onnxOpset}, {onnxMLDomain, onnxMLOpset}} {
+		var o protoBuf
+		o.string(1, opset.domain)
+		o.int(2, opset.version)
+		model.bytes(8, o)
+	}
+
+	_, err := w.Write(model)
+	return err
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/wlattner/rf/tree"
+)
+
+// protoField is a field of a decoded protocol buffer message, v holds
+// varints and fixed width values, b the contents of length delimited fields
+type protoField struct {
+	num int
+	v   uint64
+	b   []byte
+}
+
+// decodeProto splits a protocol buffer message into its fields, independently
+// of the encoder used to write it
+func decodeProto(t *testing.T, b []byte) []protoField {
+	var fields []protoField
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatal("invalid field key")
+		}
+		b = b[n:]
+		f := protoField{num: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			f.v, n = binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatal("invalid varint")
+			}
+			b = b[n:]
+		case 1:
+			f.v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || int(l) > len(b)-n {
+				t.Fatal("invalid length")
+			}
+			f.b, b = b[n:n+int(l)], b[n+int(l):]
+		case 5:
+			f.v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		default:
+			t.Fatal("unexpected wire type", key&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func protoFields(fields []protoField, num int) []protoField {
+	var fs []protoField
+	for _, f := range fields {
+		if f.num == num {
+			fs = append(fs, f)
+		}
+	}
+	return fs
+}
+
+// protoMessage returns the single message in field num
+func protoMessage(t *testing.T, fields []protoField, num int) []protoField {
+	fs := protoFields(fields, num)
+	if len(fs) != 1 {
+		t.Fatalf("expected one field %d, got: %d", num, len(fs))
+	}
+	return decodeProto(t, fs[0].b)
+}
+
+func protoStrings(fields []protoField, num int) []string {
+	var s []string
+	for _, f := range protoFields(fields, num) {
+		s = append(s, string(f.b))
+	}
+	return s
+}
+
+// protoInts reads a repeated int64 field, packed or not
+func protoInts(t *testing.T, fields []protoField, num int) []int64 {
+	var v []int64
+	for _, f := range protoFields(fields, num) {
+		if f.b == nil {
+			v = append(v, int64(f.v))
+			continue
+		}
+		for b := f.b; len(b) > 0; {
+			x, n := binary.Uvarint(b)
+			if n <= 0 {
+				t.Fatal("invalid packed varint")
+			}
+			v, b = append(v, int64(x)), b[n:]
+		}
+	}
+	return v
+}
+
+// protoFloats reads a repeated float field, packed or not
+func protoFloats(fields []protoField, num int) []float32 {
+	var v []float32
+	for _, f := range protoFields(fields, num) {
+		if f.b == nil {
+			v = append(v, math.Float32frombits(uint32(f.v)))
+			continue
+		}
+		for b := f.b; len(b) >= 4; b = b[4:] {
+			v = append(v, math.Float32frombits(binary.LittleEndian.Uint32(b)))
+		}
+	}
+	return v
+}
+
+// testEnsemble is a tree ensemble operator read from an ONNX model
+type testEnsemble struct {
+	opType  string
+	inputs  []string
+	outputs []string
+	dims    []string // of the input
+	ints    map[string][]int64
+	floats  map[string][]float32
+	strings map[string][]string
+}
+
+func decodeONNX(t *testing.T, b []byte) *testEnsemble {
+	model := decodeProto(t, b)
+	var ml bool
+	for _, f := range protoFields(model, 8) {
+		if opset := decodeProto(t, f.b); protoStrings(opset, 1)[0] == "ai.onnx.ml" {
+			ml = true
+		}
+	}
+	if !ml {
+		t.Error("expected the ai.onnx.ml opset to be imported")
+	}
+
+	graph := protoMessage(t, model, 7)
+	node := protoMessage(t, graph, 1)
+	if domain := protoStrings(node, 7); len(domain) != 1 || domain[0] != "ai.onnx.ml" {
+		t.Error("expected an ai.onnx.ml operator, got:", domain)
+	}
+	e := &testEnsemble{
+		opType:  protoStrings(node, 4)[0],
+		inputs:  protoStrings(node, 1),
+		outputs: protoStrings(node, 2),
+		ints:    make(map[string][]int64),
+		floats:  make(map[string][]float32),
+		strings: make(map[string][]string),
+	}
+	for _, f := range protoFields(node, 5) {
+		attr := decodeProto(t, f.b)
+		name := protoStrings(attr, 1)[0]
+		e.ints[name] = append(protoInts(t, attr, 3), protoInts(t, attr, 8)...)
+		e.floats[name] = protoFloats(attr, 7)
+		e.strings[name] = append(protoStrings(attr, 4), protoStrings(attr, 9)...)
+	}
+
+	// X: ValueInfoProto > TypeProto > Tensor > TensorShapeProto > Dimension
+	shape := protoMessage(t, protoMessage(t, protoMessage(t, protoMessage(t, graph, 11), 2), 1), 2)
+	for _, f := range protoFields(shape, 1) {
+		dim := decodeProto(t, f.b)
+		if param := protoStrings(dim, 2); len(param) > 0 {
+			e.dims = append(e.dims, param[0])
+		} else {
+			e.dims = append(e.dims, strconv.FormatInt(protoInts(t, dim, 1)[0], 10))
+		}
+	}
+	return e
+}
+
+// score returns the sum of the leaf weights for each id over the trees
+func (e *testEnsemble) score(t *testing.T, prefix string, x []float32, nIDs int) []float32 {
+	type key struct{ tree, node int64 }
+	index := make(map[key]int)
+	for i := range e.ints["nodes_nodeids"] {
+		index[key{e.ints["nodes_treeids"][i], e.ints["nodes_nodeids"][i]}] = i
+	}
+	leaf := make(map[key]bool)
+	for tr := int64(0); ; tr++ {
+		i, ok := index[key{tr, 0}]
+		if !ok {
+			break
+		}
+		for e.strings["nodes_modes"][i] != "LEAF" {
+			if e.strings["nodes_modes"][i] != "BRANCH_LEQ" {
+				t.Fatal("unexpected node mode:", e.strings["nodes_modes"][i])
+			}
+			next := e.ints["nodes_falsenodeids"][i]
+			if x[e.ints["nodes_featureids"][i]] <= e.floats["nodes_values"][i] {
+				next = e.ints["nodes_truenodeids"][i]
+			}
+			i = index[key{tr, next}]
+		}
+		leaf[key{tr, e.ints["nodes_nodeids"][i]}] = true
+	}
+
+	s := make([]float32, nIDs)
+	for i, w := range e.floats[prefix+"_weights"] {
+		if leaf[key{e.ints[prefix+"_treeids"][i], e.ints[prefix+"_nodeids"][i]}] {
+			s[e.ints[prefix+"_ids"][i]] += w
+		}
+	}
+	return s
+}
+
+// float32Rows rounds X to float32, the input type of the operators
+func float32Rows(X [][]float64) ([][]float32, [][]float64) {
+	x32 := make([][]float32, len(X))
+	rounded := make([][]float64, len(X))
+	for i, row := range X {
+		x32[i] = make([]float32, len(row))
+		rounded[i] = make([]float64, len(row))
+		for j, v := range row {
+			x32[i][j] = float32(v)
+			rounded[i][j] = float64(float32(v))
+		}
+	}
+	return x32, rounded
+}
+
+func countNodes(n *tree.Node) int {
+	if n.Leaf {
+		return 1
+	}
+	return 1 + countNodes(n.Left) + countNodes(n.Right)
+}
+
+func countRegNodes(n *tree.RegNode) int {
+	if n.Leaf {
+		return 1
+	}
+	return 1 + countRegNodes(n.Left) + countRegNodes(n.Right)
+}
+
+func treeSizes(treeIDs []int64) map[int]int {
+	sizes := make(map[int]int)
+	for _, id := range treeIDs {
+		sizes[int(id)]++
+	}
+	return sizes
+}
+
+func TestONNXClassifier(t *testing.T) {
+	d, err := parseCSV(strings.NewReader(syntheticCSV(300, false)), false)
+	if err != nil {
+		t.Fatal("unexpected error parsing data:", err)
+	}
+	m := new(Model)
+	m.Fit(d, modelOptions{nTree: 15, minSplit: 2, minLeaf: 1, maxFeatures: -1, nWorkers: 1, seed: 1})
+
+	var buf bytes.Buffer
+	if err := m.WriteONNX(&buf); err != nil {
+		t.Fatal("unexpected error writing ONNX:", err)
+	}
+	e := decodeONNX(t, buf.Bytes())
+
+	if e.opType != "TreeEnsembleClassifier" {
+		t.Error("expected a TreeEnsembleClassifier, got:", e.opType)
+	}
+	if strings.Join(e.inputs, ",") != "X" || strings.Join(e.outputs, ",") != "label,scores" {
+		t.Errorf("expected X -> label, scores, got: %v -> %v", e.inputs, e.outputs)
+	}
+	if strings.Join(e.dims, ",") != "N,3" {
+		t.Error("expected input shape N, 3, got:", e.dims)
+	}
+	if strings.Join(e.strings["classlabels_strings"], ",") != strings.Join(m.Clf.Classes, ",") {
+		t.Error("expected the forest's classes, got:", e.strings["classlabels_strings"])
+	}
+	sizes := treeSizes(e.ints["nodes_treeids"])
+	if len(sizes) != len(m.Clf.Trees) {
+		t.Fatalf("expected %d trees, got: %d", len(m.Clf.Trees), len(sizes))
+	}
+	for i, tr := range m.Clf.Trees {
+		if want := countNodes(tr.Root); sizes[i] != want {
+			t.Errorf("tree %d: expected %d nodes, got: %d", i, want, sizes[i])
+		}
+	}
+
+	// the operator reads float32, the thresholds must give the same splits
+	x32, rounded := float32Rows(d.X)
+	for i, want := range m.Clf.Predict(rounded) {
+		scores := e.score(t, "class", x32[i], len(m.Clf.Classes))
+		got := 0
+		for c, s := range scores {
+			if s > scores[got] {
+				got = c
+			}
+		}
+		if got != want {
+			t.Errorf("example %d: expected class %d from ONNX, got: %d %v", i, want, got, scores)
+		}
+	}
+}
+
+func TestONNXRegressor(t *testing.T) {
+	d, err := parseCSV(strings.NewReader(syntheticCSV(300, true)), false)
+	if err != nil {
+		t.Fatal("unexpected error parsing data:", err)
+	}
+	m := new(Model)
+	m.Fit(d, modelOptions{nTree: 15, minSplit: 2, minLeaf: 1, maxFeatures: -1, nWorkers: 1, seed: 1})
+
+	var buf bytes.Buffer
+	if err := m.WriteONNX(&buf); err != nil {
+		t.Fatal("unexpected error writing ONNX:", err)
+	}
+	e := decodeONNX(t, buf.Bytes())
+
+	if e.opType != "TreeEnsembleRegressor" {
+		t.Error("expected a TreeEnsembleRegressor, got:", e.opType)
+	}
+	if strings.Join(e.strings["aggregate_function"], ",") != "AVERAGE" {
+		t.Error("expected the trees to be averaged, got:", e.strings["aggregate_function"])
+	}
+	sizes := treeSizes(e.ints["nodes_treeids"])
+	if len(sizes) != len(m.Reg.Trees) {
+		t.Fatalf("expected %d trees, got: %d", len(m.Reg.Trees), len(sizes))
+	}
+	for i, tr := range m.Reg.Trees {
+		if want := countRegNodes(tr.Root); sizes[i] != want {
+			t.Errorf("tree %d: expected %d nodes, got: %d", i, want, sizes[i])
+		}
+	}
+
+	x32, rounded := float32Rows(d.X)
+	for i, want := range m.Reg.Predict(rounded) {
+		got := float64(e.score(t, "target", x32[i], 1)[0]) / float64(len(sizes))
+		if math.Abs(got-want) > 1e-5*math.Max(1, math.Abs(want)) {
+			t.Errorf("example %d: expected %f from ONNX, got: %f", i, want, got)
+		}
+	}
+
+	m.IsOnline = true
+	if err := m.WriteONNX(new(bytes.Buffer)); err == nil {
+		t.Error("expected an error exporting an online model")
+	}
+}
+
+func TestONNXThreshold(t *testing.T) {
+	for _, v := range []float64{0, 1.5, 0.1, -0.1, 1e-40, 3.4e39, -2.7182818284590455} {
+		f := roundDown32(v)
+		if float64(f) > v || float64(math.Nextafter32(f, float32(math.Inf(1)))) <= v {
+			t.Errorf("expected the largest float32 not greater than %g, got: %g", v, f)
+		}
+	}
+}
@@ -1,30 +1,66 @@
 package main
 
 import (
+	"bufio"
 	"encoding/csv"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
+
+	"github.com/wlattner/rf/tree"
 )
 
 type parsedInput struct {
 	isRegression bool
 	X            [][]float64
+	Sparse       *tree.CSR // set instead of X for LIBSVM input
 	YClf         []string  // will be nil when isRegression = true
 	YReg         []float64 // will be nil when isRegression = false
 	VarNames     []string
+	target       string       // name of the target column, "" without a header
+	Groups       []string     // will be nil without parseOptions.groupCol
+	IDs          [][]string   // values of the id columns of each example, nil without parseOptions.idCols
+	Weights      []float64    // will be nil without parseOptions.weightCol
+	layout       *csvLayout   // role of each field of the csv rows
+	pipeline     *Pipeline    // encodes the feature columns of csv rows
+	cols         []*rawColumn // feature columns read before the pipeline is fit
+}
+
+type parseOptions struct {
+	forceClf    bool          // use labels for classification
+	groupCol    string        // name of the column with group ids, not used as a feature
+	targetCol   string        // name of the target column, the first column if empty
+	modelTarget string        // name of the target saved with the model, used when targetCol is empty
+	idCols      []string      // names of columns passed through to predictions, not used as features
+	ignore      []string      // names of columns that aren't used
+	weightCol   string        // name of the column with example weights, not used as a feature
+	encode      encodeOptions // how the pipeline is fit
+	pipeline    *Pipeline     // encode with a fitted pipeline instead of fitting one
 }
 
 // parse csv file, detect if first row is header/has var names,
 // returns X, Y, varNames, error
 func parseCSV(r io.Reader, forceClf bool) (*parsedInput, error) {
+	return parseCSVOpts(r, parseOptions{forceClf: forceClf})
+}
+
+// parseCSVOpts parses a csv file as in parseCSV using the options in opt.
+// The feature columns are encoded with opt.pipeline, matched by name when
+// the file has a header, or a pipeline fit from the columns read using
+// opt.encode.
+func parseCSVOpts(r io.Reader, opt parseOptions) (*parsedInput, error) {
 	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1 // row widths are checked by ParseRow
 
 	// isRegression=true, parse as regression until we hit
 	// errors parsing floats, then set flag; set to false
 	// when forceClf
-	p := &parsedInput{isRegression: !forceClf}
+	p := &parsedInput{isRegression: !opt.forceClf}
 
 	// grab first fow
 	row, err := reader.Read()
@@ -32,20 +68,40 @@ func parseCSV(r io.Reader, forceClf bool) (*parsedInput, error) {
 		return p, err
 	}
 
-	// check if it's a header row
-	varNames, err := parseHeader(row)
-	if err == nil {
-		p.VarNames = varNames
-	} else {
-		// use X1, X2,...Xn for var names
-		for i := range row[1:] {
-			p.VarNames = append(p.VarNames, fmt.Sprintf("X%d", i+1))
+	// check if it's a header row, headerless files have the target first
+	var target string
+	var first []string
+	_, err = parseHeader(row)
+	named := err == nil
+	p.layout, p.VarNames, err = newCSVLayout(row, named, opt, true)
+	if err != nil {
+		if named {
+			return p, fmt.Errorf("line 1: %v", err)
+		}
+		return p, err
+	}
+	if !named {
+		first = row
+	} else if p.layout.target >= 0 {
+		target = row[p.layout.target]
+	}
+	p.target = target
+
+	p.pipeline = opt.pipeline
+	if p.pipeline == nil {
+		if err := checkColumnTypes(opt.encode.types, target, p.VarNames); err != nil {
+			return p, err
 		}
+		if opt.encode.types[target] == colCategorical {
+			p.isRegression = false
+		}
+		p.cols = newRawColumns(p.VarNames, opt.encode.types)
+	}
 
-		// parse row
-		err = p.ParseRow(row)
+	if first != nil {
+		err = p.ParseRow(first, 1)
 		if err != nil {
-			return p, err
+			return p, fmt.Errorf("line 1: %v", err)
 		}
 	}
 
@@ -59,10 +115,74 @@ func parseCSV(r io.Reader, forceClf bool) (*parsedInput, error) {
 			return p, err
 		}
 
-		err = p.ParseRow(row)
+		line, _ := reader.FieldPos(0)
+		err = p.ParseRow(row, line)
+		if err != nil {
+			return p, fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+
+	if target != "" && opt.encode.types[target] == colNumeric && !p.isRegression {
+		return p, fmt.Errorf("target column %s isn't numeric", target)
+	}
+
+	if p.Weights != nil && !anyPositive(p.Weights) {
+		return p, fmt.Errorf("weight column %s has no weights > 0", opt.weightCol)
+	}
+
+	// drop the y vals we aren't using
+	if p.isRegression {
+		p.YClf = nil
+	} else {
+		p.YReg = nil
+	}
+
+	if p.pipeline == nil {
+		p.pipeline, err = fitPipeline(p.cols, p, opt.encode)
 		if err != nil {
 			return p, err
 		}
+		p.X, err = p.pipeline.encode(p.cols, len(p.YClf)+len(p.YReg))
+		if err != nil {
+			return p, err
+		}
+		p.pipeline.encodeOutOfFold(p.cols, p, p.X)
+		p.cols = nil
+	}
+	p.VarNames = p.pipeline.Features()
+
+	return p, nil
+}
+
+// anyPositive returns true if one of w is > 0
+func anyPositive(w []float64) bool {
+	for _, v := range w {
+		if v > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLibSVM parses examples in LIBSVM/svmlight format, one example per
+// line as label index:value ..., feature indices start at 1 and features not
+// listed are zero. Comments (#) and query ids (qid:) are ignored.
+func parseLibSVM(r io.Reader, opt parseOptions) (*parsedInput, error) {
+	if opt.groupCol != "" {
+		return nil, errors.New("group columns are not supported for LIBSVM input")
+	}
+	if opt.targetCol != "" || opt.weightCol != "" || opt.idCols != nil || opt.ignore != nil {
+		return nil, errors.New("--target, --id, --ignore and --weight are not supported for LIBSVM input")
+	}
+
+	p := &parsedInput{isRegression: !opt.forceClf, Sparse: &tree.CSR{Indptr: []int{0}}}
+	err := scanLibSVM(r, p.parseLibSVMRow)
+	if err != nil {
+		return p, err
+	}
+
+	for i := 0; i < p.Sparse.Features; i++ {
+		p.VarNames = append(p.VarNames, fmt.Sprintf("X%d", i+1))
 	}
 
 	// drop the y vals we aren't using
@@ -72,44 +192,408 @@ func parseCSV(r io.Reader, forceClf bool) (*parsedInput, error) {
 		p.YReg = nil
 	}
 
-	return p, err
+	return p, nil
+}
+
+// errStopped is returned by a row callback to stop reading without an error
+var errStopped = errors.New("stopped reading")
+
+// readCSVRows calls header with the header row if there is one, then fn
+// with each other row of csv read from r and its line number. Errors from
+// header and fn are reported with the line number.
+func readCSVRows(r io.Reader, header func(row []string) error, fn func(row []string, line int) error) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1 // row widths are checked by fn
+
+	for rowNo := 1; ; rowNo++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line, _ := reader.FieldPos(0)
+
+		if rowNo == 1 {
+			if _, err := parseHeader(row); err == nil {
+				if err := header(row); err != nil {
+					return fmt.Errorf("line %d: %v", line, err)
+				}
+				continue
+			}
+		}
+
+		if err := fn(row, line); err != nil {
+			if err == errStopped {
+				return err
+			}
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+}
+
+// csvLayout is the role of each field of the rows of a csv file
+type csvLayout struct {
+	width    int      // number of fields in each row
+	target   int      // field of the target, -1 if the file doesn't have it
+	features []int    // field of each feature column, -1 for a missing column
+	ids      []int    // fields of the id columns
+	idNames  []string // names of the id columns
+	weight   int      // field of the example weights, -1 for none
+	group    int      // field of the group ids, -1 for none
 }
 
-func (p *parsedInput) ParseRow(row []string) error {
-	xi, err := parseFeatureVals(row)
+// newCSVLayout finds the columns given by opt in the first row of a csv
+// file, named is true when the row is a header. Files without a header have
+// the target first and features after it. With a header, the target is the
+// column named opt.targetCol or opt.modelTarget, or else the first column
+// unless it is a column of opt.pipeline. Columns not given a role by opt
+// are features, in file order, or matched by name to the columns of
+// opt.pipeline as in matchPipeline. The target, and the weights when
+// fitting a pipeline, are only required when requireTarget is true.
+// newCSVLayout also returns the names of the feature columns of the file.
+func newCSVLayout(row []string, named bool, opt parseOptions, requireTarget bool) (*csvLayout, []string, error) {
+	l := &csvLayout{width: len(row), target: 0, weight: -1, group: -1}
+	if !named {
+		for _, c := range []struct{ role, name string }{
+			{"target", opt.targetCol},
+			{"group", opt.groupCol},
+			{"weight", opt.weightCol},
+			{"id", strings.Join(opt.idCols, ",")},
+			{"ignored", strings.Join(opt.ignore, ",")},
+		} {
+			if c.name != "" {
+				return nil, nil, fmt.Errorf("a header row is required to find the %s column", c.role)
+			}
+		}
+		var names []string
+		for i := range row[1:] {
+			l.features = append(l.features, i+1)
+			names = append(names, fmt.Sprintf("X%d", i+1))
+		}
+		return l, names, nil
+	}
+
+	pos := make(map[string]int)
+	dup := make(map[string]bool)
+	for i, name := range row {
+		if _, ok := pos[name]; ok {
+			dup[name] = true
+		}
+		pos[name] = i
+	}
+
+	// role of each field, empty for features
+	roles := make([]string, len(row))
+	find := func(name, role string, required bool) (int, error) {
+		i, ok := pos[name]
+		switch {
+		case !ok && required:
+			return -1, fmt.Errorf("%s column %s not found", role, name)
+		case !ok:
+			return -1, nil
+		case dup[name]:
+			return -1, fmt.Errorf("column %s appears more than once", name)
+		case roles[i] != "":
+			return -1, fmt.Errorf("column %s can't be both the %s and the %s column", name, roles[i], role)
+		}
+		roles[i] = role
+		return i, nil
+	}
+
+	var err error
+	switch {
+	case opt.targetCol != "":
+		if l.target, err = find(opt.targetCol, "target", requireTarget); err != nil {
+			return nil, nil, err
+		}
+	case opt.modelTarget != "":
+		if l.target, err = find(opt.modelTarget, "target", requireTarget); err != nil {
+			return nil, nil, err
+		}
+	case opt.pipeline != nil && opt.pipeline.hasColumn(row[0]):
+		// a file without the target, or with it elsewhere, for a model
+		// that doesn't know the name of its target
+		if requireTarget {
+			return nil, nil, fmt.Errorf("the first column %s is a feature of the model, name the target column with --target", row[0])
+		}
+		l.target = -1
+	default:
+		roles[0] = "target"
+	}
+	if opt.groupCol != "" {
+		if l.group, err = find(opt.groupCol, "group", true); err != nil {
+			return nil, nil, err
+		}
+	}
+	if opt.weightCol != "" {
+		if l.weight, err = find(opt.weightCol, "weight", requireTarget && opt.pipeline == nil); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, name := range opt.idCols {
+		i, err := find(name, "id", true)
+		if err != nil {
+			return nil, nil, err
+		}
+		l.ids = append(l.ids, i)
+		l.idNames = append(l.idNames, name)
+	}
+	for _, name := range opt.ignore {
+		if _, err := find(name, "ignored", false); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var names []string
+	for i, name := range row {
+		if roles[i] == "" {
+			l.features = append(l.features, i)
+			names = append(names, name)
+		}
+	}
+	if opt.pipeline == nil {
+		return l, names, nil
+	}
+
+	l.features, err = matchPipeline(row, l.features, opt.pipeline)
+	return l, names, err
+}
+
+// matchPipeline matches the feature fields of header to the columns of p
+// by name, it returns the field of each column of p. Columns of p missing
+// from the header are an error unless their missing values are imputed,
+// columns p doesn't use are ignored with a warning. Files with a header for
+// a model fit without one are read by position.
+func matchPipeline(header []string, fields []int, p *Pipeline) ([]int, error) {
+	pos := make(map[string]int)
+	dup := make(map[string]bool)
+	for _, i := range fields {
+		if _, ok := pos[header[i]]; ok {
+			dup[header[i]] = true
+		}
+		pos[header[i]] = i
+	}
+
+	index := make([]int, len(p.Columns))
+	used := make(map[int]bool)
+	var missing []string
+	for j, e := range p.Columns {
+		i, ok := pos[e.Name]
+		switch {
+		case dup[e.Name]:
+			return nil, fmt.Errorf("column %s appears more than once", e.Name)
+		case ok:
+			used[i] = true
+		case e.Type != colNumeric || e.Impute == "":
+			missing = append(missing, e.Name)
+			i = -1
+		default:
+			i = -1 // read as missing values and imputed
+		}
+		index[j] = i
+	}
+
+	if len(used) == 0 && p.unnamed() {
+		if len(fields) != len(p.Columns) {
+			return nil, fmt.Errorf("expected %d feature columns, got %d", len(p.Columns), len(fields))
+		}
+		return fields, nil
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing columns required by the model: %s", strings.Join(missing, ", "))
+	}
+
+	var extra []string
+	for _, i := range fields {
+		if !used[i] {
+			extra = append(extra, header[i])
+		}
+	}
+	if len(extra) > 0 {
+		fmt.Fprintf(os.Stderr, "warning: ignoring columns not used by the model: %s\n", strings.Join(extra, ", "))
+	}
+	return index, nil
+}
+
+// scanLibSVM calls fn with the fields of each example in LIBSVM format read
+// from r, skipping comments and blank lines. Errors from fn are reported
+// with the line number.
+func scanLibSVM(r io.Reader, fn func(fields []string) error) error {
+	reader := bufio.NewReader(r)
+
+	for lineNo := 1; ; lineNo++ {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(line) == 0 && err == io.EOF {
+			return nil
+		}
+
+		if c := strings.IndexByte(line, '#'); c >= 0 {
+			line = line[:c]
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			if ferr := fn(fields); ferr != nil {
+				if ferr == errStopped {
+					return ferr
+				}
+				return fmt.Errorf("line %d: %v", lineNo, ferr)
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+func (p *parsedInput) parseLibSVMRow(fields []string) error {
+	var (
+		indices []int
+		values  []float64
+	)
+	for _, f := range fields[1:] {
+		if strings.HasPrefix(f, "qid:") {
+			continue
+		}
+		sep := strings.IndexByte(f, ':')
+		if sep < 0 {
+			return fmt.Errorf("expected index:value, got %q", f)
+		}
+		j, err := strconv.Atoi(f[:sep])
+		if err != nil || j < 1 {
+			return fmt.Errorf("invalid feature index %q, indices start at 1", f[:sep])
+		}
+		v, err := strconv.ParseFloat(f[sep+1:], 64)
+		if err != nil {
+			return err
+		}
+		indices = append(indices, j-1)
+		values = append(values, v)
+	}
+
+	if !sort.IntsAreSorted(indices) {
+		sort.Sort(sparseRow{indices, values})
+	}
+	err := p.Sparse.AppendRow(indices, values)
 	if err != nil {
 		return err
 	}
-	p.X = append(p.X, xi)
 
 	// parse as regression and classification until we encounter errors
 	// parsing floats
 	if p.isRegression {
-		yi, err := strconv.ParseFloat(row[0], 64)
+		yi, err := strconv.ParseFloat(fields[0], 64)
 		if err != nil {
 			p.isRegression = false
 		}
 		p.YReg = append(p.YReg, yi)
-
 	}
-	p.YClf = append(p.YClf, row[0])
+	p.YClf = append(p.YClf, fields[0])
 
 	return nil
 }
 
-func parseFeatureVals(row []string) ([]float64, error) {
-	var xi []float64
-	if len(row) < 1 {
-		return xi, errors.New("row only has one column")
+// sparseRow sorts the nonzero values of an example by feature index
+type sparseRow struct {
+	indices []int
+	values  []float64
+}
+
+func (s sparseRow) Len() int           { return len(s.indices) }
+func (s sparseRow) Less(i, j int) bool { return s.indices[i] < s.indices[j] }
+func (s sparseRow) Swap(i, j int) {
+	s.indices[i], s.indices[j] = s.indices[j], s.indices[i]
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+}
+
+// dataset returns the examples as a tree.Dataset
+func (p *parsedInput) dataset() tree.Dataset {
+	if p.Sparse != nil {
+		return p.Sparse
 	}
-	for _, val := range row[1:] {
-		fv, err := strconv.ParseFloat(val, 64)
+	return tree.RowMajor(p.X)
+}
+
+// numRows returns the number of examples
+func (p *parsedInput) numRows() int {
+	return p.dataset().NumRows()
+}
+
+// numFeatures returns the number of features, for sparse input the largest
+// feature index seen
+func (p *parsedInput) numFeatures() int {
+	return p.dataset().NumFeatures()
+}
+
+// ParseRow parses the target, features and other columns of a csv row read
+// from line. The features are encoded with the pipeline if there is one,
+// otherwise they are kept in columns for fitting a pipeline.
+func (p *parsedInput) ParseRow(row []string, line int) error {
+	l := p.layout
+	if len(row) != l.width {
+		return fmt.Errorf("expected %d columns, got %d", l.width, len(row))
+	}
+
+	cells := make([]string, len(l.features))
+	for j, i := range l.features {
+		if i >= 0 {
+			cells[j] = row[i]
+		}
+	}
+	if p.pipeline != nil {
+		xi, err := p.pipeline.transform(cells)
 		if err != nil {
-			return xi, err
+			return err
 		}
-		xi = append(xi, fv)
+		p.X = append(p.X, xi)
+	} else {
+		for i, cell := range cells {
+			if err := p.cols[i].add(cell, line); err != nil {
+				return err
+			}
+		}
+	}
+
+	if l.group >= 0 {
+		p.Groups = append(p.Groups, row[l.group])
+	}
+	if l.ids != nil {
+		id := make([]string, len(l.ids))
+		for j, i := range l.ids {
+			id[j] = row[i]
+		}
+		p.IDs = append(p.IDs, id)
 	}
-	return xi, nil
+	if l.weight >= 0 {
+		w, err := strconv.ParseFloat(strings.TrimSpace(row[l.weight]), 64)
+		if err != nil || w < 0 || math.IsInf(w, 0) || math.IsNaN(w) {
+			return fmt.Errorf("invalid weight %q, weights are numbers >= 0", row[l.weight])
+		}
+		p.Weights = append(p.Weights, w)
+	}
+	if l.target < 0 {
+		return nil
+	}
+	y := row[l.target]
+
+	// parse as regression and classification until we encounter errors
+	// parsing floats
+	if p.isRegression {
+		yi, err := strconv.ParseFloat(y, 64)
+		if err != nil {
+			p.isRegression = false
+		}
+		p.YReg = append(p.YReg, yi)
+
+	}
+	p.YClf = append(p.YClf, y)
+
+	return nil
 }
 
 func parseHeader(row []string) ([]string, error) {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -79,6 +80,106 @@ func TestDetectIrisClassification(t *testing.T) {
 	}
 }
 
+func TestParseGroups(t *testing.T) {
+	r := strings.NewReader(irisCSV)
+
+	p, err := parseCSVOpts(r, parseOptions{groupCol: "Petal.Width"})
+	if err != nil {
+		t.Error("unexpected error parsing iris data:", err)
+		return
+	}
+
+	if len(p.Groups) != 9 || p.Groups[5] != "0.4" {
+		t.Error("expected group ids from the Petal.Width column, got:", p.Groups)
+	}
+
+	if len(p.VarNames) != 3 || len(p.X[0]) != 3 {
+		t.Error("expected group column to be removed from the features, got:", p.VarNames)
+	}
+}
+
+var ordersCSV = `order_id,size,price,note,w,color
+a1,1,10,x,1,red
+a2,2,12,y,0,red
+a3,3,20,z,2.5,blue
+a4,4,22,,1,blue
+`
+
+// ordersRoles are the roles of the columns of ordersCSV
+var ordersRoles = parseOptions{targetCol: "price", idCols: []string{"order_id"}, ignore: []string{"note"}, weightCol: "w"}
+
+func TestParseColumnRoles(t *testing.T) {
+	p, err := parseCSVOpts(strings.NewReader(ordersCSV), ordersRoles)
+	if err != nil {
+		t.Fatal("unexpected error parsing orders:", err)
+	}
+
+	if !reflect.DeepEqual(p.VarNames, []string{"size", "color"}) || len(p.X[0]) != 2 {
+		t.Error("expected size and color to be the only features, got:", p.VarNames)
+	}
+	if !reflect.DeepEqual(p.YReg, []float64{10, 12, 20, 22}) {
+		t.Error("expected the target from the price column, got:", p.YReg)
+	}
+	if !reflect.DeepEqual(p.Weights, []float64{1, 0, 2.5, 1}) {
+		t.Error("expected weights from the w column, got:", p.Weights)
+	}
+	if len(p.IDs) != 4 || p.IDs[2][0] != "a3" {
+		t.Error("expected ids from the order_id column, got:", p.IDs)
+	}
+
+	for _, tc := range []struct {
+		name string
+		data string
+		opt  parseOptions
+		msg  string
+	}{
+		{"two roles", ordersCSV, parseOptions{targetCol: "price", idCols: []string{"price"}}, "column price can't be both the target and the id column"},
+		{"missing target", ordersCSV, parseOptions{targetCol: "cost"}, "line 1: target column cost not found"},
+		{"missing id", ordersCSV, parseOptions{idCols: []string{"customer"}}, "id column customer not found"},
+		{"bad weight", strings.Replace(ordersCSV, "2.5", "-1", 1), ordersRoles, `line 4: invalid weight "-1"`},
+		{"zero weights", "price,w,size\n1,0,2\n3,0,4\n", parseOptions{weightCol: "w"}, "weight column w has no weights > 0"},
+		{"no header", "1,2,3\n4,5,6\n", parseOptions{targetCol: "price"}, "a header row is required to find the target column"},
+	} {
+		_, err := parseCSVOpts(strings.NewReader(tc.data), tc.opt)
+		if err == nil || !strings.Contains(err.Error(), tc.msg) {
+			t.Errorf("%s: expected an error with %q, got: %v", tc.name, tc.msg, err)
+		}
+	}
+}
+
+func TestParseLibSVM(t *testing.T) {
+	r := strings.NewReader(`# comment
+1 qid:1 3:0.5 1:2
+0 2:-1 # trailing comment
+
+1
+`)
+
+	p, err := parseLibSVM(r, parseOptions{forceClf: true})
+	if err != nil {
+		t.Error("unexpected error parsing LIBSVM data:", err)
+		return
+	}
+
+	if p.isRegression || len(p.YClf) != 3 || p.YClf[1] != "0" {
+		t.Error("expected 3 class labels, got:", p.YClf)
+	}
+
+	if p.numRows() != 3 || p.numFeatures() != 3 || len(p.VarNames) != 3 {
+		t.Errorf("expected 3 rows and 3 features, got: %d and %d", p.numRows(), p.numFeatures())
+	}
+
+	X := p.dataset()
+	if X.At(0, 0) != 2 || X.At(0, 2) != 0.5 || X.At(1, 1) != -1 || X.At(2, 0) != 0 {
+		t.Error("unexpected values for sparse examples:", p.Sparse)
+	}
+
+	_, err = parseLibSVM(strings.NewReader("1 1:1\n1 0:1\n"), parseOptions{})
+	if err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Error("expected an error for feature index 0 on line 2, got:", err)
+	}
+}
+
 var bostonCSV = `"medv","crim","zn","indus","chas","nox","rm","age","dis","rad","tax","ptratio","black","lstat"
 24,0.00632,18,2.31,0,0.538,6.575,65.2,4.09,1,296,15.3,396.9,4.98
 21.6,0.02731,0,7.07,0,0.469,6.421,78.9,4.9671,2,242,17.8,396.9,9.14
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	flag "github.com/docker/docker/pkg/mflag"
+)
+
+var (
+	columnTypes = flag.String([]string{"-column_types"}, "", "types of columns as name=type,..., one of numeric, categorical, onehot, ordinal or target; undeclared columns are numeric unless they have values that aren't numbers")
+	encoding    = flag.String([]string{"-encoding"}, encodeOrdinal, "encoding of categorical columns, onehot, ordinal or target")
+	impute      = flag.String([]string{"-impute"}, "", "fill missing numeric values with the mean, median or zero of the column, missing values are an error otherwise")
+)
+
+// Column types, categorical columns are encoded with --encoding
+const (
+	colNumeric     = "numeric"
+	colCategorical = "categorical"
+	encodeOneHot   = "onehot"
+	encodeOrdinal  = "ordinal"
+	encodeTarget   = "target"
+)
+
+// targetSmoothing is the number of examples of weight given to the mean of
+// all examples when target encoding a category, so rare categories are
+// encoded close to the mean
+const targetSmoothing = 10
+
+// targetFolds is the number of folds used to target encode the examples a
+// pipeline is fit with, see encodeOutOfFold
+const targetFolds = 5
+
+// encodeOptions controls how a pipeline is fit, see fitPipeline
+type encodeOptions struct {
+	types    map[string]string // declared column types by name
+	encoding string            // encoding of categorical columns without a declared encoding
+	impute   string            // mean, median or zero, "" to reject missing values
+}
+
+// parseEncodeOpts returns the encoding options given by --column_types,
+// --encoding and --impute
+func parseEncodeOpts() (encodeOptions, error) {
+	o := encodeOptions{types: make(map[string]string), encoding: *encoding, impute: *impute}
+
+	switch o.encoding {
+	case encodeOneHot, encodeOrdinal, encodeTarget:
+	default:
+		return o, fmt.Errorf("invalid encoding %q, choices are onehot, ordinal or target", o.encoding)
+	}
+	switch o.impute {
+	case "", "mean", "median", "zero":
+	default:
+		return o, fmt.Errorf("invalid impute option %q, choices are mean, median or zero", o.impute)
+	}
+
+	if *columnTypes == "" {
+		return o, nil
+	}
+	for _, decl := range strings.Split(*columnTypes, ",") {
+		sep := strings.LastIndexByte(decl, '=')
+		if sep < 0 {
+			return o, fmt.Errorf("invalid column type %q, expected name=type", decl)
+		}
+		name, typ := strings.TrimSpace(decl[:sep]), strings.TrimSpace(decl[sep+1:])
+		switch typ {
+		case colNumeric, colCategorical, encodeOneHot, encodeOrdinal, encodeTarget:
+		default:
+			return o, fmt.Errorf("invalid type %q for column %s, choices are numeric, categorical, onehot, ordinal or target", typ, name)
+		}
+		o.types[name] = typ
+	}
+	return o, nil
+}
+
+// Pipeline encodes the feature columns of a csv row as the features of a
+// model. It is fit with the training data and saved with the model, so the
+// columns of new examples are encoded the same way.
+type Pipeline struct {
+	Columns []*ColumnEncoding `json:"columns"` // one per feature column, in input order
+}
+
+// ColumnEncoding encodes one input column as one or more features.
+//
+// Numeric columns are written as they are, missing values are replaced by
+// Fill when Impute is set. Categorical columns are encoded by their level:
+// ordinal writes its index in Levels, onehot writes a feature for each level
+// and target writes Values, the smoothed mean of the target (or fraction of
+// each class) for the level. Levels not seen in the fit are -1 (ordinal),
+// all zeros (onehot) or Prior (target).
+type ColumnEncoding struct {
+	Name     string      `json:"name"`
+	Type     string      `json:"type"` // numeric, onehot, ordinal or target
+	Impute   string      `json:"impute,omitempty"`
+	Fill     float64     `json:"fill,omitempty"`
+	Levels   []string    `json:"levels,omitempty"` // sorted
+	Values   [][]float64 `json:"values,omitempty"` // one per level
+	Prior    []float64   `json:"prior,omitempty"`
+	Features []string    `json:"features"` // names of the features written
+}
+
+// rawColumn is a feature column before encoding. Values are read as numbers
+// until one isn't, or if the column is declared categorical, then as
+// category keys.
+type rawColumn struct {
+	name        string
+	declared    string // type from --column_types, "" if not declared
+	categorical bool
+	num         []float64 // NaN for missing values
+	keys        []string
+	missingLine int // line of the first missing numeric value, 0 if none
+}
+
+func newRawColumns(names []string, types map[string]string) []*rawColumn {
+	cols := make([]*rawColumn, len(names))
+	for i, name := range names {
+		typ := types[name]
+		cols[i] = &rawColumn{name: name, declared: typ, categorical: typ != "" && typ != colNumeric}
+	}
+	return cols
+}
+
+// add adds the cell read from line to the column
+func (c *rawColumn) add(cell string, line int) error {
+	if !c.categorical {
+		v, err := parseNumber(cell)
+		if err == nil {
+			if math.IsNaN(v) && c.missingLine == 0 {
+				c.missingLine = line
+			}
+			c.num = append(c.num, v)
+			return nil
+		}
+		if c.declared == colNumeric {
+			return fmt.Errorf("column %s: %q isn't a number", c.name, cell)
+		}
+
+		// the values read so far become categories
+		c.categorical = true
+		c.keys = make([]string, len(c.num), cap(c.num))
+		for i, v := range c.num {
+			c.keys[i] = numberKey(v)
+		}
+		c.num = nil
+	}
+	c.keys = append(c.keys, categoryKey(cell))
+	return nil
+}
+
+// isMissing returns true for the values of a cell that mean missing
+func isMissing(cell string) bool {
+	switch cell {
+	case "", "NA", "N/A", "NaN", "nan", "null", "?":
+		return true
+	}
+	return false
+}
+
+// parseNumber parses the number in cell, missing values are NaN
+func parseNumber(cell string) (float64, error) {
+	cell = strings.TrimSpace(cell)
+	if isMissing(cell) {
+		return math.NaN(), nil
+	}
+	return strconv.ParseFloat(cell, 64)
+}
+
+// categoryKey returns the level of a categorical cell. Numbers are
+// formatted the same way however they are written, so 1 and 1.0 are the same
+// level, and missing values are the level "".
+func categoryKey(cell string) string {
+	if v, err := parseNumber(cell); err == nil {
+		return numberKey(v)
+	}
+	return strings.TrimSpace(cell)
+}
+
+func numberKey(v float64) string {
+	if math.IsNaN(v) {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// fitPipeline fits an encoding for each column, d holds the targets used
+// for target encoding
+func fitPipeline(cols []*rawColumn, d *parsedInput, opt encodeOptions) (*Pipeline, error) {
+	p := new(Pipeline)
+	for _, c := range cols {
+		e := &ColumnEncoding{Name: c.name, Type: colNumeric}
+		if c.categorical {
+			e.Type = c.declared
+			if e.Type == "" || e.Type == colCategorical {
+				e.Type = opt.encoding
+			}
+			if e.Type == "" {
+				e.Type = encodeOrdinal
+			}
+		}
+
+		var err error
+		switch e.Type {
+		case colNumeric:
+			err = e.fitNumeric(c.num, opt.impute)
+			if err != nil {
+				err = fmt.Errorf("line %d: %v", c.missingLine, err)
+			}
+		case encodeOneHot, encodeOrdinal:
+			e.fitLevels(c.keys)
+		case encodeTarget:
+			e.fitLevels(c.keys)
+			e.fitTarget(c.keys, d, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.Columns = append(p.Columns, e)
+	}
+	return p, nil
+}
+
+func (e *ColumnEncoding) fitNumeric(vals []float64, impute string) error {
+	e.Features = []string{e.Name}
+	e.Impute = impute
+
+	var present []float64
+	for _, v := range vals {
+		if !math.IsNaN(v) {
+			present = append(present, v)
+		}
+	}
+	if len(present) < len(vals) && impute == "" {
+		return fmt.Errorf("column %s has missing values, use --impute mean, median or zero", e.Name)
+	}
+	if len(present) == 0 {
+		return nil
+	}
+
+	switch impute {
+	case "mean":
+		for _, v := range present {
+			e.Fill += v
+		}
+		e.Fill /= float64(len(present))
+	case "median":
+		sort.Float64s(present)
+		mid := len(present) / 2
+		e.Fill = present[mid]
+		if len(present)%2 == 0 {
+			e.Fill = (present[mid-1] + present[mid]) / 2
+		}
+	}
+	return nil
+}
+
+func (e *ColumnEncoding) fitLevels(keys []string) {
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		if !seen[k] {
+			seen[k] = true
+			e.Levels = append(e.Levels, k)
+		}
+	}
+	sort.Strings(e.Levels)
+
+	if e.Type != encodeOneHot {
+		e.Features = []string{e.Name}
+		return
+	}
+	for _, level := range e.Levels {
+		e.Features = append(e.Features, e.Name+"="+level)
+	}
+}
+
+// fitTarget encodes each level by the mean of the target, or for
+// classification the fraction of each class, shrunk toward the mean of all
+// examples by targetSmoothing. Only the examples in inx are used, all
+// examples when inx is nil.
+func (e *ColumnEncoding) fitTarget(keys []string, d *parsedInput, inx []int) {
+	// targets are vectors of class indicators for classification
+	var classes []string
+	width := 1
+	if !d.isRegression {
+		classes = uniqueSorted(d.YClf)
+		width = len(classes)
+		e.Features = nil
+		for _, class := range classes {
+			e.Features = append(e.Features, e.Name+"="+class)
+		}
+	}
+	target := func(i int, sum []float64) {
+		if d.isRegression {
+			sum[0] += d.YReg[i]
+			return
+		}
+		sum[sort.SearchStrings(classes, d.YClf[i])]++
+	}
+
+	e.Prior = make([]float64, width)
+	sums := make([][]float64, len(e.Levels))
+	counts := make([]int, len(e.Levels))
+	for i := range sums {
+		sums[i] = make([]float64, width)
+	}
+	if inx == nil {
+		inx = make([]int, len(keys))
+		for i := range inx {
+			inx[i] = i
+		}
+	}
+	for _, i := range inx {
+		level := sort.SearchStrings(e.Levels, keys[i])
+		target(i, sums[level])
+		target(i, e.Prior)
+		counts[level]++
+	}
+	for j := range e.Prior {
+		e.Prior[j] /= float64(len(inx))
+	}
+
+	e.Values = make([][]float64, len(e.Levels))
+	for i, sum := range sums {
+		e.Values[i] = make([]float64, width)
+		for j := range sum {
+			e.Values[i][j] = (sum[j] + targetSmoothing*e.Prior[j]) / (float64(counts[i]) + targetSmoothing)
+		}
+	}
+}
+
+// encodeOutOfFold replaces the target encoded features in X, the examples
+// the pipeline was fit with, by encodings fit without the example's fold.
+// The features of an example then don't include its own target, which
+// would leak into out of bag and cv estimates, e.g. a column with a level
+// per example would predict the target perfectly. The pipeline keeps the
+// encodings of all examples for new examples.
+func (p *Pipeline) encodeOutOfFold(cols []*rawColumn, d *parsedInput, X [][]float64) {
+	n := len(X)
+	k := targetFolds
+	if n < k {
+		k = n
+	}
+	if k < 2 {
+		return
+	}
+
+	// folds are drawn with a fixed seed so the encoding is reproducible
+	fold := make([]int, n)
+	for i, id := range rand.New(rand.NewSource(1)).Perm(n) {
+		fold[id] = i % k
+	}
+
+	offset := 0
+	for c, e := range p.Columns {
+		if e.Type != encodeTarget {
+			offset += len(e.Features)
+			continue
+		}
+		keys := cols[c].keys
+		for f := 0; f < k; f++ {
+			var train []int
+			var trainKeys []string
+			for i := range keys {
+				if fold[i] != f {
+					train = append(train, i)
+					trainKeys = append(trainKeys, keys[i])
+				}
+			}
+			oof := &ColumnEncoding{Name: e.Name, Type: encodeTarget}
+			oof.fitLevels(trainKeys)
+			oof.fitTarget(keys, d, train)
+			for i, key := range keys {
+				if fold[i] == f {
+					copy(X[i][offset:], oof.appendLevel(nil, key))
+				}
+			}
+		}
+		offset += len(e.Features)
+	}
+}
+
+func uniqueSorted(vals []string) []string {
+	seen := make(map[string]bool)
+	var u []string
+	for _, v := range vals {
+		if !seen[v] {
+			seen[v] = true
+			u = append(u, v)
+		}
+	}
+	sort.Strings(u)
+	return u
+}
+
+// numericPipeline passes numeric columns through unchanged, it reads
+// examples for models fit without a pipeline
+func numericPipeline(names []string) *Pipeline {
+	p := new(Pipeline)
+	for _, name := range names {
+		p.Columns = append(p.Columns, &ColumnEncoding{Name: name, Type: colNumeric, Features: []string{name}})
+	}
+	return p
+}
+
+// unnamed returns true if the columns have the names given to columns of a
+// file without a header, X1, X2, ...
+func (p *Pipeline) unnamed() bool {
+	for i, e := range p.Columns {
+		if e.Name != fmt.Sprintf("X%d", i+1) {
+			return false
+		}
+	}
+	return true
+}
+
+// identity returns true if the pipeline doesn't change numeric columns,
+// models with such a pipeline don't save it
+func (p *Pipeline) identity() bool {
+	for _, e := range p.Columns {
+		if e.Type != colNumeric || e.Impute != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// hasColumn returns true if the pipeline encodes a column named name
+func (p *Pipeline) hasColumn(name string) bool {
+	for _, e := range p.Columns {
+		if e.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Features returns the names of the features written by the pipeline
+func (p *Pipeline) Features() []string {
+	var names []string
+	for _, e := range p.Columns {
+		names = append(names, e.Features...)
+	}
+	return names
+}
+
+// check returns an error if the pipeline can't encode examples, e.g. one
+// read from a damaged model file
+func (p *Pipeline) check() error {
+	for _, e := range p.Columns {
+		switch e.Type {
+		case colNumeric, encodeOrdinal:
+			if len(e.Features) != 1 {
+				return fmt.Errorf("column %s has %d features, expected 1", e.Name, len(e.Features))
+			}
+		case encodeOneHot:
+			if len(e.Features) != len(e.Levels) {
+				return fmt.Errorf("column %s has %d levels and %d features", e.Name, len(e.Levels), len(e.Features))
+			}
+		case encodeTarget:
+			if len(e.Values) != len(e.Levels) {
+				return fmt.Errorf("column %s has %d levels and %d values", e.Name, len(e.Levels), len(e.Values))
+			}
+			if len(e.Prior) != len(e.Features) {
+				return fmt.Errorf("column %s has a prior of %d features, expected %d", e.Name, len(e.Prior), len(e.Features))
+			}
+			for _, v := range e.Values {
+				if len(v) != len(e.Features) {
+					return fmt.Errorf("column %s has target values of %d features, expected %d", e.Name, len(v), len(e.Features))
+				}
+			}
+		default:
+			return fmt.Errorf("column %s has unknown type %q", e.Name, e.Type)
+		}
+		if !sort.StringsAreSorted(e.Levels) {
+			return fmt.Errorf("levels of column %s aren't sorted", e.Name)
+		}
+	}
+	return nil
+}
+
+// transform encodes the feature cells of one row
+func (p *Pipeline) transform(cells []string) ([]float64, error) {
+	if len(cells) != len(p.Columns) {
+		return nil, fmt.Errorf("expected %d feature columns, got %d", len(p.Columns), len(cells))
+	}
+
+	var err error
+	x := make([]float64, 0, len(cells))
+	for i, e := range p.Columns {
+		if e.Type != colNumeric {
+			x = e.appendLevel(x, categoryKey(cells[i]))
+			continue
+		}
+		v, perr := parseNumber(cells[i])
+		if perr != nil {
+			return nil, fmt.Errorf("column %s: %q isn't a number", e.Name, cells[i])
+		}
+		x, err = e.appendNumber(x, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return x, nil
+}
+
+// encode encodes the columns read while fitting the pipeline, one row per
+// example
+func (p *Pipeline) encode(cols []*rawColumn, n int) ([][]float64, error) {
+	width := len(p.Features())
+	X := make([][]float64, n)
+	var err error
+	for i := range X {
+		x := make([]float64, 0, width)
+		for j, e := range p.Columns {
+			if e.Type != colNumeric {
+				x = e.appendLevel(x, cols[j].keys[i])
+				continue
+			}
+			x, err = e.appendNumber(x, cols[j].num[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		X[i] = x
+	}
+	return X, nil
+}
+
+func (e *ColumnEncoding) appendNumber(x []float64, v float64) ([]float64, error) {
+	if math.IsNaN(v) {
+		if e.Impute == "" {
+			return x, fmt.Errorf("column %s: missing value, fit with --impute to fill missing values", e.Name)
+		}
+		v = e.Fill
+	}
+	return append(x, v), nil
+}
+
+func (e *ColumnEncoding) appendLevel(x []float64, key string) []float64 {
+	i := sort.SearchStrings(e.Levels, key)
+	seen := i < len(e.Levels) && e.Levels[i] == key
+
+	switch e.Type {
+	case encodeOrdinal:
+		if !seen {
+			return append(x, -1)
+		}
+		return append(x, float64(i))
+	case encodeOneHot:
+		for j := range e.Levels {
+			if seen && j == i {
+				x = append(x, 1)
+			} else {
+				x = append(x, 0)
+			}
+		}
+		return x
+	case encodeTarget:
+		if !seen {
+			return append(x, e.Prior...)
+		}
+		return append(x, e.Values[i]...)
+	}
+	return x
+}
+
+// inputPipeline returns the pipeline that encodes examples for m
+func (m *Model) inputPipeline() *Pipeline {
+	if m.Pipeline != nil {
+		return m.Pipeline
+	}
+	return numericPipeline(m.VarNames)
+}
+
+// checkColumnTypes returns an error if a declared type names a column that
+// isn't in the data, or the target is declared as an encoding
+func checkColumnTypes(types map[string]string, target string, features []string) error {
+	names := make(map[string]bool)
+	for _, name := range features {
+		names[name] = true
+	}
+	for name, typ := range types {
+		if name == target && target != "" {
+			if typ != colNumeric && typ != colCategorical {
+				return errors.New("the target column can only be numeric or categorical")
+			}
+			continue
+		}
+		if !names[name] {
+			return fmt.Errorf("column_types: no column named %s", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var colorCSV = `"price","color","size","grade"
+10,red,1,1
+12,red,NA,2
+20,blue,3,1.0
+22,blue,5,2
+30,green,,1
+`
+
+func TestPipelineEncodings(t *testing.T) {
+	enc := encodeOptions{
+		types:    map[string]string{"grade": colCategorical},
+		encoding: encodeOneHot,
+		impute:   "mean",
+	}
+	d, err := parseCSVOpts(strings.NewReader(colorCSV), parseOptions{encode: enc})
+	if err != nil {
+		t.Fatal("unexpected error parsing data:", err)
+	}
+
+	wantNames := []string{"color=blue", "color=green", "color=red", "size", "grade=1", "grade=2"}
+	if !reflect.DeepEqual(d.VarNames, wantNames) {
+		t.Fatalf("expected features %v, got: %v", wantNames, d.VarNames)
+	}
+	// missing sizes are the mean of 1, 3 and 5, 1 and 1.0 are the same grade
+	want := [][]float64{
+		{0, 0, 1, 1, 1, 0},
+		{0, 0, 1, 3, 0, 1},
+		{1, 0, 0, 3, 1, 0},
+		{1, 0, 0, 5, 0, 1},
+		{0, 1, 0, 3, 1, 0},
+	}
+	if !reflect.DeepEqual(d.X, want) {
+		t.Errorf("expected encoded rows %v, got: %v", want, d.X)
+	}
+
+	// new levels are all zeros
+	x, err := d.pipeline.transform([]string{"purple", "7", "3"})
+	if err != nil || !reflect.DeepEqual(x, []float64{0, 0, 0, 7, 0, 0}) {
+		t.Errorf("expected an unseen level to be all zeros, got: %v %v", x, err)
+	}
+
+	enc.encoding = encodeOrdinal
+	enc.types = map[string]string{"color": encodeTarget, "grade": colCategorical}
+	d, err = parseCSVOpts(strings.NewReader(colorCSV), parseOptions{encode: enc})
+	if err != nil {
+		t.Fatal("unexpected error parsing data:", err)
+	}
+	// new examples of blue are (20+22 + 10*mean)/(2+10), the mean of price
+	// is 18.8, the examples fit are encoded without their own price
+	blue := (42 + targetSmoothing*18.8) / (2 + targetSmoothing)
+	x, err = d.pipeline.transform([]string{"blue", "1", "2"})
+	if err != nil || math.Abs(x[0]-blue) > 1e-9 {
+		t.Errorf("expected blue to be encoded as %f, got: %v %v", blue, x, err)
+	}
+	if got := d.X[2][0]; math.Abs(got-blue) < 1e-9 {
+		t.Errorf("expected the fit examples of blue to be encoded out of fold, got: %f", got)
+	}
+	x, err = d.pipeline.transform([]string{"purple", "1", "2"})
+	if err != nil || math.Abs(x[0]-18.8) > 1e-9 || x[2] != 1 {
+		t.Errorf("expected an unseen color to be the mean price and grade 2 to be 1, got: %v %v", x, err)
+	}
+
+	// target encoding for classification writes the fraction of each class
+	d, err = parseCSVOpts(strings.NewReader(colorCSV), parseOptions{forceClf: true, encode: enc})
+	if err != nil {
+		t.Fatal("unexpected error parsing data:", err)
+	}
+	if len(d.VarNames) != 5+2 || d.VarNames[0] != "color=10" {
+		t.Errorf("expected a target feature for each of the 5 classes, got: %v", d.VarNames)
+	}
+
+	for _, tc := range []struct {
+		name string
+		opt  encodeOptions
+		msg  string
+	}{
+		{"missing", encodeOptions{}, "column size has missing values"},
+		{"not numeric", encodeOptions{types: map[string]string{"color": colNumeric}, impute: "zero"}, `column color: "red" isn't a number`},
+		{"unknown column", encodeOptions{types: map[string]string{"weight": colNumeric}}, "no column named weight"},
+		{"target encoded target", encodeOptions{types: map[string]string{"price": encodeOneHot}}, "target column can only be"},
+	} {
+		_, err := parseCSVOpts(strings.NewReader(colorCSV), parseOptions{encode: tc.opt})
+		if err == nil || !strings.Contains(err.Error(), tc.msg) {
+			t.Errorf("%s: expected an error with %q, got: %v", tc.name, tc.msg, err)
+		}
+	}
+}
+
+func TestPipelineTargetLeak(t *testing.T) {
+	// a level per example and a target of noise, the target encoding of the
+	// examples fit can't follow the target
+	r := rand.New(rand.NewSource(1))
+	var b strings.Builder
+	b.WriteString("y,id\n")
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&b, "%g,id%d\n", r.NormFloat64(), i)
+	}
+	enc := encodeOptions{encoding: encodeTarget}
+	d, err := parseCSVOpts(strings.NewReader(b.String()), parseOptions{encode: enc})
+	if err != nil {
+		t.Fatal("unexpected error parsing data:", err)
+	}
+
+	x := make([]float64, len(d.X))
+	for i := range d.X {
+		x[i] = d.X[i][0]
+	}
+	if c := correlation(x, d.YReg); math.Abs(c) > 0.5 {
+		t.Errorf("expected the encoded ids to be unrelated to the target, got correlation %f", c)
+	}
+}
+
+// correlation returns the Pearson correlation of x and y
+func correlation(x, y []float64) float64 {
+	n := float64(len(x))
+	var sx, sy, sxx, syy, sxy float64
+	for i := range x {
+		sx, sy = sx+x[i], sy+y[i]
+		sxx, syy, sxy = sxx+x[i]*x[i], syy+y[i]*y[i], sxy+x[i]*y[i]
+	}
+	return (sxy - sx*sy/n) / math.Sqrt((sxx-sx*sx/n)*(syy-sy*sy/n))
+}
+
+func TestPipelinePredict(t *testing.T) {
+	enc := encodeOptions{types: map[string]string{"price": colCategorical}, encoding: encodeOneHot, impute: "median"}
+	d, err := parseCSVOpts(strings.NewReader(colorCSV), parseOptions{encode: enc})
+	if err != nil {
+		t.Fatal("unexpected error parsing data:", err)
+	}
+	if d.isRegression {
+		t.Fatal("expected a categorical target to be parsed for classification")
+	}
+
+	m := new(Model)
+	m.Fit(d, modelOptions{nTree: 5, minSplit: 2, minLeaf: 1, maxFeatures: -1, nWorkers: 1, seed: 1})
+	if m.Pipeline == nil {
+		t.Fatal("expected the model to keep its pipeline")
+	}
+	want, _ := m.Predict(d)
+
+	// the pipeline is saved with the model and encodes the csv the same way
+	for _, format := range []string{formatBinary, formatJSON, formatGob} {
+		loaded := roundTrip(t, m, format)
+		if !reflect.DeepEqual(loaded.Pipeline, m.Pipeline) {
+			t.Errorf("%s: expected the same pipeline after loading", format)
+		}
+
+		var got, wantBuf bytes.Buffer
+		writePred(&wantBuf, nil, want, nil)
+		err := loaded.PredictStream(strings.NewReader(colorCSV), &got, streamOptions{batchSize: 2})
+		if err != nil || got.String() != wantBuf.String() {
+			t.Errorf("%s: expected the same predictions, got: %q %v", format, got.String(), err)
+		}
+	}
+
+	// numeric models don't save a pipeline and keep the version 1 format
+	iris, err := parseCSV(strings.NewReader(irisCSV), false)
+	if err != nil {
+		t.Fatal("unexpected error parsing iris data:", err)
+	}
+	m.Fit(iris, modelOptions{nTree: 2, minSplit: 2, minLeaf: 1, maxFeatures: -1, nWorkers: 1, seed: 1})
+	var buf bytes.Buffer
+	if err := m.SaveFormat(&buf, formatJSON); err != nil {
+		t.Fatal("unexpected error saving model:", err)
+	}
+	if m.Pipeline != nil || !strings.Contains(buf.String(), `"version":1`) {
+		t.Error("expected a numeric model to be saved without a pipeline as version 1")
+	}
+}
+
+func TestPipelineServeExport(t *testing.T) {
+	enc := encodeOptions{types: map[string]string{"grade": colCategorical}, encoding: encodeOrdinal, impute: "mean"}
+	d, err := parseCSVOpts(strings.NewReader(colorCSV), parseOptions{encode: enc})
+	if err != nil {
+		t.Fatal("unexpected error parsing data:", err)
+	}
+	m := new(Model)
+	m.Fit(d, modelOptions{nTree: 5, minSplit: 2, minLeaf: 1, maxFeatures: -1, nWorkers: 1, seed: 1})
+
+	// requests name the csv columns and are encoded as csv cells
+	s := newServer(m)
+	x, err := s.example(map[string]json.RawMessage{"color": json.RawMessage(`"blue"`), "grade": json.RawMessage(`2`)})
+	if err != nil {
+		t.Fatal("unexpected error encoding a request:", err)
+	}
+	row, _ := m.Pipeline.transform([]string{"blue", "", "2"})
+	if !reflect.DeepEqual(x, row) {
+		t.Errorf("expected the request to be encoded as %v, got: %v", row, x)
+	}
+
+	if _, err := s.example(map[string]json.RawMessage{"size": json.RawMessage(`1`)}); err == nil || !strings.Contains(err.Error(), `missing feature "color"`) {
+		t.Error("expected an error for the missing color column, got:", err)
+	}
+
+	for format, export := range exporters {
+		err := export(m, new(bytes.Buffer))
+		if err == nil || !strings.Contains(err.Error(), "encoded columns") {
+			t.Errorf("%s: expected an error exporting a model with a pipeline, got: %v", format, err)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/wlattner/rf/tree"
+)
+
+// PMML 4.4 documents, only the elements needed for a forest of binary trees
+// are defined. See http://dmg.org/pmml/v4-4/MultipleModels.html and
+// http://dmg.org/pmml/v4-4/TreeModel.html
+
+const pmmlNamespace = "http://www.dmg.org/PMML-4_4"
+
+type pmmlDoc struct {
+	XMLName        xml.Name           `xml:"PMML"`
+	Xmlns          string             `xml:"xmlns,attr"`
+	Version        string             `xml:"version,attr"`
+	Header         pmmlHeader         `xml:"Header"`
+	DataDictionary pmmlDataDictionary `xml:"DataDictionary"`
+	MiningModel    pmmlMiningModel    `xml:"MiningModel"`
+}
+
+type pmmlHeader struct {
+	Description string `xml:"description,attr"`
+	Application struct {
+		Name string `xml:"name,attr"`
+	} `xml:"Application"`
+}
+
+type pmmlDataDictionary struct {
+	NumberOfFields int             `xml:"numberOfFields,attr"`
+	DataFields     []pmmlDataField `xml:"DataField"`
+}
+
+type pmmlDataField struct {
+	Name     string      `xml:"name,attr"`
+	OpType   string      `xml:"optype,attr"`
+	DataType string      `xml:"dataType,attr"`
+	Values   []pmmlValue `xml:"Value"`
+}
+
+type pmmlValue struct {
+	Value string `xml:"value,attr"`
+}
+
+type pmmlMiningSchema struct {
+	MiningFields []pmmlMiningField `xml:"MiningField"`
+}
+
+type pmmlMiningField struct {
+	Name      string `xml:"name,attr"`
+	UsageType string `xml:"usageType,attr"`
+}
+
+type pmmlMiningModel struct {
+	FunctionName  string           `xml:"functionName,attr"`
+	AlgorithmName string           `xml:"algorithmName,attr"`
+	MiningSchema  pmmlMiningSchema `xml:"MiningSchema"`
+	Segmentation  pmmlSegmentation `xml:"Segmentation"`
+}
+
+type pmmlSegmentation struct {
+	MultipleModelMethod string        `xml:"multipleModelMethod,attr"`
+	Segments            []pmmlSegment `xml:"Segment"`
+}
+
+type pmmlSegment struct {
+	ID        string        `xml:"id,attr"`
+	True      *struct{}     `xml:"True"`
+	TreeModel pmmlTreeModel `xml:"TreeModel"`
+}
+
+type pmmlTreeModel struct {
+	FunctionName        string           `xml:"functionName,attr"`
+	SplitCharacteristic string           `xml:"splitCharacteristic,attr"`
+	NoTrueChildStrategy string           `xml:"noTrueChildStrategy,attr"`
+	MiningSchema        pmmlMiningSchema `xml:"MiningSchema"`
+	Node                pmmlNode         `xml:"Node"`
+}
+
+type pmmlNode struct {
+	ID                 int                     `xml:"id,attr"`
+	Score              string                  `xml:"score,attr"`
+	RecordCount        int                     `xml:"recordCount,attr"`
+	True               *struct{}               `xml:"True"`
+	SimplePredicate    *pmmlSimplePredicate    `xml:"SimplePredicate"`
+	ScoreDistributions []pmmlScoreDistribution `xml:"ScoreDistribution"`
+	Nodes              []pmmlNode              `xml:"Node"`
+}
+
+type pmmlSimplePredicate struct {
+	Field    string `xml:"field,attr"`
+	Operator string `xml:"operator,attr"`
+	Value    string `xml:"value,attr"`
+}
+
+type pmmlScoreDistribution struct {
+	Value       string `xml:"value,attr"`
+	RecordCount int    `xml:"recordCount,attr"`
+}
+
+// WritePMML writes the forest as a PMML 4.4 MiningModel with a TreeModel
+// segment for each tree. Classification trees are combined by majority vote
+// and regression trees by their average, as in Predict. The features are
+// continuous fields named by VarNames, examples go to the left child of a
+// node when the feature is less than or equal to the threshold. The
+// probability calibration of a classifier isn't included, it doesn't change
+// the predicted class. Online forests can't be exported.
+func (m *Model) WritePMML(w io.Writer) error {
+	if m.IsOnline {
+		return errors.New("online models can't be exported to PMML")
+	}
+	if m.Pipeline != nil {
+		return errExportPipeline("PMML")
+	}
+
+	target := m.Target
+	if target == "" {
+		target = targetName(m.VarNames)
+	}
+	doc := pmmlDoc{
+		Xmlns:   pmmlNamespace,
+		Version: "4.4",
+		Header:  pmmlHeader{Description: "random forest"},
+	}
+	doc.Header.Application.Name = "rf"
+
+	var schema pmmlMiningSchema
+	for _, name := range m.VarNames {
+		doc.DataDictionary.DataFields = append(doc.DataDictionary.DataFields,
+			pmmlDataField{Name: name, OpType: "continuous", DataType: "double"})
+		schema.MiningFields = append(schema.MiningFields, pmmlMiningField{Name: name, UsageType: "active"})
+	}
+	schema.MiningFields = append(schema.MiningFields, pmmlMiningField{Name: target, UsageType: "target"})
+
+	mm := &doc.MiningModel
+	mm.AlgorithmName = "randomForest"
+	mm.MiningSchema = schema
+	targetField := pmmlDataField{Name: target}
+
+	if m.IsRegression {
+		targetField.OpType, targetField.DataType = "continuous", "double"
+		mm.FunctionName = "regression"
+		mm.Segmentation.MultipleModelMethod = "average"
+		for i, t := range m.Reg.Trees {
+			mm.Segmentation.Segments = append(mm.Segmentation.Segments,
+				pmmlTreeSegment(i, "regression", schema, pmmlRegNode(t.Root, m.VarNames, new(int))))
+		}
+	} else {
+		// ties in the vote go to the first class, as in Predict
+		targetField.OpType, targetField.DataType = "categorical", "string"
+		for _, class := range m.Clf.Classes {
+			targetField.Values = append(targetField.Values, pmmlValue{Value: class})
+		}
+		mm.FunctionName = "classification"
+		mm.Segmentation.MultipleModelMethod = "majorityVote"
+		for i, t := range m.Clf.Trees {
+			mm.Segmentation.Segments = append(mm.Segmentation.Segments,
+				pmmlTreeSegment(i, "classification", schema, pmmlClassNode(t.Root, m.VarNames, m.Clf.Classes, new(int))))
+		}
+	}
+	doc.DataDictionary.DataFields = append(doc.DataDictionary.DataFields, targetField)
+	doc.DataDictionary.NumberOfFields = len(doc.DataDictionary.DataFields)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", " ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// targetName returns a name for the target that isn't a feature name, for
+// models fit without a header that don't have the name of the target column
+func targetName(features []string) string {
+	name := "target"
+	for taken := true; taken; {
+		taken = false
+		for _, f := range features {
+			if f == name {
+				name += "_"
+				taken = true
+				break
+			}
+		}
+	}
+	return name
+}
+
+func pmmlTreeSegment(i int, function string, schema pmmlMiningSchema, root pmmlNode) pmmlSegment {
+	return pmmlSegment{
+		ID:   strconv.Itoa(i + 1),
+		True: &struct{}{},
+		TreeModel: pmmlTreeModel{
+			FunctionName:        function,
+			SplitCharacteristic: "binarySplit",
+			NoTrueChildStrategy: "returnLastPrediction",
+			MiningSchema:        schema,
+			Node:                root,
+		},
+	}
+}
+
+// pmmlSplit sets the predicates of the children of a split, the left child
+// gets the examples with the feature less than or equal to the threshold
+func pmmlSplit(left, right *pmmlNode, feature string, threshold float64) {
+	value := strconv.FormatFloat(threshold, 'g', -1, 64)
+	left.True, right.True = nil, nil
+	left.SimplePredicate = &pmmlSimplePredicate{Field: feature, Operator: "lessOrEqual", Value: value}
+	right.SimplePredicate = &pmmlSimplePredicate{Field: feature, Operator: "greaterThan", Value: value}
+}
+
+// pmmlClassNode converts the tree rooted at n, nodes are numbered in depth
+// first order starting from *id
+func pmmlClassNode(n *tree.Node, features, classes []string, id *int) pmmlNode {
+	p := pmmlNode{ID: *id, RecordCount: n.Samples, True: &struct{}{}}
+	*id++
+
+	// the score is the most common class, as in tree.Classifier.Predict
+	maxCt := 0
+	maxC := 0
+	for class, count := range n.ClassCounts {
+		if count > maxCt {
+			maxCt = count
+			maxC = class
+		}
+		p.ScoreDistributions = append(p.ScoreDistributions, pmmlScoreDistribution{Value: classes[class], RecordCount: count})
+	}
+	p.Score = classes[maxC]
+
+	if !n.Leaf {
+		left := pmmlClassNode(n.Left, features, classes, id)
+		right := pmmlClassNode(n.Right, features, classes, id)
+		pmmlSplit(&left, &right, features[n.SplitVar], n.SplitVal)
+		p.Nodes = []pmmlNode{left, right}
+	}
+	return p
+}
+
+// pmmlRegNode converts the tree rooted at n as in pmmlClassNode
+func pmmlRegNode(n *tree.RegNode, features []string, id *int) pmmlNode {
+	p := pmmlNode{
+		ID:          *id,
+		RecordCount: n.Samples,
+		True:        &struct{}{},
+		Score:       strconv.FormatFloat(n.Value, 'g', -1, 64),
+	}
+	*id++
+
+	if !n.Leaf {
+		left := pmmlRegNode(n.Left, features, id)
+		right := pmmlRegNode(n.Right, features, id)
+		pmmlSplit(&left, &right, features[n.SplitVar], n.SplitVal)
+		p.Nodes = []pmmlNode{left, right}
+	}
+	return p
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// syntheticCSV returns n examples with 3 features, the label is a class
+// or, with regression, a number
+func syntheticCSV(n int, regression bool) string {
+	r := rand.New(rand.NewSource(1))
+	var b strings.Builder
+	b.WriteString("y,a,b,c\n")
+	for i := 0; i < n; i++ {
+		a, bb, c := r.Float64(), r.NormFloat64(), float64(r.Intn(5))
+		var y string
+		switch {
+		case regression:
+			y = strconv.FormatFloat(3*a+bb*bb+c+r.NormFloat64()*0.1, 'g', -1, 64)
+		case a+0.3*r.NormFloat64() > 0.6:
+			y = "high"
+		case bb > 0:
+			y = "mid"
+		default:
+			y = "low"
+		}
+		fmt.Fprintf(&b, "%s,%g,%g,%g\n", y, a, bb, c)
+	}
+	return b.String()
+}
+
+// the elements of a PMML document needed to score it, parsed independently
+// of the types used to write it
+type testPMML struct {
+	DataFields []struct {
+		Name   string `xml:"name,attr"`
+		Values []struct {
+			Value string `xml:"value,attr"`
+		} `xml:"Value"`
+	} `xml:"DataDictionary>DataField"`
+	MiningModel struct {
+		FunctionName string `xml:"functionName,attr"`
+		Segmentation struct {
+			Method   string `xml:"multipleModelMethod,attr"`
+			Segments []struct {
+				Root testPMMLNode `xml:"TreeModel>Node"`
+			} `xml:"Segment"`
+		} `xml:"Segmentation"`
+	} `xml:"MiningModel"`
+}
+
+type testPMMLNode struct {
+	Score     string `xml:"score,attr"`
+	Predicate *struct {
+		Field    string `xml:"field,attr"`
+		Operator string `xml:"operator,attr"`
+		Value    string `xml:"value,attr"`
+	} `xml:"SimplePredicate"`
+	Nodes []testPMMLNode `xml:"Node"`
+}
+
+// score follows the first child with a true predicate until a leaf
+func (n *testPMMLNode) score(t *testing.T, x map[string]float64) string {
+	for len(n.Nodes) > 0 {
+		next := -1
+		for i, c := range n.Nodes {
+			v, err := strconv.ParseFloat(c.Predicate.Value, 64)
+			if err != nil {
+				t.Fatal("invalid predicate value:", err)
+			}
+			switch c.Predicate.Operator {
+			case "lessOrEqual":
+				if x[c.Predicate.Field] <= v {
+					next = i
+				}
+			case "greaterThan":
+				if x[c.Predicate.Field] > v {
+					next = i
+				}
+			default:
+				t.Fatal("unexpected operator:", c.Predicate.Operator)
+			}
+			if next >= 0 {
+				break
+			}
+		}
+		if next < 0 {
+			t.Fatal("no child matches the example")
+		}
+		n = &n.Nodes[next]
+	}
+	return n.Score
+}
+
+// scorePMML scores each example of X with the PMML document
+func scorePMML(t *testing.T, doc []byte, names []string, X [][]float64) []string {
+	var p testPMML
+	if err := xml.Unmarshal(doc, &p); err != nil {
+		t.Fatal("unexpected error parsing PMML:", err)
+	}
+
+	target := p.DataFields[len(p.DataFields)-1]
+	segments := p.MiningModel.Segmentation.Segments
+	pred := make([]string, len(X))
+	for i, row := range X {
+		x := make(map[string]float64)
+		for j, name := range names {
+			x[name] = row[j]
+		}
+
+		switch p.MiningModel.Segmentation.Method {
+		case "average":
+			sum := 0.0
+			for _, s := range segments {
+				v, err := strconv.ParseFloat(s.Root.score(t, x), 64)
+				if err != nil {
+					t.Fatal("invalid score:", err)
+				}
+				sum += v
+			}
+			pred[i] = strconv.FormatFloat(sum/float64(len(segments)), 'g', -1, 64)
+		case "majorityVote":
+			votes := make(map[string]int)
+			for _, s := range segments {
+				votes[s.Root.score(t, x)]++
+			}
+			// ties go to the first category
+			best := -1
+			for _, v := range target.Values {
+				if votes[v.Value] > best {
+					best = votes[v.Value]
+					pred[i] = v.Value
+				}
+			}
+		default:
+			t.Fatal("unexpected multiple model method:", p.MiningModel.Segmentation.Method)
+		}
+	}
+	return pred
+}
+
+func TestPMMLClassifier(t *testing.T) {
+	d, err := parseCSV(strings.NewReader(syntheticCSV(300, false)), false)
+	if err != nil {
+		t.Fatal("unexpected error parsing data:", err)
+	}
+	m := new(Model)
+	m.Fit(d, modelOptions{nTree: 15, minSplit: 2, minLeaf: 1, maxFeatures: -1, nWorkers: 1, seed: 1})
+
+	var buf bytes.Buffer
+	if err := m.WritePMML(&buf); err != nil {
+		t.Fatal("unexpected error writing PMML:", err)
+	}
+	if !strings.Contains(buf.String(), `<PMML xmlns="http://www.dmg.org/PMML-4_4" version="4.4">`) {
+		t.Error("expected a PMML 4.4 document")
+	}
+	if !strings.Contains(buf.String(), `<MiningField name="y" usageType="target">`) {
+		t.Error("expected the target field to have the name of the target column y")
+	}
+
+	got := scorePMML(t, buf.Bytes(), m.VarNames, d.X)
+	for i, id := range m.Clf.Predict(d.X) {
+		if want := m.Clf.Classes[id]; got[i] != want {
+			t.Errorf("example %d: expected %s from PMML, got: %s", i, want, got[i])
+		}
+	}
+
+	// models fit without a header don't know the name of the target
+	m.Target = ""
+	buf.Reset()
+	if err := m.WritePMML(&buf); err != nil {
+		t.Fatal("unexpected error writing PMML:", err)
+	}
+	if !strings.Contains(buf.String(), `<MiningField name="target" usageType="target">`) {
+		t.Error("expected the target field to be named target without a target column name")
+	}
+}
+
+func TestPMMLRegressor(t *testing.T) {
+	d, err := parseCSV(strings.NewReader(syntheticCSV(300, true)), false)
+	if err != nil {
+		t.Fatal("unexpected error parsing data:", err)
+	}
+	m := new(Model)
+	m.Fit(d, modelOptions{nTree: 15, minSplit: 2, minLeaf: 1, maxFeatures: -1, nWorkers: 1, seed: 1})
+
+	var buf bytes.Buffer
+	if err := m.WritePMML(&buf); err != nil {
+		t.Fatal("unexpected error writing PMML:", err)
+	}
+
+	got := scorePMML(t, buf.Bytes(), m.VarNames, d.X)
+	want := m.Reg.Predict(d.X)
+	for i := range want {
+		v, _ := strconv.ParseFloat(got[i], 64)
+		if math.Abs(v-want[i]) > 1e-9 {
+			t.Errorf("example %d: expected %f from PMML, got: %s", i, want[i], got[i])
+		}
+	}
+
+	m.IsOnline = true
+	if err := m.WritePMML(new(bytes.Buffer)); err == nil {
+		t.Error("expected an error exporting an online model")
+	}
+}
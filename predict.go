@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/wlattner/rf/tree"
+)
+
+// streamOptions controls how PredictStream reads examples
+type streamOptions struct {
+	batchSize int          // number of rows read and predicted at a time
+	libSVM    bool         // examples are in LIBSVM format instead of csv
+	std       string       // add a standard deviation column, see PredictStd
+	columns   parseOptions // roles of the csv columns, the pipeline is set by PredictStream
+}
+
+// runPredict writes predictions for the examples in --data to --predictions
+// using the model in --final_model
+func runPredict() {
+	m, err := loadModel(*modelFile)
+	if err != nil {
+		fatal("error opening model file", err.Error())
+	}
+	m.setWorkers(*nWorkers)
+
+	in, err := openInput(*dataFile)
+	if err != nil {
+		fatal("error opening input data", err.Error())
+	}
+	defer in.Close()
+
+	// a file isn't left behind if the data doesn't match the model
+	opt := streamOptions{batchSize: *batchSize, libSVM: *libSVM, std: *predStd}
+	opt.columns.setColumnRoles()
+	err = writeOutput(*predictFile, func(w io.Writer) error {
+		return m.PredictStream(in, w, opt)
+	})
+	if err != nil {
+		fatal("error making predictions", err.Error())
+	}
+}
+
+// PredictStream reads examples from r in batches, predicts each batch and
+// writes the predictions to w in input order as in writePred. The next batch
+// is parsed while the current batch is predicted, so at most a few batches
+// are held in memory regardless of the size of the input. With id columns,
+// the ids are written before each prediction after a header row.
+func (m *Model) PredictStream(r io.Reader, w io.Writer, opt streamOptions) error {
+	if opt.libSVM && opt.columns.idCols != nil {
+		return errors.New("id columns are not supported for LIBSVM input")
+	}
+	opt.columns.pipeline = m.inputPipeline()
+	opt.columns.modelTarget = m.Target
+	batches := make(chan *parsedInput)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(batches)
+		readErr <- readBatches(r, opt, func(d *parsedInput) bool {
+			select {
+			case batches <- d:
+				return true
+			case <-done:
+				return false
+			}
+		})
+	}()
+
+	wtr := bufio.NewWriter(w)
+	if opt.columns.idCols != nil {
+		err := writePredHeader(wtr, opt.columns.idCols, opt.std != "")
+		if err != nil {
+			return err
+		}
+	}
+	for d := range batches {
+		// csv rows all have the same number of fields, sparse examples
+		// only list features up to the largest nonzero
+		if n := d.numFeatures(); n > len(m.VarNames) || (d.Sparse == nil && n != len(m.VarNames)) {
+			return fmt.Errorf("model was fit with %d features, data has %d", len(m.VarNames), n)
+		}
+
+		pred, err := m.Predict(d)
+		if err != nil {
+			return err
+		}
+
+		var std []float64
+		if opt.std != "" {
+			std, err = m.PredictStd(d, opt.std)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = writePred(wtr, d.IDs, pred, std)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := <-readErr; err != nil {
+		return err
+	}
+	return wtr.Flush()
+}
+
+// readBatches parses the examples in r into batches of up to opt.batchSize
+// rows and calls emit with each batch until emit returns false
+func readBatches(r io.Reader, opt streamOptions, emit func(*parsedInput) bool) error {
+	batchSize := opt.batchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	// set from the header, if any, before the first row
+	var layout *csvLayout
+	newBatch := func() *parsedInput {
+		if opt.libSVM {
+			return &parsedInput{Sparse: &tree.CSR{Indptr: []int{0}}}
+		}
+		return &parsedInput{pipeline: opt.columns.pipeline, layout: layout}
+	}
+	d := newBatch()
+
+	// add is called after each row, it sends full batches
+	add := func() error {
+		if d.numRows() < batchSize {
+			return nil
+		}
+		if !emit(d) {
+			return errStopped
+		}
+		d = newBatch()
+		return nil
+	}
+
+	var err error
+	if opt.libSVM {
+		err = scanLibSVM(r, func(fields []string) error {
+			if err := d.parseLibSVMRow(fields); err != nil {
+				return err
+			}
+			return add()
+		})
+	} else {
+		err = readCSVRows(r, func(header []string) error {
+			var err error
+			layout, _, err = newCSVLayout(header, true, opt.columns, false)
+			d.layout = layout
+			return err
+		}, func(row []string, line int) error {
+			if layout == nil {
+				var err error
+				layout, _, err = newCSVLayout(row, false, opt.columns, false)
+				if err != nil {
+					return err
+				}
+				d.layout = layout
+			}
+			if err := d.ParseRow(row, line); err != nil {
+				return err
+			}
+			return add()
+		})
+	}
+
+	if err == errStopped {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if d.numRows() > 0 {
+		emit(d)
+	}
+	return nil
+}
+
+// nopCloser wraps stdin/stdout so they aren't closed with files
+type nopCloser struct {
+	io.ReadWriter
+}
+
+func (nopCloser) Close() error { return nil }
+
+// openInput opens the file name for reading, - is stdin
+func openInput(name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return nopCloser{os.Stdin}, nil
+	}
+	return os.Open(name)
+}
+
+// writeOutput calls fn with the file name, - is stdout. Files are written
+// as in writeAtomic.
+func writeOutput(name string, fn func(io.Writer) error) error {
+	if name == "-" {
+		return fn(os.Stdout)
+	}
+	return writeAtomic(name, fn)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPredictStream(t *testing.T) {
+	d, err := parseCSV(strings.NewReader(irisCSV), false)
+	if err != nil {
+		t.Fatal("unexpected error parsing iris data:", err)
+	}
+
+	m := new(Model)
+	m.Fit(d, modelOptions{nTree: 10, minSplit: 2, minLeaf: 1, maxFeatures: -1, nWorkers: 2, seed: 1})
+
+	pred, err := m.Predict(d)
+	if err != nil {
+		t.Fatal("unexpected error predicting iris data:", err)
+	}
+	var want bytes.Buffer
+	writePred(&want, nil, pred, nil)
+
+	// batches that divide the rows evenly, unevenly and a single batch
+	for _, size := range []int{1, 3, 4, 100} {
+		var got bytes.Buffer
+		err := m.PredictStream(strings.NewReader(irisCSV), &got, streamOptions{batchSize: size})
+		if err != nil {
+			t.Errorf("unexpected error with batch size %d: %v", size, err)
+			continue
+		}
+		if got.String() != want.String() {
+			t.Errorf("expected the same predictions with batch size %d, got:\n%s", size, got.String())
+		}
+	}
+
+	bad := irisCSV + `"setosa",5.1,3.5,1.4,0.2,1.0` + "\n"
+	err = m.PredictStream(strings.NewReader(bad), new(bytes.Buffer), streamOptions{batchSize: 4})
+	if err == nil {
+		t.Error("expected an error for a row with the wrong number of fields")
+	}
+}
+
+func TestPredictColumns(t *testing.T) {
+	d, err := parseCSV(strings.NewReader(irisCSV), false)
+	if err != nil {
+		t.Fatal("unexpected error parsing iris data:", err)
+	}
+	m := new(Model)
+	m.Fit(d, modelOptions{nTree: 10, minSplit: 2, minLeaf: 1, maxFeatures: -1, nWorkers: 1, seed: 1})
+
+	var want bytes.Buffer
+	if err := m.PredictStream(strings.NewReader(irisCSV), &want, streamOptions{batchSize: 4}); err != nil {
+		t.Fatal("unexpected error predicting iris data:", err)
+	}
+
+	// move Sepal.Length to the end and add a column the model doesn't use
+	var reordered []string
+	for _, line := range strings.Split(strings.TrimSpace(irisCSV), "\n") {
+		f := strings.Split(line, ",")
+		f = append([]string{f[0]}, append(f[2:], f[1], "extra")...)
+		reordered = append(reordered, strings.Join(f, ","))
+	}
+	file := strings.Join(reordered, "\n") + "\n"
+
+	var got bytes.Buffer
+	if err := m.PredictStream(strings.NewReader(file), &got, streamOptions{batchSize: 4}); err != nil {
+		t.Fatal("unexpected error predicting reordered columns:", err)
+	}
+	if got.String() != want.String() {
+		t.Errorf("expected the same predictions with reordered columns, got:\n%s", got.String())
+	}
+
+	// files without the label, or with it last, are matched by name
+	var noLabel, labelLast []string
+	for _, line := range strings.Split(strings.TrimSpace(irisCSV), "\n") {
+		f := strings.Split(line, ",")
+		noLabel = append(noLabel, strings.Join(f[1:], ","))
+		labelLast = append(labelLast, strings.Join(append(f[1:], f[0]), ","))
+	}
+	for name, lines := range map[string][]string{"no label": noLabel, "label last": labelLast} {
+		got.Reset()
+		if err := m.PredictStream(strings.NewReader(strings.Join(lines, "\n")+"\n"), &got, streamOptions{batchSize: 4}); err != nil {
+			t.Errorf("unexpected error predicting a file with %s: %v", name, err)
+		} else if got.String() != want.String() {
+			t.Errorf("expected the same predictions for a file with %s, got:\n%s", name, got.String())
+		}
+	}
+
+	// files without a header are read by position
+	got.Reset()
+	headerless := irisCSV[strings.Index(irisCSV, "\n")+1:]
+	if err := m.PredictStream(strings.NewReader(headerless), &got, streamOptions{batchSize: 4}); err != nil {
+		t.Error("unexpected error predicting a file without a header:", err)
+	} else if got.String() != want.String() {
+		t.Errorf("expected the same predictions for a file without a header, got:\n%s", got.String())
+	}
+
+	// models saved without the target name still read files without the label
+	m.Target = ""
+	got.Reset()
+	if err := m.PredictStream(strings.NewReader(strings.Join(noLabel, "\n")+"\n"), &got, streamOptions{batchSize: 4}); err != nil {
+		t.Error("unexpected error predicting a file without the label:", err)
+	} else if got.String() != want.String() {
+		t.Errorf("expected the same predictions for a file without the label, got:\n%s", got.String())
+	}
+	m.Target = "Species"
+
+	missing := strings.Replace(irisCSV, `"Petal.Width"`, `"Petal.W"`, 1)
+	err = m.PredictStream(strings.NewReader(missing), new(bytes.Buffer), streamOptions{batchSize: 4})
+	if err == nil || !strings.Contains(err.Error(), "line 1: missing columns required by the model: Petal.Width") {
+		t.Error("expected an error for the missing Petal.Width column, got:", err)
+	}
+
+	// missing columns are imputed when the model fills missing values
+	m.Pipeline = numericPipeline(m.VarNames)
+	m.Pipeline.Columns[3].Impute, m.Pipeline.Columns[3].Fill = "mean", 1.2
+	if err := m.PredictStream(strings.NewReader(missing), new(bytes.Buffer), streamOptions{batchSize: 4}); err != nil {
+		t.Error("unexpected error imputing a missing column:", err)
+	}
+
+	ragged := strings.Replace(irisCSV, "4.6,3.1,1.5,0.2", "4.6,3.1,1.5", 1)
+	err = m.PredictStream(strings.NewReader(ragged), new(bytes.Buffer), streamOptions{batchSize: 4})
+	if err == nil || !strings.Contains(err.Error(), "line 5: expected 5 columns") {
+		t.Error("expected an error for the short row on line 5, got:", err)
+	}
+	_, err = parseCSVOpts(strings.NewReader(ragged), parseOptions{pipeline: m.inputPipeline()})
+	if err == nil || !strings.Contains(err.Error(), "line 5:") {
+		t.Error("expected an error for the short row on line 5 when parsing, got:", err)
+	}
+}
+
+func TestPredictIDs(t *testing.T) {
+	d, err := parseCSVOpts(strings.NewReader(ordersCSV), ordersRoles)
+	if err != nil {
+		t.Fatal("unexpected error parsing orders:", err)
+	}
+	m := new(Model)
+	m.Fit(d, modelOptions{nTree: 5, minSplit: 2, minLeaf: 1, maxFeatures: -1, nWorkers: 1, seed: 1})
+	pred, _ := m.Predict(d)
+
+	// new orders don't have the target, weight or ignored columns
+	orders := "color,order_id,size\nred,b1,1\nblue,b2,4\n"
+	var got bytes.Buffer
+	err = m.PredictStream(strings.NewReader(orders), &got, streamOptions{batchSize: 1, columns: ordersRoles})
+	if err != nil {
+		t.Fatal("unexpected error predicting orders:", err)
+	}
+	want := "order_id,prediction\nb1," + pred[0] + "\nb2," + pred[3] + "\n"
+	if got.String() != want {
+		t.Errorf("expected predictions with ids:\n%s\ngot:\n%s", want, got.String())
+	}
+
+	got.Reset()
+	opt := streamOptions{batchSize: 2, columns: ordersRoles, std: "trees"}
+	if err := m.PredictStream(strings.NewReader(orders), &got, opt); err != nil {
+		t.Fatal("unexpected error predicting orders with std:", err)
+	}
+	if !strings.HasPrefix(got.String(), "order_id,prediction,std\nb1,") {
+		t.Error("expected a std column after the predictions, got:", got.String())
+	}
+}
+
+func TestPredictOutputFile(t *testing.T) {
+	d, err := parseCSV(strings.NewReader(irisCSV), false)
+	if err != nil {
+		t.Fatal("unexpected error parsing iris data:", err)
+	}
+	m := new(Model)
+	m.Fit(d, modelOptions{nTree: 5, minSplit: 2, minLeaf: 1, maxFeatures: -1, nWorkers: 1, seed: 1})
+
+	dir, err := ioutil.TempDir("", "rf-predict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "pred.csv")
+
+	// the error is on line 5, after the first batch was written
+	ragged := strings.Replace(irisCSV, "4.6,3.1,1.5,0.2", "4.6,3.1,1.5", 1)
+	err = writeOutput(name, func(w io.Writer) error {
+		return m.PredictStream(strings.NewReader(ragged), w, streamOptions{batchSize: 2})
+	})
+	if err == nil {
+		t.Fatal("expected an error for the short row")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected no files after a failed prediction, got %d", len(files))
+	}
+
+	err = writeOutput(name, func(w io.Writer) error {
+		return m.PredictStream(strings.NewReader(irisCSV), w, streamOptions{batchSize: 2})
+	})
+	if err != nil {
+		t.Fatal("unexpected error writing predictions:", err)
+	}
+	if b, err := ioutil.ReadFile(name); err != nil || bytes.Count(b, []byte("\n")) != len(d.YClf) {
+		t.Errorf("expected %d predictions in %s, got: %v", len(d.YClf), name, err)
+	}
+}
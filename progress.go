@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/wlattner/rf/forest"
+)
+
+// progressBar returns a function that redraws a progress bar on w as trees
+// are added to a forest, along with the running out of bag error.
+func progressBar(w io.Writer) func(forest.FitProgress) {
+	const width = 40
+
+	return func(p forest.FitProgress) {
+		done := width * p.Trees / p.NTrees
+		fmt.Fprintf(w, "\r[%s%s] %d/%d trees", strings.Repeat("=", done),
+			strings.Repeat(" ", width-done), p.Trees, p.NTrees)
+		if !math.IsNaN(p.OOBError) {
+			fmt.Fprintf(w, ", oob error %.4f", p.OOBError)
+		}
+	}
+}
+
+// isTerminal reports whether f is a terminal (character device), progress
+// bars are only drawn for terminals.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// interruptContext returns a context that is canceled on the first interrupt
+// signal (Ctrl-C), a second interrupt exits as usual. stop releases the
+// signal handler.
+func interruptContext() (ctx context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+
+	go func() {
+		select {
+		case <-sig:
+			signal.Stop(sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(sig)
+		cancel()
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	flag "github.com/docker/docker/pkg/mflag"
+)
+
+var (
+	registryDir  = flag.String([]string{"-registry"}, "", "model registry directory for serve and rollback, models are saved as <dir>/<name>/<version>.model")
+	registryPoll = flag.Duration([]string{"-poll"}, 5*time.Second, "how often serve checks --registry for new or changed models")
+	modelName    = flag.String([]string{"-model_name"}, "", "registry model to roll back")
+	modelVersion = flag.String([]string{"-model_version"}, "", "version to roll back to, latest to serve the newest version again, defaults to the version before the one being served")
+)
+
+const (
+	// modelExt is the extension of model files in a registry
+	modelExt = ".model"
+	// pinFile names the version of a model to serve instead of the latest,
+	// it is written by rollback
+	pinFile = "current"
+)
+
+// registry serves the models in a directory laid out as
+//
+//	<dir>/<name>/<version>.model
+//
+// The newest version of each model is served unless another version is
+// pinned by rollback. Versions are ordered by their dot separated parts,
+// numerically where both parts are numbers, so 10 is newer than 9.
+//
+// The directory is scanned by reload, new and changed files are loaded and
+// then swapped in together, requests in flight finish with the model they
+// started with. Files that fail to load (e.g. a partially written file) are
+// skipped and retried on the next reload, the previously loaded version is
+// served until then. Models should be written to a temporary name and
+// renamed into place.
+type registry struct {
+	dir     string
+	workers int
+	counter *requestCounter
+
+	mu     sync.RWMutex
+	models map[string]*registryModel // by name, replaced on each reload
+
+	loaded map[string]loadedFile // by path, only used by reload
+}
+
+// registryModel is the loaded versions of one model
+type registryModel struct {
+	versions map[string]*server
+	order    []string // versions, oldest first
+	active   string   // version served without an explicit version
+	pinned   bool     // active was set by rollback
+}
+
+// loadedFile is a model file as of its last load
+type loadedFile struct {
+	modTime time.Time
+	size    int64
+	srv     *server
+}
+
+func newRegistry(dir string, workers int) *registry {
+	return &registry{
+		dir:     dir,
+		workers: workers,
+		counter: newRequestCounter(),
+		models:  make(map[string]*registryModel),
+		loaded:  make(map[string]loadedFile),
+	}
+}
+
+// watch reloads the registry every interval until done is closed
+func (r *registry) watch(interval time.Duration, done <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := r.reload(); err != nil {
+				fmt.Fprintf(os.Stderr, "error reloading registry: %v\n", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// reload scans the registry directory, loads new or changed model files and
+// swaps in the new set of models. Errors loading individual files are
+// logged, only an unreadable registry directory is returned as an error.
+func (r *registry) reload() error {
+	dirs, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return err
+	}
+
+	models := make(map[string]*registryModel)
+	loaded := make(map[string]loadedFile)
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		name := d.Name()
+		files, err := ioutil.ReadDir(filepath.Join(r.dir, name))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error reading model %s: %v\n", name, err)
+			continue
+		}
+
+		rm := &registryModel{versions: make(map[string]*server)}
+		for _, f := range files {
+			if f.IsDir() || filepath.Ext(f.Name()) != modelExt {
+				continue
+			}
+			version := strings.TrimSuffix(f.Name(), modelExt)
+			path := filepath.Join(r.dir, name, f.Name())
+
+			prev, ok := r.loaded[path]
+			if !ok || !prev.modTime.Equal(f.ModTime()) || prev.size != f.Size() {
+				m, err := loadModel(path)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "error loading %s: %v\n", path, err)
+					if !ok {
+						continue
+					}
+					// keep serving the previous load
+				} else {
+					m.setWorkers(r.workers)
+					prev = loadedFile{modTime: f.ModTime(), size: f.Size(), srv: newServer(m)}
+					fmt.Fprintf(os.Stderr, "loaded %s version %s\n", name, version)
+				}
+			}
+			loaded[path] = prev
+			rm.versions[version] = prev.srv
+			rm.order = append(rm.order, version)
+		}
+		if len(rm.order) == 0 {
+			continue
+		}
+
+		sort.Slice(rm.order, func(i, j int) bool {
+			return compareVersions(rm.order[i], rm.order[j]) < 0
+		})
+		rm.active = rm.order[len(rm.order)-1]
+		if pin, err := readPin(filepath.Join(r.dir, name)); err != nil {
+			fmt.Fprintf(os.Stderr, "error reading pinned version of %s: %v\n", name, err)
+		} else if pin != "" {
+			if _, ok := rm.versions[pin]; ok {
+				rm.active, rm.pinned = pin, true
+			} else {
+				fmt.Fprintf(os.Stderr, "pinned version %s of %s not found, serving %s\n", pin, name, rm.active)
+			}
+		}
+		models[name] = rm
+	}
+
+	r.loaded = loaded
+	r.mu.Lock()
+	r.models = models
+	r.mu.Unlock()
+	return nil
+}
+
+// lookup returns the handler for version of the model name, the active
+// version if version is empty
+func (r *registry) lookup(name, version string) (*server, string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	rm, ok := r.models[name]
+	if !ok {
+		return nil, "", false
+	}
+	if version == "" {
+		version = rm.active
+	}
+	srv, ok := rm.versions[version]
+	return srv, version, ok
+}
+
+type registryInfo struct {
+	Name     string   `json:"name"`
+	Active   string   `json:"active"`
+	Pinned   bool     `json:"pinned"`
+	Versions []string `json:"versions"`
+}
+
+// ServeHTTP handles the endpoints
+//
+//	GET  /models                                     list models and versions
+//	POST /models/{name}/predict                      predict with the active version
+//	POST /models/{name}/versions/{version}/predict   predict with a version
+//	GET  /metrics                                    request counters
+//	GET  /healthz                                    health check
+//
+// along with /predict/batch and /model under each model and version, as in
+// newServer.
+func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/healthz":
+		writeJSONResponse(w, http.StatusOK, map[string]string{"status": "ok"})
+		return
+	case "/metrics":
+		r.counter.ServeHTTP(w, req)
+		return
+	case "/models":
+		r.handleList(w, req)
+		return
+	}
+
+	rest := strings.TrimPrefix(req.URL.Path, "/models/")
+	if rest == req.URL.Path {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown path %s", req.URL.Path))
+		return
+	}
+
+	name, endpoint := splitPath(rest)
+	version := ""
+	if strings.HasPrefix(endpoint, "versions/") {
+		version, endpoint = splitPath(strings.TrimPrefix(endpoint, "versions/"))
+		if version == "" {
+			writeError(w, http.StatusNotFound, fmt.Errorf("unknown path %s", req.URL.Path))
+			return
+		}
+	}
+
+	srv, version, ok := r.lookup(name, version)
+	if !ok {
+		if version == "" {
+			writeError(w, http.StatusNotFound, fmt.Errorf("unknown model %q", name))
+		} else {
+			writeError(w, http.StatusNotFound, fmt.Errorf("unknown version %q of model %q", version, name))
+		}
+		return
+	}
+
+	// the model's handler sees the path relative to the model
+	req2 := new(http.Request)
+	*req2 = *req
+	u := *req.URL
+	u.Path = "/" + endpoint
+	req2.URL = &u
+	counted(srv, r.counter, name, version).ServeHTTP(w, req2)
+}
+
+func (r *registry) handleList(w http.ResponseWriter, req *http.Request) {
+	if !allowMethod(w, req, http.MethodGet) {
+		return
+	}
+
+	r.mu.RLock()
+	list := make([]registryInfo, 0, len(r.models))
+	for name, rm := range r.models {
+		list = append(list, registryInfo{Name: name, Active: rm.active, Pinned: rm.pinned, Versions: rm.order})
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSONResponse(w, http.StatusOK, list)
+}
+
+// splitPath splits p at the first /
+func splitPath(p string) (string, string) {
+	if i := strings.IndexByte(p, '/'); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return p, ""
+}
+
+// compareVersions orders versions by their dot separated parts, parts that
+// are both numbers are compared numerically and others as strings. It
+// returns -1, 0 or 1 as a is older, the same as or newer than b.
+func compareVersions(a, b string) int {
+	pa, pb := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		na, errA := strconv.ParseUint(pa[i], 10, 64)
+		nb, errB := strconv.ParseUint(pb[i], 10, 64)
+		switch {
+		case errA == nil && errB == nil && na < nb:
+			return -1
+		case errA == nil && errB == nil && na > nb:
+			return 1
+		case errA == nil && errB == nil:
+		case pa[i] < pb[i]:
+			return -1
+		case pa[i] > pb[i]:
+			return 1
+		}
+	}
+	switch {
+	case len(pa) < len(pb):
+		return -1
+	case len(pa) > len(pb):
+		return 1
+	}
+	return 0
+}
+
+// modelVersions returns the versions of a model in a registry, oldest first
+func modelVersions(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []string
+	for _, f := range files {
+		if !f.IsDir() && filepath.Ext(f.Name()) == modelExt {
+			versions = append(versions, strings.TrimSuffix(f.Name(), modelExt))
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return compareVersions(versions[i], versions[j]) < 0
+	})
+	return versions, nil
+}
+
+// readPin returns the pinned version of the model in dir, or "" if the
+// newest version is served
+func readPin(dir string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, pinFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(b)), err
+}
+
+// rollback pins the model in dir to version, which is served in place of the
+// newest version until the next rollback. An empty version rolls back to the
+// version before the one currently served, latest removes the pin. It
+// returns the version served before and after.
+func rollback(dir, version string) (string, string, error) {
+	versions, err := modelVersions(dir)
+	if err != nil {
+		return "", "", err
+	}
+	if len(versions) == 0 {
+		return "", "", errors.New("no model versions found")
+	}
+
+	current, err := readPin(dir)
+	if err != nil {
+		return "", "", err
+	}
+	pos := len(versions) - 1
+	for i, v := range versions {
+		if v == current {
+			pos = i
+		}
+	}
+	current = versions[pos]
+
+	switch version {
+	case "latest":
+		err = os.Remove(filepath.Join(dir, pinFile))
+		if err != nil && !os.IsNotExist(err) {
+			return "", "", err
+		}
+		return current, versions[len(versions)-1], nil
+	case "":
+		if pos == 0 {
+			return "", "", fmt.Errorf("version %s is the oldest version", current)
+		}
+		version = versions[pos-1]
+	default:
+		found := false
+		for _, v := range versions {
+			found = found || v == version
+		}
+		if !found {
+			return "", "", fmt.Errorf("version %s not found", version)
+		}
+	}
+
+	// write then rename so serve never reads a partial file
+	tmp := filepath.Join(dir, "."+pinFile+".tmp")
+	err = ioutil.WriteFile(tmp, []byte(version+"\n"), 0644)
+	if err != nil {
+		return "", "", err
+	}
+	err = os.Rename(tmp, filepath.Join(dir, pinFile))
+	if err != nil {
+		os.Remove(tmp)
+		return "", "", err
+	}
+	return current, version, nil
+}
+
+// runRollback pins --model_name in --registry to --model_version
+func runRollback() {
+	if *registryDir == "" || *modelName == "" {
+		fatal("rollback requires --registry and --model_name")
+	}
+
+	prev, current, err := rollback(filepath.Join(*registryDir, *modelName), *modelVersion)
+	if err != nil {
+		fatal("error rolling back", *modelName, err.Error())
+	}
+	fmt.Fprintf(os.Stderr, "%s: serving version %s, was %s\n", *modelName, current, prev)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// saveIrisModel fits nTree trees to the iris data and saves the model as
+// version of iris in the registry dir
+func saveIrisModel(t *testing.T, dir, version string, nTree int) {
+	d, err := parseCSV(strings.NewReader(irisCSV), false)
+	if err != nil {
+		t.Fatal("unexpected error parsing iris data:", err)
+	}
+
+	m := new(Model)
+	m.Fit(d, modelOptions{nTree: nTree, minSplit: 2, minLeaf: 1, maxFeatures: -1, nWorkers: 1, seed: 1})
+
+	err = os.MkdirAll(filepath.Join(dir, "iris"), 0755)
+	if err != nil {
+		t.Fatal("unexpected error creating registry:", err)
+	}
+	f, err := os.Create(filepath.Join(dir, "iris", version+modelExt))
+	if err != nil {
+		t.Fatal("unexpected error creating model file:", err)
+	}
+	defer f.Close()
+	if err := m.Save(f); err != nil {
+		t.Fatal("unexpected error saving model:", err)
+	}
+}
+
+func getJSON(t *testing.T, url string, v interface{}) int {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal("unexpected error making request:", err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal("unexpected error decoding response:", err)
+	}
+	return resp.StatusCode
+}
+
+func TestRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rf-registry")
+	if err != nil {
+		t.Fatal("unexpected error creating registry:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	saveIrisModel(t, dir, "2", 5)
+	saveIrisModel(t, dir, "10", 10)
+
+	r := newRegistry(dir, 1)
+	if err := r.reload(); err != nil {
+		t.Fatal("unexpected error loading registry:", err)
+	}
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	trees := func(path string) int {
+		var info modelInfo
+		if status := getJSON(t, ts.URL+path, &info); status != http.StatusOK {
+			t.Fatalf("expected status 200 for %s, got: %d", path, status)
+		}
+		return info.Trees
+	}
+
+	// 10 is newer than 2
+	if n := trees("/models/iris/model"); n != 10 {
+		t.Error("expected the newest version to be served, got trees:", n)
+	}
+	if n := trees("/models/iris/versions/2/model"); n != 5 {
+		t.Error("expected version 2 to have 5 trees, got:", n)
+	}
+
+	var pred prediction
+	status := postJSON(t, ts.URL+"/models/iris/predict", `{"features": `+irisExample+`}`, &pred)
+	if status != http.StatusOK || pred.Class != "setosa" {
+		t.Errorf("expected setosa, got: %d %+v", status, pred)
+	}
+
+	var resp map[string]string
+	for _, path := range []string{"/models/rose/model", "/models/iris/versions/3/model", "/predict"} {
+		if status := getJSON(t, ts.URL+path, &resp); status != http.StatusNotFound {
+			t.Errorf("expected status 404 for %s, got: %d", path, status)
+		}
+	}
+
+	// roll back to the previous version, then pin it past a new version
+	prev, current, err := rollback(filepath.Join(dir, "iris"), "")
+	if err != nil || prev != "10" || current != "2" {
+		t.Fatalf("expected rollback from 10 to 2, got: %s %s %v", prev, current, err)
+	}
+	saveIrisModel(t, dir, "11", 15)
+	if err := r.reload(); err != nil {
+		t.Fatal("unexpected error reloading registry:", err)
+	}
+	if n := trees("/models/iris/model"); n != 5 {
+		t.Error("expected the pinned version to be served, got trees:", n)
+	}
+
+	var list []registryInfo
+	getJSON(t, ts.URL+"/models", &list)
+	if len(list) != 1 || list[0].Active != "2" || !list[0].Pinned || strings.Join(list[0].Versions, ",") != "2,10,11" {
+		t.Errorf("unexpected model list: %+v", list)
+	}
+
+	if _, _, err := rollback(filepath.Join(dir, "iris"), "latest"); err != nil {
+		t.Fatal("unexpected error removing the pinned version:", err)
+	}
+	if err := r.reload(); err != nil {
+		t.Fatal("unexpected error reloading registry:", err)
+	}
+	if n := trees("/models/iris/model"); n != 15 {
+		t.Error("expected the new version to be served, got trees:", n)
+	}
+
+	mresp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal("unexpected error making request:", err)
+	}
+	defer mresp.Body.Close()
+	metrics, _ := ioutil.ReadAll(mresp.Body)
+	for _, line := range []string{
+		"# TYPE rf_requests_total counter",
+		`rf_requests_total{model="iris",version="10",code="200"} 2`,
+		`rf_requests_total{model="iris",version="2",code="200"} 2`,
+		`rf_requests_total{model="iris",version="11",code="200"} 1`,
+	} {
+		if !strings.Contains(string(metrics), line+"\n") {
+			t.Errorf("expected metrics to contain %q, got:\n%s", line, metrics)
+		}
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"1", "2", -1},
+		{"10", "9", 1},
+		{"1.2", "1.10", -1},
+		{"1.2", "1.2.1", -1},
+		{"b", "a", 1},
+		{"2024-01-02", "2024-01-02", 0},
+	} {
+		if got := compareVersions(tc.a, tc.b); got != tc.want {
+			t.Errorf("compareVersions(%q, %q) = %d, expected %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	flag "github.com/docker/docker/pkg/mflag"
+)
+
+var serveAddr = flag.String([]string{"-addr"}, ":8080", "address for serve to listen on")
+
+// maxRequestBytes limits the size of a prediction request
+const maxRequestBytes = 32 << 20
+
+// runServe serves predictions over HTTP until interrupted, from the models
+// in --registry if given or the model in --final_model otherwise.
+func runServe() {
+	var (
+		handler http.Handler
+		name    string
+	)
+	if *registryDir != "" {
+		r := newRegistry(*registryDir, *nWorkers)
+		if err := r.reload(); err != nil {
+			fatal("error loading registry", err.Error())
+		}
+		done := make(chan struct{})
+		defer close(done)
+		go r.watch(*registryPoll, done)
+		handler, name = r, *registryDir
+	} else {
+		m, err := loadModel(*modelFile)
+		if err != nil {
+			fatal("error opening model file", err.Error())
+		}
+		m.setWorkers(*nWorkers)
+		handler, name = singleModelHandler(m, strings.TrimSuffix(filepath.Base(*modelFile), filepath.Ext(*modelFile))), *modelFile
+	}
+
+	srv := &http.Server{
+		Addr:         *serveAddr,
+		Handler:      handler,
+		ReadTimeout:  time.Minute,
+		WriteTimeout: time.Minute,
+	}
+
+	// Ctrl-C lets in flight requests finish
+	ctx, stop := interruptContext()
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+
+	fmt.Fprintf(os.Stderr, "serving %s on %s\n", name, *serveAddr)
+	err := srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		fatal("error serving model", err.Error())
+	}
+}
+
+// singleModelHandler serves m as in newServer, with request counters for
+// the model at /metrics
+func singleModelHandler(m *Model, name string) http.Handler {
+	counter := newRequestCounter()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", counter)
+	mux.Handle("/", counted(newServer(m), counter, name, ""))
+	return mux
+}
+
+// server handles prediction requests for a fitted model. The model is only
+// read, so requests are handled concurrently.
+type server struct {
+	m        *Model
+	pipeline *Pipeline      // encodes the columns of requests
+	columns  map[string]int // index of each column of the pipeline by name
+	mux      *http.ServeMux
+}
+
+// newServer returns a handler with the endpoints
+//
+//	POST /predict        {"features": {"name": value, ...}}
+//	POST /predict/batch  {"examples": [{"name": value, ...}, ...]}
+//	GET  /model          model metadata
+//	GET  /healthz        health check
+//
+// Features are the columns of the csv the model was fit with, matched by
+// name and encoded by the model's pipeline as csv cells are. Every column is
+// required unless the model imputes its missing values.
+func newServer(m *Model) *server {
+	s := &server{m: m, pipeline: m.inputPipeline(), columns: make(map[string]int), mux: http.NewServeMux()}
+	for i, e := range s.pipeline.Columns {
+		s.columns[e.Name] = i
+	}
+
+	s.mux.HandleFunc("/predict", s.handlePredict)
+	s.mux.HandleFunc("/predict/batch", s.handleBatch)
+	s.mux.HandleFunc("/model", s.handleModel)
+	s.mux.HandleFunc("/healthz", s.handleHealth)
+	return s
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// prediction is the response for one example, Class and Probabilities for
+// classification or Value for regression
+type prediction struct {
+	Class         string             `json:"class,omitempty"`
+	Probabilities map[string]float64 `json:"probabilities,omitempty"`
+	Value         *float64           `json:"value,omitempty"`
+}
+
+// the values of features are numbers, strings or null for missing values
+type predictRequest struct {
+	Features map[string]json.RawMessage `json:"features"`
+}
+
+type batchRequest struct {
+	Examples []map[string]json.RawMessage `json:"examples"`
+}
+
+type batchResponse struct {
+	Predictions []prediction `json:"predictions"`
+}
+
+type modelInfo struct {
+	Type     string   `json:"type"` // classification or regression
+	Online   bool     `json:"online"`
+	Trees    int      `json:"trees"`
+	Columns  []string `json:"columns"`  // named in requests
+	Features []string `json:"features"` // the encoded columns the trees use
+	Classes  []string `json:"classes,omitempty"`
+}
+
+func (s *server) handlePredict(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var req predictRequest
+	if err := decodeRequest(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	x, err := s.example(req.Features)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSONResponse(w, http.StatusOK, s.predict([][]float64{x})[0])
+}
+
+func (s *server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var req batchRequest
+	if err := decodeRequest(w, r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(req.Examples) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("no examples"))
+		return
+	}
+
+	X := make([][]float64, len(req.Examples))
+	for i, features := range req.Examples {
+		x, err := s.example(features)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("example %d: %v", i, err))
+			return
+		}
+		X[i] = x
+	}
+
+	writeJSONResponse(w, http.StatusOK, batchResponse{Predictions: s.predict(X)})
+}
+
+func (s *server) handleModel(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	info := modelInfo{
+		Type:     "classification",
+		Online:   s.m.IsOnline,
+		Features: s.m.VarNames,
+	}
+	for _, e := range s.pipeline.Columns {
+		info.Columns = append(info.Columns, e.Name)
+	}
+	if s.m.IsRegression {
+		info.Type = "regression"
+	}
+	switch {
+	case s.m.OnlineClf != nil:
+		info.Trees, info.Classes = s.m.OnlineClf.NTrees, s.m.OnlineClf.Classes
+	case s.m.OnlineReg != nil:
+		info.Trees = s.m.OnlineReg.NTrees
+	case s.m.Clf != nil:
+		info.Trees, info.Classes = s.m.Clf.NTrees, s.m.Clf.Classes
+	case s.m.Reg != nil:
+		info.Trees = s.m.Reg.NTrees
+	}
+
+	writeJSONResponse(w, http.StatusOK, info)
+}
+
+func (s *server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSONResponse(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// example returns the encoded features of an example given by column name.
+// Unknown columns are rejected, missing and null values are an error unless
+// the model imputes them or the column is categorical.
+func (s *server) example(features map[string]json.RawMessage) ([]float64, error) {
+	if len(features) == 0 {
+		return nil, errors.New("no features")
+	}
+
+	cells := make([]string, len(s.pipeline.Columns))
+	given := make([]bool, len(cells))
+	for name, raw := range features {
+		i, ok := s.columns[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown feature %q", name)
+		}
+		cell, null, err := jsonCell(raw)
+		if err != nil {
+			return nil, fmt.Errorf("feature %q: %v", name, err)
+		}
+		if e := s.pipeline.Columns[i]; null && e.Type == colNumeric && e.Impute == "" {
+			return nil, fmt.Errorf("feature %q is null", name)
+		}
+		cells[i], given[i] = cell, true
+	}
+	for i, e := range s.pipeline.Columns {
+		if !given[i] && (e.Type != colNumeric || e.Impute == "") {
+			return nil, fmt.Errorf("missing feature %q", e.Name)
+		}
+	}
+	return s.pipeline.transform(cells)
+}
+
+// jsonCell returns a JSON number or string as a csv cell, null is an empty
+// (missing) cell
+func jsonCell(raw json.RawMessage) (string, bool, error) {
+	if string(raw) == "null" {
+		return "", true, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, false, nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err != nil {
+		return "", false, errors.New("expected a number, a string or null")
+	}
+	return n.String(), false, nil
+}
+
+// predict returns the prediction for each example in X
+func (s *server) predict(X [][]float64) []prediction {
+	pred := make([]prediction, len(X))
+
+	if s.m.IsRegression {
+		var values []float64
+		if s.m.IsOnline {
+			values = s.m.OnlineReg.Predict(X)
+		} else {
+			values = s.m.Reg.Predict(X)
+		}
+		for i := range values {
+			pred[i].Value = &values[i]
+		}
+		return pred
+	}
+
+	// the class is the majority vote of the trees as with predict, the
+	// probabilities are averaged (and calibrated) separately
+	var (
+		ids     []int
+		prob    [][]float64
+		classes []string
+	)
+	if s.m.IsOnline {
+		ids, prob, classes = s.m.OnlineClf.Predict(X), s.m.OnlineClf.PredictProb(X), s.m.OnlineClf.Classes
+	} else {
+		ids, prob, classes = s.m.Clf.Predict(X), s.m.Clf.PredictProb(X), s.m.Clf.Classes
+	}
+	for i, p := range prob {
+		pred[i].Class = classes[ids[i]]
+		pred[i].Probabilities = make(map[string]float64, len(classes))
+		for id, class := range classes {
+			pred[i].Probabilities[class] = p[id]
+		}
+	}
+	return pred
+}
+
+// allowMethod writes a 405 response and returns false unless r uses method
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed, use %s", r.Method, method))
+	return false
+}
+
+// decodeRequest decodes the JSON body of r into v, rejecting unknown fields
+// and bodies over maxRequestBytes
+func decodeRequest(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid request: %v", err)
+	}
+	return nil
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSONResponse(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSONResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func irisServer(t *testing.T) *httptest.Server {
+	d, err := parseCSV(strings.NewReader(irisCSV), false)
+	if err != nil {
+		t.Fatal("unexpected error parsing iris data:", err)
+	}
+
+	m := new(Model)
+	m.Fit(d, modelOptions{nTree: 10, minSplit: 2, minLeaf: 1, maxFeatures: -1, nWorkers: 2, seed: 1})
+	return httptest.NewServer(newServer(m))
+}
+
+func postJSON(t *testing.T, url, body string, v interface{}) int {
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal("unexpected error making request:", err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal("unexpected error decoding response:", err)
+	}
+	return resp.StatusCode
+}
+
+const irisExample = `{"Sepal.Length": 5.1, "Sepal.Width": 3.5, "Petal.Length": 1.4, "Petal.Width": 0.2}`
+
+func TestServePredict(t *testing.T) {
+	ts := irisServer(t)
+	defer ts.Close()
+
+	var pred prediction
+	status := postJSON(t, ts.URL+"/predict", `{"features": `+irisExample+`}`, &pred)
+	if status != http.StatusOK {
+		t.Fatal("expected status 200, got:", status)
+	}
+	if pred.Class != "setosa" || len(pred.Probabilities) != 2 || pred.Value != nil {
+		t.Errorf("expected setosa with 2 class probabilities, got: %+v", pred)
+	}
+
+	var batch batchResponse
+	status = postJSON(t, ts.URL+"/predict/batch", `{"examples": [`+irisExample+`,`+irisExample+`]}`, &batch)
+	if status != http.StatusOK || len(batch.Predictions) != 2 {
+		t.Fatalf("expected 2 predictions, got: %d %+v", status, batch)
+	}
+	if batch.Predictions[1].Class != pred.Class {
+		t.Error("expected batch predictions to match single predictions")
+	}
+
+	resp, err := http.Get(ts.URL + "/model")
+	if err != nil {
+		t.Fatal("unexpected error making request:", err)
+	}
+	defer resp.Body.Close()
+	var info modelInfo
+	json.NewDecoder(resp.Body).Decode(&info)
+	if info.Type != "classification" || info.Trees != 10 || len(info.Features) != 4 {
+		t.Errorf("unexpected model metadata: %+v", info)
+	}
+}
+
+func TestServeMajorityVote(t *testing.T) {
+	d, err := parseCSV(strings.NewReader(syntheticCSV(600, false)), false)
+	if err != nil {
+		t.Fatal("unexpected error parsing data:", err)
+	}
+
+	// with large leaves the most probable class can differ from the vote
+	m := new(Model)
+	m.Fit(d, modelOptions{nTree: 10, minSplit: 2, minLeaf: 20, maxFeatures: -1, nWorkers: 2, seed: 1})
+	want, _ := m.Predict(d)
+	for i, pred := range newServer(m).predict(d.X) {
+		if pred.Class != want[i] {
+			t.Fatalf("example %d: expected class %s as predicted by the cli, got: %s", i, want[i], pred.Class)
+		}
+	}
+}
+
+func TestServeValidation(t *testing.T) {
+	ts := irisServer(t)
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		path, body, msg string
+	}{
+		{"/predict", `{"features": {"Sepal.Length": 5.1}}`, `missing feature`},
+		{"/predict", `{"features": {"Sepal.Length": 5.1, "Color": 1}}`, `unknown feature "Color"`},
+		{"/predict", `{"features": {"Sepal.Length": null, "Sepal.Width": 3.5, "Petal.Length": 1.4, "Petal.Width": 0.2}}`, `is null`},
+		{"/predict", `{"features": {"Sepal.Length": "a", "Sepal.Width": 3.5, "Petal.Length": 1.4, "Petal.Width": 0.2}}`, `"a" isn't a number`},
+		{"/predict", `{"features": {"Sepal.Length": true}}`, `expected a number, a string or null`},
+		{"/predict", `{"feature": {}}`, `invalid request`},
+		{"/predict/batch", `{"examples": []}`, `no examples`},
+		{"/predict/batch", `{"examples": [` + irisExample + `, {}]}`, `example 1: no features`},
+	} {
+		var resp map[string]string
+		status := postJSON(t, ts.URL+tc.path, tc.body, &resp)
+		if status != http.StatusBadRequest || !strings.Contains(resp["error"], tc.msg) {
+			t.Errorf("expected 400 with %q for %s, got: %d %q", tc.msg, tc.body, status, resp["error"])
+		}
+	}
+
+	resp, err := http.Get(ts.URL + "/predict")
+	if err != nil {
+		t.Fatal("unexpected error making request:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("expected status 405 for GET /predict, got:", resp.StatusCode)
+	}
+}
+
+func TestServeConcurrent(t *testing.T) {
+	ts := irisServer(t)
+	defer ts.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// t.Fatal can't be called from other goroutines
+			resp, err := http.Post(ts.URL+"/predict", "application/json",
+				strings.NewReader(`{"features": `+irisExample+`}`))
+			if err != nil {
+				t.Error("unexpected error making request:", err)
+				return
+			}
+			defer resp.Body.Close()
+			var pred prediction
+			json.NewDecoder(resp.Body).Decode(&pred)
+			if resp.StatusCode != http.StatusOK || pred.Class != "setosa" {
+				t.Errorf("expected setosa, got: %d %+v", resp.StatusCode, pred)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/wlattner/rf/forest"
+	"github.com/wlattner/rf/tree"
+)
+
+// treeArrays is a tree stored by node, the layout scikit-learn and XGBoost
+// use. Nodes are numbered from the root at 0, leaves have -1 for their
+// children and feature. Examples go to the left child when their feature is
+// less than or equal to threshold, as in Predict.
+type treeArrays struct {
+	left, right, feature []int
+	threshold            []float64
+	samples              []int
+	impurity             []float64   // may be nil
+	value                [][]float64 // class counts or a target value, may be nil for splits
+}
+
+func (a *treeArrays) add(feature int, threshold float64, samples int, impurity float64, value []float64) int {
+	a.left = append(a.left, -1)
+	a.right = append(a.right, -1)
+	a.feature = append(a.feature, feature)
+	a.threshold = append(a.threshold, threshold)
+	a.samples = append(a.samples, samples)
+	a.impurity = append(a.impurity, impurity)
+	a.value = append(a.value, value)
+	return len(a.left) - 1
+}
+
+// classArrays stores the tree rooted at n in depth first order
+func classArrays(n *tree.Node) *treeArrays {
+	a := new(treeArrays)
+	var add func(n *tree.Node) int
+	add = func(n *tree.Node) int {
+		counts := make([]float64, len(n.ClassCounts))
+		for c, ct := range n.ClassCounts {
+			counts[c] = float64(ct)
+		}
+		if n.Leaf {
+			return a.add(-1, 0, n.Samples, n.Impurity, counts)
+		}
+		i := a.add(n.SplitVar, n.SplitVal, n.Samples, n.Impurity, counts)
+		a.left[i] = add(n.Left)
+		a.right[i] = add(n.Right)
+		return i
+	}
+	add(n)
+	return a
+}
+
+// regArrays stores the tree rooted at n as in classArrays
+func regArrays(n *tree.RegNode) *treeArrays {
+	a := new(treeArrays)
+	var add func(n *tree.RegNode) int
+	add = func(n *tree.RegNode) int {
+		if n.Leaf {
+			return a.add(-1, 0, n.Samples, n.Impurity, []float64{n.Value})
+		}
+		i := a.add(n.SplitVar, n.SplitVal, n.Samples, n.Impurity, []float64{n.Value})
+		a.left[i] = add(n.Left)
+		a.right[i] = add(n.Right)
+		return i
+	}
+	add(n)
+	return a
+}
+
+// check returns an error unless the arrays hold a binary tree rooted at node
+// 0, with features less than nFeatures and width values for each leaf.
+// Children come after their parent, so the tree has no cycles. Nodes that
+// can't be reached from the root are ignored.
+func (a *treeArrays) check(nFeatures, width int) error {
+	n := len(a.left)
+	if n == 0 {
+		return errors.New("tree has no nodes")
+	}
+	if len(a.right) != n || len(a.feature) != n || len(a.threshold) != n || len(a.samples) != n ||
+		len(a.value) != n || (a.impurity != nil && len(a.impurity) != n) {
+		return errors.New("tree arrays have different lengths")
+	}
+
+	linked := make([]bool, n)
+	for i := range a.left {
+		l, r := a.left[i], a.right[i]
+		if l == -1 && r == -1 {
+			if len(a.value[i]) != width {
+				return fmt.Errorf("leaf %d has %d values, expected %d", i, len(a.value[i]), width)
+			}
+			continue
+		}
+		if l <= i || r <= i || l >= n || r >= n || l == r || linked[l] || linked[r] {
+			return fmt.Errorf("node %d has invalid children", i)
+		}
+		linked[l], linked[r] = true, true
+		if a.feature[i] < 0 || a.feature[i] >= nFeatures {
+			return fmt.Errorf("node %d has invalid feature %d", i, a.feature[i])
+		}
+		if len(a.value[i]) != 0 && len(a.value[i]) != width {
+			return fmt.Errorf("node %d has %d values, expected %d", i, len(a.value[i]), width)
+		}
+	}
+	return nil
+}
+
+func (a *treeArrays) nodeImpurity(i int) float64 {
+	if a.impurity == nil {
+		return 0
+	}
+	return a.impurity[i]
+}
+
+// classNode returns the tree rooted at node i of checked arrays. The class
+// values of a leaf are scaled to its examples and rounded to counts, as
+// scikit-learn may store fractions or weighted counts. The counts of a split
+// are the sums of its children.
+func (a *treeArrays) classNode(i int) *tree.Node {
+	n := &tree.Node{Impurity: a.nodeImpurity(i)}
+	if a.left[i] == -1 {
+		n.Leaf = true
+		n.ClassCounts = leafCounts(a.value[i], a.samples[i])
+		for _, ct := range n.ClassCounts {
+			n.Samples += ct
+		}
+		return n
+	}
+
+	n.SplitVar, n.SplitVal = a.feature[i], a.threshold[i]
+	n.Left, n.Right = a.classNode(a.left[i]), a.classNode(a.right[i])
+	n.ClassCounts = make([]int, len(n.Left.ClassCounts))
+	for c := range n.ClassCounts {
+		n.ClassCounts[c] = n.Left.ClassCounts[c] + n.Right.ClassCounts[c]
+	}
+	n.Samples = n.Left.Samples + n.Right.Samples
+	return n
+}
+
+// leafCounts scales value to samples examples. The most common class is kept
+// when rounding would tie it with an earlier class, so the leaf votes as it
+// did before.
+func leafCounts(value []float64, samples int) []int {
+	total := 0.0
+	best := 0
+	for c, v := range value {
+		total += v
+		if v > value[best] {
+			best = c
+		}
+	}
+
+	counts := make([]int, len(value))
+	if total <= 0 {
+		return counts
+	}
+	for c, v := range value {
+		counts[c] = int(math.Round(v / total * float64(samples)))
+	}
+	for c := 0; c < best; c++ {
+		if counts[c] >= counts[best] {
+			counts[best] = counts[c] + 1
+		}
+	}
+	if counts[best] == 0 {
+		counts[best] = 1
+	}
+	return counts
+}
+
+// regNode returns the tree rooted at node i of checked arrays. A split
+// without a value gets the mean of its children.
+func (a *treeArrays) regNode(i int) *tree.RegNode {
+	n := &tree.RegNode{Samples: a.samples[i], Impurity: a.nodeImpurity(i)}
+	if a.left[i] == -1 {
+		n.Leaf = true
+		n.Value = a.value[i][0]
+		return n
+	}
+
+	n.SplitVar, n.SplitVal = a.feature[i], a.threshold[i]
+	n.Left, n.Right = a.regNode(a.left[i]), a.regNode(a.right[i])
+	switch {
+	case len(a.value[i]) > 0:
+		n.Value = a.value[i][0]
+	case n.Left.Samples+n.Right.Samples > 0:
+		n.Value = (n.Left.Value*float64(n.Left.Samples) + n.Right.Value*float64(n.Right.Samples)) /
+			float64(n.Left.Samples+n.Right.Samples)
+	default:
+		n.Value = (n.Left.Value + n.Right.Value) / 2
+	}
+	return n
+}
+
+// classForest returns a forest of the checked trees
+func classForest(trees []*treeArrays, classes []string, nFeatures int) *forest.Classifier {
+	f := forest.NewClassifier(forest.NumTrees(len(trees)))
+	f.Classes = classes
+	f.NFeatures = nFeatures
+	for _, a := range trees {
+		t := tree.NewClassifier()
+		t.Root = a.classNode(0)
+		t.Classes = classes
+		t.NFeatures = nFeatures
+		f.Trees = append(f.Trees, t)
+	}
+	return f
+}
+
+// regForest returns a forest of the checked trees
+func regForest(trees []*treeArrays, nFeatures int) *forest.Regressor {
+	f := forest.NewRegressor(forest.NumTrees(len(trees)))
+	f.NFeatures = nFeatures
+	for _, a := range trees {
+		t := tree.NewRegressor()
+		t.Root = a.regNode(0)
+		t.NFeatures = nFeatures
+		f.Trees = append(f.Trees, t)
+	}
+	return f
+}
+
+// defaultVarNames names features as parseCSV does without a header
+func defaultVarNames(n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("X%d", i+1)
+	}
+	return names
+}
+
+// sklearnForest is a scikit-learn random forest, the arrays of each tree are
+// the attributes of its tree_ of the same name. See README.md for a script
+// that writes one.
+type sklearnForest struct {
+	NFeatures    int           `json:"n_features"`
+	FeatureNames []string      `json:"feature_names,omitempty"`
+	Classes      []string      `json:"classes,omitempty"` // only for classifiers
+	Trees        []sklearnTree `json:"trees"`
+}
+
+type sklearnTree struct {
+	ChildrenLeft  []int             `json:"children_left"`
+	ChildrenRight []int             `json:"children_right"`
+	Feature       []int             `json:"feature"`
+	Threshold     []float64         `json:"threshold"`
+	Value         []json.RawMessage `json:"value"` // [n_outputs][n_classes] for each node
+	NNodeSamples  []int             `json:"n_node_samples"`
+	Impurity      []float64         `json:"impurity,omitempty"`
+}
+
+// sklearnUndefined is scikit-learn's TREE_UNDEFINED, the feature and
+// threshold of leaves
+const sklearnUndefined = -2
+
+// WriteSklearn writes the forest as the arrays of scikit-learn trees. The
+// value of a classification node is its class counts, scikit-learn before
+// 1.4 stores weighted counts in the same place. Online forests can't be
+// exported.
+func (m *Model) WriteSklearn(w io.Writer) error {
+	if m.IsOnline {
+		return errors.New("online models can't be exported to scikit-learn")
+	}
+	if m.Pipeline != nil {
+		return errExportPipeline("scikit-learn")
+	}
+
+	sf := sklearnForest{NFeatures: len(m.VarNames), FeatureNames: m.VarNames}
+	var trees []*treeArrays
+	if m.IsRegression {
+		for _, t := range m.Reg.Trees {
+			trees = append(trees, regArrays(t.Root))
+		}
+	} else {
+		sf.Classes = m.Clf.Classes
+		for _, t := range m.Clf.Trees {
+			trees = append(trees, classArrays(t.Root))
+		}
+	}
+
+	for _, a := range trees {
+		st := sklearnTree{
+			ChildrenLeft:  a.left,
+			ChildrenRight: a.right,
+			Feature:       a.feature,
+			Threshold:     a.threshold,
+			NNodeSamples:  a.samples,
+			Impurity:      a.impurity,
+		}
+		for i := range a.left {
+			if a.left[i] == -1 {
+				st.Feature[i], st.Threshold[i] = sklearnUndefined, sklearnUndefined
+			}
+			v, err := json.Marshal([][]float64{a.value[i]})
+			if err != nil {
+				return err
+			}
+			st.Value = append(st.Value, v)
+		}
+		sf.Trees = append(sf.Trees, st)
+	}
+	return json.NewEncoder(w).Encode(sf)
+}
+
+// readSklearn reads a forest written by WriteSklearn or from scikit-learn,
+// it is a classifier when classes are given.
+func readSklearn(r io.Reader) (*Model, error) {
+	var sf sklearnForest
+	if err := json.NewDecoder(r).Decode(&sf); err != nil {
+		return nil, fmt.Errorf("invalid scikit-learn forest: %v", err)
+	}
+	if sf.NFeatures < 1 || len(sf.Trees) == 0 {
+		return nil, errors.New("invalid scikit-learn forest: expected n_features and trees")
+	}
+	if sf.FeatureNames != nil && len(sf.FeatureNames) != sf.NFeatures {
+		return nil, fmt.Errorf("invalid scikit-learn forest: %d feature names for %d features", len(sf.FeatureNames), sf.NFeatures)
+	}
+
+	width := 1
+	if sf.Classes != nil {
+		width = len(sf.Classes)
+	}
+	var trees []*treeArrays
+	for i, st := range sf.Trees {
+		a := &treeArrays{
+			left:      st.ChildrenLeft,
+			right:     st.ChildrenRight,
+			feature:   st.Feature,
+			threshold: st.Threshold,
+			samples:   st.NNodeSamples,
+			impurity:  st.Impurity,
+		}
+		for _, raw := range st.Value {
+			v, err := flattenFloats(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid scikit-learn tree %d: %v", i, err)
+			}
+			a.value = append(a.value, v)
+		}
+		if err := a.check(sf.NFeatures, width); err != nil {
+			return nil, fmt.Errorf("invalid scikit-learn tree %d: %v", i, err)
+		}
+		trees = append(trees, a)
+	}
+
+	m := &Model{VarNames: sf.FeatureNames}
+	if m.VarNames == nil {
+		m.VarNames = defaultVarNames(sf.NFeatures)
+	}
+	if sf.Classes != nil {
+		m.Clf = classForest(trees, sf.Classes, sf.NFeatures)
+	} else {
+		m.IsRegression = true
+		m.Reg = regForest(trees, sf.NFeatures)
+	}
+	return m, nil
+}
+
+// flattenFloats returns the numbers of a json number or nested array, in order
+func flattenFloats(raw json.RawMessage) ([]float64, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, err
+	}
+	var floats []float64
+	var flatten func(v interface{}) error
+	flatten = func(v interface{}) error {
+		switch v := v.(type) {
+		case float64:
+			floats = append(floats, v)
+		case []interface{}:
+			for _, x := range v {
+				if err := flatten(x); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("invalid value %v", v)
+		}
+		return nil
+	}
+	return floats, flatten(v)
+}
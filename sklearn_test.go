@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// a stump on the second feature as written by scikit-learn 1.4 and later,
+// which stores class fractions in value
+const sklearnStump = `{
+  "n_features": 2,
+  "feature_names": ["a", "b"],
+  "classes": ["no", "yes"],
+  "trees": [{
+    "children_left": [1, -1, -1],
+    "children_right": [2, -1, -1],
+    "feature": [1, -2, -2],
+    "threshold": [2.5, -2.0, -2.0],
+    "value": [[[0.5, 0.5]], [[0.75, 0.25]], [[0.0, 1.0]]],
+    "n_node_samples": [8, 4, 4],
+    "impurity": [0.5, 0.375, 0.0]
+  }]
+}`
+
+func TestSklearnImport(t *testing.T) {
+	m, err := readSklearn(strings.NewReader(sklearnStump))
+	if err != nil {
+		t.Fatal("unexpected error reading forest:", err)
+	}
+	if !reflect.DeepEqual(m.VarNames, []string{"a", "b"}) || m.IsRegression {
+		t.Fatal("expected a classifier with features a and b, got:", m.VarNames, m.IsRegression)
+	}
+
+	// scikit-learn sends examples equal to the threshold left, as Predict does
+	got := m.Clf.Predict([][]float64{{9, 2.5}, {9, 2.5000001}, {9, -1}})
+	if want := []int{0, 1, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected classes %v, got: %v", want, got)
+	}
+	prob := m.Clf.PredictProb([][]float64{{0, 0}})
+	if want := [][]float64{{0.75, 0.25}}; !reflect.DeepEqual(prob, want) {
+		t.Errorf("expected probabilities %v, got: %v", want, prob)
+	}
+	if root := m.Clf.Trees[0].Root; root.Samples != 8 || !reflect.DeepEqual(root.ClassCounts, []int{3, 5}) {
+		t.Errorf("expected 8 examples with counts [3 5] at the root, got: %d %v", root.Samples, root.ClassCounts)
+	}
+
+	// a regressor has no classes
+	reg := strings.Replace(sklearnStump, `"classes": ["no", "yes"],`, "", 1)
+	reg = strings.Replace(reg, `"value": [[[0.5, 0.5]], [[0.75, 0.25]], [[0.0, 1.0]]]`, `"value": [[[2.0]], [[1.0]], [[3.0]]]`, 1)
+	m, err = readSklearn(strings.NewReader(reg))
+	if err != nil {
+		t.Fatal("unexpected error reading forest:", err)
+	}
+	if got := m.Reg.Predict([][]float64{{0, 2.5}, {0, 2.6}}); !reflect.DeepEqual(got, []float64{1, 3}) {
+		t.Error("expected predictions [1 3], got:", got)
+	}
+
+	for _, tc := range []struct {
+		name, from, to, msg string
+	}{
+		{"cycle", `"children_left": [1, -1, -1]`, `"children_left": [0, -1, -1]`, "invalid children"},
+		{"bad feature", `"feature": [1, -2, -2]`, `"feature": [2, -2, -2]`, "invalid feature"},
+		{"short value", `[[0.0, 1.0]]]`, `[[0.0]]]`, "has 1 values, expected 2"},
+		{"missing samples", `"n_node_samples": [8, 4, 4],`, ``, "different lengths"},
+	} {
+		_, err := readSklearn(strings.NewReader(strings.Replace(sklearnStump, tc.from, tc.to, 1)))
+		if err == nil || !strings.Contains(err.Error(), tc.msg) {
+			t.Errorf("%s: expected an error with %q, got: %v", tc.name, tc.msg, err)
+		}
+	}
+}
+
+func TestSklearnRoundTrip(t *testing.T) {
+	for _, regression := range []bool{false, true} {
+		d, err := parseCSV(strings.NewReader(syntheticCSV(200, regression)), false)
+		if err != nil {
+			t.Fatal("unexpected error parsing data:", err)
+		}
+		m := new(Model)
+		m.Fit(d, modelOptions{nTree: 5, minSplit: 2, minLeaf: 3, maxFeatures: -1, nWorkers: 1, seed: 1})
+
+		var buf bytes.Buffer
+		if err := m.WriteSklearn(&buf); err != nil {
+			t.Fatal("unexpected error writing forest:", err)
+		}
+		loaded, err := readSklearn(&buf)
+		if err != nil {
+			t.Fatal("unexpected error reading forest:", err)
+		}
+
+		want, _ := m.Predict(d)
+		if got, err := loaded.Predict(d); err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("regression %v: expected the same predictions, got: %v", regression, err)
+		}
+		if !regression && !reflect.DeepEqual(loaded.Clf.PredictProb(d.X), m.Clf.PredictProb(d.X)) {
+			t.Error("expected the same class probabilities")
+		}
+		if !reflect.DeepEqual(loaded.VarImp(), m.VarImp()) {
+			t.Errorf("regression %v: expected the same variable importance, got: %v", regression, loaded.VarImp())
+		}
+	}
+}
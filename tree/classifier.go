@@ -18,7 +18,7 @@ type Classifier struct {
 	Classes     []string
 	impurityFn  func(int, []int) float64
 	randState   *rand.Rand
-	nFeatures   int
+	NFeatures   int // number of features the tree was fit with
 }
 
 // methods for the treeConfiger interface
@@ -35,8 +35,9 @@ func (c *Classifier) setImpurity(f ImpurityMeasure) {
 		c.impurityFn = gini
 	}
 }
-func (c *Classifier) setMaxFeatures(n int) { c.MaxFeatures = n }
-func (c *Classifier) setRandState(n int64) { c.randState = rand.New(rand.NewSource(n)) }
+func (c *Classifier) setMaxFeatures(n int)  { c.MaxFeatures = n }
+func (c *Classifier) setLifetime(l float64) {}
+func (c *Classifier) setRandState(n int64)  { c.randState = rand.New(rand.NewSource(n)) }
 
 // NewClassifier returns a configured/initialized decision tree classifier.
 // If no options are passed, the returned Classifier will be equivalent to the
@@ -62,6 +63,11 @@ func NewClassifier(options ...func(treeConfiger)) *Classifier {
 
 // Fit constructs a tree from the provided features X, and labels Y.
 func (t *Classifier) Fit(X [][]float64, Y []string) {
+	t.FitDataset(RowMajor(X), Y)
+}
+
+// FitDataset constructs a tree as in Fit from the examples in the Dataset X.
+func (t *Classifier) FitDataset(X Dataset, Y []string) {
 	// labels as integer ids
 	var yIDs []int
 	uniq := make(map[string]int)
@@ -90,22 +96,28 @@ func (t *Classifier) Fit(X [][]float64, Y []string) {
 // of class id to class name). FitInx is intended to be used with a meta algorithm
 // that rely on bootstrap sampling, such as RandomForest.
 func (t *Classifier) FitInx(X [][]float64, Y []int, inx []int, classes []string) {
+	t.fit(RowMajor(X), Y, inx, classes)
+}
+
+// FitInxDataset constructs a tree as in FitInx from the examples in the
+// Dataset X.
+func (t *Classifier) FitInxDataset(X Dataset, Y []int, inx []int, classes []string) {
 	t.fit(X, Y, inx, classes)
 }
 
 // classes should be a mapping from integer ids to string class names, len(classes)
 // should equal max(Y)
-func (t *Classifier) fit(X [][]float64, Y []int, inx []int, classes []string) {
+func (t *Classifier) fit(X Dataset, Y []int, inx []int, classes []string) {
 	// all examples are in root node
 	t.Root = &Node{Samples: len(inx)}
 
 	t.Classes = classes
 
-	t.nFeatures = len(X[0])
+	t.NFeatures = X.NumFeatures()
 
 	maxFeatures := t.MaxFeatures
 	if maxFeatures < 0 {
-		maxFeatures = t.nFeatures
+		maxFeatures = t.NFeatures
 	}
 
 	minSplit := t.MinSplit
@@ -118,13 +130,14 @@ func (t *Classifier) fit(X [][]float64, Y []int, inx []int, classes []string) {
 		minLeaf = 1
 	}
 
-	features := make([]int, len(X[0]))
+	features := make([]int, t.NFeatures)
 	for i := range features {
 		features[i] = i
 	}
 
 	// working copies of features and labels
 	xBuf := make([]float64, len(inx))
+	sorter := newColumnSorter(X)
 
 	classCtL := make([]int, len(classes))
 	classCtR := make([]int, len(classes))
@@ -162,14 +175,16 @@ func (t *Classifier) fit(X [][]float64, Y []int, inx []int, classes []string) {
 				iBest = -1    // left = w.inx[:iBest], right = w.inx[iBest:]
 			)
 
+			sorter.setNode(w.inx)
+
 			// sample maxFeatures from features using Fisher-Yates,
 			// Algorithm P, Knuth, The Art of Computer Programming Vol. 2, p. 145
-			j := t.nFeatures - 1
+			j := t.NFeatures - 1
 			visited := 0
 			nDrawnConstant := 0
 			// need to visit at least one non-constant feature
 			for j > 0 && (visited < maxFeatures || visited <= nDrawnConstant) {
-				k := rand.Intn(j + 1)
+				k := t.randState.Intn(j + 1)
 				currentFeature := features[k]
 				features[k], features[j] = features[j], features[k]
 
@@ -182,23 +197,22 @@ func (t *Classifier) fit(X [][]float64, Y []int, inx []int, classes []string) {
 					continue
 				}
 
-				// copy feature values to buffer
-				for i, inx := range w.inx {
-					xBuf[i] = X[inx][currentFeature]
-				}
+				// copy feature values to buffer, sort labels and indices by
+				// the value of the ith feature
 				xt := xBuf[:len(w.inx)]
+				sorter.sort(currentFeature, w.inx, xt)
 
-				// sort labels and indices by the value of the ith feature
-				bSort(xt, w.inx)
-
-				//TODO: find a better way to share the constant feature list with
-				// child nodes
 				if xt[len(xt)-1] <= xt[0]+1e-7 {
 					nDrawnConstant++
-					c := make([]bool, t.nFeatures)
-					copy(c, w.constantFeatures)
-					c[currentFeature] = true
-					w.constantFeatures = c
+					// the list is shared with the parent and siblings, copy
+					// it once before the first change
+					if !w.ownConstant {
+						c := make([]bool, t.NFeatures)
+						copy(c, w.constantFeatures)
+						w.constantFeatures = c
+						w.ownConstant = true
+					}
+					w.constantFeatures[currentFeature] = true
 					continue // constant feature, skip
 				}
 
@@ -223,7 +237,7 @@ func (t *Classifier) fit(X [][]float64, Y []int, inx []int, classes []string) {
 				j := len(w.inx)
 
 				for i < j {
-					if X[w.inx[i]][xBest] < vBest {
+					if X.At(w.inx[i], xBest) < vBest {
 						i++
 					} else {
 						j--
@@ -251,56 +265,31 @@ func (t *Classifier) fit(X [][]float64, Y []int, inx []int, classes []string) {
 // Predict returns the most probable class id for each example. The id
 // corresponds to the index of the class label in Classifier.Classes
 func (t *Classifier) Predict(X [][]float64) []int {
-	p := make([]int, len(X))
+	return t.PredictDataset(RowMajor(X))
+}
 
+// PredictDataset returns the most probable class id for each example in the
+// Dataset X as in Predict.
+func (t *Classifier) PredictDataset(X Dataset) []int {
+	p := make([]int, X.NumRows())
 	for i := range p {
-		n := t.Root
-		for !n.Leaf {
-			if X[i][n.SplitVar] > n.SplitVal {
-				n = n.Right
-			} else {
-				n = n.Left
-			}
-		}
-
-		maxCt := 0
-		maxC := 0
-		for class, count := range n.ClassCounts {
-			if count > maxCt {
-				maxCt = count
-				maxC = class
-			}
-		}
-		p[i] = maxC
+		p[i] = t.leaf(X, i).maxClass()
 	}
-
 	return p
 }
 
 // PredictInx returns the most probable class index for each input example masked by inx.
 // This function is intended for OOB error estimating.
 func (t *Classifier) PredictID(X [][]float64, inx []int) []int {
-	p := make([]int, len(inx))
+	return t.PredictIDDataset(RowMajor(X), inx)
+}
 
+// PredictIDDataset returns the most probable class index for each example in
+// the Dataset X masked by inx as in PredictID.
+func (t *Classifier) PredictIDDataset(X Dataset, inx []int) []int {
+	p := make([]int, len(inx))
 	for i, id := range inx {
-		n := t.Root
-		for !n.Leaf {
-			if X[id][n.SplitVar] > n.SplitVal {
-				n = n.Right
-			} else {
-				n = n.Left
-			}
-		}
-
-		maxCt := 0
-		maxC := 0
-		for class, count := range n.ClassCounts {
-			if count > maxCt {
-				maxCt = count
-				maxC = class
-			}
-		}
-		p[i] = maxC
+		p[i] = t.leaf(X, id).maxClass()
 	}
 	return p
 }
@@ -308,31 +297,52 @@ func (t *Classifier) PredictID(X [][]float64, inx []int) []int {
 // PredictProb returns the class probability for each example. The indices
 // of the return value correspond to Classifier.Classes.
 func (t *Classifier) PredictProb(X [][]float64) [][]float64 {
-	p := make([][]float64, len(X))
+	return t.PredictProbDataset(RowMajor(X))
+}
 
+// PredictProbDataset returns the class probability for each example in the
+// Dataset X as in PredictProb.
+func (t *Classifier) PredictProbDataset(X Dataset) [][]float64 {
+	p := make([][]float64, X.NumRows())
 	for i := range p {
-		n := t.Root
-		for !n.Leaf {
-			if X[i][n.SplitVar] > n.SplitVal {
-				n = n.Right
-			} else {
-				n = n.Left
-			}
-		}
+		p[i] = t.leaf(X, i).classProb()
+	}
+	return p
+}
 
-		row := make([]float64, len(n.ClassCounts))
-		for i := range row {
-			row[i] = float64(n.ClassCounts[i]) / float64(n.Samples)
-		}
-		p[i] = row
+// PredictProbInx returns the class probability for each input example masked
+// by inx. This function is intended for OOB error estimating.
+func (t *Classifier) PredictProbInx(X [][]float64, inx []int) [][]float64 {
+	return t.PredictProbInxDataset(RowMajor(X), inx)
+}
+
+// PredictProbInxDataset returns the class probability for each example in
+// the Dataset X masked by inx as in PredictProbInx.
+func (t *Classifier) PredictProbInxDataset(X Dataset, inx []int) [][]float64 {
+	p := make([][]float64, len(inx))
+	for i, id := range inx {
+		p[i] = t.leaf(X, id).classProb()
 	}
 	return p
 }
 
+// leaf returns the leaf node for example i of X
+func (t *Classifier) leaf(X Dataset, i int) *Node {
+	n := t.Root
+	for !n.Leaf {
+		if X.At(i, n.SplitVar) > n.SplitVal {
+			n = n.Right
+		} else {
+			n = n.Left
+		}
+	}
+	return n
+}
+
 // VarImp returns an estimate of the importance of the variables used to fit
 // the tree.
 func (t *Classifier) VarImp() []float64 {
-	imp := make([]float64, t.nFeatures)
+	imp := make([]float64, t.NFeatures)
 
 	var s stack
 	s.Push(&stackNode{node: t.Root})
@@ -453,6 +463,7 @@ func entropy(n int, ct []int) float64 {
 type stackNode struct {
 	inx              []int
 	constantFeatures []bool
+	ownConstant      bool // constantFeatures isn't shared
 	depth            int
 	node             *Node
 }
@@ -469,6 +480,28 @@ type Node struct {
 	Samples     int
 }
 
+// maxClass returns the class id with the most examples in the node
+func (n *Node) maxClass() int {
+	maxCt := 0
+	maxC := 0
+	for class, count := range n.ClassCounts {
+		if count > maxCt {
+			maxCt = count
+			maxC = class
+		}
+	}
+	return maxC
+}
+
+// classProb returns the fraction of examples in the node for each class
+func (n *Node) classProb() []float64 {
+	p := make([]float64, len(n.ClassCounts))
+	for i := range p {
+		p[i] = float64(n.ClassCounts[i]) / float64(n.Samples)
+	}
+	return p
+}
+
 // lifo stack for unexpanded nodes
 type stack []*stackNode
 
@@ -0,0 +1,121 @@
+package tree
+
+// Dataset is a matrix of examples (rows) by features (columns) used to fit
+// trees and make predictions. RowMajor adapts the [][]float64 accepted by
+// Fit and Predict. ColMajor and ColMajor32 store each feature contiguously,
+// making the feature scans of Fit cache friendly; ColMajor32 stores values as
+// float32, halving memory.
+type Dataset interface {
+	NumRows() int
+	NumFeatures() int
+	// At returns the value of feature j for example i.
+	At(i, j int) float64
+	// Column copies feature j of the examples in inx to buf.
+	Column(j int, inx []int, buf []float64)
+}
+
+// RowMajor is a Dataset backed by a slice of examples, X[i][j] is the value
+// of feature j for example i.
+type RowMajor [][]float64
+
+func (X RowMajor) NumRows() int { return len(X) }
+
+func (X RowMajor) NumFeatures() int {
+	if len(X) == 0 {
+		return 0
+	}
+	return len(X[0])
+}
+
+func (X RowMajor) At(i, j int) float64 { return X[i][j] }
+
+func (X RowMajor) Column(j int, inx []int, buf []float64) {
+	for i, id := range inx {
+		buf[i] = X[id][j]
+	}
+}
+
+// ColMajor is a Dataset storing the values of each feature contiguously.
+type ColMajor struct {
+	nRows     int
+	nFeatures int
+	data      []float64 // feature j is data[j*nRows : (j+1)*nRows]
+}
+
+// NewColMajor returns a column-major copy of the examples in X.
+func NewColMajor(X [][]float64) *ColMajor {
+	c := MakeColMajor(len(X), RowMajor(X).NumFeatures())
+	for i, row := range X {
+		c.SetRow(i, row)
+	}
+	return c
+}
+
+// MakeColMajor returns a ColMajor of nRows examples with nFeatures features,
+// all zero. The examples can be set one at a time with SetRow as they are
+// read, without a [][]float64 copy of the data.
+func MakeColMajor(nRows, nFeatures int) *ColMajor {
+	return &ColMajor{nRows: nRows, nFeatures: nFeatures, data: make([]float64, nRows*nFeatures)}
+}
+
+// SetRow sets the features of example i to x, x has NumFeatures values.
+func (c *ColMajor) SetRow(i int, x []float64) {
+	for j, v := range x {
+		c.data[j*c.nRows+i] = v
+	}
+}
+
+func (c *ColMajor) NumRows() int        { return c.nRows }
+func (c *ColMajor) NumFeatures() int    { return c.nFeatures }
+func (c *ColMajor) At(i, j int) float64 { return c.data[j*c.nRows+i] }
+
+func (c *ColMajor) Column(j int, inx []int, buf []float64) {
+	col := c.data[j*c.nRows : (j+1)*c.nRows]
+	for i, id := range inx {
+		buf[i] = col[id]
+	}
+}
+
+// ColMajor32 is a Dataset storing the values of each feature contiguously
+// as float32. Split thresholds are computed from the float32 values, so
+// predictions for float64 data may differ from predictions for the same data
+// as a ColMajor32 for values within float32 rounding of a threshold.
+type ColMajor32 struct {
+	nRows     int
+	nFeatures int
+	data      []float32 // feature j is data[j*nRows : (j+1)*nRows]
+}
+
+// NewColMajor32 returns a column-major float32 copy of the examples in X.
+func NewColMajor32(X [][]float64) *ColMajor32 {
+	c := MakeColMajor32(len(X), RowMajor(X).NumFeatures())
+	for i, row := range X {
+		c.SetRow(i, row)
+	}
+	return c
+}
+
+// MakeColMajor32 returns a ColMajor32 of nRows examples with nFeatures
+// features, all zero. Filling it with SetRow as examples are read keeps peak
+// memory at the float32 values instead of a [][]float64 copy of the data.
+func MakeColMajor32(nRows, nFeatures int) *ColMajor32 {
+	return &ColMajor32{nRows: nRows, nFeatures: nFeatures, data: make([]float32, nRows*nFeatures)}
+}
+
+// SetRow sets the features of example i to x, x has NumFeatures values.
+func (c *ColMajor32) SetRow(i int, x []float64) {
+	for j, v := range x {
+		c.data[j*c.nRows+i] = float32(v)
+	}
+}
+
+func (c *ColMajor32) NumRows() int        { return c.nRows }
+func (c *ColMajor32) NumFeatures() int    { return c.nFeatures }
+func (c *ColMajor32) At(i, j int) float64 { return float64(c.data[j*c.nRows+i]) }
+
+func (c *ColMajor32) Column(j int, inx []int, buf []float64) {
+	col := c.data[j*c.nRows : (j+1)*c.nRows]
+	for i, id := range inx {
+		buf[i] = float64(col[id])
+	}
+}
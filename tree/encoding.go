@@ -0,0 +1,530 @@
+package tree
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// The JSON form of a tree stores its nodes by field in depth first order,
+// the root first, e.g. a stump from a Classifier:
+//
+//	{
+//	  "min_split": 2, "min_leaf": 1, "max_depth": -1, "max_features": 2,
+//	  "n_features": 4,
+//	  "classes": ["setosa", "versicolor", "virginica"],
+//	  "nodes": {
+//	    "left":         [1, -1, -1],
+//	    "right":        [2, -1, -1],
+//	    "feature":      [2, -1, -1],
+//	    "threshold":    [2.45, 0, 0],
+//	    "samples":      [150, 50, 100],
+//	    "impurity":     [0.667, 0, 0.5],
+//	    "class_counts": [[50, 50, 50], [50, 0, 0], [0, 50, 50]]
+//	  }
+//	}
+//
+// Left and right are the indexes of the children of each node, -1 for
+// leaves. Examples go right when their value of the feature is greater than
+// the threshold, left otherwise. Regressor nodes have "value" in place of
+// "class_counts". Mondrian trees store "lifetime" instead of the fitting
+// parameters, and their nodes have "tau", "lower" and "upper" in place of
+// "impurity", along with "class_counts" or the "sum" and "sum_sq" of the
+// targets. Non-finite numbers, which JSON can't represent, are written as the
+// strings "NaN", "+Inf" and "-Inf".
+
+// Float is a float64 that is encoded in JSON as a number, or as one of the
+// strings "NaN", "+Inf" and "-Inf" when not finite.
+type Float float64
+
+// Floats is a []float64 with the elements encoded as Float.
+type Floats []float64
+
+// FloatRows converts each row of x to Floats.
+func FloatRows(x [][]float64) []Floats {
+	if x == nil {
+		return nil
+	}
+	rows := make([]Floats, len(x))
+	for i := range x {
+		rows[i] = x[i]
+	}
+	return rows
+}
+
+// Float64Rows converts each row of x to []float64, the inverse of FloatRows.
+func Float64Rows(x []Floats) [][]float64 {
+	if x == nil {
+		return nil
+	}
+	rows := make([][]float64, len(x))
+	for i := range x {
+		rows[i] = x[i]
+	}
+	return rows
+}
+
+func appendFloat(b []byte, v float64) []byte {
+	switch {
+	case math.IsNaN(v):
+		return append(b, `"NaN"`...)
+	case math.IsInf(v, 1):
+		return append(b, `"+Inf"`...)
+	case math.IsInf(v, -1):
+		return append(b, `"-Inf"`...)
+	}
+	return strconv.AppendFloat(b, v, 'g', -1, 64)
+}
+
+func parseFloat(b []byte) (float64, error) {
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return 0, err
+		}
+		switch s {
+		case "NaN":
+			return math.NaN(), nil
+		case "+Inf", "Inf":
+			return math.Inf(1), nil
+		case "-Inf":
+			return math.Inf(-1), nil
+		}
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return strconv.ParseFloat(string(b), 64)
+}
+
+func (f Float) MarshalJSON() ([]byte, error) {
+	return appendFloat(nil, float64(f)), nil
+}
+
+func (f *Float) UnmarshalJSON(b []byte) error {
+	v, err := parseFloat(b)
+	*f = Float(v)
+	return err
+}
+
+func (f Floats) MarshalJSON() ([]byte, error) {
+	if f == nil {
+		return []byte("null"), nil
+	}
+	b := make([]byte, 0, 2+len(f)*8)
+	b = append(b, '[')
+	for i, v := range f {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendFloat(b, v)
+	}
+	return append(b, ']'), nil
+}
+
+func (f *Floats) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*f = nil
+		return nil
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	*f = make(Floats, len(raw))
+	for i, r := range raw {
+		v, err := parseFloat(r)
+		if err != nil {
+			return err
+		}
+		(*f)[i] = v
+	}
+	return nil
+}
+
+// nodeArrays is the JSON form of the nodes of a tree, see above
+type nodeArrays struct {
+	Left        []int    `json:"left"`
+	Right       []int    `json:"right"`
+	Feature     []int    `json:"feature"`
+	Threshold   Floats   `json:"threshold"`
+	Samples     []int    `json:"samples"`
+	Impurity    Floats   `json:"impurity,omitempty"`
+	ClassCounts [][]int  `json:"class_counts,omitempty"`
+	Value       Floats   `json:"value,omitempty"`
+	Tau         Floats   `json:"tau,omitempty"`
+	Lower       []Floats `json:"lower,omitempty"`
+	Upper       []Floats `json:"upper,omitempty"`
+	Sum         Floats   `json:"sum,omitempty"`
+	SumSq       Floats   `json:"sum_sq,omitempty"`
+}
+
+// walk visits the nodes of a tree in depth first order, children returns the
+// left and right child of a node, nil for leaves. visit is called with each
+// node and its index, then the nodes are linked to their children.
+func (a *nodeArrays) walk(root interface{}, children func(n interface{}) (interface{}, interface{}), visit func(n interface{})) {
+	if root == nil {
+		return
+	}
+
+	type entry struct {
+		n      interface{}
+		parent int
+		left   bool
+	}
+	s := []entry{{n: root, parent: -1}}
+	for len(s) > 0 {
+		e := s[len(s)-1]
+		s = s[:len(s)-1]
+
+		i := len(a.Left)
+		if e.parent >= 0 {
+			if e.left {
+				a.Left[e.parent] = i
+			} else {
+				a.Right[e.parent] = i
+			}
+		}
+		a.Left = append(a.Left, -1)
+		a.Right = append(a.Right, -1)
+		visit(e.n)
+
+		l, r := children(e.n)
+		if l != nil {
+			// left is visited first
+			s = append(s, entry{r, i, false}, entry{l, i, true})
+		}
+	}
+}
+
+// split appends the structure of a node
+func (a *nodeArrays) split(leaf bool, feature int, threshold float64, samples int) {
+	if leaf {
+		feature, threshold = -1, 0
+	}
+	a.Feature = append(a.Feature, feature)
+	a.Threshold = append(a.Threshold, threshold)
+	a.Samples = append(a.Samples, samples)
+}
+
+// check validates the structure of the nodes, that every field has a value
+// for each node and that the nodes form a single tree with the root first.
+// nFeatures limits the feature of each split, -1 for no limit.
+func (a *nodeArrays) check(nFeatures int, fields ...int) (int, error) {
+	n := len(a.Left)
+	for _, l := range append([]int{len(a.Right), len(a.Feature), len(a.Threshold), len(a.Samples)}, fields...) {
+		if l != n {
+			return 0, fmt.Errorf("nodes have %d values for a field, expected %d", l, n)
+		}
+	}
+
+	linked := make([]bool, n)
+	for i := 0; i < n; i++ {
+		l, r := a.Left[i], a.Right[i]
+		if l == -1 && r == -1 {
+			continue
+		}
+		// children come after their parent, so there can't be a cycle
+		if l <= i || r <= i || l >= n || r >= n || l == r || linked[l] || linked[r] {
+			return 0, fmt.Errorf("node %d has invalid children %d and %d", i, l, r)
+		}
+		linked[l], linked[r] = true, true
+		if f := a.Feature[i]; f < 0 || (nFeatures >= 0 && f >= nFeatures) {
+			return 0, fmt.Errorf("node %d splits on invalid feature %d", i, f)
+		}
+	}
+	for i := 1; i < n; i++ {
+		if !linked[i] {
+			return 0, fmt.Errorf("node %d isn't in the tree", i)
+		}
+	}
+	return n, nil
+}
+
+type classifierJSON struct {
+	MinSplit    int        `json:"min_split"`
+	MinLeaf     int        `json:"min_leaf"`
+	MaxDepth    int        `json:"max_depth"`
+	MaxFeatures int        `json:"max_features"`
+	NFeatures   int        `json:"n_features"`
+	Classes     []string   `json:"classes"`
+	Nodes       nodeArrays `json:"nodes"`
+}
+
+// MarshalJSON encodes the fitted tree.
+func (t *Classifier) MarshalJSON() ([]byte, error) {
+	c := classifierJSON{
+		MinSplit:    t.MinSplit,
+		MinLeaf:     t.MinLeaf,
+		MaxDepth:    t.MaxDepth,
+		MaxFeatures: t.MaxFeatures,
+		NFeatures:   t.NFeatures,
+		Classes:     t.Classes,
+	}
+
+	var root interface{}
+	if t.Root != nil {
+		root = t.Root
+	}
+	a := &c.Nodes
+	a.walk(root, func(n interface{}) (interface{}, interface{}) {
+		if w := n.(*Node); !w.Leaf {
+			return w.Left, w.Right
+		}
+		return nil, nil
+	}, func(n interface{}) {
+		w := n.(*Node)
+		a.split(w.Leaf, w.SplitVar, w.SplitVal, w.Samples)
+		a.Impurity = append(a.Impurity, w.Impurity)
+		a.ClassCounts = append(a.ClassCounts, w.ClassCounts)
+	})
+
+	return json.Marshal(c)
+}
+
+// UnmarshalJSON decodes a tree encoded by MarshalJSON.
+func (t *Classifier) UnmarshalJSON(b []byte) error {
+	var c classifierJSON
+	if err := json.Unmarshal(b, &c); err != nil {
+		return err
+	}
+
+	a := &c.Nodes
+	n, err := a.check(c.NFeatures, len(a.Impurity), len(a.ClassCounts))
+	if err != nil {
+		return err
+	}
+	nodes := make([]Node, n)
+	for i := range nodes {
+		if len(a.ClassCounts[i]) > len(c.Classes) {
+			return fmt.Errorf("node %d has counts for %d classes, expected %d", i, len(a.ClassCounts[i]), len(c.Classes))
+		}
+		nodes[i] = Node{
+			Leaf:        a.Left[i] == -1,
+			Samples:     a.Samples[i],
+			Impurity:    a.Impurity[i],
+			ClassCounts: a.ClassCounts[i],
+		}
+		if !nodes[i].Leaf {
+			nodes[i].SplitVar, nodes[i].SplitVal = a.Feature[i], a.Threshold[i]
+			nodes[i].Left, nodes[i].Right = &nodes[a.Left[i]], &nodes[a.Right[i]]
+		}
+	}
+
+	*t = Classifier{
+		MinSplit:    c.MinSplit,
+		MinLeaf:     c.MinLeaf,
+		MaxDepth:    c.MaxDepth,
+		MaxFeatures: c.MaxFeatures,
+		NFeatures:   c.NFeatures,
+		Classes:     c.Classes,
+		impurityFn:  gini,
+	}
+	if n > 0 {
+		t.Root = &nodes[0]
+	}
+	return nil
+}
+
+type regressorJSON struct {
+	MinSplit    int        `json:"min_split"`
+	MinLeaf     int        `json:"min_leaf"`
+	MaxDepth    int        `json:"max_depth"`
+	MaxFeatures int        `json:"max_features"`
+	NFeatures   int        `json:"n_features"`
+	Nodes       nodeArrays `json:"nodes"`
+}
+
+// MarshalJSON encodes the fitted tree.
+func (t *Regressor) MarshalJSON() ([]byte, error) {
+	c := regressorJSON{
+		MinSplit:    t.MinSplit,
+		MinLeaf:     t.MinLeaf,
+		MaxDepth:    t.MaxDepth,
+		MaxFeatures: t.MaxFeatures,
+		NFeatures:   t.NFeatures,
+	}
+
+	var root interface{}
+	if t.Root != nil {
+		root = t.Root
+	}
+	a := &c.Nodes
+	a.walk(root, func(n interface{}) (interface{}, interface{}) {
+		if w := n.(*RegNode); !w.Leaf {
+			return w.Left, w.Right
+		}
+		return nil, nil
+	}, func(n interface{}) {
+		w := n.(*RegNode)
+		a.split(w.Leaf, w.SplitVar, w.SplitVal, w.Samples)
+		a.Impurity = append(a.Impurity, w.Impurity)
+		a.Value = append(a.Value, w.Value)
+	})
+
+	return json.Marshal(c)
+}
+
+// UnmarshalJSON decodes a tree encoded by MarshalJSON.
+func (t *Regressor) UnmarshalJSON(b []byte) error {
+	var c regressorJSON
+	if err := json.Unmarshal(b, &c); err != nil {
+		return err
+	}
+
+	a := &c.Nodes
+	n, err := a.check(c.NFeatures, len(a.Impurity), len(a.Value))
+	if err != nil {
+		return err
+	}
+	nodes := make([]RegNode, n)
+	for i := range nodes {
+		nodes[i] = RegNode{
+			Leaf:     a.Left[i] == -1,
+			Samples:  a.Samples[i],
+			Impurity: a.Impurity[i],
+			Value:    a.Value[i],
+		}
+		if !nodes[i].Leaf {
+			nodes[i].SplitVar, nodes[i].SplitVal = a.Feature[i], a.Threshold[i]
+			nodes[i].Left, nodes[i].Right = &nodes[a.Left[i]], &nodes[a.Right[i]]
+		}
+	}
+
+	*t = Regressor{
+		MinSplit:    c.MinSplit,
+		MinLeaf:     c.MinLeaf,
+		MaxDepth:    c.MaxDepth,
+		MaxFeatures: c.MaxFeatures,
+		NFeatures:   c.NFeatures,
+	}
+	if n > 0 {
+		t.Root = &nodes[0]
+	}
+	return nil
+}
+
+type mondrianJSON struct {
+	Lifetime Float      `json:"lifetime"`
+	Classes  []string   `json:"classes,omitempty"`
+	Nodes    nodeArrays `json:"nodes"`
+}
+
+// marshalMondrian encodes the nodes of a Mondrian tree, counts is true for
+// a classifier
+func marshalMondrian(root *MondrianNode, lifetime float64, classes []string, counts bool) ([]byte, error) {
+	c := mondrianJSON{Lifetime: Float(lifetime), Classes: classes}
+
+	var r interface{}
+	if root != nil {
+		r = root
+	}
+	a := &c.Nodes
+	a.walk(r, func(n interface{}) (interface{}, interface{}) {
+		if w := n.(*MondrianNode); !w.Leaf {
+			return w.Left, w.Right
+		}
+		return nil, nil
+	}, func(n interface{}) {
+		w := n.(*MondrianNode)
+		a.split(w.Leaf, w.SplitVar, w.SplitVal, w.Samples)
+		a.Tau = append(a.Tau, w.Tau)
+		a.Lower = append(a.Lower, w.Lower)
+		a.Upper = append(a.Upper, w.Upper)
+		if counts {
+			a.ClassCounts = append(a.ClassCounts, w.ClassCounts)
+		} else {
+			a.Sum = append(a.Sum, w.Sum)
+			a.SumSq = append(a.SumSq, w.SumSq)
+		}
+	})
+
+	return json.Marshal(c)
+}
+
+// unmarshalMondrian decodes a Mondrian tree encoded by marshalMondrian
+func unmarshalMondrian(b []byte, counts bool) (*mondrianJSON, *MondrianNode, error) {
+	var c mondrianJSON
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, nil, err
+	}
+
+	a := &c.Nodes
+	fields := []int{len(a.Tau), len(a.Lower), len(a.Upper)}
+	if counts {
+		fields = append(fields, len(a.ClassCounts))
+	} else {
+		fields = append(fields, len(a.Sum), len(a.SumSq))
+	}
+	n, err := a.check(-1, fields...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if n == 0 {
+		return &c, nil, nil
+	}
+
+	dims := len(a.Lower[0])
+	nodes := make([]MondrianNode, n)
+	for i := range nodes {
+		if len(a.Lower[i]) != dims || len(a.Upper[i]) != dims {
+			return nil, nil, fmt.Errorf("node %d has a %d dimensional bounding box, expected %d", i, len(a.Lower[i]), dims)
+		}
+		nodes[i] = MondrianNode{
+			Leaf:    a.Left[i] == -1,
+			Samples: a.Samples[i],
+			Tau:     a.Tau[i],
+			Lower:   a.Lower[i],
+			Upper:   a.Upper[i],
+		}
+		if counts {
+			if len(a.ClassCounts[i]) > len(c.Classes) {
+				return nil, nil, fmt.Errorf("node %d has counts for %d classes, expected %d", i, len(a.ClassCounts[i]), len(c.Classes))
+			}
+			nodes[i].ClassCounts = a.ClassCounts[i]
+		} else {
+			nodes[i].Sum, nodes[i].SumSq = a.Sum[i], a.SumSq[i]
+		}
+		if !nodes[i].Leaf {
+			if a.Feature[i] >= dims {
+				return nil, nil, fmt.Errorf("node %d splits on invalid feature %d", i, a.Feature[i])
+			}
+			nodes[i].SplitVar, nodes[i].SplitVal = a.Feature[i], a.Threshold[i]
+			nodes[i].Left, nodes[i].Right = &nodes[a.Left[i]], &nodes[a.Right[i]]
+		}
+	}
+	return &c, &nodes[0], nil
+}
+
+// MarshalJSON encodes the tree.
+func (t *MondrianClassifier) MarshalJSON() ([]byte, error) {
+	return marshalMondrian(t.Root, t.Lifetime, t.Classes, true)
+}
+
+// UnmarshalJSON decodes a tree encoded by MarshalJSON.
+func (t *MondrianClassifier) UnmarshalJSON(b []byte) error {
+	c, root, err := unmarshalMondrian(b, true)
+	if err != nil {
+		return err
+	}
+	*t = MondrianClassifier{Root: root, Lifetime: float64(c.Lifetime), Classes: c.Classes}
+	return nil
+}
+
+// MarshalJSON encodes the tree.
+func (t *MondrianRegressor) MarshalJSON() ([]byte, error) {
+	return marshalMondrian(t.Root, t.Lifetime, nil, false)
+}
+
+// UnmarshalJSON decodes a tree encoded by MarshalJSON.
+func (t *MondrianRegressor) UnmarshalJSON(b []byte) error {
+	c, root, err := unmarshalMondrian(b, false)
+	if err != nil {
+		return err
+	}
+	if len(c.Classes) > 0 {
+		return errors.New("regression tree has classes")
+	}
+	*t = MondrianRegressor{Root: root, Lifetime: float64(c.Lifetime)}
+	return nil
+}
@@ -1,8 +1,11 @@
 package tree
 
 import (
+	"encoding/json"
 	"fmt"
 	"math"
+	"math/rand"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -44,6 +47,165 @@ func TestIrisVariableImportance(t *testing.T) {
 
 }
 
+func TestIrisDataset(t *testing.T) {
+	rows := NewClassifier(RandState(1))
+	rows.Fit(X, Y)
+
+	cols := NewClassifier(RandState(1))
+	cols.FitDataset(NewColMajor(X), Y)
+
+	if !reflect.DeepEqual(rows.Root, cols.Root) {
+		t.Error("expected the same tree from row and column major data")
+	}
+
+	cols32 := NewClassifier(RandState(1))
+	X32 := NewColMajor32(X)
+	cols32.FitDataset(X32, Y)
+
+	if !reflect.DeepEqual(rows.Predict(X), cols32.PredictDataset(X32)) {
+		t.Error("expected the same predictions from float64 and float32 data")
+	}
+	if !reflect.DeepEqual(cols32.PredictDataset(X32), cols32.Predict(X)) {
+		t.Error("expected the same predictions from row and column major data")
+	}
+
+	// filled one example at a time
+	byRow := MakeColMajor32(len(X), len(X[0]))
+	for i, x := range X {
+		byRow.SetRow(i, x)
+	}
+	if !reflect.DeepEqual(byRow, X32) {
+		t.Error("expected the same dataset filled with SetRow")
+	}
+}
+
+// benchmarks the memory used to hold the iris data as [][]float64 and as
+// float32 columns filled one example at a time, run with -benchmem
+func BenchmarkIrisRowMajor(b *testing.B) {
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		rows := make([][]float64, len(X))
+		for i, x := range X {
+			rows[i] = append([]float64(nil), x...)
+		}
+	}
+}
+
+func BenchmarkIrisColMajor32(b *testing.B) {
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		c := MakeColMajor32(len(X), len(X[0]))
+		for i, x := range X {
+			c.SetRow(i, x)
+		}
+	}
+}
+
+func TestSparseNegatives(t *testing.T) {
+	// most columns have many negative values, small nodes look up each
+	// example when sorting a column
+	r := rand.New(rand.NewSource(1))
+	Xs := make([][]float64, 400)
+	Ys := make([]string, len(Xs))
+	for i := range Xs {
+		Xs[i] = make([]float64, 3)
+		for j := range Xs[i] {
+			switch u := r.Float64(); {
+			case u < 0.5:
+				Xs[i][j] = -1 - float64(r.Intn(20))
+			case u < 0.7:
+				Xs[i][j] = float64(1 + r.Intn(20))
+			}
+		}
+		Ys[i] = "a"
+		if Xs[i][0]+Xs[i][1] > -10+4*r.NormFloat64() {
+			Ys[i] = "b"
+		}
+	}
+
+	dense := NewClassifier(RandState(1))
+	dense.Fit(Xs, Ys)
+
+	sparse := NewClassifier(RandState(1))
+	sparse.FitDataset(NewCSR(Xs).ToCSC(), Ys)
+
+	if !reflect.DeepEqual(dense.Root, sparse.Root) {
+		t.Error("expected the same tree from dense and sparse data with negative values")
+	}
+	if !reflect.DeepEqual(sparse.Predict(Xs), dense.Predict(Xs)) {
+		t.Error("expected the same predictions from dense and sparse data with negative values")
+	}
+}
+
+func TestIrisJSON(t *testing.T) {
+	clf := NewClassifier(RandState(1))
+	clf.Fit(X, Y)
+
+	b, err := json.Marshal(clf)
+	if err != nil {
+		t.Fatal("unexpected error encoding tree:", err)
+	}
+	loaded := new(Classifier)
+	if err := json.Unmarshal(b, loaded); err != nil {
+		t.Fatal("unexpected error decoding tree:", err)
+	}
+	if !reflect.DeepEqual(clf.Root, loaded.Root) || !reflect.DeepEqual(clf.VarImp(), loaded.VarImp()) {
+		t.Error("expected the same tree after decoding")
+	}
+
+	// JSON has no NaN or Inf
+	f := Floats{math.NaN(), math.Inf(1), math.Inf(-1), 0.1}
+	b, err = json.Marshal(f)
+	if err != nil || string(b) != `["NaN","+Inf","-Inf",0.1]` {
+		t.Fatalf("unexpected encoding of non-finite values: %s %v", b, err)
+	}
+	var g Floats
+	if err := json.Unmarshal(b, &g); err != nil || !math.IsNaN(g[0]) || !math.IsInf(g[1], 1) || !math.IsInf(g[2], -1) || g[3] != 0.1 {
+		t.Errorf("unexpected decoding of non-finite values: %v %v", g, err)
+	}
+}
+
+func TestIrisSparse(t *testing.T) {
+	// center each feature on the first example so there are negative, zero
+	// and positive values
+	Xc := make([][]float64, len(X))
+	for i, row := range X {
+		Xc[i] = make([]float64, len(row))
+		for j, v := range row {
+			Xc[i][j] = v - X[0][j]
+		}
+	}
+
+	csr := NewCSR(Xc)
+	csc := csr.ToCSC()
+	for i := range Xc {
+		for j := range Xc[i] {
+			if csr.At(i, j) != Xc[i][j] || csc.At(i, j) != Xc[i][j] {
+				t.Fatalf("expected sparse value %f at (%d, %d), got: %f and %f",
+					Xc[i][j], i, j, csr.At(i, j), csc.At(i, j))
+			}
+		}
+	}
+
+	dense := NewClassifier(RandState(1))
+	dense.Fit(Xc, Y)
+
+	sparse := NewClassifier(RandState(1))
+	sparse.FitDataset(csc, Y)
+
+	if !reflect.DeepEqual(dense.Root, sparse.Root) {
+		t.Error("expected the same tree from dense and sparse data")
+	}
+	if !reflect.DeepEqual(dense.Predict(Xc), sparse.PredictDataset(csr)) {
+		t.Error("expected the same predictions from dense and sparse data")
+	}
+
+	var c CSR
+	if err := c.AppendRow([]int{2, 1}, []float64{1, 1}); err == nil {
+		t.Error("expected an error for decreasing indices")
+	}
+}
+
 func BenchmarkIrisFit(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		clf := NewClassifier()
@@ -0,0 +1,461 @@
+package tree
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Mondrian trees are described in
+// Lakshminarayanan, B., Roy, D. M., Teh, Y. W. (2014) "Mondrian Forests:
+// Efficient Online Random Forests" http://arxiv.org/abs/1406.2673
+//
+// Unlike the greedy trees in this package, the splits of a Mondrian tree do
+// not depend on the labels, which allows the tree to be extended one example
+// at a time (Algorithm 3 and 4 of the paper). Each node records the bounding
+// box of the examples it has seen along with the time of the split; a new
+// example falling outside of the box may introduce a new split above the node.
+
+// MondrianNode is a node in a Mondrian tree, it is used for classification and
+// regression. For classification only ClassCounts is populated, for regression
+// only Sum and SumSq are populated.
+type MondrianNode struct {
+	Left        *MondrianNode
+	Right       *MondrianNode
+	SplitVar    int
+	SplitVal    float64
+	Tau         float64   // split time, Lifetime for leaves
+	Lower       []float64 // bounding box of examples seen by the node
+	Upper       []float64
+	ClassCounts []int
+	Sum         float64 // sum of targets
+	SumSq       float64 // sum of squared targets
+	Leaf        bool
+	Samples     int
+}
+
+// NumFeatures returns the number of features of the examples seen by the
+// node, 0 for a nil node.
+func (n *MondrianNode) NumFeatures() int {
+	if n == nil {
+		return 0
+	}
+	return len(n.Lower)
+}
+
+// Value returns the mean target value of the examples seen by the node.
+func (n *MondrianNode) Value() float64 {
+	return n.Sum / float64(n.Samples)
+}
+
+// MondrianClassifier implements an online decision tree classifier. The
+// classifier should be initialized with NewMondrianClassifier.
+type MondrianClassifier struct {
+	Root      *MondrianNode
+	Lifetime  float64 // budget for the Mondrian process, -1 for unlimited
+	Classes   []string
+	randState *rand.Rand
+}
+
+// methods for the treeConfiger interface
+func (c *MondrianClassifier) setMinSplit(n int)             {}
+func (c *MondrianClassifier) setMinLeaf(n int)              {}
+func (c *MondrianClassifier) setMaxDepth(n int)             {}
+func (c *MondrianClassifier) setImpurity(f ImpurityMeasure) {}
+func (c *MondrianClassifier) setMaxFeatures(n int)          {}
+func (c *MondrianClassifier) setLifetime(l float64)         { c.Lifetime = l }
+func (c *MondrianClassifier) setRandState(n int64)          { c.randState = rand.New(rand.NewSource(n)) }
+
+// NewMondrianClassifier returns a configured/initialized Mondrian tree
+// classifier. Only the Lifetime and RandState options are used, if no options
+// are passed, the returned MondrianClassifier will be equivalent to the
+// following call:
+//
+//	clf := NewMondrianClassifier(Lifetime(-1))
+func NewMondrianClassifier(options ...func(treeConfiger)) *MondrianClassifier {
+	c := &MondrianClassifier{
+		Lifetime:  -1,
+		randState: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	for _, opt := range options {
+		opt(c)
+	}
+
+	return c
+}
+
+// Fit constructs a tree from the provided features X, and labels Y. Any
+// previously fitted tree is discarded.
+func (t *MondrianClassifier) Fit(X [][]float64, Y []string) {
+	t.Root = nil
+	t.Classes = nil
+	t.PartialFit(X, Y)
+}
+
+// PartialFit extends the tree with the examples in X and labels Y. Labels not
+// seen in previous calls are appended to Classifier.Classes.
+func (t *MondrianClassifier) PartialFit(X [][]float64, Y []string) {
+	uniq := make(map[string]int)
+	for id, class := range t.Classes {
+		uniq[class] = id
+	}
+
+	var yIDs []int
+	for _, val := range Y {
+		id, ok := uniq[val]
+		if !ok {
+			id = len(uniq)
+			uniq[val] = id
+			t.Classes = append(t.Classes, val)
+		}
+		yIDs = append(yIDs, id)
+	}
+
+	inx := make([]int, len(Y))
+	for i := range inx {
+		inx[i] = i
+	}
+
+	t.PartialFitInx(X, yIDs, inx, t.Classes)
+}
+
+// PartialFitInx extends the tree as in PartialFit, but uses the inx slice to
+// mask the examples in X and Y. As with Classifier.FitInx, the caller supplies
+// the mapping of class ids to class names, it may grow between calls.
+func (t *MondrianClassifier) PartialFitInx(X [][]float64, Y []int, inx []int, classes []string) {
+	if t.randState == nil {
+		// not persisted with the tree
+		t.randState = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	t.Classes = classes
+
+	for _, i := range inx {
+		y := Y[i]
+		extendMondrian(&t.Root, X[i], t.Lifetime, t.randState, func(n *MondrianNode) {
+			if y >= len(n.ClassCounts) {
+				c := make([]int, len(classes))
+				copy(c, n.ClassCounts)
+				n.ClassCounts = c
+			}
+			n.ClassCounts[y]++
+			n.Samples++
+		})
+	}
+}
+
+// Predict returns the most probable class id for each example. The id
+// corresponds to the index of the class label in MondrianClassifier.Classes.
+// Predict returns nil if the tree hasn't seen any examples.
+func (t *MondrianClassifier) Predict(X [][]float64) []int {
+	if t.Root == nil {
+		return nil
+	}
+	p := make([]int, len(X))
+
+	for i := range p {
+		n := t.Root.leaf(X[i])
+
+		maxCt := 0
+		maxC := 0
+		for class, count := range n.ClassCounts {
+			if count > maxCt {
+				maxCt = count
+				maxC = class
+			}
+		}
+		p[i] = maxC
+	}
+
+	return p
+}
+
+// PredictProb returns the class probability for each example. The indices
+// of the return value correspond to MondrianClassifier.Classes. PredictProb
+// returns nil if the tree hasn't seen any examples.
+func (t *MondrianClassifier) PredictProb(X [][]float64) [][]float64 {
+	if t.Root == nil {
+		return nil
+	}
+	p := make([][]float64, len(X))
+
+	for i := range p {
+		n := t.Root.leaf(X[i])
+
+		// leaves created before a class was first seen have short counts
+		row := make([]float64, len(t.Classes))
+		for class, count := range n.ClassCounts {
+			row[class] = float64(count) / float64(n.Samples)
+		}
+		p[i] = row
+	}
+	return p
+}
+
+// VarImp returns an estimate of the importance of the variables used to fit
+// the tree. The Gini impurity of each node is computed from the class counts.
+func (t *MondrianClassifier) VarImp() []float64 {
+	return t.Root.varImp(func(n *MondrianNode) float64 {
+		return gini(n.Samples, n.ClassCounts)
+	})
+}
+
+// MondrianRegressor implements an online regression tree. The regressor
+// should be initialized with NewMondrianRegressor.
+type MondrianRegressor struct {
+	Root      *MondrianNode
+	Lifetime  float64 // budget for the Mondrian process, -1 for unlimited
+	randState *rand.Rand
+}
+
+// methods for the treeConfiger interface
+func (c *MondrianRegressor) setMinSplit(n int)             {}
+func (c *MondrianRegressor) setMinLeaf(n int)              {}
+func (c *MondrianRegressor) setMaxDepth(n int)             {}
+func (c *MondrianRegressor) setImpurity(f ImpurityMeasure) {}
+func (c *MondrianRegressor) setMaxFeatures(n int)          {}
+func (c *MondrianRegressor) setLifetime(l float64)         { c.Lifetime = l }
+func (c *MondrianRegressor) setRandState(n int64)          { c.randState = rand.New(rand.NewSource(n)) }
+
+// NewMondrianRegressor returns a configured/initialized Mondrian regression
+// tree. Only the Lifetime and RandState options are used, if no options are
+// passed, the returned MondrianRegressor will be equivalent to the following
+// call:
+//
+//	reg := NewMondrianRegressor(Lifetime(-1))
+func NewMondrianRegressor(options ...func(treeConfiger)) *MondrianRegressor {
+	r := &MondrianRegressor{
+		Lifetime:  -1,
+		randState: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	for _, opt := range options {
+		opt(r)
+	}
+
+	return r
+}
+
+// Fit constructs a tree from the provided features X, and targets Y. Any
+// previously fitted tree is discarded.
+func (t *MondrianRegressor) Fit(X [][]float64, Y []float64) {
+	t.Root = nil
+	t.PartialFit(X, Y)
+}
+
+// PartialFit extends the tree with the examples in X and targets Y.
+func (t *MondrianRegressor) PartialFit(X [][]float64, Y []float64) {
+	inx := make([]int, len(Y))
+	for i := range inx {
+		inx[i] = i
+	}
+
+	t.PartialFitInx(X, Y, inx)
+}
+
+// PartialFitInx extends the tree as in PartialFit, but uses only the indices
+// of X and Y specified in inx.
+func (t *MondrianRegressor) PartialFitInx(X [][]float64, Y []float64, inx []int) {
+	if t.randState == nil {
+		// not persisted with the tree
+		t.randState = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	for _, i := range inx {
+		y := Y[i]
+		extendMondrian(&t.Root, X[i], t.Lifetime, t.randState, func(n *MondrianNode) {
+			n.Sum += y
+			n.SumSq += y * y
+			n.Samples++
+		})
+	}
+}
+
+// Predict returns the expected value for each example X, nil if the tree
+// hasn't seen any examples.
+func (t *MondrianRegressor) Predict(X [][]float64) []float64 {
+	if t.Root == nil {
+		return nil
+	}
+	p := make([]float64, len(X))
+
+	for i := range p {
+		p[i] = t.Root.leaf(X[i]).Value()
+	}
+	return p
+}
+
+// VarImp returns an estimate of the importance of the variables used to fit
+// the tree. The variance of each node is computed from the target sums.
+func (t *MondrianRegressor) VarImp() []float64 {
+	return t.Root.varImp(func(n *MondrianNode) float64 {
+		mean := n.Value()
+		return n.SumSq/float64(n.Samples) - mean*mean
+	})
+}
+
+// extendMondrian adds the example x to the tree rooted at *root following
+// ExtendMondrianBlock, Algorithm 4 in Lakshminarayanan et al. update is
+// called once for every node the example passes through, including any nodes
+// created for it, to accumulate the labels/targets.
+//
+// Leaves are never split from their own examples, a leaf is only split when
+// a new example falls outside of its bounding box. With an unlimited lifetime
+// every distinct example eventually gets its own leaf, as with a fully grown
+// tree from Classifier.
+func extendMondrian(root **MondrianNode, x []float64, lifetime float64, r *rand.Rand, update func(*MondrianNode)) {
+	if lifetime < 0 {
+		lifetime = math.Inf(1)
+	}
+
+	parentTau := 0.0
+	link := root
+
+	for {
+		n := *link
+		if n == nil {
+			// empty tree
+			leaf := newMondrianLeaf(x, lifetime)
+			update(leaf)
+			*link = leaf
+			return
+		}
+
+		// rate of the exponential is the distance of x outside of the box
+		rate := 0.0
+		for d, v := range x {
+			rate += math.Max(n.Lower[d]-v, 0) + math.Max(v-n.Upper[d], 0)
+		}
+
+		e := math.Inf(1)
+		if rate > 0 {
+			e = r.ExpFloat64() / rate
+		}
+
+		if parentTau+e < n.Tau {
+			// introduce a new parent for n, the split dimension is drawn
+			// proportional to the distance outside the box in each dimension
+			u := r.Float64() * rate
+			d := 0
+			for ; d < len(x)-1; d++ {
+				ext := math.Max(n.Lower[d]-x[d], 0) + math.Max(x[d]-n.Upper[d], 0)
+				if u < ext {
+					break
+				}
+				u -= ext
+			}
+
+			parent := &MondrianNode{
+				SplitVar:    d,
+				Tau:         parentTau + e,
+				Lower:       make([]float64, len(x)),
+				Upper:       make([]float64, len(x)),
+				ClassCounts: append([]int(nil), n.ClassCounts...),
+				Sum:         n.Sum,
+				SumSq:       n.SumSq,
+				Samples:     n.Samples,
+			}
+			for i, v := range x {
+				parent.Lower[i] = math.Min(n.Lower[i], v)
+				parent.Upper[i] = math.Max(n.Upper[i], v)
+			}
+
+			leaf := newMondrianLeaf(x, lifetime)
+
+			// the split falls between the box and x, x <= SplitVal goes left
+			if x[d] > n.Upper[d] {
+				parent.SplitVal = n.Upper[d] + r.Float64()*(x[d]-n.Upper[d])
+				parent.Left, parent.Right = n, leaf
+			} else {
+				parent.SplitVal = x[d] + r.Float64()*(n.Lower[d]-x[d])
+				parent.Left, parent.Right = leaf, n
+			}
+
+			update(parent)
+			update(leaf)
+			*link = parent
+			return
+		}
+
+		// no new split, grow the box to include x
+		for d, v := range x {
+			n.Lower[d] = math.Min(n.Lower[d], v)
+			n.Upper[d] = math.Max(n.Upper[d], v)
+		}
+		update(n)
+
+		if n.Leaf {
+			return
+		}
+
+		parentTau = n.Tau
+		if x[n.SplitVar] > n.SplitVal {
+			link = &n.Right
+		} else {
+			link = &n.Left
+		}
+	}
+}
+
+func newMondrianLeaf(x []float64, lifetime float64) *MondrianNode {
+	n := &MondrianNode{
+		Tau:   lifetime,
+		Lower: make([]float64, len(x)),
+		Upper: make([]float64, len(x)),
+		Leaf:  true,
+	}
+	copy(n.Lower, x)
+	copy(n.Upper, x)
+	return n
+}
+
+// leaf returns the leaf node for the example x
+func (n *MondrianNode) leaf(x []float64) *MondrianNode {
+	for !n.Leaf {
+		if x[n.SplitVar] > n.SplitVal {
+			n = n.Right
+		} else {
+			n = n.Left
+		}
+	}
+	return n
+}
+
+// varImp computes the weighted impurity decrease for each variable, impurity
+// returns the impurity of a node. varImp returns nil for an empty tree.
+func (n *MondrianNode) varImp(impurity func(*MondrianNode) float64) []float64 {
+	if n == nil {
+		return nil
+	}
+	imp := make([]float64, len(n.Lower))
+
+	s := []*MondrianNode{n}
+	for len(s) > 0 {
+		w := s[len(s)-1]
+		s = s[:len(s)-1]
+
+		if !w.Leaf {
+			imp[w.SplitVar] += (float64(w.Samples)*impurity(w) -
+				float64(w.Right.Samples)*impurity(w.Right) -
+				float64(w.Left.Samples)*impurity(w.Left))
+
+			s = append(s, w.Left, w.Right)
+		}
+	}
+
+	nSamples := float64(n.Samples)
+	total := 0.0
+	for i := range imp {
+		imp[i] /= nSamples
+		total += imp[i]
+	}
+
+	// normalize
+	if total > 0 {
+		for i := range imp {
+			imp[i] /= total
+		}
+	}
+
+	return imp
+}
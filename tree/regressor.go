@@ -12,7 +12,7 @@ type Regressor struct {
 	MaxDepth    int
 	MaxFeatures int
 	randState   *rand.Rand
-	nFeatures   int
+	NFeatures   int // number of features the tree was fit with
 }
 
 // methods for treeConfiger interface
@@ -21,6 +21,7 @@ func (c *Regressor) setMinLeaf(n int)              { c.MinLeaf = n }
 func (c *Regressor) setMaxDepth(n int)             { c.MaxDepth = n }
 func (c *Regressor) setImpurity(f ImpurityMeasure) {}
 func (c *Regressor) setMaxFeatures(n int)          { c.MaxFeatures = n }
+func (c *Regressor) setLifetime(l float64)         {}
 func (c *Regressor) setRandState(n int64)          { c.randState = rand.New(rand.NewSource(n)) }
 
 // NewRegressor returns a configured/initialized regression tree.
@@ -46,24 +47,35 @@ func NewRegressor(options ...func(treeConfiger)) *Regressor {
 
 // Fit constructs a tree from the provided features X, and targets Y.
 func (t *Regressor) Fit(X [][]float64, Y []float64) {
+	t.FitDataset(RowMajor(X), Y)
+}
+
+// FitDataset constructs a tree as in Fit from the examples in the Dataset X.
+func (t *Regressor) FitDataset(X Dataset, Y []float64) {
 	inx := make([]int, len(Y))
 	for i := 0; i < len(Y); i++ {
 		inx[i] = i
 	}
 
-	t.FitInx(X, Y, inx)
+	t.FitInxDataset(X, Y, inx)
 }
 
 // FitInx constructs a tree as in Fit, but uses only the indices
 // of X and Y specified in inx.
 func (t *Regressor) FitInx(X [][]float64, Y []float64, inx []int) {
+	t.FitInxDataset(RowMajor(X), Y, inx)
+}
+
+// FitInxDataset constructs a tree as in FitInx from the examples in the
+// Dataset X.
+func (t *Regressor) FitInxDataset(X Dataset, Y []float64, inx []int) {
 	t.Root = &RegNode{Samples: len(inx)}
 
-	t.nFeatures = len(X[0])
+	t.NFeatures = X.NumFeatures()
 
 	maxFeatures := t.MaxFeatures
 	if maxFeatures < 0 {
-		maxFeatures = t.nFeatures
+		maxFeatures = t.NFeatures
 	}
 
 	minSplit := t.MinSplit
@@ -76,13 +88,14 @@ func (t *Regressor) FitInx(X [][]float64, Y []float64, inx []int) {
 		minLeaf = 1
 	}
 
-	features := make([]int, len(X[0]))
+	features := make([]int, t.NFeatures)
 	for i := range features {
 		features[i] = i
 	}
 
 	// working copies of features and labels
 	xBuf := make([]float64, len(inx))
+	sorter := newColumnSorter(X)
 
 	var s regStack
 	s.Push(&regStackNode{node: t.Root, inx: inx})
@@ -108,15 +121,17 @@ func (t *Regressor) FitInx(X [][]float64, Y []float64, inx []int) {
 				iBest = -1    // left = w.inx[:iBest], right = w.inx[iBest:]
 			)
 
+			sorter.setNode(w.inx)
+
 			// sample maxFeatures from features using Fisher-Yates,
 			// Algorithm P, Knuth, The Art of Computer Programming Vol. 2, p. 145
-			j := t.nFeatures - 1
+			j := t.NFeatures - 1
 			visited := 0
 			nDrawnConstant := 0
 			// need to visit at least one non-constant feature
 			for j > 0 && (visited < maxFeatures || visited <= nDrawnConstant) {
 
-				k := rand.Intn(j + 1)
+				k := t.randState.Intn(j + 1)
 				currentFeature := features[k]
 				features[k], features[j] = features[j], features[k]
 
@@ -129,23 +144,22 @@ func (t *Regressor) FitInx(X [][]float64, Y []float64, inx []int) {
 					continue
 				}
 
-				// copy feature values to buffer
-				for i, inx := range w.inx {
-					xBuf[i] = X[inx][currentFeature]
-				}
+				// copy feature values to buffer, sort labels and indices by
+				// the value of the ith feature
 				xt := xBuf[:len(w.inx)]
+				sorter.sort(currentFeature, w.inx, xt)
 
-				// sort labels and indices by the value of the ith feature
-				bSort(xt, w.inx)
-
-				//TODO: find a better way to share the constant feature list with
-				// child nodes
 				if xt[len(xt)-1] <= xt[0]+1e-7 {
 					nDrawnConstant++
-					c := make([]bool, t.nFeatures)
-					copy(c, w.constantFeatures)
-					c[currentFeature] = true
-					w.constantFeatures = c
+					// the list is shared with the parent and siblings, copy
+					// it once before the first change
+					if !w.ownConstant {
+						c := make([]bool, t.NFeatures)
+						copy(c, w.constantFeatures)
+						w.constantFeatures = c
+						w.ownConstant = true
+					}
+					w.constantFeatures[currentFeature] = true
 					continue // constant feature, skip
 				}
 
@@ -165,7 +179,7 @@ func (t *Regressor) FitInx(X [][]float64, Y []float64, inx []int) {
 				j := len(w.inx)
 
 				for i < j {
-					if X[w.inx[i]][xBest] < vBest {
+					if X.At(w.inx[i], xBest) < vBest {
 						i++
 					} else {
 						j--
@@ -276,44 +290,51 @@ func meanVar(Y []float64, inx []int) (float64, float64) {
 
 // Predict returns the expected value for each example X.
 func (t *Regressor) Predict(X [][]float64) []float64 {
-	p := make([]float64, len(X))
+	return t.PredictDataset(RowMajor(X))
+}
 
+// PredictDataset returns the expected value for each example in the Dataset
+// X.
+func (t *Regressor) PredictDataset(X Dataset) []float64 {
+	p := make([]float64, X.NumRows())
 	for i := range p {
-		n := t.Root
-		for !n.Leaf {
-			if X[i][n.SplitVar] > n.SplitVal {
-				n = n.Right
-			} else {
-				n = n.Left
-			}
-		}
-		p[i] = n.Value
+		p[i] = t.leaf(X, i).Value
 	}
 	return p
 }
 
 // Predict returns the expected value for each example selected by inx.
 func (t *Regressor) PredictInx(X [][]float64, inx []int) []float64 {
-	p := make([]float64, len(inx))
+	return t.PredictInxDataset(RowMajor(X), inx)
+}
 
+// PredictInxDataset returns the expected value for each example in the
+// Dataset X selected by inx.
+func (t *Regressor) PredictInxDataset(X Dataset, inx []int) []float64 {
+	p := make([]float64, len(inx))
 	for i, id := range inx {
-		n := t.Root
-		for !n.Leaf {
-			if X[id][n.SplitVar] > n.SplitVal {
-				n = n.Right
-			} else {
-				n = n.Left
-			}
-		}
-		p[i] = n.Value
+		p[i] = t.leaf(X, id).Value
 	}
 	return p
 }
 
+// leaf returns the leaf node for example i of X
+func (t *Regressor) leaf(X Dataset, i int) *RegNode {
+	n := t.Root
+	for !n.Leaf {
+		if X.At(i, n.SplitVar) > n.SplitVal {
+			n = n.Right
+		} else {
+			n = n.Left
+		}
+	}
+	return n
+}
+
 // VarImp returns an estimate of the importance of the variables used to fit
 // the tree.
 func (t *Regressor) VarImp() []float64 {
-	imp := make([]float64, t.nFeatures)
+	imp := make([]float64, t.NFeatures)
 
 	var s regStack
 	s.Push(&regStackNode{node: t.Root})
@@ -359,6 +380,7 @@ type RegNode struct {
 type regStackNode struct {
 	inx              []int
 	constantFeatures []bool
+	ownConstant      bool // constantFeatures isn't shared
 	depth            int
 	node             *RegNode
 }
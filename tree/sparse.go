@@ -0,0 +1,286 @@
+package tree
+
+import (
+	"errors"
+	"sort"
+)
+
+// CSR is a sparse Dataset in compressed sparse row format, suited to
+// prediction. The nonzero values of example i are
+// Data[Indptr[i]:Indptr[i+1]] for the features in
+// Indices[Indptr[i]:Indptr[i+1]], indices must be increasing within a row.
+type CSR struct {
+	Features int // number of features
+	Indptr   []int
+	Indices  []int
+	Data     []float64
+}
+
+// NewCSR returns a sparse copy of the examples in X.
+func NewCSR(X [][]float64) *CSR {
+	c := &CSR{Features: RowMajor(X).NumFeatures(), Indptr: []int{0}}
+	for _, row := range X {
+		for j, v := range row {
+			if v != 0 {
+				c.Indices = append(c.Indices, j)
+				c.Data = append(c.Data, v)
+			}
+		}
+		c.Indptr = append(c.Indptr, len(c.Indices))
+	}
+	return c
+}
+
+// AppendRow adds an example with the nonzero values in values for the
+// features in indices, indices must be increasing. Features is increased if
+// needed to include the largest index.
+func (c *CSR) AppendRow(indices []int, values []float64) error {
+	if len(indices) != len(values) {
+		return errors.New("indices and values must be the same length")
+	}
+	for i := range indices {
+		if indices[i] < 0 || (i > 0 && indices[i] <= indices[i-1]) {
+			return errors.New("indices must be increasing and non-negative")
+		}
+	}
+
+	if len(c.Indptr) == 0 {
+		c.Indptr = []int{0}
+	}
+	c.Indices = append(c.Indices, indices...)
+	c.Data = append(c.Data, values...)
+	c.Indptr = append(c.Indptr, len(c.Indices))
+
+	if n := len(indices); n > 0 && indices[n-1] >= c.Features {
+		c.Features = indices[n-1] + 1
+	}
+	return nil
+}
+
+func (c *CSR) NumRows() int {
+	if len(c.Indptr) == 0 {
+		return 0
+	}
+	return len(c.Indptr) - 1
+}
+
+func (c *CSR) NumFeatures() int { return c.Features }
+
+func (c *CSR) At(i, j int) float64 {
+	start, end := c.Indptr[i], c.Indptr[i+1]
+	return sparseAt(c.Indices[start:end], c.Data[start:end], j)
+}
+
+func (c *CSR) Column(j int, inx []int, buf []float64) {
+	for i, id := range inx {
+		buf[i] = c.At(id, j)
+	}
+}
+
+// ToCSC returns the examples in compressed sparse column format, used to fit
+// trees.
+func (c *CSR) ToCSC() *CSC {
+	cc := &CSC{
+		Rows:    c.NumRows(),
+		Indptr:  make([]int, c.Features+1),
+		Indices: make([]int, len(c.Indices)),
+		Data:    make([]float64, len(c.Data)),
+	}
+
+	// count the nonzero values of each feature, then place the values of
+	// each row in order
+	for _, j := range c.Indices {
+		cc.Indptr[j+1]++
+	}
+	for j := 0; j < c.Features; j++ {
+		cc.Indptr[j+1] += cc.Indptr[j]
+	}
+	next := make([]int, c.Features)
+	copy(next, cc.Indptr)
+	for i := 0; i < cc.Rows; i++ {
+		for k := c.Indptr[i]; k < c.Indptr[i+1]; k++ {
+			j := c.Indices[k]
+			cc.Indices[next[j]] = i
+			cc.Data[next[j]] = c.Data[k]
+			next[j]++
+		}
+	}
+	return cc
+}
+
+// CSC is a sparse Dataset in compressed sparse column format, suited to
+// fitting. The nonzero values of feature j are Data[Indptr[j]:Indptr[j+1]]
+// for the examples in Indices[Indptr[j]:Indptr[j+1]], indices must be
+// increasing within a column. When searching for a split, Fit sorts only the
+// nonzero values of a feature.
+type CSC struct {
+	Rows    int // number of examples
+	Indptr  []int
+	Indices []int
+	Data    []float64
+}
+
+func (c *CSC) NumRows() int { return c.Rows }
+
+func (c *CSC) NumFeatures() int {
+	if len(c.Indptr) == 0 {
+		return 0
+	}
+	return len(c.Indptr) - 1
+}
+
+func (c *CSC) At(i, j int) float64 {
+	start, end := c.Indptr[j], c.Indptr[j+1]
+	return sparseAt(c.Indices[start:end], c.Data[start:end], i)
+}
+
+func (c *CSC) Column(j int, inx []int, buf []float64) {
+	start, end := c.Indptr[j], c.Indptr[j+1]
+	rows, vals := c.Indices[start:end], c.Data[start:end]
+	for i, id := range inx {
+		buf[i] = sparseAt(rows, vals, id)
+	}
+}
+
+// columnSorter copies the values of a feature for the examples of a node to
+// a buffer, sorting the buffer and the examples by value
+type columnSorter interface {
+	// setNode is called with the examples of each node before sort
+	setNode(inx []int)
+	sort(j int, inx []int, buf []float64)
+}
+
+// newColumnSorter returns the columnSorter for X, a tree being fit needs its
+// own columnSorter
+func newColumnSorter(X Dataset) columnSorter {
+	if c, ok := X.(*CSC); ok {
+		return &cscSorter{X: c, count: make([]int32, c.Rows), nonzero: make([]bool, c.Rows)}
+	}
+	return denseSorter{X}
+}
+
+type denseSorter struct {
+	X Dataset
+}
+
+func (s denseSorter) setNode(inx []int) {}
+
+func (s denseSorter) sort(j int, inx []int, buf []float64) {
+	s.X.Column(j, inx, buf)
+	bSort(buf, inx)
+}
+
+// cscSorter sorts only the nonzero values of a feature. The examples of the
+// node with a nonzero value are found from the nonzero values of the feature,
+// features that are zero for all examples of the node are found without
+// visiting the examples.
+type cscSorter struct {
+	X       *CSC
+	inx     []int     // examples of the current node
+	count   []int32   // number of times each example is in the current node
+	nonzero []bool    // examples with a nonzero value for the current feature
+	vals    []float64 // nonzero values of the current feature
+	rows    []int     // and their examples
+	zeros   []int     // examples with a zero value
+}
+
+func (s *cscSorter) setNode(inx []int) {
+	for _, id := range s.inx {
+		s.count[id] = 0
+	}
+	for _, id := range inx {
+		s.count[id]++
+	}
+	s.inx = inx
+}
+
+func (s *cscSorter) sort(j int, inx []int, buf []float64) {
+	start, end := s.X.Indptr[j], s.X.Indptr[j+1]
+
+	// for small nodes it's cheaper to look up each example
+	if end-start > 8*len(inx) {
+		s.sortLookup(j, inx, buf)
+		return
+	}
+
+	s.vals, s.rows = s.vals[:0], s.rows[:0]
+	for k := start; k < end; k++ {
+		id := s.X.Indices[k]
+		for c := s.count[id]; c > 0; c-- {
+			s.vals = append(s.vals, s.X.Data[k])
+			s.rows = append(s.rows, id)
+		}
+	}
+	if len(s.rows) == 0 {
+		for i := range buf {
+			buf[i] = 0
+		}
+		return
+	}
+	bSort(s.vals, s.rows)
+
+	s.zeros = s.zeros[:0]
+	for _, id := range s.rows {
+		s.nonzero[id] = true
+	}
+	for _, id := range inx {
+		if !s.nonzero[id] {
+			s.zeros = append(s.zeros, id)
+		}
+	}
+	for _, id := range s.rows {
+		s.nonzero[id] = false
+	}
+
+	// negative values, zeros then positive values
+	nNeg := sort.SearchFloat64s(s.vals, 0)
+	i := copy(inx, s.rows[:nNeg])
+	copy(buf, s.vals[:nNeg])
+	for _, id := range s.zeros {
+		inx[i], buf[i] = id, 0
+		i++
+	}
+	copy(inx[i:], s.rows[nNeg:])
+	copy(buf[i:], s.vals[nNeg:])
+}
+
+// sortLookup sorts as sort, looking up the value of each example
+func (s *cscSorter) sortLookup(j int, inx []int, buf []float64) {
+	start, end := s.X.Indptr[j], s.X.Indptr[j+1]
+	rows, vals := s.X.Indices[start:end], s.X.Data[start:end]
+
+	// three way partition, [0, lo) negative, [lo, i) zero, [hi, n) positive
+	lo, i, hi := 0, 0, len(inx)
+	for i < hi {
+		v := sparseAt(rows, vals, inx[i])
+		switch {
+		case v < 0:
+			// buf[lo] is a zero unless lo == i, set it last
+			inx[lo], inx[i] = inx[i], inx[lo]
+			buf[i] = 0
+			buf[lo] = v
+			lo++
+			i++
+		case v > 0:
+			hi--
+			inx[hi], inx[i] = inx[i], inx[hi]
+			buf[hi] = v
+		default:
+			buf[i] = 0
+			i++
+		}
+	}
+
+	bSort(buf[:lo], inx[:lo])
+	bSort(buf[hi:len(inx)], inx[hi:])
+}
+
+// sparseAt returns the value for index i given the nonzero values vals at
+// the increasing indices inx
+func sparseAt(inx []int, vals []float64, i int) float64 {
+	k := sort.SearchInts(inx, i)
+	if k < len(inx) && inx[k] == i {
+		return vals[k]
+	}
+	return 0
+}
@@ -21,6 +21,7 @@ type treeConfiger interface {
 	setMaxDepth(n int)
 	setImpurity(f ImpurityMeasure)
 	setMaxFeatures(n int)
+	setLifetime(l float64)
 	setRandState(n int64)
 }
 
@@ -64,6 +65,15 @@ func MaxFeatures(n int) func(treeConfiger) {
 	}
 }
 
+// Lifetime sets the budget of the Mondrian process used to grow Mondrian
+// trees, larger values result in deeper trees. Specifying -1 will grow an
+// unlimited tree. Lifetime will be ignored for all other trees.
+func Lifetime(l float64) func(treeConfiger) {
+	return func(c treeConfiger) {
+		c.setLifetime(l)
+	}
+}
+
 // RandState sets the seed for the random number generator
 func RandState(n int64) func(treeConfiger) {
 	return func(c treeConfiger) {
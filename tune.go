@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wlattner/rf/forest"
+	"github.com/wlattner/rf/tree"
+
+	flag "github.com/docker/docker/pkg/mflag"
+)
+
+var (
+	searchType   = flag.String([]string{"-search"}, "grid", "hyperparameter search, one of grid, random or max_features")
+	gridTrees    = flag.String([]string{"-grid_trees"}, "", "comma separated values of --trees to search, defaults to --trees")
+	gridFeatures = flag.String([]string{"-grid_max_features"}, "", "comma separated values of --max_features to search, defaults to --max_features")
+	gridMinLeaf  = flag.String([]string{"-grid_min_leaf"}, "", "comma separated values of --min_leaf to search, defaults to --min_leaf")
+	gridImpurity = flag.String([]string{"-grid_impurity"}, "", "comma separated values of --impurity to search, defaults to --impurity")
+	nTrials      = flag.Int([]string{"-trials"}, 0, "maximum number of forests to evaluate, also the number of candidates for random search, 0 for no limit")
+	maxTime      = flag.Duration([]string{"-max_time"}, 0, "stop the search after this long, e.g. 10m, 0 for no limit")
+	halving      = flag.Bool([]string{"-halving"}, false, "use successive halving on the number of trees")
+	minTrees     = flag.Int([]string{"-min_trees"}, 10, "number of trees in the first round of successive halving")
+	eta          = flag.Int([]string{"-eta"}, 3, "fraction (1/eta) of candidates kept in each round of successive halving")
+	tuneFolds    = flag.Int([]string{"-tune_folds"}, 0, "score candidates with k-fold cross validation instead of out of bag error, 0 for out of bag")
+	stepFactor   = flag.Float64([]string{"-step_factor"}, 2, "factor to scale --max_features by in each step of max_features search")
+	improve      = flag.Float64([]string{"-improve"}, 0.05, "minimum relative improvement in error to continue max_features search")
+	tuneFile     = flag.String([]string{"-tune_results"}, "", "file to output the error of each evaluated candidate")
+)
+
+// runTune searches for the hyperparameters with the lowest out of bag (or
+// cross validation) error, the best model is refit on all of the examples
+// and saved to --final_model.
+func runTune() {
+	opt, err := parseModelOpts()
+	if err != nil {
+		fatal("invalid model option", err.Error())
+	}
+	if err := checkModelFormat(); err != nil {
+		fatal("invalid model option", err.Error())
+	}
+	if opt.online {
+		fatal("hyperparameter search is not supported for online models")
+	}
+
+	d, err := loadData(parseOptions{forceClf: *forceClf})
+	if err != nil {
+		fatal("error parsing input data", err.Error())
+	}
+	if d.Sparse != nil {
+		fatal("hyperparameter search is not supported for sparse (LIBSVM) input")
+	}
+	if d.Weights != nil {
+		fatal("hyperparameter search is not supported with --weight")
+	}
+
+	grid, err := parseGrid(opt)
+	if err != nil {
+		fatal("invalid search option", err.Error())
+	}
+
+	var trials []forest.Trial
+	r := opt.rand()
+	base := forest.Params{NTrees: opt.nTree, MaxFeatures: opt.maxFeatures, MinLeaf: opt.minLeaf, Impurity: opt.impurity}
+
+	s := &forest.Search{
+		Candidates: grid.Params(),
+		Folds:      *tuneFolds,
+		Halving:    *halving,
+		MinTrees:   *minTrees,
+		Eta:        *eta,
+		MaxTrials:  *nTrials,
+		MaxTime:    *maxTime,
+		NumWorkers: opt.nWorkers,
+		Rand:       r,
+	}
+	// candidates are scored with the options of the final model that
+	// aren't searched
+	s.Options = append(s.Options, forest.MinSplit(opt.minSplit), forest.Calibrate(opt.calibration))
+	if opt.earlyStop > 0 {
+		s.Options = append(s.Options, forest.EarlyStopping(opt.earlyStop, opt.stopTol))
+	}
+	if opt.maxFitTime > 0 {
+		s.Options = append(s.Options, forest.MaxFitTime(opt.maxFitTime))
+	}
+
+	switch *searchType {
+	case "grid", "random":
+		if *searchType == "random" {
+			if *nTrials < 1 {
+				fatal("random search requires --trials")
+			}
+			// --trials limits the candidates, halving rounds may refit them
+			s.Candidates = grid.Sample(*nTrials, r)
+			s.MaxTrials = 0
+		}
+
+		if d.isRegression {
+			trials = s.Regressor(d.X, d.YReg)
+		} else {
+			trials = s.Classifier(d.X, d.YClf)
+		}
+	case "max_features":
+		if *stepFactor <= 1 {
+			fatal("invalid step factor", *stepFactor)
+		}
+		if d.isRegression {
+			trials = forest.TuneMaxFeaturesRegressor(d.X, d.YReg, base, *stepFactor, *improve, opt.nWorkers, r, s.Options...)
+		} else {
+			trials = forest.TuneMaxFeaturesClassifier(d.X, d.YClf, base, *stepFactor, *improve, opt.nWorkers, r, s.Options...)
+		}
+	default:
+		fatal("invalid search option, choices are grid, random or max_features")
+	}
+
+	if len(trials) == 0 {
+		fatal("no candidates were evaluated, increase --trials or --max_time")
+	}
+
+	if *tuneFile != "" {
+		err = writeFile(*tuneFile, func(w io.Writer) error {
+			return writeTrials(w, trials)
+		})
+		if err != nil {
+			fatal("error saving search results", err.Error())
+		}
+	}
+
+	best, ok := forest.Best(trials)
+	if !ok {
+		fatal("no candidates were evaluated, increase --trials or --max_time")
+	}
+	if math.IsInf(best.Error, 1) {
+		fatal("no trees were fit for any candidate, increase --max_fit_time")
+	}
+	reportTune(os.Stderr, trials, best, d.isRegression)
+
+	// refit the best candidate on all examples, with the options it was
+	// scored with
+	opt.nTree = best.Target
+	opt.maxFeatures = best.MaxFeatures
+	opt.minLeaf = best.MinLeaf
+	opt.impurity = best.Impurity
+
+	m := new(Model)
+	m.Fit(d, opt)
+
+	err = saveModel(m, *modelFile)
+	if err != nil {
+		fatal("error saving model", err.Error())
+	}
+
+	fmt.Fprintf(os.Stderr, "\n")
+	m.Report(os.Stderr)
+}
+
+// parseGrid builds the search grid from the --grid_* flags, dimensions
+// without values use the value of the corresponding model option
+func parseGrid(opt modelOptions) (forest.Grid, error) {
+	var g forest.Grid
+	var err error
+
+	if g.NTrees, err = parseInts(*gridTrees, opt.nTree); err != nil {
+		return g, err
+	}
+	if g.MaxFeatures, err = parseInts(*gridFeatures, opt.maxFeatures); err != nil {
+		return g, err
+	}
+	if g.MinLeaf, err = parseInts(*gridMinLeaf, opt.minLeaf); err != nil {
+		return g, err
+	}
+
+	if *gridImpurity == "" {
+		g.Impurity = []tree.ImpurityMeasure{opt.impurity}
+		return g, nil
+	}
+	for _, s := range strings.Split(*gridImpurity, ",") {
+		imp, ok := impurityCode[strings.TrimSpace(s)]
+		if !ok {
+			return g, errors.New("invalid impurity option, choices are gini or entropy")
+		}
+		g.Impurity = append(g.Impurity, imp)
+	}
+
+	return g, nil
+}
+
+// parseInts parses a comma separated list of integers, def is returned for
+// an empty list
+func parseInts(s string, def int) ([]int, error) {
+	if s == "" {
+		return []int{def}, nil
+	}
+
+	var vals []int
+	for _, field := range strings.Split(s, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+	}
+	return vals, nil
+}
+
+// impurityName is the inverse of impurityCode
+func impurityName(imp tree.ImpurityMeasure) string {
+	for name, code := range impurityCode {
+		if code == imp {
+			return name
+		}
+	}
+	return ""
+}
+
+func writeTrials(w io.Writer, trials []forest.Trial) error {
+	wtr := csv.NewWriter(w)
+
+	err := wtr.Write([]string{"round", "trees", "max_features", "min_leaf", "impurity", "error", "fit_time"})
+	if err != nil {
+		return err
+	}
+
+	for _, t := range trials {
+		err = wtr.Write([]string{
+			strconv.Itoa(t.Round),
+			strconv.Itoa(t.NTrees),
+			strconv.Itoa(t.MaxFeatures),
+			strconv.Itoa(t.MinLeaf),
+			impurityName(t.Impurity),
+			strconv.FormatFloat(t.Error, 'f', -1, 64),
+			strconv.FormatFloat(t.FitTime.Seconds(), 'f', -1, 64),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	wtr.Flush()
+	return wtr.Error()
+}
+
+func reportTune(w io.Writer, trials []forest.Trial, best forest.Trial, isRegression bool) {
+	var total time.Duration
+	for _, t := range trials {
+		total += t.FitTime
+	}
+
+	errName := "Error Rate"
+	if isRegression {
+		errName = "MSE"
+	}
+
+	fmt.Fprintf(w, "Evaluated %d candidate(s) in %v\n", len(trials), total)
+	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "Best parameters\n")
+	fmt.Fprintf(w, "  Trees:        %d\n", best.Target)
+	fmt.Fprintf(w, "  Max Features: %d\n", best.MaxFeatures)
+	fmt.Fprintf(w, "  Min Leaf:     %d\n", best.MinLeaf)
+	fmt.Fprintf(w, "  Impurity:     %s\n", impurityName(best.Impurity))
+	fmt.Fprintf(w, "  %-13s %.4f\n", errName+":", best.Error)
+}
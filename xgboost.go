@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// XGBoost models saved with save_model as JSON, see
+// https://xgboost.readthedocs.io/en/stable/tutorials/saving_model.html. The
+// parameters of the model are strings.
+type xgbModel struct {
+	Learner xgbLearner `json:"learner"`
+	Version []int      `json:"version"`
+}
+
+type xgbLearner struct {
+	Attributes      map[string]string `json:"attributes"`
+	FeatureNames    []string          `json:"feature_names"`
+	FeatureTypes    []string          `json:"feature_types"`
+	GradientBooster struct {
+		Name  string         `json:"name"`
+		Model xgbGBTreeModel `json:"model"`
+	} `json:"gradient_booster"`
+	LearnerModelParam struct {
+		BaseScore        string `json:"base_score"`
+		BoostFromAverage string `json:"boost_from_average"`
+		NumClass         string `json:"num_class"`
+		NumFeature       string `json:"num_feature"`
+		NumTarget        string `json:"num_target"`
+	} `json:"learner_model_param"`
+	Objective xgbObjective `json:"objective"`
+}
+
+type xgbObjective struct {
+	Name                   string            `json:"name"`
+	RegLossParam           map[string]string `json:"reg_loss_param,omitempty"`
+	SoftmaxMulticlassParam map[string]string `json:"softmax_multiclass_param,omitempty"`
+}
+
+type xgbGBTreeModel struct {
+	Param struct {
+		NumParallelTree string `json:"num_parallel_tree"`
+		NumTrees        string `json:"num_trees"`
+	} `json:"gbtree_model_param"`
+	IterationIndptr []int     `json:"iteration_indptr"`
+	TreeInfo        []int     `json:"tree_info"` // the class of each tree
+	Trees           []xgbTree `json:"trees"`
+}
+
+type xgbTree struct {
+	TreeParam struct {
+		NumDeleted     string `json:"num_deleted"`
+		NumFeature     string `json:"num_feature"`
+		NumNodes       string `json:"num_nodes"`
+		SizeLeafVector string `json:"size_leaf_vector"`
+	} `json:"tree_param"`
+	ID                 int             `json:"id"`
+	LossChanges        []float32       `json:"loss_changes"`
+	SumHessian         []float32       `json:"sum_hessian"`
+	BaseWeights        []float32       `json:"base_weights"`
+	LeftChildren       []int           `json:"left_children"`
+	RightChildren      []int           `json:"right_children"`
+	Parents            []int           `json:"parents"`
+	SplitIndices       []int           `json:"split_indices"`
+	SplitConditions    []float32       `json:"split_conditions"` // the value of leaves
+	SplitType          []int           `json:"split_type"`
+	DefaultLeft        json.RawMessage `json:"default_left"` // numbers or booleans
+	Categories         []int           `json:"categories"`
+	CategoriesNodes    []int           `json:"categories_nodes"`
+	CategoriesSegments []int           `json:"categories_segments"`
+	CategoriesSizes    []int           `json:"categories_sizes"`
+}
+
+const (
+	xgbRootParent = math.MaxInt32
+	// xgbClassesAttr holds the json encoded class names of a classifier
+	// written by WriteXGBoost
+	xgbClassesAttr = "rf_classes"
+)
+
+// xgbRegObjectives are the objectives that predict the sum of the trees and
+// the base score, without a link function
+var xgbRegObjectives = map[string]bool{
+	"reg:squarederror":     true,
+	"reg:linear":           true,
+	"reg:absoluteerror":    true,
+	"reg:pseudohubererror": true,
+}
+
+// xgbThreshold returns the split condition for threshold, XGBoost sends an
+// example left when its feature is less than the condition and compares
+// float32 features. A float32 x is less than the smallest float32 greater
+// than roundDown32(threshold) exactly when x <= threshold.
+func xgbThreshold(threshold float64) float32 {
+	return math.Nextafter32(roundDown32(threshold), float32(math.Inf(1)))
+}
+
+// xgbSplitVal returns the threshold for a split condition, x < cond exactly
+// when x <= the largest float64 less than cond.
+func xgbSplitVal(cond float32) float64 {
+	return math.Nextafter(float64(cond), math.Inf(-1))
+}
+
+// xgbTreeFrom stores a tree in the XGBoost layout, with leaf values from
+// leaf, which is given the index of each leaf
+func xgbTreeFrom(a *treeArrays, id, nFeatures int, leaf func(i int) float32) xgbTree {
+	n := len(a.left)
+	t := xgbTree{
+		ID:                 id,
+		LossChanges:        make([]float32, n),
+		SumHessian:         make([]float32, n),
+		BaseWeights:        make([]float32, n),
+		LeftChildren:       a.left,
+		RightChildren:      a.right,
+		Parents:            make([]int, n),
+		SplitIndices:       make([]int, n),
+		SplitConditions:    make([]float32, n),
+		SplitType:          make([]int, n),
+		Categories:         []int{},
+		CategoriesNodes:    []int{},
+		CategoriesSegments: []int{},
+		CategoriesSizes:    []int{},
+	}
+	t.TreeParam.NumDeleted = "0"
+	t.TreeParam.NumFeature = strconv.Itoa(nFeatures)
+	t.TreeParam.NumNodes = strconv.Itoa(n)
+	t.TreeParam.SizeLeafVector = "1"
+
+	// missing values go left, as NaN does in Predict
+	defaultLeft := make([]int, n)
+	t.Parents[0] = xgbRootParent
+	for i := range a.left {
+		t.SumHessian[i] = float32(a.samples[i])
+		defaultLeft[i] = 1
+		if a.left[i] == -1 {
+			t.SplitConditions[i] = leaf(i)
+			t.BaseWeights[i] = t.SplitConditions[i]
+			continue
+		}
+		t.Parents[a.left[i]], t.Parents[a.right[i]] = i, i
+		t.SplitIndices[i] = a.feature[i]
+		t.SplitConditions[i] = xgbThreshold(a.threshold[i])
+	}
+	t.DefaultLeft, _ = json.Marshal(defaultLeft)
+	return t
+}
+
+// WriteXGBoost writes the forest as an XGBoost model saved as JSON. A
+// regressor is the sum of its trees, with leaf values divided by the number
+// of trees. A classifier has an objective of multi:softmax and, for each
+// tree, a tree for each class with a leaf value of one where the tree votes
+// for the class. The predicted class id is the class with the most votes, as
+// in Predict, class names are in the rf_classes attribute. Features are
+// compared as float32 and missing values go left. Online forests can't be
+// exported.
+func (m *Model) WriteXGBoost(w io.Writer) error {
+	if m.IsOnline {
+		return errors.New("online models can't be exported to XGBoost")
+	}
+	if m.Pipeline != nil {
+		return errExportPipeline("XGBoost")
+	}
+
+	nFeatures := len(m.VarNames)
+	xm := xgbModel{Version: []int{2, 0, 0}}
+	l := &xm.Learner
+	l.Attributes = map[string]string{}
+	l.FeatureNames = m.VarNames
+	for range m.VarNames {
+		l.FeatureTypes = append(l.FeatureTypes, "float")
+	}
+	l.GradientBooster.Name = "gbtree"
+	l.LearnerModelParam.BaseScore = "0"
+	l.LearnerModelParam.BoostFromAverage = "0"
+	l.LearnerModelParam.NumFeature = strconv.Itoa(nFeatures)
+	l.LearnerModelParam.NumTarget = "1"
+	gb := &l.GradientBooster.Model
+	gb.IterationIndptr = []int{0}
+
+	if m.IsRegression {
+		l.LearnerModelParam.NumClass = "0"
+		l.Objective = xgbObjective{Name: "reg:squarederror", RegLossParam: map[string]string{"scale_pos_weight": "1"}}
+		n := float64(len(m.Reg.Trees))
+		for i, t := range m.Reg.Trees {
+			a := regArrays(t.Root)
+			gb.Trees = append(gb.Trees, xgbTreeFrom(a, i, nFeatures, func(j int) float32 {
+				return float32(a.value[j][0] / n)
+			}))
+			gb.TreeInfo = append(gb.TreeInfo, 0)
+			gb.IterationIndptr = append(gb.IterationIndptr, len(gb.Trees))
+		}
+	} else {
+		nClass := len(m.Clf.Classes)
+		if nClass < 2 {
+			return errors.New("XGBoost classifiers need at least two classes")
+		}
+		classes, err := json.Marshal(m.Clf.Classes)
+		if err != nil {
+			return err
+		}
+		l.Attributes[xgbClassesAttr] = string(classes)
+		l.LearnerModelParam.NumClass = strconv.Itoa(nClass)
+		l.Objective = xgbObjective{Name: "multi:softmax", SoftmaxMulticlassParam: map[string]string{"num_class": strconv.Itoa(nClass)}}
+		for _, t := range m.Clf.Trees {
+			a := classArrays(t.Root)
+			for class := 0; class < nClass; class++ {
+				gb.Trees = append(gb.Trees, xgbTreeFrom(a, len(gb.Trees), nFeatures, func(j int) float32 {
+					if argmax(a.value[j]) == class {
+						return 1
+					}
+					return 0
+				}))
+				gb.TreeInfo = append(gb.TreeInfo, class)
+			}
+			gb.IterationIndptr = append(gb.IterationIndptr, len(gb.Trees))
+		}
+	}
+	gb.Param.NumParallelTree = "1"
+	gb.Param.NumTrees = strconv.Itoa(len(gb.Trees))
+
+	return json.NewEncoder(w).Encode(xm)
+}
+
+// argmax returns the index of the first largest value, the class a leaf
+// votes for in tree.Classifier.Predict
+func argmax(v []float64) int {
+	best := 0
+	for i, x := range v {
+		if x > v[best] {
+			best = i
+		}
+	}
+	return best
+}
+
+// xgbParam parses an integer model parameter, missing parameters are 0
+func xgbParam(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(s)
+}
+
+// readXGBoost reads an XGBoost model saved as JSON. Regression models with
+// an objective without a link function are read as a forest averaging trees
+// with leaf values scaled by the number of trees and shifted by the base
+// score, which predicts the same sum. Classifiers are read only when each
+// tree votes for one class, as in models written by WriteXGBoost, boosted
+// classifiers add up margins that a forest's vote can't represent.
+func readXGBoost(r io.Reader) (*Model, error) {
+	var xm xgbModel
+	if err := json.NewDecoder(r).Decode(&xm); err != nil {
+		return nil, fmt.Errorf("invalid XGBoost model: %v", err)
+	}
+	l := xm.Learner
+	if l.GradientBooster.Name != "gbtree" {
+		return nil, fmt.Errorf("XGBoost booster %q can't be read, only gbtree", l.GradientBooster.Name)
+	}
+	nFeatures, err := xgbParam(l.LearnerModelParam.NumFeature)
+	if err != nil || nFeatures < 1 {
+		return nil, errors.New("invalid XGBoost model: expected num_feature")
+	}
+	if nTarget, _ := xgbParam(l.LearnerModelParam.NumTarget); nTarget > 1 {
+		return nil, errors.New("XGBoost models with more than one target can't be read")
+	}
+	gb := l.GradientBooster.Model
+	if len(gb.Trees) == 0 || len(gb.TreeInfo) != len(gb.Trees) {
+		return nil, errors.New("invalid XGBoost model: expected trees and tree_info")
+	}
+
+	m := &Model{VarNames: l.FeatureNames}
+	if len(m.VarNames) != nFeatures {
+		m.VarNames = defaultVarNames(nFeatures)
+	}
+
+	switch obj := l.Objective.Name; {
+	case xgbRegObjectives[obj]:
+		base, err := strconv.ParseFloat(strings.Trim(l.LearnerModelParam.BaseScore, "[]"), 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid XGBoost base_score %q", l.LearnerModelParam.BaseScore)
+		}
+		n := float64(len(gb.Trees))
+		var trees []*treeArrays
+		for i, xt := range gb.Trees {
+			a, err := xt.arrays(nFeatures, 1, func(v float32) []float64 {
+				return []float64{n*float64(v) + base}
+			})
+			if err != nil {
+				return nil, fmt.Errorf("invalid XGBoost tree %d: %v", i, err)
+			}
+			trees = append(trees, a)
+		}
+		m.IsRegression = true
+		m.Reg = regForest(trees, nFeatures)
+	case obj == "multi:softmax" || obj == "multi:softprob":
+		nClass, err := xgbParam(l.LearnerModelParam.NumClass)
+		if err != nil || nClass < 2 {
+			return nil, errors.New("invalid XGBoost model: expected num_class")
+		}
+		trees, err := xgbVotes(gb, nFeatures, nClass)
+		if err != nil {
+			return nil, err
+		}
+		var classes []string
+		if attr, ok := l.Attributes[xgbClassesAttr]; ok {
+			if err := json.Unmarshal([]byte(attr), &classes); err != nil || len(classes) != nClass {
+				return nil, fmt.Errorf("invalid XGBoost model: attribute %s doesn't have %d classes", xgbClassesAttr, nClass)
+			}
+		} else {
+			for c := 0; c < nClass; c++ {
+				classes = append(classes, strconv.Itoa(c))
+			}
+		}
+		m.Clf = classForest(trees, classes, nFeatures)
+	default:
+		return nil, fmt.Errorf("XGBoost objective %q can't be read, only regression without a link function and classifiers written by rf", obj)
+	}
+	return m, nil
+}
+
+// arrays returns the tree with width leaf values from value, the thresholds
+// are converted to Predict's comparison
+func (t *xgbTree) arrays(nFeatures, width int, value func(leaf float32) []float64) (*treeArrays, error) {
+	n := len(t.LeftChildren)
+	if len(t.RightChildren) != n || len(t.SplitConditions) != n || len(t.SplitIndices) != n || len(t.SumHessian) != n {
+		return nil, errors.New("tree arrays have different lengths")
+	}
+	for _, st := range t.SplitType {
+		if st != 0 {
+			return nil, errors.New("categorical splits can't be read")
+		}
+	}
+	defaultLeft, err := t.defaultLeft()
+	if err != nil {
+		return nil, err
+	}
+	if defaultLeft != nil && len(defaultLeft) != n {
+		return nil, errors.New("tree arrays have different lengths")
+	}
+
+	a := &treeArrays{
+		left:      t.LeftChildren,
+		right:     t.RightChildren,
+		feature:   t.SplitIndices,
+		threshold: make([]float64, n),
+		samples:   make([]int, n),
+		value:     make([][]float64, n),
+	}
+	for i := range a.left {
+		a.samples[i] = int(math.Round(float64(t.SumHessian[i])))
+		if a.left[i] == -1 {
+			a.value[i] = value(t.SplitConditions[i])
+			continue
+		}
+		if defaultLeft != nil && !defaultLeft[i] {
+			return nil, fmt.Errorf("node %d sends missing values right, rf sends them left", i)
+		}
+		a.threshold[i] = xgbSplitVal(t.SplitConditions[i])
+	}
+	if err := a.check(nFeatures, width); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// defaultLeft returns whether each node sends missing values left, nil if
+// the tree doesn't say. XGBoost writes default_left as numbers or booleans.
+func (t *xgbTree) defaultLeft() ([]bool, error) {
+	if len(t.DefaultLeft) == 0 {
+		return nil, nil
+	}
+	var nums []int
+	if err := json.Unmarshal(t.DefaultLeft, &nums); err == nil {
+		left := make([]bool, len(nums))
+		for i, v := range nums {
+			left[i] = v != 0
+		}
+		return left, nil
+	}
+	var left []bool
+	if err := json.Unmarshal(t.DefaultLeft, &left); err != nil {
+		return nil, errors.New("invalid default_left, expected numbers or booleans")
+	}
+	return left, nil
+}
+
+// xgbVotes returns the trees of a classifier where each round has a tree
+// for each class, with the same splits, and each leaf is one for a single
+// class and zero for the rest.
+func xgbVotes(gb xgbGBTreeModel, nFeatures, nClass int) ([]*treeArrays, error) {
+	errVotes := errors.New("XGBoost classifiers can only be read when each tree votes for one class, as in models written by rf")
+	if len(gb.Trees)%nClass != 0 {
+		return nil, errVotes
+	}
+
+	var trees []*treeArrays
+	for r := 0; r < len(gb.Trees); r += nClass {
+		round := make([]*treeArrays, nClass)
+		for c := range round {
+			if gb.TreeInfo[r+c] != c {
+				return nil, errVotes
+			}
+			a, err := gb.Trees[r+c].arrays(nFeatures, 1, func(v float32) []float64 { return []float64{float64(v)} })
+			if err != nil {
+				return nil, fmt.Errorf("invalid XGBoost tree %d: %v", r+c, err)
+			}
+			round[c] = a
+		}
+
+		// one tree with the splits of the round and a vote for each leaf
+		vote := round[0]
+		for i := range vote.left {
+			for _, a := range round[1:] {
+				if len(a.left) != len(vote.left) || a.left[i] != vote.left[i] || a.right[i] != vote.right[i] ||
+					a.feature[i] != vote.feature[i] || a.threshold[i] != vote.threshold[i] {
+					return nil, errVotes
+				}
+			}
+			if vote.left[i] != -1 {
+				continue
+			}
+			counts := make([]float64, nClass)
+			votes := 0
+			for c, a := range round {
+				switch a.value[i][0] {
+				case 1:
+					counts[c] = math.Max(1, float64(vote.samples[i]))
+					votes++
+				case 0:
+				default:
+					return nil, errVotes
+				}
+			}
+			if votes != 1 {
+				return nil, errVotes
+			}
+			vote.value[i] = counts
+		}
+		if err := vote.check(nFeatures, nClass); err != nil {
+			return nil, fmt.Errorf("invalid XGBoost tree %d: %v", r, err)
+		}
+		trees = append(trees, vote)
+	}
+	return trees, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// two regression stumps as saved by XGBoost 2.0, the prediction is the base
+// score plus the leaves
+const xgbStumps = `{
+  "learner": {
+    "attributes": {},
+    "feature_names": [],
+    "feature_types": [],
+    "gradient_booster": {
+      "model": {
+        "gbtree_model_param": {"num_parallel_tree": "1", "num_trees": "2"},
+        "iteration_indptr": [0, 1, 2],
+        "tree_info": [0, 0],
+        "trees": [
+          {"base_weights": [0, -1, 1], "categories": [], "categories_nodes": [], "categories_segments": [], "categories_sizes": [],
+           "default_left": [1, 0, 0], "id": 0, "left_children": [1, -1, -1], "loss_changes": [4, 0, 0], "parents": [2147483647, 0, 0],
+           "right_children": [2, -1, -1], "split_conditions": [2.5, -1, 1], "split_indices": [0, 0, 0], "split_type": [0, 0, 0],
+           "sum_hessian": [10, 6, 4], "tree_param": {"num_deleted": "0", "num_feature": "2", "num_nodes": "3", "size_leaf_vector": "1"}},
+          {"base_weights": [0, 0.25, 0.5], "categories": [], "categories_nodes": [], "categories_segments": [], "categories_sizes": [],
+           "default_left": [1, 0, 0], "id": 1, "left_children": [1, -1, -1], "loss_changes": [1, 0, 0], "parents": [2147483647, 0, 0],
+           "right_children": [2, -1, -1], "split_conditions": [0.1, 0.25, 0.5], "split_indices": [1, 0, 0], "split_type": [0, 0, 0],
+           "sum_hessian": [10, 5, 5], "tree_param": {"num_deleted": "0", "num_feature": "2", "num_nodes": "3", "size_leaf_vector": "1"}}
+        ]
+      },
+      "name": "gbtree"
+    },
+    "learner_model_param": {"base_score": "5E-1", "boost_from_average": "1", "num_class": "0", "num_feature": "2", "num_target": "1"},
+    "objective": {"name": "reg:squarederror", "reg_loss_param": {"scale_pos_weight": "1"}}
+  },
+  "version": [2, 0, 3]
+}`
+
+func TestXGBoostImport(t *testing.T) {
+	m, err := readXGBoost(strings.NewReader(xgbStumps))
+	if err != nil {
+		t.Fatal("unexpected error reading model:", err)
+	}
+	if !reflect.DeepEqual(m.VarNames, []string{"X1", "X2"}) || !m.IsRegression {
+		t.Fatal("expected a regressor with features X1 and X2, got:", m.VarNames, m.IsRegression)
+	}
+
+	// XGBoost sends examples less than the split condition left, examples
+	// equal to it go right. Conditions are float32, as are the features.
+	X := [][]float64{
+		{2.5, float64(float32(0.1))},
+		{float64(math.Nextafter32(2.5, 0)), float64(math.Nextafter32(0.1, 0))},
+		{-3, 1},
+	}
+	want := []float64{0.5 + 1 + 0.5, 0.5 - 1 + 0.25, 0.5 - 1 + 0.5}
+	for i, got := range m.Reg.Predict(X) {
+		if math.Abs(got-want[i]) > 1e-6 {
+			t.Errorf("example %d: expected %f, got: %f", i, want[i], got)
+		}
+	}
+
+	for _, tc := range []struct {
+		name, from, to, msg string
+	}{
+		{"link function", `"reg:squarederror"`, `"reg:logistic"`, `objective "reg:logistic" can't be read`},
+		{"dart", `"name": "gbtree"`, `"name": "dart"`, `booster "dart" can't be read`},
+		{"categorical", `"split_type": [0, 0, 0]`, `"split_type": [1, 0, 0]`, "categorical splits"},
+		{"bad feature", `"split_indices": [1, 0, 0]`, `"split_indices": [2, 0, 0]`, "invalid feature"},
+		{"default right", `"default_left": [1, 0, 0], "id": 1`, `"default_left": [0, 0, 0], "id": 1`, "node 0 sends missing values right"},
+		{"default right bool", `"default_left": [1, 0, 0], "id": 1`, `"default_left": [false, true, true], "id": 1`, "node 0 sends missing values right"},
+		{"boosted classifier", `"num_class": "0"`, `"num_class": "2"`, "each tree votes for one class"},
+	} {
+		file := strings.Replace(xgbStumps, tc.from, tc.to, 1)
+		if tc.name == "boosted classifier" {
+			file = strings.Replace(file, `"reg:squarederror"`, `"multi:softprob"`, 1)
+			file = strings.Replace(file, `"tree_info": [0, 0]`, `"tree_info": [0, 1]`, 1)
+		}
+		_, err := readXGBoost(strings.NewReader(file))
+		if err == nil || !strings.Contains(err.Error(), tc.msg) {
+			t.Errorf("%s: expected an error with %q, got: %v", tc.name, tc.msg, err)
+		}
+	}
+}
+
+func TestXGBoostRoundTrip(t *testing.T) {
+	for _, regression := range []bool{false, true} {
+		d, err := parseCSV(strings.NewReader(syntheticCSV(200, regression)), false)
+		if err != nil {
+			t.Fatal("unexpected error parsing data:", err)
+		}
+		m := new(Model)
+		m.Fit(d, modelOptions{nTree: 5, minSplit: 2, minLeaf: 1, maxFeatures: -1, nWorkers: 1, seed: 1})
+
+		var buf bytes.Buffer
+		if err := m.WriteXGBoost(&buf); err != nil {
+			t.Fatal("unexpected error writing model:", err)
+		}
+		loaded, err := readXGBoost(&buf)
+		if err != nil {
+			t.Fatal("unexpected error reading model:", err)
+		}
+		if !reflect.DeepEqual(loaded.VarNames, m.VarNames) {
+			t.Error("expected the feature names to be kept, got:", loaded.VarNames)
+		}
+
+		// XGBoost compares float32 features, the splits are the same for them
+		_, X := float32Rows(d.X)
+		if regression {
+			want := m.Reg.Predict(X)
+			for i, got := range loaded.Reg.Predict(X) {
+				if math.Abs(got-want[i]) > 1e-5*math.Max(1, math.Abs(want[i])) {
+					t.Errorf("example %d: expected %f, got: %f", i, want[i], got)
+				}
+			}
+			continue
+		}
+		if !reflect.DeepEqual(loaded.Clf.Classes, m.Clf.Classes) {
+			t.Error("expected the class names to be kept, got:", loaded.Clf.Classes)
+		}
+		if got, want := loaded.Clf.Predict(X), m.Clf.Predict(X); !reflect.DeepEqual(got, want) {
+			t.Errorf("expected the same classes, got: %v", got)
+		}
+	}
+}
+
+func TestXGBoostThreshold(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		// thresholds are midpoints between float32 features
+		a, b := float32(r.NormFloat64()), float32(r.NormFloat64())
+		s := (float64(a) + float64(b)) / 2
+		cond := xgbThreshold(s)
+		for _, x := range []float32{a, b, float32(s), math.Nextafter32(float32(s), 0)} {
+			if (float64(x) <= s) != (x < cond) {
+				t.Fatalf("%g <= %g, expected %g < %g to match", x, s, x, cond)
+			}
+			if (x < cond) != (float64(x) <= xgbSplitVal(cond)) {
+				t.Fatalf("%g < %g, expected %g <= %g to match", x, cond, x, xgbSplitVal(cond))
+			}
+		}
+	}
+}